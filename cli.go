@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/config"
+	"github.com/kweusuf/novel-qa-go/logging"
+	"github.com/kweusuf/novel-qa-go/services"
+	"github.com/kweusuf/novel-qa-go/tracing"
+
+	"go.opentelemetry.io/otel"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `Usage: novel-qa <command> [flags] [args]
+
+Commands:
+  serve                    start the web server (the default)
+  ingest <files...>        add novels to the library
+  ask "question"           answer a question from the library
+  list                     list the novels in the library
+  delete <novels...>       remove novels from the library
+  reindex                  reconcile the index with the novels directory
+  export                   write the indexed chunks as JSON
+  config print             show the effective configuration
+  invite                   create an invite code for registering
+
+Run 'novel-qa <command> -h' for a command's flags.
+`
+
+// command runs a subcommand with its arguments, writing results to stdout
+type command func(args []string, stdout io.Writer) error
+
+var commands = map[string]command{
+	"serve":   serveCommand,
+	"ingest":  ingestCommand,
+	"ask":     askCommand,
+	"list":    listCommand,
+	"delete":  deleteCommand,
+	"reindex": reindexCommand,
+	"export":  exportCommand,
+	"config":  configCommand,
+	"invite":  inviteCommand,
+}
+
+// errUsage reports bad arguments whose explanation has already been printed
+var errUsage = errors.New("invalid arguments")
+
+// run dispatches to a subcommand and returns the process exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" || name == "-h" || name == "--help" {
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", name, usage)
+		return 2
+	}
+	err := cmd(args, stdout)
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if flushErr := tracing.Shutdown(flushCtx); flushErr != nil {
+		fmt.Fprintf(stderr, "novel-qa %s: %v\n", name, flushErr)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		}
+		fmt.Fprintf(stderr, "novel-qa %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// library is the configuration a command works with, loaded from the
+// configuration file, environment and its flags
+type library struct {
+	flags  *config.Flags
+	cfg    *config.Config
+	asJSON bool
+}
+
+// newFlagSet creates the flag set for a command with the configuration
+// flags every command shares, and -json for commands with output
+func newFlagSet(name string, lib *library) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	lib.flags = config.NewFlags(fs)
+	if name != "serve" {
+		fs.BoolVar(&lib.asJSON, "json", false, "write JSON instead of text")
+	}
+	return fs
+}
+
+// parse parses a command's arguments, with flags wherever they appear among
+// the positional arguments so `ask "question" --model llama3` works, and
+// loads the configuration
+func (lib *library) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, errUsage
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	cfg, err := lib.flags.Load(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	lib.cfg = cfg
+
+	// Logs go to stderr, leaving stdout to command output
+	logger, err := logging.New(os.Stderr, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+
+	// Spans are flushed by run once the command finishes. The stdout
+	// exporter writes to stderr too, so it can't corrupt --json output.
+	if err := tracing.Setup(cfg.Tracing, version, os.Stderr); err != nil {
+		return nil, err
+	}
+	return positional, nil
+}
+
+// open creates the services for the library's directories
+func (lib *library) open() (*services.NovelService, *services.ChromaService, *services.IngestService) {
+	ns := services.NewNovelService(lib.cfg.Storage.NovelsDir)
+	ns.SetChunkWords(lib.cfg.Retrieval.ChunkWords)
+	cs := services.NewChromaService(lib.cfg.Storage.DBDir)
+	cs.SetContextWindow(lib.cfg.Retrieval.ContextWindow)
+	return ns, cs, services.NewIngestService(ns, cs)
+}
+
+// write prints v as indented JSON, or calls text to print it otherwise
+func (lib *library) write(stdout io.Writer, v interface{}, text func()) error {
+	if !lib.asJSON {
+		text()
+		return nil
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func serveCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("serve", &lib)
+	if _, err := lib.parse(fs, args); err != nil {
+		return err
+	}
+
+	s, err := runServer(lib.cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize server: %v", err)
+	}
+	return s.serve(lib.cfg.Server.Addr, time.Duration(lib.cfg.Server.ShutdownTimeout))
+}
+
+// ingestResult reports one file added by the ingest command
+type ingestResult struct {
+	File      string                   `json:"file"`
+	Name      string                   `json:"name,omitempty"`
+	Chunks    int                      `json:"chunks"`
+	Encoding  string                   `json:"encoding,omitempty"`
+	Duplicate *services.DuplicateMatch `json:"duplicate,omitempty"`
+	Action    string                   `json:"duplicateAction,omitempty"`
+	Error     string                   `json:"error,omitempty"`
+}
+
+func ingestCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("ingest", &lib)
+	charset := fs.String("charset", "", "character set of plain-text files, detected when empty")
+	duplicate := fs.String("duplicate", services.DuplicateSkip, "how to handle novels already in the library: skip, link or replace")
+	files, err := lib.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no files given")
+	}
+	switch *duplicate {
+	case services.DuplicateSkip, services.DuplicateLink, services.DuplicateReplace:
+	default:
+		return fmt.Errorf("invalid duplicate option %q: use skip, link or replace", *duplicate)
+	}
+
+	ns, _, is := lib.open()
+	var results []ingestResult
+	failed := 0
+	for _, file := range files {
+		result := ingestResult{File: file}
+		stored, ingested, err := ingestFile(ns, is, file, services.IngestOptions{
+			ReadOptions: services.ReadOptions{Charset: *charset},
+			OnDuplicate: *duplicate,
+		})
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		} else {
+			result.Name = stored.Name
+			result.Chunks = ingested.Chunks
+			result.Encoding = ingested.Content.Encoding
+			result.Duplicate = ingested.Duplicate
+			result.Action = ingested.Action
+		}
+		results = append(results, result)
+	}
+
+	err = lib.write(stdout, results, func() {
+		for _, r := range results {
+			switch {
+			case r.Error != "":
+				fmt.Fprintf(stdout, "❌ %s: %s\n", r.File, r.Error)
+			case r.Action == services.DuplicateSkip:
+				fmt.Fprintf(stdout, "⏭️ %s: already in library as '%s'\n", r.File, r.Duplicate.OriginalName)
+			case r.Action == services.DuplicateLink:
+				fmt.Fprintf(stdout, "🔗 %s: linked to '%s'\n", r.File, r.Duplicate.OriginalName)
+			default:
+				fmt.Fprintf(stdout, "✅ %s: %d chunks added as %s\n", r.File, r.Chunks, r.Name)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(files))
+	}
+	return nil
+}
+
+// ingestFile copies a file into the library as an upload would be and
+// ingests it
+func ingestFile(ns *services.NovelService, is *services.IngestService, path string, opts services.IngestOptions) (*services.StoredNovel, *services.IngestResult, error) {
+	format, err := services.DetectFileFormat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.Format = format.Name
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	stored, err := ns.SaveUpload(f, filepath.Base(path), format, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := is.Ingest(ns.StoredPath(stored.Name), opts, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stored, result, nil
+}
+
+func askCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("ask", &lib)
+	novel := fs.String("novel", "", "only use passages from this novel")
+	model := fs.String("model", "", "Ollama model (default the first configured model)")
+	questions, err := lib.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(questions) != 1 {
+		return fmt.Errorf("expected one question, got %d", len(questions))
+	}
+	question := questions[0]
+
+	ns, cs, _ := lib.open()
+	name := ""
+	if *novel != "" {
+		var ok bool
+		if name, ok = ns.ResolveNovel(*novel); !ok {
+			return fmt.Errorf("novel %q not found", *novel)
+		}
+	}
+
+	// Trace retrieval and generation together
+	ctx, span := otel.Tracer("github.com/kweusuf/novel-qa-go").Start(context.Background(), "ask")
+	defer span.End()
+
+	result, err := cs.Search(ctx, question, lib.cfg.Retrieval.Results, name, services.FullAccess)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve context: %v", err)
+	}
+
+	if *model == "" {
+		*model = lib.cfg.DefaultModel()
+	}
+	ollama := services.NewOllamaPool(lib.cfg.OllamaNodes())
+	ollama.SetTimeout(time.Duration(lib.cfg.Ollama.Timeout))
+	ollama.SetRetries(lib.cfg.Ollama.Retries, time.Duration(lib.cfg.Ollama.RetryBackoff))
+	ollama.SetFallbacks(lib.cfg.Ollama.FallbackModels)
+	answer, err := ollama.Chat(ctx, question, *model, result.Context)
+	if err != nil {
+		return fmt.Errorf("failed to get answer from model: %v", err)
+	}
+
+	response := map[string]any{"question": question, "answer": answer.Text, "model": answer.Model, "novel": name, "node": answer.Node, "passages": result.Passages}
+	return lib.write(stdout, response, func() {
+		fmt.Fprintln(stdout, answer.Text)
+	})
+}
+
+// listedNovel describes a novel for the list command
+type listedNovel struct {
+	services.StoredNovel
+	Chunks int `json:"chunks"`
+}
+
+func listCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("list", &lib)
+	if _, err := lib.parse(fs, args); err != nil {
+		return err
+	}
+
+	ns, cs, _ := lib.open()
+	indexed, err := cs.IndexedNovels()
+	if err != nil {
+		return fmt.Errorf("failed to read index: %v", err)
+	}
+
+	var novels []listedNovel
+	catalogued := make(map[string]bool)
+	for _, novel := range ns.StoredNovels() {
+		catalogued[novel.Name] = true
+		// Fingerprints are internal to duplicate detection
+		novel.TextHash, novel.MinHash = "", nil
+		novels = append(novels, listedNovel{StoredNovel: novel, Chunks: indexed[novel.Name]})
+	}
+	for name, chunks := range indexed {
+		if !catalogued[name] {
+			novels = append(novels, listedNovel{StoredNovel: services.StoredNovel{Name: name, OriginalName: name}, Chunks: chunks})
+		}
+	}
+	sort.Slice(novels, func(i, j int) bool { return novels[i].Name < novels[j].Name })
+
+	return lib.write(stdout, novels, func() {
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tUPLOADED AS\tCHUNKS")
+		for _, novel := range novels {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", novel.Name, novel.OriginalName, novel.Chunks)
+		}
+		w.Flush()
+	})
+}
+
+func deleteCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("delete", &lib)
+	names, err := lib.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no novels given")
+	}
+
+	ns, _, is := lib.open()
+	// Resolve every name first so a typo deletes nothing
+	var stored []string
+	for _, name := range names {
+		resolved, ok := ns.ResolveNovel(name)
+		if !ok {
+			return fmt.Errorf("novel %q not found", name)
+		}
+		stored = append(stored, resolved)
+	}
+	for _, name := range stored {
+		if err := is.Remove(name); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", name, err)
+		}
+	}
+
+	return lib.write(stdout, map[string][]string{"deleted": stored}, func() {
+		for _, name := range stored {
+			fmt.Fprintf(stdout, "🗑️ Deleted %s\n", name)
+		}
+	})
+}
+
+func reindexCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("reindex", &lib)
+	if _, err := lib.parse(fs, args); err != nil {
+		return err
+	}
+
+	_, _, is := lib.open()
+	report, err := is.Reconcile(nil)
+	if err != nil {
+		return err
+	}
+
+	return lib.write(stdout, report, func() {
+		fmt.Fprintln(stdout, report)
+		for _, list := range []struct {
+			label string
+			names []string
+		}{{"added", report.Added}, {"updated", report.Updated}, {"removed", report.Removed}, {"skipped", report.Skipped}} {
+			if len(list.names) > 0 {
+				fmt.Fprintf(stdout, "%s: %s\n", list.label, strings.Join(list.names, ", "))
+			}
+		}
+		for _, failure := range report.Failed {
+			fmt.Fprintf(stdout, "failed: %s: %s\n", failure.Name, failure.Error)
+		}
+	})
+}
+
+func exportCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("export", &lib)
+	novel := fs.String("novel", "", "only export this novel")
+	output := fs.String("output", "", "file to write instead of standard output")
+	if _, err := lib.parse(fs, args); err != nil {
+		return err
+	}
+
+	ns, cs, _ := lib.open()
+	name := ""
+	if *novel != "" {
+		var ok bool
+		if name, ok = ns.ResolveNovel(*novel); !ok {
+			return fmt.Errorf("novel %q not found", *novel)
+		}
+	}
+	docs, err := cs.Documents(name)
+	if err != nil {
+		return fmt.Errorf("failed to read index: %v", err)
+	}
+
+	w := stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	// Exports are always JSON
+	lib.asJSON = true
+	return lib.write(w, docs, nil)
+}
+
+func configCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("config", &lib)
+	positional, err := lib.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || positional[0] != "print" {
+		return fmt.Errorf("expected 'config print'")
+	}
+
+	redacted := lib.cfg.Redacted()
+	return lib.write(stdout, redacted, func() {
+		data, _ := yaml.Marshal(redacted)
+		stdout.Write(data)
+	})
+}
+
+func inviteCommand(args []string, stdout io.Writer) error {
+	var lib library
+	fs := newFlagSet("invite", &lib)
+	if _, err := lib.parse(fs, args); err != nil {
+		return err
+	}
+
+	users, err := services.OpenUserStore(lib.cfg.Auth.UsersDB)
+	if err != nil {
+		return err
+	}
+	defer users.Close()
+	code, expires, err := users.CreateInvite(0)
+	if err != nil {
+		return err
+	}
+
+	invite := map[string]string{"code": code, "expiresAt": expires.UTC().Format(time.RFC3339), "url": "/register?invite=" + code}
+	return lib.write(stdout, invite, func() {
+		fmt.Fprintf(stdout, "🎟️ Invite code %s, valid until %s\n", code, expires.Format(time.RFC1123))
+		fmt.Fprintf(stdout, "Register at %s\n", invite["url"])
+	})
+}
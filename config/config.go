@@ -0,0 +1,527 @@
+// Package config loads the application's settings from defaults, an
+// optional YAML file, environment variables and command-line flags, each
+// overriding the one before
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is the configuration file read when no other is named and it
+// exists in the working directory
+const DefaultFile = "novel-qa.yaml"
+
+// FileEnv names the environment variable that can point at the
+// configuration file
+const FileEnv = "NOVEL_QA_CONFIG"
+
+type Config struct {
+	Server    ServerConfig    `yaml:"server" json:"server"`
+	Storage   StorageConfig   `yaml:"storage" json:"storage"`
+	Ollama    OllamaConfig    `yaml:"ollama" json:"ollama"`
+	Retrieval RetrievalConfig `yaml:"retrieval" json:"retrieval"`
+	Ingest    IngestConfig    `yaml:"ingest" json:"ingest"`
+	Uploads   UploadsConfig   `yaml:"uploads" json:"uploads"`
+	Log       LogConfig       `yaml:"log" json:"log"`
+	Tracing   TracingConfig   `yaml:"tracing" json:"tracing"`
+	Auth      AuthConfig      `yaml:"auth" json:"auth"`
+	Limits    LimitsConfig    `yaml:"limits" json:"limits"`
+}
+
+type ServerConfig struct {
+	// Addr is the address the web server listens on
+	Addr string `yaml:"addr" json:"addr"`
+	// ShutdownTimeout is how long a stopping server waits for requests and
+	// ingestion jobs to finish
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" json:"shutdownTimeout"`
+	// TrustedProxies are the addresses or CIDR ranges of proxies whose
+	// X-Forwarded-For headers are believed when working out a client's IP
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trustedProxies"`
+}
+
+type StorageConfig struct {
+	NovelsDir string `yaml:"novels_dir" json:"novelsDir"`
+	DBDir     string `yaml:"db_dir" json:"dbDir"`
+}
+
+type OllamaConfig struct {
+	Host string `yaml:"host" json:"host"`
+	// Pool are more Ollama servers sharing questions with Host, as base
+	// URLs. Each question goes to the least busy one that has the model.
+	Pool    []string `yaml:"pool" json:"pool"`
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+	// Retries is how many more times a question is asked when Ollama can't
+	// be reached or is unavailable, waiting RetryBackoff before the first
+	// retry and twice as long before each one after, less some jitter
+	Retries      int      `yaml:"retries" json:"retries"`
+	RetryBackoff Duration `yaml:"retry_backoff" json:"retryBackoff"`
+	// Models are the models offered in the UI; the first is the default
+	Models []string `yaml:"models" json:"models"`
+	// FallbackModels are tried in order when the model asked for is missing
+	// or fails
+	FallbackModels []string `yaml:"fallback_models" json:"fallbackModels"`
+	// AllowedEndpoints are the other Ollama servers clients may send
+	// questions to, as base URLs such as http://gpu-box:11434. They are
+	// only contacted at public addresses unless AllowPrivateEndpoints is
+	// set; link-local addresses are never contacted.
+	AllowedEndpoints      []string `yaml:"allowed_endpoints" json:"allowedEndpoints"`
+	AllowPrivateEndpoints bool     `yaml:"allow_private_endpoints" json:"allowPrivateEndpoints"`
+	// HealthInterval is how often the endpoints admins register are checked
+	HealthInterval Duration `yaml:"health_interval" json:"healthInterval"`
+}
+
+type RetrievalConfig struct {
+	// ChunkWords is the number of words in each indexed passage
+	ChunkWords int `yaml:"chunk_words" json:"chunkWords"`
+	// Results is the number of passages given to the model as context
+	Results int `yaml:"results" json:"results"`
+	// ContextWindow is how many neighbouring child chunks on each side of a
+	// match are returned; zero returns the enclosing passage
+	ContextWindow int `yaml:"context_window" json:"contextWindow"`
+}
+
+type IngestConfig struct {
+	Workers int `yaml:"workers" json:"workers"`
+	// Watch polls the novels directory for files added outside the app
+	Watch         bool     `yaml:"watch" json:"watch"`
+	WatchInterval Duration `yaml:"watch_interval" json:"watchInterval"`
+	WatchSettle   Duration `yaml:"watch_settle" json:"watchSettle"`
+	// JobRetention is how long finished ingestion jobs are kept, and
+	// MaxFinishedJobs how many at most
+	JobRetention    Duration `yaml:"job_retention" json:"jobRetention"`
+	MaxFinishedJobs int      `yaml:"max_finished_jobs" json:"maxFinishedJobs"`
+}
+
+type UploadsConfig struct {
+	// MaxFileMB and MaxRequestMB limit uploads in megabytes; zero means no
+	// limit
+	MaxFileMB    int64 `yaml:"max_file_mb" json:"maxFileMB"`
+	MaxRequestMB int64 `yaml:"max_request_mb" json:"maxRequestMB"`
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error and Format json or text
+	Level  string `yaml:"level" json:"level"`
+	Format string `yaml:"format" json:"format"`
+}
+
+type TracingConfig struct {
+	// Exporter is where spans are sent: none, otlp, stdout or file
+	Exporter string `yaml:"exporter" json:"exporter"`
+	// Endpoint is the OTLP/HTTP collector URL for the otlp exporter. When
+	// empty the standard OTEL_EXPORTER_OTLP_* variables apply.
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	// File is where the file exporter writes spans, one JSON object each
+	File string `yaml:"file" json:"file"`
+	// SampleRatio is the share of new traces recorded; traces started by a
+	// caller follow the caller's decision
+	SampleRatio float64 `yaml:"sample_ratio" json:"sampleRatio"`
+}
+
+type AuthConfig struct {
+	// Enabled requires logging in to upload, ask questions and administer
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Registration is open, letting anyone create an account, or invite,
+	// requiring a code from an admin. The first account becomes the admin
+	// and always needs a code from the invite command.
+	Registration string `yaml:"registration" json:"registration"`
+	// UsersDB is the SQLite database of accounts and sessions
+	UsersDB    string   `yaml:"users_db" json:"usersDB"`
+	SessionTTL Duration `yaml:"session_ttl" json:"sessionTTL"`
+	// SecureCookies sends cookies over HTTPS only even when requests arrive
+	// over plain HTTP, as they do behind a TLS-terminating proxy
+	SecureCookies bool `yaml:"secure_cookies" json:"secureCookies"`
+}
+
+type LimitsConfig struct {
+	// Routes limits each client's requests to a route, keyed by its path
+	// such as /ask. A client is an API key, a logged-in user or otherwise an
+	// IP address. Routes not listed are limited by Default; a zero rate
+	// means no limit.
+	Routes  map[string]Rate `yaml:"routes" json:"routes"`
+	Default Rate            `yaml:"default" json:"default"`
+	// MaxGenerations caps the answers being generated at once, zero for no
+	// cap. Questions beyond it wait in a queue taking turns between
+	// clients, of at most MaxQueue questions each waiting up to
+	// QueueTimeout.
+	MaxGenerations int      `yaml:"max_generations" json:"maxGenerations"`
+	MaxQueue       int      `yaml:"max_queue" json:"maxQueue"`
+	QueueTimeout   Duration `yaml:"queue_timeout" json:"queueTimeout"`
+}
+
+// RegistrationModes are the accepted registration modes
+var RegistrationModes = []string{"open", "invite"}
+
+// TracingExporters are the accepted tracing exporters
+var TracingExporters = []string{"none", "otlp", "stdout", "file"}
+
+// Default returns the settings used when nothing overrides them
+func Default() *Config {
+	return &Config{
+		Server:  ServerConfig{Addr: ":8080", ShutdownTimeout: Duration(30 * time.Second)},
+		Storage: StorageConfig{NovelsDir: "novels", DBDir: "chroma_db"},
+		Ollama: OllamaConfig{
+			Host:           "http://localhost:11434",
+			Timeout:        Duration(300 * time.Second),
+			Retries:        2,
+			RetryBackoff:   Duration(500 * time.Millisecond),
+			Models:         []string{"phi3", "llama3", "mistral", "gemma"},
+			HealthInterval: Duration(30 * time.Second),
+		},
+		Retrieval: RetrievalConfig{ChunkWords: 400, Results: 2},
+		Ingest: IngestConfig{
+			Workers:         2,
+			WatchInterval:   Duration(2 * time.Second),
+			WatchSettle:     Duration(5 * time.Second),
+			JobRetention:    Duration(7 * 24 * time.Hour),
+			MaxFinishedJobs: 500,
+		},
+		Uploads: UploadsConfig{MaxFileMB: 50, MaxRequestMB: 200},
+		Log:     LogConfig{Level: "info", Format: "json"},
+		Tracing: TracingConfig{Exporter: "none", File: "traces.json", SampleRatio: 1},
+		Auth: AuthConfig{
+			Registration: "open",
+			UsersDB:      "users.db",
+			SessionTTL:   Duration(7 * 24 * time.Hour),
+		},
+		Limits: LimitsConfig{
+			Routes: map[string]Rate{
+				"/ask":      {Requests: 20, Per: time.Minute},
+				"/upload":   {Requests: 60, Per: time.Hour},
+				"/login":    {Requests: 10, Per: time.Minute},
+				"/register": {Requests: 5, Per: time.Minute},
+			},
+			MaxGenerations: 2,
+			MaxQueue:       100,
+			QueueTimeout:   Duration(5 * time.Minute),
+		},
+	}
+}
+
+// Load returns the default settings overridden by the YAML file at path,
+// when path isn't empty, and then by environment variables read with
+// getenv. The result is validated.
+func Load(path string, getenv func(string) string) (*Config, error) {
+	return load(path, getenv, nil)
+}
+
+// load implements Load, applying overrides, when set, after the
+// environment
+func load(path string, getenv func(string) string, overrides func(*Config) error) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+	if overrides != nil {
+		if err := overrides(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// FilePath picks the configuration file: the one named by NOVEL_QA_CONFIG,
+// or DefaultFile if it exists, or none
+func FilePath(getenv func(string) string) string {
+	if path := getenv(FileEnv); path != "" {
+		return path
+	}
+	if _, err := os.Stat(DefaultFile); err == nil {
+		return DefaultFile
+	}
+	return ""
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	// Misspelt keys would otherwise be silently ignored
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv(getenv func(string) string) error {
+	for _, s := range settings {
+		value := getenv(s.env)
+		if value == "" {
+			continue
+		}
+		if err := s.set(c, value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", s.env, value, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks every setting, reporting all problems at once
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, key, problem string) {
+		if !ok {
+			problems = append(problems, key+": "+problem)
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr", "must not be empty")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout", "must be positive")
+	check(c.Storage.NovelsDir != "", "storage.novels_dir", "must not be empty")
+	check(c.Storage.DBDir != "", "storage.db_dir", "must not be empty")
+	check(baseURL(c.Ollama.Host), "ollama.host", fmt.Sprintf("%q is not the base URL of an http or https server", c.Ollama.Host))
+	check(c.Ollama.Timeout > 0, "ollama.timeout", "must be positive")
+	check(len(c.Ollama.Models) > 0, "ollama.models", "must list at least one model")
+	for _, model := range c.Ollama.Models {
+		check(strings.TrimSpace(model) != "", "ollama.models", "must not contain empty names")
+	}
+	check(c.Ollama.Retries >= 0, "ollama.retries", "must not be negative")
+	check(c.Ollama.RetryBackoff > 0, "ollama.retry_backoff", "must be positive")
+	for _, model := range c.Ollama.FallbackModels {
+		check(strings.TrimSpace(model) != "", "ollama.fallback_models", "must not contain empty names")
+	}
+	for _, node := range c.Ollama.Pool {
+		check(baseURL(node), "ollama.pool", fmt.Sprintf("%q is not the base URL of an http or https server", node))
+	}
+	for _, endpoint := range c.Ollama.AllowedEndpoints {
+		check(baseURL(endpoint), "ollama.allowed_endpoints", fmt.Sprintf("%q is not the base URL of an http or https server", endpoint))
+	}
+	check(c.Ollama.HealthInterval > 0, "ollama.health_interval", "must be positive")
+	check(c.Retrieval.ChunkWords > 0, "retrieval.chunk_words", "must be positive")
+	check(c.Retrieval.Results > 0, "retrieval.results", "must be positive")
+	check(c.Retrieval.ContextWindow >= 0, "retrieval.context_window", "must not be negative")
+	check(c.Ingest.Workers > 0, "ingest.workers", "must be positive")
+	check(c.Ingest.WatchInterval > 0, "ingest.watch_interval", "must be positive")
+	check(c.Ingest.JobRetention > 0, "ingest.job_retention", "must be positive")
+	check(c.Ingest.MaxFinishedJobs > 0, "ingest.max_finished_jobs", "must be positive")
+	check(c.Ingest.WatchSettle >= 0, "ingest.watch_settle", "must not be negative")
+	check(c.Uploads.MaxFileMB >= 0, "uploads.max_file_mb", "must not be negative")
+	check(c.Uploads.MaxRequestMB >= 0, "uploads.max_request_mb", "must not be negative")
+	check(oneOf(c.Log.Level, logging.Levels), "log.level", fmt.Sprintf("%q is not one of %s", c.Log.Level, strings.Join(logging.Levels, ", ")))
+	check(oneOf(c.Log.Format, logging.Formats), "log.format", fmt.Sprintf("%q is not one of %s", c.Log.Format, strings.Join(logging.Formats, ", ")))
+	check(oneOf(c.Tracing.Exporter, TracingExporters), "tracing.exporter", fmt.Sprintf("%q is not one of %s", c.Tracing.Exporter, strings.Join(TracingExporters, ", ")))
+	if c.Tracing.Endpoint != "" {
+		endpoint, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && (endpoint.Scheme == "http" || endpoint.Scheme == "https") && endpoint.Host != "",
+			"tracing.endpoint", fmt.Sprintf("%q is not an http or https URL", c.Tracing.Endpoint))
+	}
+	check(!strings.EqualFold(c.Tracing.Exporter, "file") || c.Tracing.File != "", "tracing.file", "must not be empty for the file exporter")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio", "must be between 0 and 1")
+	check(oneOf(c.Auth.Registration, RegistrationModes), "auth.registration", fmt.Sprintf("%q is not one of %s", c.Auth.Registration, strings.Join(RegistrationModes, ", ")))
+	check(!c.Auth.Enabled || c.Auth.UsersDB != "", "auth.users_db", "must not be empty when auth is enabled")
+	check(c.Auth.SessionTTL > 0, "auth.session_ttl", "must be positive")
+	for route, rate := range c.Limits.Routes {
+		check(strings.HasPrefix(route, "/"), "limits.routes", fmt.Sprintf("%q is not a path", route))
+		check(rate.valid(), "limits.routes", fmt.Sprintf("%s: rate must not be negative", route))
+	}
+	check(c.Limits.Default.valid(), "limits.default", "rate must not be negative")
+	check(c.Limits.MaxGenerations >= 0, "limits.max_generations", "must not be negative")
+	check(c.Limits.MaxQueue >= 0, "limits.max_queue", "must not be negative")
+	check(c.Limits.QueueTimeout > 0, "limits.queue_timeout", "must be positive")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// baseURL reports whether s is an http or https URL with no path beyond
+// "/" and no query, to which API paths such as /api/chat can be added
+func baseURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && (u.Path == "" || u.Path == "/") && u.RawQuery == ""
+}
+
+// oneOf reports whether value is one of names, ignoring case
+func oneOf(value string, names []string) bool {
+	for _, name := range names {
+		if strings.EqualFold(value, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultModel is the model used when a request doesn't name a known one
+func (c *Config) DefaultModel() string {
+	return c.Ollama.Models[0]
+}
+
+// OllamaNodes are the Ollama servers questions are shared between: the host,
+// then the pool
+func (c *Config) OllamaNodes() []string {
+	return append([]string{c.Ollama.Host}, c.Ollama.Pool...)
+}
+
+// Redacted returns a copy of the configuration safe to print, with any
+// credentials in URLs hidden
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.Ollama.Models = append([]string(nil), c.Ollama.Models...)
+	redacted.Ollama.FallbackModels = append([]string(nil), c.Ollama.FallbackModels...)
+	redacted.Server.TrustedProxies = append([]string(nil), c.Server.TrustedProxies...)
+	redacted.Limits.Routes = make(map[string]Rate, len(c.Limits.Routes))
+	for route, rate := range c.Limits.Routes {
+		redacted.Limits.Routes[route] = rate
+	}
+	if u, err := url.Parse(c.Ollama.Host); err == nil {
+		redacted.Ollama.Host = u.Redacted()
+	}
+	redacted.Ollama.Pool = nil
+	for _, node := range c.Ollama.Pool {
+		if u, err := url.Parse(node); err == nil {
+			node = u.Redacted()
+		}
+		redacted.Ollama.Pool = append(redacted.Ollama.Pool, node)
+	}
+	redacted.Ollama.AllowedEndpoints = nil
+	for _, endpoint := range c.Ollama.AllowedEndpoints {
+		if u, err := url.Parse(endpoint); err == nil {
+			endpoint = u.Redacted()
+		}
+		redacted.Ollama.AllowedEndpoints = append(redacted.Ollama.AllowedEndpoints, endpoint)
+	}
+	if u, err := url.Parse(c.Tracing.Endpoint); err == nil {
+		redacted.Tracing.Endpoint = u.Redacted()
+	}
+	return &redacted
+}
+
+// Duration is a time.Duration written as a string such as "300s" in YAML
+// and JSON
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", node.Line, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Rate is a number of requests allowed per period, written as "20/1m" or
+// "20/m". The zero Rate, written "0", allows any number.
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRate parses a rate such as "20/1m"
+func ParseRate(value string) (Rate, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" || strings.EqualFold(value, "none") {
+		return Rate{}, nil
+	}
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("not a rate such as 20/1m")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("not a rate such as 20/1m")
+	}
+	period = strings.TrimSpace(period)
+	if period != "" && strings.IndexAny(period[:1], "0123456789.") != 0 {
+		period = "1" + period
+	}
+	per, err := time.ParseDuration(period)
+	if err != nil || per <= 0 {
+		return Rate{}, fmt.Errorf("not a rate such as 20/1m")
+	}
+	return Rate{Requests: n, Per: per}, nil
+}
+
+// Unlimited reports whether the rate allows any number of requests
+func (r Rate) Unlimited() bool {
+	return r.Requests == 0
+}
+
+func (r Rate) valid() bool {
+	return r.Requests >= 0 && (r.Requests == 0 || r.Per > 0)
+}
+
+func (r Rate) String() string {
+	if r.Unlimited() {
+		return "none"
+	}
+	per := r.Per.String()
+	// 1m0s reads better as 1m, and 1h0m0s as 1h
+	if strings.HasSuffix(per, "m0s") {
+		per = strings.TrimSuffix(per, "0s")
+	}
+	if strings.HasSuffix(per, "h0m") {
+		per = strings.TrimSuffix(per, "0m")
+	}
+	return strconv.Itoa(r.Requests) + "/" + per
+}
+
+func (r Rate) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+func (r *Rate) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := ParseRate(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", node.Line, err)
+	}
+	*r = parsed
+	return nil
+}
+
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Rate) UnmarshalText(text []byte) error {
+	parsed, err := ParseRate(string(text))
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
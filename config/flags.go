@@ -0,0 +1,369 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting is one configuration value that can be set from the environment
+// or a flag
+type setting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	// isBool settings can be given as a flag without a value
+	isBool bool
+	get    func(c *Config) string
+	set    func(c *Config, value string) error
+}
+
+var settings = []setting{
+	stringSetting("server.addr", "LISTEN_ADDR", "addr", "address to listen on",
+		func(c *Config) *string { return &c.Server.Addr }),
+	durationSetting("server.shutdown_timeout", "SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long to wait for requests and jobs when stopping",
+		func(c *Config) *Duration { return &c.Server.ShutdownTimeout }),
+	{
+		key: "server.trusted_proxies", env: "TRUSTED_PROXIES", flag: "trusted-proxies",
+		usage: "comma-separated proxy addresses or CIDR ranges whose X-Forwarded-For is believed",
+		get:   func(c *Config) string { return strings.Join(c.Server.TrustedProxies, ",") },
+		set: func(c *Config, value string) error {
+			c.Server.TrustedProxies = nil
+			for _, proxy := range strings.Split(value, ",") {
+				if proxy = strings.TrimSpace(proxy); proxy != "" {
+					c.Server.TrustedProxies = append(c.Server.TrustedProxies, proxy)
+				}
+			}
+			return nil
+		},
+	},
+	stringSetting("storage.novels_dir", "NOVELS_DIR", "novels", "novels directory",
+		func(c *Config) *string { return &c.Storage.NovelsDir }),
+	stringSetting("storage.db_dir", "CHROMA_DB_DIR", "db", "index directory",
+		func(c *Config) *string { return &c.Storage.DBDir }),
+	stringSetting("ollama.host", "OLLAMA_HOST", "ollama", "Ollama endpoint",
+		func(c *Config) *string { return &c.Ollama.Host }),
+	{
+		key: "ollama.pool", env: "OLLAMA_POOL", flag: "pool",
+		usage: "comma-separated base URLs of more Ollama servers sharing questions with the host",
+		get:   func(c *Config) string { return strings.Join(c.Ollama.Pool, ",") },
+		set: func(c *Config, value string) error {
+			c.Ollama.Pool = nil
+			for _, node := range strings.Split(value, ",") {
+				if node = strings.TrimSpace(node); node != "" {
+					c.Ollama.Pool = append(c.Ollama.Pool, node)
+				}
+			}
+			return nil
+		},
+	},
+	durationSetting("ollama.timeout", "OLLAMA_TIMEOUT", "ollama-timeout", "timeout for Ollama requests",
+		func(c *Config) *Duration { return &c.Ollama.Timeout }),
+	{
+		key: "ollama.models", env: "OLLAMA_MODELS", flag: "models",
+		usage: "comma-separated models to offer; the first is the default",
+		get:   func(c *Config) string { return strings.Join(c.Ollama.Models, ",") },
+		set: func(c *Config, value string) error {
+			c.Ollama.Models = nil
+			for _, model := range strings.Split(value, ",") {
+				c.Ollama.Models = append(c.Ollama.Models, strings.TrimSpace(model))
+			}
+			return nil
+		},
+	},
+	{
+		key: "ollama.allowed_endpoints", env: "OLLAMA_ALLOWED_ENDPOINTS", flag: "allowed-endpoints",
+		usage: "comma-separated Ollama base URLs clients may send questions to",
+		get:   func(c *Config) string { return strings.Join(c.Ollama.AllowedEndpoints, ",") },
+		set: func(c *Config, value string) error {
+			c.Ollama.AllowedEndpoints = nil
+			for _, endpoint := range strings.Split(value, ",") {
+				if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+					c.Ollama.AllowedEndpoints = append(c.Ollama.AllowedEndpoints, endpoint)
+				}
+			}
+			return nil
+		},
+	},
+	intSetting("ollama.retries", "OLLAMA_RETRIES", "ollama-retries", "times to retry a question when Ollama can't be reached or is unavailable",
+		func(c *Config) *int { return &c.Ollama.Retries }),
+	durationSetting("ollama.retry_backoff", "OLLAMA_RETRY_BACKOFF", "retry-backoff", "wait before the first retry, doubled for each one after",
+		func(c *Config) *Duration { return &c.Ollama.RetryBackoff }),
+	{
+		key: "ollama.fallback_models", env: "OLLAMA_FALLBACK_MODELS", flag: "fallback-models",
+		usage: "comma-separated models tried in order when the model asked for is missing or fails",
+		get:   func(c *Config) string { return strings.Join(c.Ollama.FallbackModels, ",") },
+		set: func(c *Config, value string) error {
+			c.Ollama.FallbackModels = nil
+			for _, model := range strings.Split(value, ",") {
+				if model = strings.TrimSpace(model); model != "" {
+					c.Ollama.FallbackModels = append(c.Ollama.FallbackModels, model)
+				}
+			}
+			return nil
+		},
+	},
+	boolSetting("ollama.allow_private_endpoints", "OLLAMA_ALLOW_PRIVATE", "allow-private-endpoints", "let allowed endpoints resolve to loopback and private network addresses",
+		func(c *Config) *bool { return &c.Ollama.AllowPrivateEndpoints }),
+	durationSetting("ollama.health_interval", "OLLAMA_HEALTH_INTERVAL", "health-interval", "how often registered Ollama endpoints are checked",
+		func(c *Config) *Duration { return &c.Ollama.HealthInterval }),
+	intSetting("retrieval.chunk_words", "CHUNK_WORDS", "chunk-words", "words in each indexed passage",
+		func(c *Config) *int { return &c.Retrieval.ChunkWords }),
+	intSetting("retrieval.results", "RETRIEVAL_RESULTS", "results", "passages given to the model as context",
+		func(c *Config) *int { return &c.Retrieval.Results }),
+	intSetting("retrieval.context_window", "RETRIEVAL_CONTEXT_WINDOW", "context-window", "neighbouring chunks returned around a match",
+		func(c *Config) *int { return &c.Retrieval.ContextWindow }),
+	intSetting("ingest.workers", "INGEST_WORKERS", "workers", "ingestion workers",
+		func(c *Config) *int { return &c.Ingest.Workers }),
+	boolSetting("ingest.watch", "WATCH_NOVELS", "watch", "watch the novels directory for changes",
+		func(c *Config) *bool { return &c.Ingest.Watch }),
+	durationSetting("ingest.watch_interval", "WATCH_INTERVAL", "watch-interval", "how often to poll the novels directory",
+		func(c *Config) *Duration { return &c.Ingest.WatchInterval }),
+	durationSetting("ingest.watch_settle", "WATCH_SETTLE", "watch-settle", "how long a file must stay unchanged before it is ingested",
+		func(c *Config) *Duration { return &c.Ingest.WatchSettle }),
+	durationSetting("ingest.job_retention", "JOB_RETENTION", "job-retention", "how long finished ingestion jobs are kept",
+		func(c *Config) *Duration { return &c.Ingest.JobRetention }),
+	intSetting("ingest.max_finished_jobs", "MAX_FINISHED_JOBS", "max-finished-jobs", "most finished ingestion jobs kept",
+		func(c *Config) *int { return &c.Ingest.MaxFinishedJobs }),
+	int64Setting("uploads.max_file_mb", "MAX_UPLOAD_FILE_MB", "max-upload-file-mb", "largest upload file in megabytes, 0 for no limit",
+		func(c *Config) *int64 { return &c.Uploads.MaxFileMB }),
+	int64Setting("uploads.max_request_mb", "MAX_UPLOAD_REQUEST_MB", "max-upload-request-mb", "largest upload request in megabytes, 0 for no limit",
+		func(c *Config) *int64 { return &c.Uploads.MaxRequestMB }),
+	stringSetting("log.level", "LOG_LEVEL", "log-level", "log level: debug, info, warn or error",
+		func(c *Config) *string { return &c.Log.Level }),
+	stringSetting("log.format", "LOG_FORMAT", "log-format", "log format: json or text",
+		func(c *Config) *string { return &c.Log.Format }),
+	stringSetting("tracing.exporter", "TRACING_EXPORTER", "tracing-exporter", "where trace spans go: none, otlp, stdout or file",
+		func(c *Config) *string { return &c.Tracing.Exporter }),
+	stringSetting("tracing.endpoint", "TRACING_ENDPOINT", "tracing-endpoint", "OTLP/HTTP collector URL for the otlp exporter",
+		func(c *Config) *string { return &c.Tracing.Endpoint }),
+	stringSetting("tracing.file", "TRACING_FILE", "tracing-file", "file the file exporter writes spans to",
+		func(c *Config) *string { return &c.Tracing.File }),
+	floatSetting("tracing.sample_ratio", "TRACING_SAMPLE_RATIO", "tracing-sample-ratio", "share of new traces recorded, from 0 to 1",
+		func(c *Config) *float64 { return &c.Tracing.SampleRatio }),
+	boolSetting("auth.enabled", "AUTH_ENABLED", "auth", "require logging in to upload, ask and administer",
+		func(c *Config) *bool { return &c.Auth.Enabled }),
+	stringSetting("auth.registration", "REGISTRATION", "registration", "who can register: open or invite",
+		func(c *Config) *string { return &c.Auth.Registration }),
+	stringSetting("auth.users_db", "USERS_DB", "users-db", "SQLite database of accounts and sessions",
+		func(c *Config) *string { return &c.Auth.UsersDB }),
+	durationSetting("auth.session_ttl", "SESSION_TTL", "session-ttl", "how long a login lasts",
+		func(c *Config) *Duration { return &c.Auth.SessionTTL }),
+	boolSetting("auth.secure_cookies", "SECURE_COOKIES", "secure-cookies", "send cookies over HTTPS only, as behind a TLS proxy",
+		func(c *Config) *bool { return &c.Auth.SecureCookies }),
+	{
+		key: "limits.routes", env: "RATE_LIMITS", flag: "rate-limits",
+		usage: "comma-separated per-client route limits such as /ask=20/1m replacing the defaults, or none",
+		get: func(c *Config) string {
+			var routes []string
+			for route, rate := range c.Limits.Routes {
+				routes = append(routes, route+"="+rate.String())
+			}
+			sort.Strings(routes)
+			return strings.Join(routes, ",")
+		},
+		set: func(c *Config, value string) error {
+			routes := make(map[string]Rate)
+			if strings.EqualFold(strings.TrimSpace(value), "none") {
+				value = ""
+			}
+			for _, limit := range strings.Split(value, ",") {
+				if limit = strings.TrimSpace(limit); limit == "" {
+					continue
+				}
+				route, rate, ok := strings.Cut(limit, "=")
+				if !ok {
+					return fmt.Errorf("not a list of limits such as /ask=20/1m")
+				}
+				parsed, err := ParseRate(rate)
+				if err != nil {
+					return fmt.Errorf("%s: %v", strings.TrimSpace(route), err)
+				}
+				routes[strings.TrimSpace(route)] = parsed
+			}
+			c.Limits.Routes = routes
+			return nil
+		},
+	},
+	rateSetting("limits.default", "RATE_LIMIT_DEFAULT", "rate-limit-default", "per-client limit on routes not listed in the route limits",
+		func(c *Config) *Rate { return &c.Limits.Default }),
+	intSetting("limits.max_generations", "MAX_GENERATIONS", "max-generations", "answers generated at once, 0 for no cap",
+		func(c *Config) *int { return &c.Limits.MaxGenerations }),
+	intSetting("limits.max_queue", "GENERATION_QUEUE", "generation-queue", "questions that can wait for a generation slot",
+		func(c *Config) *int { return &c.Limits.MaxQueue }),
+	durationSetting("limits.queue_timeout", "GENERATION_QUEUE_TIMEOUT", "generation-queue-timeout", "how long a question waits for a generation slot",
+		func(c *Config) *Duration { return &c.Limits.QueueTimeout }),
+}
+
+func stringSetting(key, env, flag, usage string, field func(*Config) *string) setting {
+	return setting{
+		key: key, env: env, flag: flag, usage: usage,
+		get: func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+func intSetting(key, env, flag, usage string, field func(*Config) *int) setting {
+	return setting{
+		key: key, env: env, flag: flag, usage: usage,
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("not a whole number")
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func int64Setting(key, env, flag, usage string, field func(*Config) *int64) setting {
+	return setting{
+		key: key, env: env, flag: flag, usage: usage,
+		get: func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+		set: func(c *Config, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("not a whole number")
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+func boolSetting(key, env, flag, usage string, field func(*Config) *bool) setting {
+	return setting{
+		key: key, env: env, flag: flag, usage: usage, isBool: true,
+		get: func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *Config, value string) error {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("not a boolean")
+			}
+			*field(c) = b
+			return nil
+		},
+	}
+}
+
+func floatSetting(key, env, flag, usage string, field func(*Config) *float64) setting {
+	return setting{
+		key: key, env: env, flag: flag, usage: usage,
+		get: func(c *Config) string { return strconv.FormatFloat(*field(c), 'g', -1, 64) },
+		set: func(c *Config, value string) error {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("not a number")
+			}
+			*field(c) = f
+			return nil
+		},
+	}
+}
+
+func durationSetting(key, env, flag, usage string, field func(*Config) *Duration) setting {
+	return setting{
+		key: key, env: env, flag: flag, usage: usage,
+		get: func(c *Config) string { return field(c).String() },
+		set: func(c *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("not a duration such as 30s or 5m")
+			}
+			*field(c) = Duration(d)
+			return nil
+		},
+	}
+}
+
+func rateSetting(key, env, flag, usage string, field func(*Config) *Rate) setting {
+	return setting{
+		key: key, env: env, flag: flag, usage: usage,
+		get: func(c *Config) string { return field(c).String() },
+		set: func(c *Config, value string) error {
+			rate, err := ParseRate(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = rate
+			return nil
+		},
+	}
+}
+
+// Flags are the configuration flags registered on a flag set. Flags that
+// are given override the file and environment.
+type Flags struct {
+	path   *string
+	values []*flagValue
+}
+
+// flagValue holds a flag's value until the configuration is loaded
+type flagValue struct {
+	setting *setting
+	value   string
+	given   bool
+}
+
+func (v *flagValue) String() string {
+	return v.value
+}
+
+func (v *flagValue) Set(value string) error {
+	// Check the value now so flag parsing reports it
+	if err := v.setting.set(Default(), value); err != nil {
+		return err
+	}
+	v.value, v.given = value, true
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.setting.isBool
+}
+
+// NewFlags registers a flag for every setting, plus -config naming the
+// configuration file, on fs
+func NewFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{
+		path: fs.String("config", "", fmt.Sprintf("configuration file (default $%s or %s if present)", FileEnv, DefaultFile)),
+	}
+	defaults := Default()
+	for i := range settings {
+		s := &settings[i]
+		v := &flagValue{setting: s, value: s.get(defaults)}
+		fs.Var(v, s.flag, fmt.Sprintf("%s (%s, $%s)", s.usage, s.key, s.env))
+		f.values = append(f.values, v)
+	}
+	return f
+}
+
+// Load loads the configuration as the package-level Load does, from the
+// file named by -config or chosen by FilePath, then applies the flags that
+// were given on the parsed flag set
+func (f *Flags) Load(getenv func(string) string) (*Config, error) {
+	path := *f.path
+	if path == "" {
+		path = FilePath(getenv)
+	}
+
+	return load(path, getenv, func(cfg *Config) error {
+		for _, v := range f.values {
+			if v.given {
+				if err := v.setting.set(cfg, v.value); err != nil {
+					return fmt.Errorf("invalid -%s %q: %v", v.setting.flag, v.value, err)
+				}
+			}
+		}
+		return nil
+	})
+}
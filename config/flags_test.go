@@ -0,0 +1,59 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func parseFlags(t *testing.T, args ...string) (*Flags, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	flags := NewFlags(fs)
+	return flags, fs.Parse(args)
+}
+
+func TestFlags_OverrideEnvironmentAndFile(t *testing.T) {
+	path := writeConfig(t, "server:\n  addr: \":9090\"\nretrieval:\n  results: 4\n")
+	flags, err := parseFlags(t, "-config", path, "-results", "6", "-watch", "-models", "gemma, phi3")
+	if err != nil {
+		t.Fatalf("Expected no error parsing flags, got %v", err)
+	}
+
+	cfg, err := flags.Load(env(map[string]string{"RETRIEVAL_RESULTS": "5", "LISTEN_ADDR": ":7070"}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.Retrieval.Results != 6 {
+		t.Errorf("Expected the flag to win, got %d results", cfg.Retrieval.Results)
+	}
+	if cfg.Server.Addr != ":7070" {
+		t.Errorf("Expected the environment to override the file, got %s", cfg.Server.Addr)
+	}
+	if !cfg.Ingest.Watch {
+		t.Error("Expected -watch to enable watching")
+	}
+	if len(cfg.Ollama.Models) != 2 || cfg.Ollama.Models[1] != "phi3" {
+		t.Errorf("Expected models from the flag, got %v", cfg.Ollama.Models)
+	}
+}
+
+func TestFlags_ConfigFileFromEnvironment(t *testing.T) {
+	path := writeConfig(t, "storage:\n  novels_dir: library\n")
+	flags, _ := parseFlags(t)
+
+	cfg, err := flags.Load(env(map[string]string{FileEnv: path}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if cfg.Storage.NovelsDir != "library" {
+		t.Errorf("Expected the file named by %s to be read, got %s", FileEnv, cfg.Storage.NovelsDir)
+	}
+}
+
+func TestFlags_InvalidValue(t *testing.T) {
+	if _, err := parseFlags(t, "-ollama-timeout", "soon"); err == nil {
+		t.Error("Expected an invalid duration to be rejected while parsing")
+	}
+}
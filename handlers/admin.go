@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminHandler struct {
+	ingestService *services.IngestService
+	jobs          *services.JobManager
+}
+
+func NewAdminHandler(is *services.IngestService, jm *services.JobManager) *AdminHandler {
+	return &AdminHandler{ingestService: is, jobs: jm}
+}
+
+// Reindex reconciles the index with the novels directory and returns what
+// changed
+func (ah *AdminHandler) Reindex(c *gin.Context) {
+	var pending []string
+	if ah.jobs != nil {
+		pending = ah.jobs.PendingFiles()
+	}
+
+	report, err := ah.ingestService.Reconcile(pending)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to reindex: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
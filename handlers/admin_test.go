@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kweusuf/novel-qa-go/services"
+)
+
+func TestReindex(t *testing.T) {
+	tempDir := t.TempDir()
+	novelsDir := filepath.Join(tempDir, "novels")
+	novelService := services.NewNovelService(novelsDir)
+	chromaService := services.NewChromaService(filepath.Join(tempDir, "db"))
+	adminHandler := NewAdminHandler(services.NewIngestService(novelService, chromaService), nil)
+
+	if err := os.WriteFile(filepath.Join(novelsDir, "emma.txt"), []byte("Emma Woodhouse, handsome, clever, and rich."), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/admin/reindex", adminHandler.Reindex)
+
+	req := httptest.NewRequest("POST", "/admin/reindex", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var report services.ReconcileReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if !reflect.DeepEqual(report.Added, []string{"emma.txt"}) {
+		t.Errorf("Expected emma.txt to be added, got %v", report.Added)
+	}
+
+	context, err := chromaService.Query("clever", 1, services.FullAccess)
+	if err != nil || context == "" {
+		t.Errorf("Expected emma.txt to be searchable, got %q (%v)", context, err)
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeysHandler lets users manage the API keys their scripts use
+type APIKeysHandler struct {
+	users *services.UserStore
+}
+
+func NewAPIKeysHandler(us *services.UserStore) *APIKeysHandler {
+	return &APIKeysHandler{users: us}
+}
+
+type apiKeyRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	Scopes []string `json:"scopes" binding:"required"`
+}
+
+// List returns the user's keys, without the keys themselves
+func (kh *APIKeysHandler) List(c *gin.Context) {
+	keys, err := kh.users.APIKeys(CurrentUser(c).ID)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("Failed to list API keys", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// Create makes a key for the user. The key is only ever returned here.
+func (kh *APIKeysHandler) Create(c *gin.Context) {
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
+		return
+	}
+
+	user := CurrentUser(c)
+	secret, key, err := kh.users.CreateAPIKey(user, req.Name, req.Scopes)
+	logger := logging.FromContext(c.Request.Context())
+	switch {
+	case errors.Is(err, services.ErrInvalidAPIKeyName), errors.Is(err, services.ErrInvalidScope):
+		c.JSON(http.StatusBadRequest, gin.H{"error": capitalize(err.Error())})
+		return
+	case errors.Is(err, services.ErrAdminScope):
+		c.JSON(http.StatusForbidden, gin.H{"error": capitalize(err.Error())})
+		return
+	case err != nil:
+		logger.Error("Failed to create API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	logger.Info("Created API key", "user", user.Username, "key_id", key.ID, "scopes", key.Scopes)
+	c.JSON(http.StatusCreated, gin.H{"key": secret, "apiKey": key})
+}
+
+// Revoke deletes one of the user's keys
+func (kh *APIKeysHandler) Revoke(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	user := CurrentUser(c)
+	err = kh.users.RevokeAPIKey(user.ID, id)
+	logger := logging.FromContext(c.Request.Context())
+	switch {
+	case errors.Is(err, services.ErrAPIKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	case err != nil:
+		logger.Error("Failed to revoke API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	logger.Info("Revoked API key", "user", user.Username, "key_id", id)
+	c.Status(http.StatusNoContent)
+}
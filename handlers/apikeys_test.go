@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAPIKeysRouter is newAuthRouter with key management and routes needing
+// each scope
+func newAPIKeysRouter(t *testing.T) (*gin.Engine, *services.UserStore) {
+	t.Helper()
+	r, users := newAuthRouter(t, RegistrationOpen)
+	apiKeysHandler := NewAPIKeysHandler(users)
+	manageKeys := RequireScope(services.ScopeAdmin)
+	r.GET("/api-keys", manageKeys, apiKeysHandler.List)
+	r.POST("/api-keys", manageKeys, apiKeysHandler.Create)
+	r.DELETE("/api-keys/:id", manageKeys, apiKeysHandler.Revoke)
+	r.POST("/query", RequireScope(services.ScopeAsk), func(c *gin.Context) { c.String(http.StatusOK, "answered "+CurrentUser(c).Username) })
+	r.POST("/upload", RequireScope(services.ScopeUpload), func(c *gin.Context) { c.String(http.StatusOK, "uploaded") })
+	r.POST("/admin/reindex", RequireAdmin, func(c *gin.Context) { c.String(http.StatusOK, "reindexed") })
+	return r, users
+}
+
+// createKey creates a key from a logged-in browser
+func createKey(t *testing.T, b *browser, scopes ...string) (string, services.APIKey) {
+	t.Helper()
+	var created struct {
+		Key    string          `json:"key"`
+		APIKey services.APIKey `json:"apiKey"`
+	}
+	if code := b.send("POST", "/api-keys", map[string]any{"name": "script", "scopes": scopes}, &created); code != http.StatusCreated {
+		t.Fatalf("Expected a key to be created, got %d", code)
+	}
+	return created.Key, created.APIKey
+}
+
+// withKey makes a request as a script would, with a bearer token and no
+// cookies or CSRF token
+func withKey(r *gin.Engine, method, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(nil))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIKeys_Scopes(t *testing.T) {
+	r, users := newAPIKeysRouter(t)
+	emma := register(t, r, "emma", newInvite(t, users))
+	harriet := register(t, r, "harriet", "")
+
+	askKey, _ := createKey(t, harriet, services.ScopeAsk)
+	uploadKey, _ := createKey(t, harriet, services.ScopeUpload)
+	adminKey, _ := createKey(t, emma, services.ScopeAdmin)
+	if code := harriet.send("POST", "/api-keys", map[string]any{"name": "script", "scopes": []string{"admin"}}, nil); code != http.StatusForbidden {
+		t.Errorf("Expected a reader's admin key to be refused, got %d", code)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		path     string
+		expected int
+	}{
+		{"no key or CSRF token", "", "/query", http.StatusForbidden},
+		{"unknown key", "nqa_unknown", "/query", http.StatusUnauthorized},
+		{"ask key asks", askKey, "/query", http.StatusOK},
+		{"ask key can't upload", askKey, "/upload", http.StatusForbidden},
+		{"upload key asks", uploadKey, "/query", http.StatusOK},
+		{"upload key uploads", uploadKey, "/upload", http.StatusOK},
+		{"upload key isn't admin", uploadKey, "/admin/reindex", http.StatusForbidden},
+		{"upload key can't make keys", uploadKey, "/api-keys", http.StatusForbidden},
+		{"admin key", adminKey, "/admin/reindex", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := withKey(r, "POST", tt.path, tt.key); w.Code != tt.expected {
+				t.Errorf("Expected status code %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// A key acts as its user, without cookies or a CSRF token
+	w := withKey(r, "POST", "/query", askKey)
+	if w.Body.String() != "answered harriet" || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected harriet's answer and no cookies, got %q %v", w.Body.String(), w.Result().Cookies())
+	}
+}
+
+func TestAPIKeys_ListAndRevoke(t *testing.T) {
+	r, users := newAPIKeysRouter(t)
+	emma := register(t, r, "emma", newInvite(t, users))
+	harriet := register(t, r, "harriet", "")
+	secret, key := createKey(t, harriet, services.ScopeAsk)
+	withKey(r, "POST", "/query", secret)
+
+	var listed struct {
+		Keys []map[string]any `json:"keys"`
+	}
+	harriet.send("GET", "/api-keys", nil, &listed)
+	if len(listed.Keys) != 1 || listed.Keys[0]["lastUsedAt"] == nil || listed.Keys[0]["key"] != nil {
+		t.Errorf("Expected one used key without its secret, got %+v", listed.Keys)
+	}
+	emma.send("GET", "/api-keys", nil, &listed)
+	if len(listed.Keys) != 0 {
+		t.Errorf("Expected emma not to see harriet's keys, got %+v", listed.Keys)
+	}
+
+	path := fmt.Sprintf("/api-keys/%d", key.ID)
+	if code := emma.send("DELETE", path, nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected emma not to revoke harriet's key, got %d", code)
+	}
+	if code := harriet.send("DELETE", path, nil, nil); code != http.StatusNoContent {
+		t.Errorf("Expected the key to be revoked, got %d", code)
+	}
+	if w := withKey(r, "POST", "/query", secret); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked key to be refused, got %d", w.Code)
+	}
+}
+
+func TestAPIKeys_CreateRequest(t *testing.T) {
+	r, users := newAPIKeysRouter(t)
+	b := register(t, r, "emma", newInvite(t, users))
+	var response map[string]string
+	if code := b.send("POST", "/api-keys", map[string]any{"name": "script", "scopes": []string{"write"}}, &response); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown scope to be refused, got %d", code)
+	}
+	if response["error"] != "Scopes are ask, upload, admin" {
+		t.Errorf("Unexpected error %q", response["error"])
+	}
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionCookie holds the token of a logged-in user's session
+const SessionCookie = "novelqa_session"
+
+// Registration modes
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+)
+
+// userKey is where Session stores the logged-in user on the gin context,
+// and apiKeyKey the API key they authenticated with, if any
+const (
+	userKey   = "user"
+	apiKeyKey = "apiKey"
+)
+
+type AuthHandler struct {
+	users        *services.UserStore
+	registration string
+	// secureCookies marks cookies HTTPS-only even on plain HTTP requests,
+	// for servers behind a proxy that terminates TLS
+	secureCookies bool
+}
+
+func NewAuthHandler(us *services.UserStore) *AuthHandler {
+	return &AuthHandler{users: us, registration: RegistrationOpen}
+}
+
+// SetRegistration sets whether anyone can register or an invite code is
+// needed
+func (ah *AuthHandler) SetRegistration(mode string) {
+	ah.registration = strings.ToLower(mode)
+}
+
+// SetSecureCookies makes cookies HTTPS-only whether or not requests arrive
+// over TLS
+func (ah *AuthHandler) SetSecureCookies(secure bool) {
+	ah.secureCookies = secure
+}
+
+// Session is middleware loading the user logged in with the request's
+// session cookie or, for programmatic clients, the API key sent as a bearer
+// token. Only an invalid API key is rejected; RequireUser and RequireAdmin
+// reject requests without a user.
+func (ah *AuthHandler) Session() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key, ok := bearerToken(c); ok {
+			user, apiKey, err := ah.users.APIKeyUser(key)
+			if err != nil {
+				if !errors.Is(err, services.ErrAPIKeyNotFound) {
+					logging.FromContext(c.Request.Context()).Error("Failed to check API key", "error", err)
+				}
+				c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				return
+			}
+			c.Set(userKey, user)
+			c.Set(apiKeyKey, apiKey)
+			c.Next()
+			return
+		}
+		if token, err := c.Cookie(SessionCookie); err == nil && token != "" {
+			user, err := ah.users.SessionUser(token)
+			switch {
+			case err == nil:
+				c.Set(userKey, user)
+			case !errors.Is(err, services.ErrSessionNotFound):
+				logging.FromContext(c.Request.Context()).Error("Failed to load session", "error", err)
+			}
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser returns the logged-in user, or nil
+func CurrentUser(c *gin.Context) *services.User {
+	if user, ok := c.Get(userKey); ok {
+		return user.(*services.User)
+	}
+	return nil
+}
+
+// RequireUser rejects requests without a logged-in user. Pages redirect to
+// the login form; API calls get a 401.
+func RequireUser(c *gin.Context) {
+	if CurrentUser(c) != nil {
+		c.Next()
+		return
+	}
+	if c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Redirect(http.StatusFound, "/login")
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+}
+
+// RequireAdmin rejects requests unless an admin is logged in, with an API
+// key having the admin scope if they used one
+func RequireAdmin(c *gin.Context) {
+	user := CurrentUser(c)
+	switch {
+	case user == nil:
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Login required"})
+	case !user.Admin:
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+	case !keyAllows(c, services.ScopeAdmin):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the admin scope"})
+	default:
+		c.Next()
+	}
+}
+
+// RequireScope is RequireUser also rejecting API keys without scope.
+// Logins through the browser can do anything their user can.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if CurrentUser(c) == nil {
+			RequireUser(c)
+			return
+		}
+		if !keyAllows(c, scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentAPIKey returns the API key the request authenticated with, or nil
+// for browser sessions
+func CurrentAPIKey(c *gin.Context) *services.APIKey {
+	if key, ok := c.Get(apiKeyKey); ok {
+		return key.(*services.APIKey)
+	}
+	return nil
+}
+
+// keyAllows reports whether the request's API key, if any, grants scope
+func keyAllows(c *gin.Context, scope string) bool {
+	key := CurrentAPIKey(c)
+	return key == nil || key.HasScope(scope)
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// ShowLogin renders the login form
+func (ah *AuthHandler) ShowLogin(c *gin.Context) {
+	if CurrentUser(c) != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	c.HTML(http.StatusOK, "login.html", gin.H{"csrfToken": CSRFToken(c)})
+}
+
+// Login checks the submitted username and password and starts a session
+func (ah *AuthHandler) Login(c *gin.Context) {
+	username := strings.TrimSpace(c.PostForm("username"))
+	user, err := ah.users.Authenticate(username, c.PostForm("password"))
+	logger := logging.FromContext(c.Request.Context())
+	if err != nil {
+		status := http.StatusUnauthorized
+		message := "Invalid username or password"
+		if !errors.Is(err, services.ErrInvalidCredentials) {
+			status, message = http.StatusInternalServerError, "Login failed, please try again"
+			logger.Error("Failed to log in", "username", username, "error", err)
+		} else {
+			logger.Warn("Login failed", "username", username)
+		}
+		c.HTML(status, "login.html", gin.H{"error": message, "csrfToken": CSRFToken(c)})
+		return
+	}
+
+	if !ah.startSession(c, user) {
+		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"error": "Login failed, please try again", "csrfToken": CSRFToken(c)})
+		return
+	}
+	logger.Info("Logged in", "user", user.Username)
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// ShowRegister renders the registration form, with an invite code field
+// when one is needed. ?invite= fills the code in.
+func (ah *AuthHandler) ShowRegister(c *gin.Context) {
+	c.HTML(http.StatusOK, "register.html", ah.registerData(c, ""))
+}
+
+// Register creates an account and logs it in. The first account becomes
+// the admin, and needs an invite from the invite command.
+func (ah *AuthHandler) Register(c *gin.Context) {
+	username := strings.TrimSpace(c.PostForm("username"))
+	password := c.PostForm("password")
+	if password != c.PostForm("confirm") {
+		c.HTML(http.StatusBadRequest, "register.html", ah.registerData(c, "Passwords don't match"))
+		return
+	}
+
+	requireInvite := ah.registration == RegistrationInvite
+	user, err := ah.users.Register(username, password, strings.TrimSpace(c.PostForm("invite")), requireInvite)
+	logger := logging.FromContext(c.Request.Context())
+	switch {
+	case errors.Is(err, services.ErrUserExists):
+		c.HTML(http.StatusConflict, "register.html", ah.registerData(c, "That username is taken"))
+		return
+	case errors.Is(err, services.ErrInvalidUsername), errors.Is(err, services.ErrInvalidPassword), errors.Is(err, services.ErrInvalidInvite):
+		c.HTML(http.StatusBadRequest, "register.html", ah.registerData(c, capitalize(err.Error())))
+		return
+	case err != nil:
+		logger.Error("Failed to register user", "username", username, "error", err)
+		c.HTML(http.StatusInternalServerError, "register.html", ah.registerData(c, "Registration failed, please try again"))
+		return
+	}
+	logger.Info("Registered user", "user", user.Username, "admin", user.Admin)
+
+	if !ah.startSession(c, user) {
+		c.Redirect(http.StatusSeeOther, "/login")
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/")
+}
+
+// Logout ends the session and returns to the login form
+func (ah *AuthHandler) Logout(c *gin.Context) {
+	if token, err := c.Cookie(SessionCookie); err == nil && token != "" {
+		if err := ah.users.DeleteSession(token); err != nil {
+			logging.FromContext(c.Request.Context()).Error("Failed to log out", "error", err)
+		}
+	}
+	ah.setCookie(c, SessionCookie, "", -1, http.SameSiteLaxMode)
+	c.Redirect(http.StatusSeeOther, "/login")
+}
+
+// CreateInvite returns a new invite code for registering while registration
+// is invite-only
+func (ah *AuthHandler) CreateInvite(c *gin.Context) {
+	var createdBy int64
+	if user := CurrentUser(c); user != nil {
+		createdBy = user.ID
+	}
+	code, expires, err := ah.users.CreateInvite(createdBy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"code":      code,
+		"expiresAt": expires.UTC().Format(time.RFC3339),
+		"url":       "/register?invite=" + code,
+	})
+}
+
+// startSession creates a session for user and sets its cookie, reporting
+// whether it could
+func (ah *AuthHandler) startSession(c *gin.Context, user *services.User) bool {
+	token, expires, err := ah.users.CreateSession(user.ID)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("Failed to start session", "user", user.Username, "error", err)
+		return false
+	}
+	ah.setCookie(c, SessionCookie, token, int(time.Until(expires).Seconds()), http.SameSiteLaxMode)
+	return true
+}
+
+// setCookie sets an HttpOnly cookie for the whole site, secure when the
+// request came over TLS or secure cookies are forced
+func (ah *AuthHandler) setCookie(c *gin.Context, name, value string, maxAge int, sameSite http.SameSite) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   ah.secureCookies || c.Request.TLS != nil,
+		SameSite: sameSite,
+	})
+}
+
+func (ah *AuthHandler) registerData(c *gin.Context, message string) gin.H {
+	// The first account is the admin and always needs an invite
+	inviteOnly := ah.registration == RegistrationInvite
+	if n, err := ah.users.Count(); err != nil || n == 0 {
+		inviteOnly = true
+	}
+	data := gin.H{
+		"csrfToken":  CSRFToken(c),
+		"inviteOnly": inviteOnly,
+		"invite":     c.Query("invite"),
+		"username":   c.PostForm("username"),
+	}
+	if message != "" {
+		data["error"] = message
+	}
+	if invite := c.PostForm("invite"); invite != "" {
+		data["invite"] = invite
+	}
+	return data
+}
+
+// capitalize upper-cases the first letter of an error for display
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAuthRouter serves the account routes in front of a protected page, a
+// protected API and an admin route
+func newAuthRouter(t *testing.T, registration string) (*gin.Engine, *services.UserStore) {
+	t.Helper()
+	users, err := services.OpenUserStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Failed to open user store: %v", err)
+	}
+	t.Cleanup(func() { users.Close() })
+
+	authHandler := NewAuthHandler(users)
+	authHandler.SetRegistration(registration)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	r.Use(authHandler.Session(), authHandler.CSRF())
+	r.GET("/login", authHandler.ShowLogin)
+	r.POST("/login", authHandler.Login)
+	r.GET("/register", authHandler.ShowRegister)
+	r.POST("/register", authHandler.Register)
+	r.POST("/logout", authHandler.Logout)
+	r.POST("/admin/invites", RequireAdmin, authHandler.CreateInvite)
+	r.GET("/", RequireUser, func(c *gin.Context) { c.String(http.StatusOK, "hello "+CurrentUser(c).Username) })
+	r.POST("/ask", RequireUser, func(c *gin.Context) { c.String(http.StatusOK, "answered") })
+	return r, users
+}
+
+// browser sends requests to a router keeping cookies between them, as a
+// browser would
+type browser struct {
+	t       *testing.T
+	r       *gin.Engine
+	cookies map[string]string
+}
+
+func newBrowser(t *testing.T, r *gin.Engine) *browser {
+	return &browser{t: t, r: r, cookies: make(map[string]string)}
+}
+
+func (b *browser) do(req *http.Request) *httptest.ResponseRecorder {
+	for name, value := range b.cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	w := httptest.NewRecorder()
+	b.r.ServeHTTP(w, req)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(b.cookies, cookie.Name)
+		} else {
+			b.cookies[cookie.Name] = cookie.Value
+		}
+	}
+	return w
+}
+
+func (b *browser) get(path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Accept", "text/html")
+	return b.do(req)
+}
+
+// post submits a form, with the CSRF token from the browser's cookie
+func (b *browser) post(path string, form url.Values) *httptest.ResponseRecorder {
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set(csrfField, b.cookies[CSRFCookie])
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(req)
+}
+
+// newInvite creates an invite code, as the invite command does for the first
+// account
+func newInvite(t *testing.T, users *services.UserStore) string {
+	t.Helper()
+	code, _, err := users.CreateInvite(0)
+	if err != nil {
+		t.Fatalf("Failed to create an invite: %v", err)
+	}
+	return code
+}
+
+// register signs a new browser up as username, leaving it logged in
+func register(t *testing.T, r *gin.Engine, username, invite string) *browser {
+	t.Helper()
+	b := newBrowser(t, r)
+	b.get("/register")
+	w := b.post("/register", url.Values{"username": {username}, "password": {"knightley1"}, "confirm": {"knightley1"}, "invite": {invite}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected %s to register, got %d: %s", username, w.Code, w.Body.String())
+	}
+	return b
+}
+
+func TestAuth_RegisterLoginLogout(t *testing.T) {
+	r, users := newAuthRouter(t, RegistrationOpen)
+
+	b := register(t, r, "emma", newInvite(t, users))
+	if b.cookies[SessionCookie] == "" {
+		t.Fatalf("Expected registering to log in")
+	}
+	if w := b.get("/"); w.Code != http.StatusOK || w.Body.String() != "hello emma" {
+		t.Errorf("Expected the page for emma, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Logging out ends the session on the server too
+	token := b.cookies[SessionCookie]
+	if w := b.post("/logout", nil); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a redirect to /login, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	b.cookies[SessionCookie] = token
+	if w := b.get("/"); w.Code != http.StatusFound {
+		t.Errorf("Expected the old session to be refused, got %d", w.Code)
+	}
+
+	// Logging back in
+	delete(b.cookies, SessionCookie)
+	w := b.post("/login", url.Values{"username": {"emma"}, "password": {"wrong-password"}})
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Invalid username or password") {
+		t.Errorf("Expected a wrong password to be refused, got %d", w.Code)
+	}
+	w = b.post("/login", url.Values{"username": {"emma"}, "password": {"knightley1"}})
+	if w.Code != http.StatusSeeOther || b.cookies[SessionCookie] == "" {
+		t.Fatalf("Expected emma to log in, got %d", w.Code)
+	}
+	if w := b.get("/"); w.Code != http.StatusOK {
+		t.Errorf("Expected the page after logging in, got %d", w.Code)
+	}
+}
+
+func TestAuth_SessionCookie(t *testing.T) {
+	r, users := newAuthRouter(t, RegistrationOpen)
+	b := newBrowser(t, r)
+	b.get("/register")
+	w := b.post("/register", url.Values{"username": {"emma"}, "password": {"knightley1"}, "confirm": {"knightley1"}, "invite": {newInvite(t, users)}})
+
+	var session *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == SessionCookie {
+			session = cookie
+		}
+	}
+	if session == nil {
+		t.Fatalf("Expected a session cookie")
+	}
+	if !session.HttpOnly || session.SameSite != http.SameSiteLaxMode || session.MaxAge <= 0 {
+		t.Errorf("Expected an HttpOnly, SameSite=Lax cookie with an expiry, got %+v", session)
+	}
+	if session.Secure {
+		t.Errorf("Expected no Secure flag over plain HTTP unless forced")
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	r, _ := newAuthRouter(t, RegistrationOpen)
+	b := newBrowser(t, r)
+
+	// Pages send visitors to log in, API calls are refused
+	if w := b.get("/"); w.Code != http.StatusFound || w.Header().Get("Location") != "/login" {
+		t.Errorf("Expected a redirect to /login, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	req := httptest.NewRequest("POST", "/ask", nil)
+	req.Header.Set(CSRFHeader, b.cookies[CSRFCookie])
+	if w := b.do(req); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	r, users := newAuthRouter(t, RegistrationOpen)
+	admin := register(t, r, "emma", newInvite(t, users))
+	reader := register(t, r, "harriet", "")
+
+	if w := reader.post("/admin/invites", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for a reader, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := admin.post("/admin/invites", nil); w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"code"`) {
+		t.Errorf("Expected an invite for the admin, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuth_FirstAccountNeedsInvite(t *testing.T) {
+	// Even with open registration, the first visitor can't make themselves
+	// the admin
+	r, users := newAuthRouter(t, RegistrationOpen)
+	b := newBrowser(t, r)
+	if w := b.get("/register"); !strings.Contains(w.Body.String(), `name="invite"`) {
+		t.Errorf("Expected an invite field before the first account exists")
+	}
+	w := b.post("/register", url.Values{"username": {"emma"}, "password": {"knightley1"}, "confirm": {"knightley1"}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "The invite code is invalid") {
+		t.Errorf("Expected the first account to need an invite, got %d", w.Code)
+	}
+	register(t, r, "emma", newInvite(t, users))
+
+	// Later accounts don't
+	if w := newBrowser(t, r).get("/register"); strings.Contains(w.Body.String(), `name="invite"`) {
+		t.Errorf("Expected no invite field once the admin exists")
+	}
+	register(t, r, "harriet", "")
+}
+
+func TestAuth_InviteOnlyRegistration(t *testing.T) {
+	r, users := newAuthRouter(t, RegistrationInvite)
+
+	// The first account, the admin, needs an invite from the invite command
+	b := newBrowser(t, r)
+	if w := b.get("/register"); !strings.Contains(w.Body.String(), `name="invite"`) {
+		t.Errorf("Expected an invite field before the first account exists")
+	}
+	admin := register(t, r, "emma", newInvite(t, users))
+
+	b = newBrowser(t, r)
+	if w := b.get("/register?invite=abc"); !strings.Contains(w.Body.String(), `name="invite" placeholder="Invite code" value="abc"`) {
+		t.Errorf("Expected the invite field filled in, got %s", w.Body.String())
+	}
+	w := b.post("/register", url.Values{"username": {"harriet"}, "password": {"martin123"}, "confirm": {"martin123"}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "The invite code is invalid") {
+		t.Errorf("Expected registration without an invite to be refused, got %d", w.Code)
+	}
+
+	w = admin.post("/admin/invites", nil)
+	code := strings.Split(strings.Split(w.Body.String(), `"code":"`)[1], `"`)[0]
+	register(t, r, "harriet", code)
+}
+
+func TestAuth_RegisterErrors(t *testing.T) {
+	r, users := newAuthRouter(t, RegistrationOpen)
+	register(t, r, "emma", newInvite(t, users))
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		expected int
+		message  string
+	}{
+		{"mismatched passwords", url.Values{"username": {"jane"}, "password": {"fairfax12"}, "confirm": {"fairfax13"}}, http.StatusBadRequest, "Passwords don&#39;t match"},
+		{"taken username", url.Values{"username": {"Emma"}, "password": {"fairfax12"}, "confirm": {"fairfax12"}}, http.StatusConflict, "That username is taken"},
+		{"short password", url.Values{"username": {"jane"}, "password": {"short"}, "confirm": {"short"}}, http.StatusBadRequest, "Passwords are 8 to 72 bytes long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBrowser(t, r)
+			b.get("/register")
+			w := b.post("/register", tt.form)
+			if w.Code != tt.expected || !strings.Contains(w.Body.String(), tt.message) {
+				t.Errorf("Expected %d with %q, got %d: %s", tt.expected, tt.message, w.Code, w.Body.String())
+			}
+		})
+	}
+}
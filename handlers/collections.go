@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CollectionsHandler serves each user's view of the library and the
+// collections they share novels through
+type CollectionsHandler struct {
+	users        *services.UserStore
+	novelService *services.NovelService
+}
+
+func NewCollectionsHandler(us *services.UserStore, ns *services.NovelService) *CollectionsHandler {
+	return &CollectionsHandler{users: us, novelService: ns}
+}
+
+// libraryNovel is a novel as listed for a user, with how they can read it:
+// "mine", "library" for the shared library or "shared" through a collection
+type libraryNovel struct {
+	Name         string    `json:"name"`
+	OriginalName string    `json:"originalName"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+	Access       string    `json:"access"`
+}
+
+type collectionRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type memberRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+type novelRequest struct {
+	Novel string `json:"novel" binding:"required"`
+}
+
+// readAccess works out which documents the user asking may read: their own
+// novels, the shared library and novels shared with them, or only the
+// novels of one of their collections. Without accounts everything is
+// readable.
+func readAccess(c *gin.Context, users *services.UserStore, collection int64) (services.Access, error) {
+	if users == nil {
+		if collection != 0 {
+			return services.Access{}, services.ErrCollectionNotFound
+		}
+		return services.FullAccess, nil
+	}
+	user := CurrentUser(c)
+	if user == nil {
+		return services.Access{}, nil
+	}
+
+	if collection != 0 {
+		found, err := users.Collection(collection, user.ID)
+		if err != nil {
+			return services.Access{}, err
+		}
+		novels := make(map[string]bool, len(found.Novels))
+		for _, novel := range found.Novels {
+			novels[novel] = true
+		}
+		return services.NovelsAccess(novels), nil
+	}
+
+	shared, err := users.SharedNovels(user.ID)
+	if err != nil {
+		return services.Access{}, err
+	}
+	return services.UserAccess(user.ID, shared), nil
+}
+
+// ListNovels returns the novels the user can ask about
+func (ch *CollectionsHandler) ListNovels(c *gin.Context) {
+	user := CurrentUser(c)
+	shared, err := ch.users.SharedNovels(user.ID)
+	if err != nil {
+		ch.fail(c, err)
+		return
+	}
+
+	novels := []libraryNovel{}
+	for _, novel := range ch.novelService.StoredNovels() {
+		access := ""
+		switch {
+		case novel.Owner == user.ID:
+			access = "mine"
+		case novel.Owner == 0:
+			access = "library"
+		case shared[novel.Name]:
+			access = "shared"
+		default:
+			continue
+		}
+		novels = append(novels, libraryNovel{
+			Name:         novel.Name,
+			OriginalName: novel.OriginalName,
+			UploadedAt:   novel.UploadedAt,
+			Access:       access,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"novels": novels})
+}
+
+// List returns the collections the user is a member of
+func (ch *CollectionsHandler) List(c *gin.Context) {
+	collections, err := ch.users.Collections(CurrentUser(c).ID)
+	if err != nil {
+		ch.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"collections": collections})
+}
+
+// Create makes a collection owned by the user
+func (ch *CollectionsHandler) Create(c *gin.Context) {
+	var req collectionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
+		return
+	}
+	collection, err := ch.users.CreateCollection(CurrentUser(c).ID, req.Name)
+	if err != nil {
+		ch.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, collection)
+}
+
+// Get returns one of the user's collections
+func (ch *CollectionsHandler) Get(c *gin.Context) {
+	id, ok := collectionID(c)
+	if !ok {
+		return
+	}
+	collection, err := ch.users.Collection(id, CurrentUser(c).ID)
+	if err != nil {
+		ch.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, collection)
+}
+
+// Delete deletes a collection the user owns
+func (ch *CollectionsHandler) Delete(c *gin.Context) {
+	id, ok := collectionID(c)
+	if !ok {
+		return
+	}
+	if err := ch.users.DeleteCollection(id, CurrentUser(c).ID); err != nil {
+		ch.fail(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// AddMember adds a user to a collection the user owns
+func (ch *CollectionsHandler) AddMember(c *gin.Context) {
+	id, ok := collectionID(c)
+	if !ok {
+		return
+	}
+	var req memberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
+		return
+	}
+	ch.update(c, id, ch.users.AddMember(id, CurrentUser(c).ID, req.Username))
+}
+
+// RemoveMember takes a user out of a collection, or lets a member leave
+func (ch *CollectionsHandler) RemoveMember(c *gin.Context) {
+	id, ok := collectionID(c)
+	if !ok {
+		return
+	}
+	user := CurrentUser(c)
+	err := ch.users.RemoveMember(id, user.ID, c.Param("username"))
+	if err == nil && c.Param("username") == user.Username {
+		// Having left, the user can no longer see the collection
+		c.Status(http.StatusNoContent)
+		return
+	}
+	ch.update(c, id, err)
+}
+
+// AddNovel shares one of the user's own novels with a collection
+func (ch *CollectionsHandler) AddNovel(c *gin.Context) {
+	id, ok := collectionID(c)
+	if !ok {
+		return
+	}
+	var req novelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
+		return
+	}
+	user := CurrentUser(c)
+	name, found := ch.novelService.ResolveOwnedNovel(req.Novel, user.ID)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You have no novel called " + req.Novel})
+		return
+	}
+	ch.update(c, id, ch.users.AddNovel(id, user.ID, name))
+}
+
+// RemoveNovel stops sharing a novel with a collection
+func (ch *CollectionsHandler) RemoveNovel(c *gin.Context) {
+	id, ok := collectionID(c)
+	if !ok {
+		return
+	}
+	ch.update(c, id, ch.users.RemoveNovel(id, CurrentUser(c).ID, c.Param("novel")))
+}
+
+// update responds to a change to a collection with the collection as it
+// now is
+func (ch *CollectionsHandler) update(c *gin.Context, id int64, err error) {
+	if err != nil {
+		ch.fail(c, err)
+		return
+	}
+	collection, err := ch.users.Collection(id, CurrentUser(c).ID)
+	if err != nil {
+		ch.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, collection)
+}
+
+// fail responds with the status matching a collection error
+func (ch *CollectionsHandler) fail(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, services.ErrCollectionNotFound), errors.Is(err, services.ErrUserNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, services.ErrNotCollectionOwner), errors.Is(err, services.ErrOwnerCannotLeave):
+		status = http.StatusForbidden
+	case errors.Is(err, services.ErrCollectionExists):
+		status = http.StatusConflict
+	case errors.Is(err, services.ErrInvalidCollectionName):
+		status = http.StatusBadRequest
+	default:
+		logging.FromContext(c.Request.Context()).Error("Failed to update collections", "error", err)
+		c.JSON(status, gin.H{"error": "Failed to update collections"})
+		return
+	}
+	c.JSON(status, gin.H{"error": capitalize(err.Error())})
+}
+
+// collectionID parses the :id parameter, responding with 404 when it isn't
+// a number
+func collectionID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return 0, false
+	}
+	return id, true
+}
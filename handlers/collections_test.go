@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newLibraryRouter serves uploads, questions and collections behind
+// accounts, with a model that answers with the prompt it was given so tests
+// can see which passages it was shown
+func newLibraryRouter(t *testing.T) (*gin.Engine, *services.UserStore) {
+	t.Helper()
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req services.OllamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(services.OllamaStreamResponse{Message: req.Messages[len(req.Messages)-1], Done: true})
+	}))
+	t.Cleanup(ollama.Close)
+
+	tempDir := t.TempDir()
+	users, err := services.OpenUserStore(filepath.Join(tempDir, "users.db"))
+	if err != nil {
+		t.Fatalf("Failed to open user store: %v", err)
+	}
+	t.Cleanup(func() { users.Close() })
+	novelService := services.NewNovelService(filepath.Join(tempDir, "novels"))
+	chromaService := services.NewChromaService(filepath.Join(tempDir, "db"))
+
+	qaHandler := NewQAHandler(novelService, chromaService, services.NewOllamaService(ollama.URL))
+	qaHandler.SetUserStore(users)
+	qaHandler.SetResults(5)
+	collectionsHandler := NewCollectionsHandler(users, novelService)
+	authHandler := NewAuthHandler(users)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	r.Use(authHandler.Session(), authHandler.CSRF())
+	r.GET("/register", authHandler.ShowRegister)
+	r.POST("/register", authHandler.Register)
+	r.POST("/upload", RequireUser, qaHandler.UploadNovel)
+	r.POST("/ask", RequireUser, qaHandler.AskQuestion)
+	r.GET("/novels", RequireUser, collectionsHandler.ListNovels)
+	r.GET("/collections", RequireUser, collectionsHandler.List)
+	r.POST("/collections", RequireUser, collectionsHandler.Create)
+	r.GET("/collections/:id", RequireUser, collectionsHandler.Get)
+	r.DELETE("/collections/:id", RequireUser, collectionsHandler.Delete)
+	r.POST("/collections/:id/members", RequireUser, collectionsHandler.AddMember)
+	r.DELETE("/collections/:id/members/:username", RequireUser, collectionsHandler.RemoveMember)
+	r.POST("/collections/:id/novels", RequireUser, collectionsHandler.AddNovel)
+	r.DELETE("/collections/:id/novels/:novel", RequireUser, collectionsHandler.RemoveNovel)
+	return r, users
+}
+
+// send makes a JSON request with the browser's CSRF token, decoding the
+// response into v when given
+func (b *browser) send(method, path string, body, v any) int {
+	b.t.Helper()
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CSRFHeader, b.cookies[CSRFCookie])
+	w := b.do(req)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			b.t.Fatalf("Failed to parse response to %s %s: %v", method, path, err)
+		}
+	}
+	return w.Code
+}
+
+// upload uploads a text file as the browser's user
+func (b *browser) upload(filename, content string) {
+	b.t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("files", filename)
+	part.Write([]byte(content))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(CSRFHeader, b.cookies[CSRFCookie])
+	if w := b.do(req); w.Code != http.StatusOK {
+		b.t.Fatalf("Expected %s to be uploaded, got %d: %s", filename, w.Code, w.Body.String())
+	}
+}
+
+// ask returns the prompt the model was given for a question, or the error
+func (b *browser) ask(question string, collection int64) (int, string) {
+	b.t.Helper()
+	var response struct {
+		Answer string `json:"answer"`
+		Error  string `json:"error"`
+	}
+	code := b.send("POST", "/ask", map[string]any{"question": question, "model": "phi3", "collection": collection}, &response)
+	return code, response.Answer + response.Error
+}
+
+// prompt returns the prompt the model was given for a question, failing
+// the test if it wasn't answered
+func (b *browser) prompt(question string, collection int64) string {
+	b.t.Helper()
+	code, prompt := b.ask(question, collection)
+	if code != http.StatusOK {
+		b.t.Fatalf("Expected %q to be answered, got %d: %s", question, code, prompt)
+	}
+	return prompt
+}
+
+func TestAskQuestion_PrivateNovels(t *testing.T) {
+	r, users := newLibraryRouter(t)
+	emma := register(t, r, "emma", newInvite(t, users))
+	harriet := register(t, r, "harriet", "")
+	emma.upload("diary.txt", "Emma kept a secret diary about Mr Knightley.")
+	harriet.upload("letters.txt", "Harriet wrote letters to Robert Martin.")
+
+	if prompt := emma.prompt("secret diary", 0); !strings.Contains(prompt, "Emma kept") {
+		t.Errorf("Expected emma's own novel in her context, got %q", prompt)
+	}
+	// However she asks, harriet is never shown emma's passages
+	for _, question := range []string{"secret diary", "Knightley", "what happened?"} {
+		if prompt := harriet.prompt(question, 0); strings.Contains(prompt, "Emma kept") {
+			t.Errorf("Expected %q not to reveal emma's novel, got %q", question, prompt)
+		}
+	}
+
+	var listed struct {
+		Novels []libraryNovel `json:"novels"`
+	}
+	harriet.send("GET", "/novels", nil, &listed)
+	if len(listed.Novels) != 1 || listed.Novels[0].OriginalName != "letters.txt" || listed.Novels[0].Access != "mine" {
+		t.Errorf("Expected harriet to list only her novel, got %+v", listed.Novels)
+	}
+}
+
+func TestCollections_Sharing(t *testing.T) {
+	r, users := newLibraryRouter(t)
+	emma := register(t, r, "emma", newInvite(t, users))
+	harriet := register(t, r, "harriet", "")
+	jane := register(t, r, "jane", "")
+	emma.upload("diary.txt", "Emma kept a secret diary about Mr Knightley.")
+	harriet.upload("letters.txt", "Harriet wrote letters to Robert Martin.")
+
+	var collection services.Collection
+	if code := emma.send("POST", "/collections", map[string]string{"name": "Highbury"}, &collection); code != http.StatusCreated {
+		t.Fatalf("Expected the collection to be created, got %d", code)
+	}
+	path := fmt.Sprintf("/collections/%d", collection.ID)
+	if code := emma.send("POST", "/collections", map[string]string{"name": "highbury"}, nil); code != http.StatusConflict {
+		t.Errorf("Expected a duplicate name to conflict, got %d", code)
+	}
+	if code := emma.send("POST", path+"/members", map[string]string{"username": "harriet"}, nil); code != http.StatusOK {
+		t.Fatalf("Expected harriet to be added, got %d", code)
+	}
+	if code := emma.send("POST", path+"/novels", map[string]string{"novel": "diary.txt"}, &collection); code != http.StatusOK || len(collection.Novels) != 1 {
+		t.Fatalf("Expected the diary to be shared, got %d %+v", code, collection)
+	}
+
+	// Only one's own novels can be shared
+	if code := harriet.send("POST", path+"/novels", map[string]string{"novel": collection.Novels[0]}, nil); code != http.StatusNotFound {
+		t.Errorf("Expected sharing someone else's novel to be refused, got %d", code)
+	}
+	// Only the owner manages members, and outsiders can't see the collection
+	if code := harriet.send("POST", path+"/members", map[string]string{"username": "jane"}, nil); code != http.StatusForbidden {
+		t.Errorf("Expected a member adding members to be forbidden, got %d", code)
+	}
+	if code := jane.send("GET", path, nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected an outsider not to see the collection, got %d", code)
+	}
+
+	// Members read the shared novel; asking within the collection reads
+	// nothing else, and outsiders can't ask within it
+	if prompt := harriet.prompt("secret diary", 0); !strings.Contains(prompt, "Emma kept") {
+		t.Errorf("Expected harriet to read the shared diary, got %q", prompt)
+	}
+	if prompt := harriet.prompt("letters diary", collection.ID); !strings.Contains(prompt, "Emma kept") || strings.Contains(prompt, "Robert Martin") {
+		t.Errorf("Expected only the collection's novels, got %q", prompt)
+	}
+	if code, _ := jane.ask("secret diary", collection.ID); code != http.StatusNotFound {
+		t.Errorf("Expected an outsider asking within the collection to get 404, got %d", code)
+	}
+	if prompt := jane.prompt("secret diary", 0); strings.Contains(prompt, "Emma kept") {
+		t.Errorf("Expected jane not to read the diary, got %q", prompt)
+	}
+
+	// Leaving the collection ends access
+	if code := harriet.send("DELETE", path+"/members/harriet", nil, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected harriet to leave, got %d", code)
+	}
+	if prompt := harriet.prompt("secret diary", 0); strings.Contains(prompt, "Emma kept") {
+		t.Errorf("Expected harriet not to read the diary after leaving, got %q", prompt)
+	}
+	if code := emma.send("DELETE", path, nil, nil); code != http.StatusNoContent {
+		t.Errorf("Expected the collection to be deleted, got %d", code)
+	}
+}
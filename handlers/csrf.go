@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CSRF tokens are kept in a cookie and must be echoed back by every form
+// post, in the csrf_token field, or API call, in the X-CSRF-Token header.
+// Another site can make a browser send the cookie but can't read it to
+// echo it. Requests made with an API key carry no cookies a browser would
+// add by itself, so need no token.
+const (
+	CSRFCookie = "novelqa_csrf"
+	CSRFHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+	csrfKey    = "csrfToken"
+)
+
+// CSRF is middleware giving each browser a CSRF token and rejecting posts
+// that don't send it back
+func (ah *AuthHandler) CSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if CurrentAPIKey(c) != nil {
+			c.Next()
+			return
+		}
+
+		token, err := c.Cookie(CSRFCookie)
+		if err != nil || token == "" {
+			token = newCSRFToken()
+			ah.setCookie(c, CSRFCookie, token, 0, http.SameSiteStrictMode)
+		}
+		c.Set(csrfKey, token)
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		sent := c.GetHeader(CSRFHeader)
+		// Only plain forms are read for the field; multipart bodies are
+		// uploads, whose size limits apply before they are parsed
+		if sent == "" && strings.HasPrefix(c.ContentType(), "application/x-www-form-urlencoded") {
+			sent = c.PostForm(csrfField)
+		}
+		if err != nil || sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid or missing CSRF token, reload the page and try again"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CSRFToken returns the token for pages to include in their forms, or an
+// empty string when CSRF protection is off
+func CSRFToken(c *gin.Context) string {
+	return c.GetString(csrfKey)
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	r, users := newAuthRouter(t, RegistrationOpen)
+	b := newBrowser(t, r)
+
+	// Pages hand out a token in a cookie and in their forms
+	w := b.get("/login")
+	token := b.cookies[CSRFCookie]
+	if token == "" || !strings.Contains(w.Body.String(), `name="csrf_token" value="`+token+`"`) {
+		t.Fatalf("Expected the login form to carry the CSRF token, got %s", w.Body.String())
+	}
+
+	form := url.Values{"username": {"emma"}, "password": {"knightley1"}, "confirm": {"knightley1"}, "invite": {newInvite(t, users)}}
+	post := func(token, header string) int {
+		f := url.Values{}
+		for k, v := range form {
+			f[k] = v
+		}
+		if token != "" {
+			f.Set(csrfField, token)
+		}
+		req := httptest.NewRequest("POST", "/register", strings.NewReader(f.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			req.Header.Set(CSRFHeader, header)
+		}
+		return b.do(req).Code
+	}
+
+	if code := post("", ""); code != http.StatusForbidden {
+		t.Errorf("Expected a post without a token to be refused, got %d", code)
+	}
+	if code := post("forged", ""); code != http.StatusForbidden {
+		t.Errorf("Expected a post with a wrong token to be refused, got %d", code)
+	}
+	if code := post("", token); code != http.StatusSeeOther {
+		t.Errorf("Expected the token in the header to be accepted, got %d", code)
+	}
+
+	// Without the cookie, as from another site's page, a token is useless
+	delete(b.cookies, CSRFCookie)
+	delete(b.cookies, SessionCookie)
+	req := httptest.NewRequest("POST", "/ask", nil)
+	req.Header.Set(CSRFHeader, token)
+	if w := b.do(req); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a post without the cookie to be refused, got %d", w.Code)
+	}
+}
+
+func TestCSRF_Cookie(t *testing.T) {
+	r, _ := newAuthRouter(t, RegistrationOpen)
+	w := newBrowser(t, r).get("/login")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CSRFCookie || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Errorf("Expected one HttpOnly, SameSite=Strict CSRF cookie, got %+v", cookies)
+	}
+}
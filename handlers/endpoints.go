@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EndpointsHandler serves the registry of Ollama endpoints: anyone who can
+// ask sees their names, health and models, and admins add and remove them
+type EndpointsHandler struct {
+	registry *services.EndpointRegistry
+}
+
+func NewEndpointsHandler(r *services.EndpointRegistry) *EndpointsHandler {
+	return &EndpointsHandler{registry: r}
+}
+
+// List returns the registered endpoints without their URLs
+func (eh *EndpointsHandler) List(c *gin.Context) {
+	endpoints := eh.registry.List()
+	for i := range endpoints {
+		endpoints[i].URL = ""
+	}
+	c.JSON(http.StatusOK, gin.H{"endpoints": endpoints})
+}
+
+// AdminList returns the registered endpoints with their URLs, credentials
+// hidden
+func (eh *EndpointsHandler) AdminList(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"endpoints": eh.registry.List()})
+}
+
+// Add registers an endpoint and checks it straight away
+func (eh *EndpointsHandler) Add(c *gin.Context) {
+	var spec services.EndpointSpec
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
+		return
+	}
+	endpoint, err := eh.registry.Add(spec)
+	if err != nil {
+		eh.fail(c, err)
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Registered Ollama endpoint", "endpoint", endpoint.ID, "url", endpoint.URL)
+	c.JSON(http.StatusCreated, eh.registry.Check(c.Request.Context(), endpoint.ID))
+}
+
+// Remove unregisters an endpoint
+func (eh *EndpointsHandler) Remove(c *gin.Context) {
+	if err := eh.registry.Remove(c.Param("id")); err != nil {
+		eh.fail(c, err)
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Removed Ollama endpoint", "endpoint", c.Param("id"))
+	c.Status(http.StatusNoContent)
+}
+
+// fail responds with the status matching a registry error
+func (eh *EndpointsHandler) fail(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, services.ErrEndpointNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, services.ErrEndpointExists):
+		status = http.StatusConflict
+	case errors.Is(err, services.ErrInvalidEndpointName), errors.Is(err, services.ErrInvalidEndpoint),
+		errors.Is(err, services.ErrInvalidCapability), errors.Is(err, services.ErrEndpointBlocked):
+		status = http.StatusBadRequest
+	default:
+		logging.FromContext(c.Request.Context()).Error("Failed to update endpoints", "error", err)
+		c.JSON(status, gin.H{"error": "Failed to update endpoints"})
+		return
+	}
+	c.JSON(status, gin.H{"error": capitalize(err.Error())})
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEndpoints(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/tags" {
+			w.Write([]byte(`{"models":[{"name":"llama3"}]}`))
+			return
+		}
+		w.Write([]byte(`{"message":{"role":"assistant","content":"From the workstation."},"done":true}`))
+	}))
+	defer ollama.Close()
+
+	tempDir := t.TempDir()
+	registry, err := services.NewEndpointRegistry(filepath.Join(tempDir, "endpoints.json"), services.NewEndpointGuard(nil, true))
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	chromaService := services.NewChromaService(filepath.Join(tempDir, "db"))
+	chromaService.Initialize()
+	qaHandler := NewQAHandler(services.NewNovelService(filepath.Join(tempDir, "novels")), chromaService, services.NewOllamaService("http://localhost:1"))
+	qaHandler.SetEndpointRegistry(registry)
+	handler := NewEndpointsHandler(registry)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/endpoints", handler.List)
+	r.GET("/admin/endpoints", handler.AdminList)
+	r.POST("/admin/endpoints", handler.Add)
+	r.DELETE("/admin/endpoints/:id", handler.Remove)
+	r.GET("/models", qaHandler.GetModels)
+	r.POST("/ask", qaHandler.AskQuestion)
+	send := func(method, path string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(data))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/admin/endpoints", services.EndpointSpec{Name: "Workstation", URL: ollama.URL, Token: "s3cret"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var added services.Endpoint
+	json.Unmarshal(w.Body.Bytes(), &added)
+	// The endpoint is checked as it is added
+	if added.ID != "workstation" || added.Health.Status != services.HealthOK || len(added.Health.Models) != 1 {
+		t.Errorf("Unexpected endpoint %+v", added)
+	}
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Error("Expected the token to be hidden")
+	}
+
+	errorCases := []struct {
+		spec   services.EndpointSpec
+		status int
+	}{
+		{services.EndpointSpec{Name: "workstation", URL: ollama.URL}, http.StatusConflict},
+		{services.EndpointSpec{Name: "Metadata", URL: "http://169.254.169.254"}, http.StatusBadRequest},
+		{services.EndpointSpec{Name: "Path", URL: ollama.URL + "/api"}, http.StatusBadRequest},
+	}
+	for _, tt := range errorCases {
+		if w := send("POST", "/admin/endpoints", tt.spec); w.Code != tt.status {
+			t.Errorf("Expected %d adding %+v, got %d", tt.status, tt.spec, w.Code)
+		}
+	}
+
+	// Only admins see where endpoints are
+	if w := send("GET", "/endpoints", nil); strings.Contains(w.Body.String(), ollama.URL) || !strings.Contains(w.Body.String(), `"workstation"`) {
+		t.Errorf("Expected the endpoint without its URL, got %s", w.Body.String())
+	}
+	if w := send("GET", "/admin/endpoints", nil); !strings.Contains(w.Body.String(), ollama.URL) {
+		t.Errorf("Expected the endpoint with its URL, got %s", w.Body.String())
+	}
+
+	// Clients choose the endpoint by ID
+	if w := send("GET", "/models?endpoint=workstation", nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "llama3") {
+		t.Errorf("Expected the endpoint's models, got %d: %s", w.Code, w.Body.String())
+	}
+	question := map[string]string{"question": "Who?", "model": "phi3", "ollamaEndpoint": "workstation"}
+	// Answers name a registered endpoint by ID rather than its address
+	if w := send("POST", "/ask", question); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "From the workstation.") || !strings.Contains(w.Body.String(), `"node":"workstation"`) {
+		t.Errorf("Expected an answer from the endpoint, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A failing endpoint's errors don't give its address away (nothing
+	// listens on port 1)
+	send("POST", "/admin/endpoints", services.EndpointSpec{Name: "Down", URL: "http://127.0.0.1:1"})
+	down := map[string]string{"question": "Who?", "model": "phi3", "ollamaEndpoint": "down"}
+	for _, w := range []*httptest.ResponseRecorder{send("POST", "/ask", down), send("GET", "/models?endpoint=down", nil)} {
+		if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "unreachable") || strings.Contains(w.Body.String(), "127.0.0.1") {
+			t.Errorf("Expected the failure without the endpoint's address, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	if w := send("DELETE", "/admin/endpoints/workstation", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", w.Code)
+	}
+	if w := send("DELETE", "/admin/endpoints/workstation", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+	if w := send("POST", "/ask", question); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a removed endpoint to be unknown, got %d", w.Code)
+	}
+	if w := send("GET", "/models?endpoint=workstation", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a removed endpoint to be unknown, got %d", w.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultCheckTimeout bounds each dependency check so probes answer quickly
+// even when Ollama hangs
+const DefaultCheckTimeout = 2 * time.Second
+
+type HealthHandler struct {
+	chromaService *services.ChromaService
+	ollamaService *services.OllamaService
+	version       string
+	started       time.Time
+	timeout       time.Duration
+	// draining is set once shutdown starts so load balancers stop sending
+	// traffic before the listener closes
+	draining atomic.Bool
+	// endpoints, when set, are reported by Status as of their last checks
+	endpoints *services.EndpointRegistry
+}
+
+// Check is the result of probing one dependency
+type Check struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func NewHealthHandler(cs *services.ChromaService, os *services.OllamaService, version string) *HealthHandler {
+	return &HealthHandler{
+		chromaService: cs,
+		ollamaService: os,
+		version:       version,
+		started:       time.Now(),
+		timeout:       DefaultCheckTimeout,
+	}
+}
+
+// SetTimeout sets how long each dependency check may take
+func (hh *HealthHandler) SetTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		hh.timeout = timeout
+	}
+}
+
+// SetEndpointRegistry makes Status report the health of the endpoints in
+// r. They don't affect readiness, as questions can still use the default.
+func (hh *HealthHandler) SetEndpointRegistry(r *services.EndpointRegistry) {
+	hh.endpoints = r
+}
+
+// Drain makes readiness fail from now on
+func (hh *HealthHandler) Drain() {
+	hh.draining.Store(true)
+}
+
+// Healthz reports that the process is up and serving requests
+func (hh *HealthHandler) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz reports whether the index can be loaded and Ollama answers,
+// returning 503 when either fails or the server is shutting down
+func (hh *HealthHandler) Readyz(c *gin.Context) {
+	store, _ := hh.checkStore(c.Request.Context())
+	ollama, _ := hh.checkOllama(c.Request.Context())
+	checks := gin.H{"store": store, "ollama": ollama}
+
+	status := http.StatusOK
+	state := "ok"
+	switch {
+	case hh.draining.Load():
+		status, state = http.StatusServiceUnavailable, "draining"
+	case store.Status != "ok" || ollama.Status != "ok":
+		status, state = http.StatusServiceUnavailable, "unavailable"
+	}
+	c.JSON(status, gin.H{"status": state, "checks": checks})
+}
+
+// Status reports the version, uptime, index contents and available models,
+// with how long each dependency took to answer. It is always 200 so a
+// failing dependency can still be inspected.
+func (hh *HealthHandler) Status(c *gin.Context) {
+	store, stats := hh.checkStore(c.Request.Context())
+	ollama, models := hh.checkOllama(c.Request.Context())
+	if models == nil {
+		models = []string{}
+	}
+	endpoints := []services.Endpoint{}
+	if hh.endpoints != nil {
+		endpoints = hh.endpoints.List()
+		for i := range endpoints {
+			endpoints[i].URL = ""
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"version":       hh.version,
+		"uptimeSeconds": int64(time.Since(hh.started).Seconds()),
+		"novels":        stats.Novels,
+		"chunks":        stats.Chunks,
+		"documents":     stats.Documents,
+		"indexBytes":    stats.SizeBytes,
+		"models":        models,
+		"dependencies":  gin.H{"store": store, "ollama": ollama},
+		"endpoints":     endpoints,
+	})
+}
+
+// Nodes reports how each Ollama node in the pool is doing. It names the
+// nodes' addresses, so it is for admins only.
+func (hh *HealthHandler) Nodes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"nodes": hh.ollamaService.Nodes()})
+}
+
+func (hh *HealthHandler) checkStore(ctx context.Context) (Check, services.IndexStats) {
+	start := time.Now()
+	stats, err := hh.chromaService.Stats()
+	return newCheck(ctx, "store", start, err, func(error) string { return "unreadable" }), stats
+}
+
+func (hh *HealthHandler) checkOllama(ctx context.Context) (Check, []string) {
+	ctx, cancel := context.WithTimeout(ctx, hh.timeout)
+	defer cancel()
+
+	start := time.Now()
+	models, err := hh.ollamaService.GetModelsContext(ctx)
+	return newCheck(ctx, "ollama", start, err, services.DescribeError), models
+}
+
+// newCheck records how a dependency check went. The probes are public and
+// the error may name file paths or Ollama nodes' addresses, so clients only
+// get it as describe puts it and the error itself is logged.
+func newCheck(ctx context.Context, dependency string, start time.Time, err error, describe func(error) string) Check {
+	check := Check{
+		Status:    "ok",
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("Dependency check failed", "dependency", dependency, "error", err)
+		check.Status = "error"
+		check.Error = describe(err)
+	}
+	return check
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kweusuf/novel-qa-go/services"
+)
+
+// newHealthRouter serves the health endpoints against a fresh index in
+// dbDir and an Ollama answering with handler
+func newHealthRouter(t *testing.T, dbDir string, ollama http.HandlerFunc) (*gin.Engine, *HealthHandler, *services.ChromaService) {
+	t.Helper()
+	server := httptest.NewServer(ollama)
+	t.Cleanup(server.Close)
+
+	chromaService := services.NewChromaService(dbDir)
+	chromaService.Initialize()
+	healthHandler := NewHealthHandler(chromaService, services.NewOllamaService(server.URL), "1.2.3")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.GET("/healthz", healthHandler.Healthz)
+	r.GET("/readyz", healthHandler.Readyz)
+	r.GET("/status", healthHandler.Status)
+	return r, healthHandler, chromaService
+}
+
+func ollamaTags(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{"models":[{"name":"llama3"},{"name":"phi3"}]}`))
+}
+
+func get(r *gin.Engine, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestHealthz(t *testing.T) {
+	r, _, _ := newHealthRouter(t, t.TempDir(), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	// Liveness doesn't depend on Ollama
+	if w := get(r, "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	dbDir := t.TempDir()
+	r, healthHandler, _ := newHealthRouter(t, dbDir, ollamaTags)
+
+	w := get(r, "/readyz")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response struct {
+		Status string           `json:"status"`
+		Checks map[string]Check `json:"checks"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Checks["store"].Status != "ok" || response.Checks["ollama"].Status != "ok" {
+		t.Errorf("Expected both checks to pass, got %+v", response.Checks)
+	}
+
+	// An unreadable index fails readiness
+	collection := filepath.Join(dbDir, "documents.json")
+	os.WriteFile(collection, []byte("{not json"), 0644)
+	if w := get(r, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d for a corrupt index, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	os.WriteFile(collection, []byte("[]"), 0644)
+
+	// So does shutting down
+	healthHandler.Drain()
+	w = get(r, "/readyz")
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusServiceUnavailable || response.Status != "draining" {
+		t.Errorf("Expected draining to fail readiness, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyz_OllamaDown(t *testing.T) {
+	tests := map[string]struct {
+		ollama   http.HandlerFunc
+		expected string
+	}{
+		"error": {func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, "status 500"},
+		"slow": {func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}, "timed out"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, healthHandler, _ := newHealthRouter(t, t.TempDir(), tt.ollama)
+			healthHandler.SetTimeout(50 * time.Millisecond)
+
+			w := get(r, "/readyz")
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+			}
+			var response struct {
+				Checks map[string]Check `json:"checks"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &response)
+			// The error doesn't give the server's address away
+			if check := response.Checks["ollama"]; check.Status != "error" || check.Error != tt.expected {
+				t.Errorf("Expected the Ollama check to fail with %q, got %+v", tt.expected, check)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	r, _, chromaService := newHealthRouter(t, t.TempDir(), ollamaTags)
+	chromaService.AddDocuments([]services.NovelChunk{
+		{ID: "emma.txt-0", Text: "Emma was clever", Novel: "emma.txt"},
+		{ID: "emma.txt-0-0", Text: "Emma", Novel: "emma.txt", ParentID: "emma.txt-0"},
+	})
+
+	w := get(r, "/status")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var status struct {
+		Version      string                `json:"version"`
+		Novels       int                   `json:"novels"`
+		Chunks       int                   `json:"chunks"`
+		IndexBytes   int64                 `json:"indexBytes"`
+		Models       []string              `json:"models"`
+		Dependencies map[string]Check      `json:"dependencies"`
+		Nodes        []services.OllamaNode `json:"nodes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if status.Version != "1.2.3" || status.Novels != 1 || status.Chunks != 1 || status.IndexBytes == 0 {
+		t.Errorf("Unexpected status %s", w.Body.String())
+	}
+	if len(status.Models) != 2 || status.Models[0] != "llama3" {
+		t.Errorf("Expected the models from Ollama, got %v", status.Models)
+	}
+	if _, ok := status.Dependencies["ollama"]; !ok {
+		t.Errorf("Expected Ollama latency to be reported, got %v", status.Dependencies)
+	}
+	// The nodes' addresses are only shown to admins
+	if status.Nodes != nil {
+		t.Errorf("Expected no Ollama nodes, got %+v", status.Nodes)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	r, healthHandler, _ := newHealthRouter(t, t.TempDir(), ollamaTags)
+	r.GET("/admin/nodes", healthHandler.Nodes)
+
+	var nodes struct {
+		Nodes []services.OllamaNode `json:"nodes"`
+	}
+	w := get(r, "/admin/nodes")
+	if err := json.Unmarshal(w.Body.Bytes(), &nodes); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(nodes.Nodes) != 1 || !nodes.Nodes[0].Healthy || nodes.Nodes[0].Node == "" {
+		t.Errorf("Expected the Ollama node to be reported, got %s", w.Body.String())
+	}
+}
+
+func TestStatus_Endpoints(t *testing.T) {
+	dir := t.TempDir()
+	r, healthHandler, _ := newHealthRouter(t, dir, ollamaTags)
+	registry, err := services.NewEndpointRegistry(filepath.Join(dir, "endpoints.json"), services.NewEndpointGuard(nil, true))
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	// Nothing listens on port 1
+	registry.Add(services.EndpointSpec{Name: "Workstation", URL: "http://127.0.0.1:1"})
+	registry.CheckAll(t.Context())
+	healthHandler.SetEndpointRegistry(registry)
+
+	var status struct {
+		Endpoints []services.Endpoint `json:"endpoints"`
+	}
+	w := get(r, "/status")
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(status.Endpoints) != 1 || status.Endpoints[0].Health.Status != services.HealthError || status.Endpoints[0].URL != "" {
+		t.Errorf("Expected the endpoint's health without its URL, got %s", w.Body.String())
+	}
+	if len(status.Endpoints) == 1 && status.Endpoints[0].Health.Error != "unreachable" {
+		t.Errorf("Expected the error without the endpoint's address, got %q", status.Endpoints[0].Health.Error)
+	}
+
+	// Registered endpoints don't affect readiness
+	if w := get(r, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("Expected ready, got %d", w.Code)
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JobsHandler struct {
+	jobs *services.JobManager
+}
+
+func NewJobsHandler(jm *services.JobManager) *JobsHandler {
+	return &JobsHandler{jobs: jm}
+}
+
+// GetJob returns the current state of an ingestion job
+func (jh *JobsHandler) GetJob(c *gin.Context) {
+	job, ok := jh.jobs.Get(c.Param("id"))
+	if !ok || !canSee(c, job) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// StreamJob sends a job's progress as server-sent events, one "progress"
+// event per change, ending with a "done" or "failed" event
+func (jh *JobsHandler) StreamJob(c *gin.Context) {
+	id := c.Param("id")
+	if job, ok := jh.jobs.Get(id); ok && !canSee(c, job) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	updates, cancel, ok := jh.jobs.Subscribe(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case job, open := <-updates:
+			if !open {
+				// Progress may have been dropped for a slow reader, so
+				// always finish with the final state
+				job, _ = jh.jobs.Get(id)
+				c.SSEvent(job.Stage, job)
+				return false
+			}
+			if job.Finished() {
+				return true
+			}
+			c.SSEvent("progress", job)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// canSee reports whether the user asking may follow a job: anyone can
+// follow jobs for the shared library, but a private upload's job only
+// reveals itself to its owner
+func canSee(c *gin.Context, job services.Job) bool {
+	if job.Owner == 0 {
+		return true
+	}
+	user := CurrentUser(c)
+	return user != nil && user.ID == job.Owner
+}
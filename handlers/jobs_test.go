@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kweusuf/novel-qa-go/services"
+)
+
+// setupJobsRouter wires an upload handler that queues jobs to a running job
+// manager, along with the job status routes
+func setupJobsRouter(t *testing.T) (*gin.Engine, *services.JobManager) {
+	t.Helper()
+	tempDir := t.TempDir()
+
+	novelService := services.NewNovelService(filepath.Join(tempDir, "novels"))
+	chromaService := services.NewChromaService(filepath.Join(tempDir, "db"))
+	ollamaService := services.NewOllamaService("http://localhost:11434")
+
+	jm, err := services.NewJobManager(filepath.Join(tempDir, "db", "jobs.json"), services.NewIngestService(novelService, chromaService), 1)
+	if err != nil {
+		t.Fatalf("Failed to create job manager: %v", err)
+	}
+	jm.Start()
+	t.Cleanup(jm.Stop)
+
+	qaHandler := NewQAHandler(novelService, chromaService, ollamaService)
+	qaHandler.SetJobManager(jm)
+	jobsHandler := NewJobsHandler(jm)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", qaHandler.UploadNovel)
+	r.GET("/jobs/:id", jobsHandler.GetJob)
+	r.GET("/jobs/:id/events", jobsHandler.StreamJob)
+	return r, jm
+}
+
+// uploadForJob uploads a text file and returns the ID of the queued job
+func uploadForJob(t *testing.T, r *gin.Engine, filename, content string) string {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("files", filename)
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write([]byte(content))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Jobs []services.Job `json:"jobs"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(response.Jobs) != 1 {
+		t.Fatalf("Expected 1 job, got %d", len(response.Jobs))
+	}
+	return response.Jobs[0].ID
+}
+
+func TestUploadNovel_QueuesJob(t *testing.T) {
+	r, _ := setupJobsRouter(t)
+	id := uploadForJob(t, r, "job.txt", "Emma Woodhouse, handsome, clever, and rich.")
+
+	deadline := time.Now().Add(5 * time.Second)
+	var job services.Job
+	for time.Now().Before(deadline) {
+		req := httptest.NewRequest("GET", "/jobs/"+id, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.Finished() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if job.Stage != services.StageDone {
+		t.Errorf("Expected job to be done, got %s (%s)", job.Stage, job.Error)
+	}
+	if job.Chunks != 1 {
+		t.Errorf("Expected 1 chunk, got %d", job.Chunks)
+	}
+}
+
+func TestGetJob_NotFound(t *testing.T) {
+	r, _ := setupJobsRouter(t)
+
+	for _, path := range []string{"/jobs/unknown", "/jobs/unknown/events"} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusNotFound, path, w.Code)
+		}
+	}
+}
+
+func TestStreamJob_EndsWithFinalState(t *testing.T) {
+	r, _ := setupJobsRouter(t)
+	id := uploadForJob(t, r, "stream.txt", "Emma Woodhouse, handsome, clever, and rich.")
+
+	// Streaming needs a real connection rather than a recorder
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/jobs/" + id + "/events")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Expected event stream, got %s", ct)
+	}
+
+	events, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(events), "event:done") {
+		t.Errorf("Expected a final done event, got %s", events)
+	}
+}
+
+func TestUploadNovel_QueuedUploadReportsRejections(t *testing.T) {
+	r, _ := setupJobsRouter(t)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("files", "good.txt")
+	part.Write([]byte("Emma Woodhouse, handsome, clever, and rich."))
+	part, _ = writer.CreateFormFile("files", "bad.mobi")
+	part.Write([]byte("BOOKMOBI\x00\x00"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status code %d, got %d", http.StatusAccepted, w.Code)
+	}
+
+	var response struct {
+		Jobs     []services.Job `json:"jobs"`
+		Rejected []struct {
+			Filename string `json:"filename"`
+			Code     string `json:"code"`
+		} `json:"rejected"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(response.Jobs) != 1 || response.Jobs[0].Filename != "good.txt" {
+		t.Errorf("Expected one job for good.txt, got %+v", response.Jobs)
+	}
+	if len(response.Rejected) != 1 || response.Rejected[0].Filename != "bad.mobi" || response.Rejected[0].Code != "unsupported_format" {
+		t.Errorf("Expected bad.mobi to be rejected, got %+v", response.Rejected)
+	}
+}
+
+func TestGetJob_PrivateToOwner(t *testing.T) {
+	_, jm := setupJobsRouter(t)
+	job, err := jm.Submit("diary.txt", filepath.Join(t.TempDir(), "diary.txt"), services.IngestOptions{Owner: 1})
+	if err != nil {
+		t.Fatalf("Failed to submit job: %v", err)
+	}
+
+	// Stand in for a session, logging in the user named by a header
+	jobsHandler := NewJobsHandler(jm)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if id, err := strconv.ParseInt(c.GetHeader("X-User"), 10, 64); err == nil {
+			c.Set(userKey, &services.User{ID: id})
+		}
+	})
+	r.GET("/jobs/:id", jobsHandler.GetJob)
+	r.GET("/jobs/:id/events", jobsHandler.StreamJob)
+
+	for _, path := range []string{"/jobs/" + job.ID, "/jobs/" + job.ID + "/events"} {
+		for user, expected := range map[string]int{"2": http.StatusNotFound, "": http.StatusNotFound} {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("X-User", user)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != expected {
+				t.Errorf("Expected status code %d for %s as %q, got %d", expected, path, user, w.Code)
+			}
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/jobs/"+job.ID, nil)
+	req.Header.Set("X-User", "1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the owner to see their job, got %d", w.Code)
+	}
+}
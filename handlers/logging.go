@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries a request's ID. A valid ID sent by the client is
+// kept so requests can be traced across services; otherwise one is made up.
+// Either way it is returned in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestLogger is middleware giving each request an ID and a logger that
+// records it, carried by the request's context, and logging one line per
+// request once it is handled. Behind Tracing, records carry the trace ID.
+func RequestLogger(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+
+		// Tie logs and traces together both ways
+		ctx := c.Request.Context()
+		requestLogger := logger
+		if span := trace.SpanFromContext(ctx); span.SpanContext().IsValid() {
+			requestLogger = logger.With("trace_id", span.SpanContext().TraceID().String())
+			span.SetAttributes(attribute.String("request.id", id))
+		}
+		ctx = logging.WithRequestID(logging.NewContext(ctx, requestLogger), id)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", status,
+			"bytes", c.Writer.Size(),
+			"latency_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+		logging.FromContext(ctx).Log(ctx, level, "Handled request", attrs...)
+	}
+}
+
+// Recovery is middleware turning a panic into a 500 response, logging it
+// with the request's ID
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, err any) {
+		logging.FromContext(c.Request.Context()).Error("Request panicked", "panic", err, "stack", string(debug.Stack()))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	})
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kweusuf/novel-qa-go/logging"
+)
+
+// logRecords parses JSON log output into one map per record
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected JSON log records, got %q", line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := logging.New(&buf, "info", "json")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestLogger(logger), Recovery())
+	r.GET("/jobs/:id", func(c *gin.Context) {
+		logging.FromContext(c.Request.Context()).Info("Looking up job")
+		c.Status(http.StatusNotFound)
+	})
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	tests := []struct {
+		name      string
+		sent      string
+		keepsSent bool
+	}{
+		{"generated", "", false},
+		{"kept from the client", "trace-42", true},
+		{"unsafe replaced", "bad id\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest("GET", "/jobs/7", nil)
+			if tt.sent != "" {
+				req.Header.Set(RequestIDHeader, tt.sent)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			id := w.Header().Get(RequestIDHeader)
+			if !logging.ValidRequestID(id) || (id == tt.sent) != tt.keepsSent {
+				t.Errorf("Unexpected request ID %q for %q", id, tt.sent)
+			}
+
+			// The handler's record and the request line share the ID
+			records := logRecords(t, &buf)
+			if len(records) != 2 {
+				t.Fatalf("Expected 2 records, got %d: %s", len(records), buf.String())
+			}
+			for _, record := range records {
+				if record["request_id"] != id {
+					t.Errorf("Expected request_id %s, got %v", id, record)
+				}
+			}
+			if line := records[1]; line["route"] != "/jobs/:id" || line["status"] != float64(404) || line["level"] != "WARN" {
+				t.Errorf("Unexpected request line %v", line)
+			}
+		})
+	}
+
+	buf.Reset()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if records := logRecords(t, &buf); len(records) != 2 || records[0]["panic"] != "boom" || records[0]["request_id"] == nil {
+		t.Errorf("Expected the panic to be logged with the request ID, got %s", buf.String())
+	}
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestMetrics is middleware recording each request's method, route,
+// status and latency to m. Requests matching no route are grouped together
+// so unknown paths can't create new series.
+func RequestMetrics(m *services.Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.ObserveRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kweusuf/novel-qa-go/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := services.NewMetrics(registry)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestMetrics(metrics))
+	r.GET("/jobs/:id", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+	r.GET("/metrics", gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+
+	for _, path := range []string{"/jobs/1", "/jobs/2", "/nowhere"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{
+		// Counted by route pattern, not path
+		`novelqa_http_requests_total{method="GET",route="/jobs/:id",status="404"} 2`,
+		`novelqa_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`novelqa_http_request_duration_seconds_count{method="GET",route="/jobs/:id"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, w.Body.String())
+		}
+	}
+}
@@ -2,10 +2,16 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
+	"github.com/kweusuf/novel-qa-go/logging"
 	"github.com/kweusuf/novel-qa-go/models"
 	"github.com/kweusuf/novel-qa-go/services"
 
@@ -16,6 +22,25 @@ type QAHandler struct {
 	novelService  *services.NovelService
 	chromaService *services.ChromaService
 	ollamaService *services.OllamaService
+	ingestService *services.IngestService
+	// jobs, when set, runs uploads as background ingestion jobs instead of
+	// processing them within the request
+	jobs   *services.JobManager
+	limits UploadLimits
+	// models are offered in the UI, the first being the default, and
+	// results is the number of passages given to the model as context
+	models  []string
+	results int
+	metrics *services.Metrics
+	// users, when set, makes uploads private to the user and limits the
+	// context of questions to the novels they may read
+	users *services.UserStore
+	// queue, when set, caps the answers generated at once
+	queue *services.GenerationQueue
+	// guard decides which other Ollama endpoints questions may be sent to
+	// by URL, and endpoints, when set, holds those chosen by ID
+	guard     *services.EndpointGuard
+	endpoints *services.EndpointRegistry
 }
 
 func NewQAHandler(ns *services.NovelService, cs *services.ChromaService, os *services.OllamaService) *QAHandler {
@@ -23,18 +48,87 @@ func NewQAHandler(ns *services.NovelService, cs *services.ChromaService, os *ser
 		novelService:  ns,
 		chromaService: cs,
 		ollamaService: os,
+		ingestService: services.NewIngestService(ns, cs),
+		limits:        DefaultUploadLimits,
+		models:        []string{"phi3", "llama3", "mistral", "gemma"},
+		results:       2,
+		guard:         services.NewEndpointGuard(nil, false),
 	}
 }
 
+// SetJobManager makes uploads enqueue ingestion jobs on jm and return their
+// IDs rather than waiting for each novel to be indexed
+func (qh *QAHandler) SetJobManager(jm *services.JobManager) {
+	qh.jobs = jm
+}
+
+// SetUploadLimits changes the file and request size limits
+func (qh *QAHandler) SetUploadLimits(limits UploadLimits) {
+	qh.limits = limits
+}
+
+// SetModels changes the models offered; the first is used when a question
+// names none of them
+func (qh *QAHandler) SetModels(models []string) {
+	if len(models) > 0 {
+		qh.models = models
+	}
+}
+
+// SetResults sets how many passages are given to the model as context
+func (qh *QAHandler) SetResults(n int) {
+	if n > 0 {
+		qh.results = n
+	}
+}
+
+// SetMetrics records rejected uploads and invalid questions to m, along with
+// the Ollama metrics of questions sent to a custom endpoint
+func (qh *QAHandler) SetMetrics(m *services.Metrics) {
+	qh.metrics = m
+}
+
+// SetUserStore makes uploads belong to the signed-in user and answers use
+// only the novels that user can read
+func (qh *QAHandler) SetUserStore(us *services.UserStore) {
+	qh.users = us
+}
+
+// SetGenerationQueue makes questions wait their turn in q before an answer
+// is generated
+func (qh *QAHandler) SetGenerationQueue(q *services.GenerationQueue) {
+	qh.queue = q
+}
+
+// SetEndpointGuard lets clients choose the Ollama endpoints g allows
+// instead of the configured one; by default they can't choose any other
+func (qh *QAHandler) SetEndpointGuard(g *services.EndpointGuard) {
+	qh.guard = g
+}
+
+// SetEndpointRegistry lets clients choose the endpoints registered in r by
+// their IDs
+func (qh *QAHandler) SetEndpointRegistry(r *services.EndpointRegistry) {
+	qh.endpoints = r
+}
+
 func (qh *QAHandler) ShowIndex(c *gin.Context) {
-	models := []string{"phi3", "llama3", "mistral", "gemma"}
-	c.HTML(http.StatusOK, "index.html", gin.H{"models": models})
+	c.HTML(http.StatusOK, "index.html", gin.H{
+		"models":    qh.models,
+		"user":      CurrentUser(c),
+		"csrfToken": CSRFToken(c),
+	})
 }
 
 func (qh *QAHandler) UploadNovel(c *gin.Context) {
 	// Use MultipartForm to get all files associated with the 'files' field
+	limitRequest(c, qh.limits)
 	form, err := c.MultipartForm()
 	if err != nil {
+		if tooLarge(err) {
+			c.String(http.StatusRequestEntityTooLarge, "Upload exceeds the %d byte request limit", qh.limits.MaxRequestBytes)
+			return
+		}
 		c.String(http.StatusBadRequest, "Failed to parse multipart form: %v", err)
 		return
 	}
@@ -45,59 +139,78 @@ func (qh *QAHandler) UploadNovel(c *gin.Context) {
 		return
 	}
 
+	// Optional charset override for plain-text files; detected when empty
+	charset := c.PostForm("charset")
+
+	// How to handle novels already in the library
+	onDuplicate, err := duplicateOption(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	// With accounts, uploads are private to the user until shared
+	var owner int64
+	if user := CurrentUser(c); qh.users != nil && user != nil {
+		owner = user.ID
+	}
+
 	var results []string // To store results for each file
+	var jobs []services.Job
+	var rejected []*uploadError
 	processedCount := 0
 
 	for _, fileHeader := range files {
-		// Validate file type (updated to support both .txt and .epub)
-		if len(fileHeader.Filename) < 4 {
-			results = append(results, fmt.Sprintf("Skipped '%s': Invalid filename", fileHeader.Filename))
-			continue
-		}
+		// Validate size and file type by sniffing its contents, then store
+		// the file under a sanitised, collision-free name
+		dst, format, reject := saveUpload(qh.novelService, fileHeader, qh.limits, owner)
 
-		// Check for .txt extension (4 characters)
-		// Check for .epub extension (5 characters)
-		var isValidExtension bool
-		if strings.HasSuffix(fileHeader.Filename, ".txt") {
-			isValidExtension = true
-		} else if strings.HasSuffix(fileHeader.Filename, ".epub") {
-			isValidExtension = true
-		}
+		logging.FromContext(c.Request.Context()).Debug("Processing upload", "filename", fileHeader.Filename, "format_detected", format != nil)
 
-		// Debug: Log filename and extension check results
-		fmt.Printf("DEBUG: Processing file '%s', isValidExtension: %t\n", fileHeader.Filename, isValidExtension)
-
-		if !isValidExtension {
-			results = append(results, fmt.Sprintf("Skipped '%s': Only .txt and .epub files are supported. Please upload files with .txt or .epub extensions.", fileHeader.Filename))
+		if reject != nil {
+			qh.metrics.Error(services.CauseUploadRejected)
+			results = append(results, fmt.Sprintf("Skipped '%s': %v", fileHeader.Filename, reject))
+			rejected = append(rejected, reject)
 			continue
 		}
 
-		// Save file (same as before, but using fileHeader)
-		dst := "novels/" + fileHeader.Filename
-		if err := c.SaveUploadedFile(fileHeader, dst); err != nil {
-			results = append(results, fmt.Sprintf("Failed to save '%s': %v", fileHeader.Filename, err))
-			continue // Continue with next file
+		opts := services.IngestOptions{
+			ReadOptions: services.ReadOptions{Charset: charset, Format: format.Name},
+			OnDuplicate: onDuplicate,
+			Owner:       owner,
 		}
-
-		// Read content (same as before)
-		content, err := qh.novelService.ReadNovel(dst)
-		if err != nil {
-			results = append(results, fmt.Sprintf("Failed to read '%s': %v", fileHeader.Filename, err))
-			continue // Continue with next file
+		if qh.jobs != nil {
+			job, err := qh.jobs.SubmitContext(c.Request.Context(), fileHeader.Filename, dst, opts)
+			if err != nil {
+				results = append(results, fmt.Sprintf("Failed to queue '%s': %v", fileHeader.Filename, err))
+				continue
+			}
+			jobs = append(jobs, job)
+			results = append(results, fmt.Sprintf("Queued '%s' as job %s", fileHeader.Filename, job.ID))
+			processedCount++
+			continue
 		}
 
-		// Process and add to ChromaDB (same core logic)
-		chunks := qh.novelService.ProcessNovel(fileHeader.Filename, content)
-		err = qh.chromaService.AddDocuments(chunks)
+		// Read, chunk and index the novel within the request
+		result, err := qh.ingestService.IngestContext(c.Request.Context(), dst, opts, nil)
 		if err != nil {
-			results = append(results, fmt.Sprintf("Failed to add '%s' to DB: %v", fileHeader.Filename, err))
+			results = append(results, fmt.Sprintf("Failed to process '%s': %v", fileHeader.Filename, err))
 			continue // Continue with next file
 		}
 
-		results = append(results, fmt.Sprintf("Successfully uploaded '%s' (%d chunks added)", fileHeader.Filename, len(chunks)))
+		results = append(results, uploadSummary(fileHeader.Filename, result))
 		processedCount++
 	}
 
+	if qh.jobs != nil {
+		status := http.StatusAccepted
+		if processedCount == 0 {
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, gin.H{"jobs": jobs, "rejected": rejected, "results": results})
+		return
+	}
+
 	if processedCount == 0 {
 		// If no files were successfully processed
 		c.String(http.StatusInternalServerError, "No files were successfully uploaded. Details:\n%s", strings.Join(results, "\n"))
@@ -109,70 +222,310 @@ func (qh *QAHandler) UploadNovel(c *gin.Context) {
 }
 
 func (qh *QAHandler) AskQuestion(c *gin.Context) {
+	ctx := c.Request.Context()
+	summary := &askSummary{started: time.Now()}
+	defer summary.log(ctx)
+
 	var req models.QuestionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
+		qh.metrics.Error(services.CauseInvalidRequest)
+		summary.fail("invalid_request", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format: " + err.Error()})
 		return
 	}
 
 	// Validate model
-	validModels := map[string]bool{
-		"phi3": true, "llama3": true, "mistral": true, "gemma": true,
+	validModel := false
+	for _, model := range qh.models {
+		validModel = validModel || model == req.Model
+	}
+	if !validModel {
+		req.Model = qh.models[0] // Use the default model if invalid
+	}
+	summary.model = req.Model
+
+	// Use custom endpoint if provided and allowed, otherwise use default
+	// service
+	summary.endpoint = redactURL(req.OllamaEndpoint)
+	ollamaService, err := qh.ollamaFor(req.OllamaEndpoint, services.CapabilityChat)
+	if err != nil {
+		summary.fail("endpoint_blocked", err)
+		qh.refuseEndpoint(c, req.OllamaEndpoint, err)
+		return
+	}
+	summary.endpoint = ollamaService.Endpoint()
+
+	// Only the novels the user may read are searched, so another user's
+	// passages can never end up in the prompt
+	access, err := readAccess(c, qh.users, req.Collection)
+	if errors.Is(err, services.ErrCollectionNotFound) {
+		summary.fail("invalid_request", err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collection not found"})
+		return
 	}
-	if !validModels[req.Model] {
-		req.Model = "phi3" // Default to phi3 if invalid
+	if err != nil {
+		summary.fail("retrieval_error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve context: " + err.Error()})
+		return
 	}
 
 	// Get context from ChromaDB
-	context, err := qh.chromaService.Query(req.Question, 2)
+	retrievalStart := time.Now()
+	result, err := qh.chromaService.Search(ctx, req.Question, qh.results, "", access)
+	summary.retrieval = time.Since(retrievalStart)
 	if err != nil {
+		summary.fail("retrieval_error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve context: " + err.Error()})
 		return
 	}
+	summary.search = result
+	summary.promptChars = len(services.BuildPrompt(req.Question, result.Context))
 
-	// Use custom endpoint if provided, otherwise use default service
-	var answer string
-	if req.OllamaEndpoint != "" {
-		// Create a temporary Ollama service with custom endpoint
-		customOllamaService := services.NewOllamaService(req.OllamaEndpoint)
-		answer, err = customOllamaService.Ask(req.Question, req.Model, context)
-	} else {
-		// Use the default Ollama service
-		answer, err = qh.ollamaService.Ask(req.Question, req.Model, context)
+	// Wait for a turn to generate, taking turns with other clients
+	queueStart := time.Now()
+	release, err := qh.queue.Acquire(ctx, ClientKey(c))
+	summary.queued = time.Since(queueStart)
+	if errors.Is(err, services.ErrQueueFull) || errors.Is(err, services.ErrQueueTimeout) {
+		summary.fail("queue_full", err)
+		qh.metrics.Error(services.CauseQueueFull)
+		tooManyRequests(c, qh.queue.RetryAfter(), capitalize(err.Error()))
+		return
 	}
+	if err != nil {
+		// The client went away while waiting
+		summary.fail("cancelled", err)
+		c.Abort()
+		return
+	}
+	defer release()
 
+	generationStart := time.Now()
+	answer, err := ollamaService.Chat(ctx, req.Question, req.Model, result.Context)
+	summary.generation = time.Since(generationStart)
+	if errors.Is(err, services.ErrEndpointBlocked) {
+		summary.fail("endpoint_blocked", err)
+		qh.refuseEndpoint(c, req.OllamaEndpoint, err)
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get answer from model: " + err.Error()})
+		summary.fail("model_error", err)
+		// The error names the server's address, so clients only get its
+		// cause; the summary logs it whole
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get answer from model: " + services.DescribeError(err)})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"answer": answer})
+	// Registered endpoints are named by ID, as their addresses are only for
+	// admins
+	node := answer.Node
+	if registeredEndpoint(req.OllamaEndpoint) {
+		node = req.OllamaEndpoint
+	}
+	summary.node, summary.answerModel = answer.Node, answer.Model
+	summary.answerChars = len(answer.Text)
+	c.JSON(http.StatusOK, gin.H{"answer": answer.Text, "node": node, "model": answer.Model, "passages": result.Passages})
+}
+
+// askSummary collects what happened while answering a question so it can
+// be logged as one line
+type askSummary struct {
+	started     time.Time
+	model       string
+	answerModel string
+	endpoint    string
+	node        string
+	search      *services.SearchResult
+	promptChars int
+	answerChars int
+	retrieval   time.Duration
+	queued      time.Duration
+	generation  time.Duration
+	outcome     string
+	err         error
+}
+
+func (s *askSummary) fail(outcome string, err error) {
+	s.outcome, s.err = outcome, err
+}
+
+func (s *askSummary) log(ctx context.Context) {
+	outcome, level := "answered", slog.LevelInfo
+	if s.outcome != "" {
+		outcome, level = s.outcome, slog.LevelWarn
+	}
+	attrs := []any{
+		"outcome", outcome,
+		"model", s.model,
+		"answer_model", s.answerModel,
+		"endpoint", s.endpoint,
+		"node", s.node,
+		"prompt_chars", s.promptChars,
+		"answer_chars", s.answerChars,
+		"retrieval_ms", s.retrieval.Milliseconds(),
+		"queue_ms", s.queued.Milliseconds(),
+		"generation_ms", s.generation.Milliseconds(),
+		"latency_ms", time.Since(s.started).Milliseconds(),
+	}
+	if s.search != nil {
+		attrs = append(attrs,
+			"hits", len(s.search.IDs),
+			"chunk_ids", s.search.IDs,
+			"matched", s.search.Matched,
+			"top_score", s.search.TopScore,
+		)
+	}
+	if s.err != nil {
+		attrs = append(attrs, "error", s.err.Error())
+	}
+	logging.FromContext(ctx).Log(ctx, level, "Handled question", attrs...)
+}
+
+// QueueStatus reports how busy answering is and where the client's
+// questions are in the queue, so a waiting page can show its position
+func (qh *QAHandler) QueueStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, qh.queue.Status(ClientKey(c)))
 }
 
 func (qh *QAHandler) GetModels(c *gin.Context) {
 	// Get Ollama endpoint from query parameter or use default
-	ollamaEndpoint := c.Query("endpoint")
-	if ollamaEndpoint == "" {
-		// Use the default Ollama service endpoint from the handler's service
-		// This will use the same endpoint that was configured at startup
-		models, err := qh.ollamaService.GetModels()
+	endpoint := c.Query("endpoint")
+	if registeredEndpoint(endpoint) && qh.endpoints != nil {
+		// Registered endpoints' models are kept from their health checks
+		models, err := qh.endpoints.Models(c.Request.Context(), endpoint)
+		if errors.Is(err, services.ErrEndpointNotFound) {
+			qh.refuseEndpoint(c, endpoint, err)
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get models: " + err.Error()})
+			logging.FromContext(c.Request.Context()).Warn("Failed to get models", "endpoint", endpoint, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get models: " + services.DescribeError(err)})
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"models": models})
 		return
 	}
-
-	// Create a temporary Ollama service to get models from custom endpoint
-	ollamaService := services.NewOllamaService(ollamaEndpoint)
+	ollamaService, err := qh.ollamaFor(endpoint, "")
+	if err != nil {
+		qh.refuseEndpoint(c, endpoint, err)
+		return
+	}
 
 	// Get available models
-	models, err := ollamaService.GetModels()
+	models, err := ollamaService.GetModelsContext(c.Request.Context())
+	if errors.Is(err, services.ErrEndpointBlocked) {
+		qh.refuseEndpoint(c, endpoint, err)
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get models: " + err.Error()})
+		logging.FromContext(c.Request.Context()).Warn("Failed to get models", "endpoint", redactURL(endpoint), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get models: " + services.DescribeError(err)})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"models": models})
 }
+
+// ollamaFor returns the Ollama service for an endpoint a client chose: the
+// configured one when they chose none or the same one, a registered one with
+// the capability, or else one the endpoint guard allows
+func (qh *QAHandler) ollamaFor(endpoint, capability string) (*services.OllamaService, error) {
+	if endpoint == "" || qh.ollamaService.Serves(endpoint) {
+		return qh.ollamaService, nil
+	}
+	if registeredEndpoint(endpoint) {
+		if qh.endpoints == nil {
+			return nil, services.ErrEndpointNotFound
+		}
+		return qh.endpoints.Service(endpoint, capability)
+	}
+	ollamaService, err := qh.guard.Service(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	ollamaService.SetMetrics(qh.metrics)
+	return ollamaService, nil
+}
+
+// refuseEndpoint logs and responds to a client's attempt to use an Ollama
+// endpoint the server won't contact. Why a blocked endpoint was blocked
+// isn't said, as it would reveal what its name resolves to.
+func (qh *QAHandler) refuseEndpoint(c *gin.Context, endpoint string, err error) {
+	switch {
+	case errors.Is(err, services.ErrEndpointNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Endpoint not found"})
+		return
+	case errors.Is(err, services.ErrEndpointNotCapable):
+		c.JSON(http.StatusBadRequest, gin.H{"error": capitalize(err.Error())})
+		return
+	}
+
+	logging.FromContext(c.Request.Context()).Warn("Blocked Ollama endpoint",
+		"endpoint", redactURL(endpoint), "client", ClientKey(c), "error", err)
+	qh.metrics.Error(services.CauseEndpointBlocked)
+
+	switch {
+	case errors.Is(err, services.ErrInvalidEndpoint):
+		c.JSON(http.StatusBadRequest, gin.H{"error": capitalize(err.Error())})
+	case errors.Is(err, services.ErrEndpointBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": services.ErrEndpointBlocked.Error()})
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": capitalize(err.Error())})
+	}
+}
+
+// registeredEndpoint reports whether a client named an endpoint by its ID
+// in the registry rather than by URL
+func registeredEndpoint(endpoint string) bool {
+	return endpoint != "" && !strings.Contains(endpoint, "://")
+}
+
+// redactURL hides any credentials in a URL for logging
+func redactURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Redacted()
+	}
+	return raw
+}
+
+// readNote describes how an upload was read: the charset plain text was
+// decoded from and any boilerplate stripped before chunking
+func readNote(novel *services.NovelContent) string {
+	var note string
+	if novel.Encoding != "" {
+		note += ", encoding: " + novel.Encoding
+	}
+	if len(novel.Stripped) > 0 {
+		note += "; stripped: " + strings.Join(novel.Stripped, ", ")
+	}
+	return note
+}
+
+// duplicateOption reads the optional "duplicate" form field saying how to
+// handle an upload that duplicates a novel already in the library
+func duplicateOption(c *gin.Context) (string, error) {
+	switch option := c.PostForm("duplicate"); option {
+	case "", services.DuplicateSkip, services.DuplicateLink, services.DuplicateReplace:
+		return option, nil
+	default:
+		return "", fmt.Errorf("Invalid duplicate option %q: use skip, link or replace", option)
+	}
+}
+
+// uploadSummary reports the outcome of ingesting an upload, including any
+// duplicate of a novel already in the library
+func uploadSummary(filename string, result *services.IngestResult) string {
+	dup := result.Duplicate
+	switch {
+	case dup == nil:
+		return fmt.Sprintf("Successfully uploaded '%s' (%d chunks added%s)", filename, result.Chunks, readNote(result.Content))
+	case result.Action == services.DuplicateSkip:
+		return fmt.Sprintf("Skipped '%s': already in library as '%s' (upload again with duplicate=link to add it as another name, or duplicate=replace to replace it)", filename, dup.OriginalName)
+	case result.Action == services.DuplicateLink:
+		return fmt.Sprintf("Linked '%s' to '%s' already in library", filename, dup.OriginalName)
+	case result.Action == services.DuplicateReplace:
+		return fmt.Sprintf("Successfully uploaded '%s' (%d chunks added%s; replaced '%s')", filename, result.Chunks, readNote(result.Content), dup.OriginalName)
+	default:
+		return fmt.Sprintf("Successfully uploaded '%s' (%d chunks added%s; similar to '%s' already in library, %.0f%% match: upload again with duplicate=link or duplicate=replace to keep only one)",
+			filename, result.Chunks, readNote(result.Content), dup.OriginalName, dup.Similarity*100)
+	}
+}
@@ -6,10 +6,15 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/kweusuf/novel-qa-go/logging"
 	"github.com/kweusuf/novel-qa-go/services"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Import the actual service types
@@ -95,7 +100,7 @@ func TestUploadNovel_InvalidFile(t *testing.T) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
-	part, err := writer.CreateFormFile("files", "test.pdf")
+	part, err := writer.CreateFormFile("files", "test.mobi")
 	if err != nil {
 		t.Fatalf("Failed to create form file: %v", err)
 	}
@@ -117,9 +122,9 @@ func TestUploadNovel_InvalidFile(t *testing.T) {
 		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, w.Code)
 	}
 
-	// Check that response contains error message about file type (updated for EPUB support)
+	// Check that response contains error message about file type
 	response := w.Body.String()
-	if !bytes.Contains([]byte(response), []byte("Only .txt and .epub files are supported")) {
+	if !bytes.Contains([]byte(response), []byte("unsupported file format")) {
 		t.Error("Expected response to contain file type error message")
 	}
 }
@@ -205,7 +210,7 @@ func TestAskQuestion_ValidRequest(t *testing.T) {
 
 	// If we get a 200, check for answer; if 500, that's also acceptable in CI
 	if w.Code == http.StatusOK {
-		var response map[string]string
+		var response map[string]interface{}
 		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
 			t.Errorf("Failed to unmarshal response: %v", err)
 		} else if response["answer"] == "" {
@@ -257,6 +262,42 @@ func TestAskQuestion_InvalidModel(t *testing.T) {
 	}
 }
 
+func TestAskQuestion_ConfiguredModels(t *testing.T) {
+	var model string
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req services.OllamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		model = req.Model
+		w.Write([]byte(`{"message":{"role":"assistant","content":"An answer."},"done":true}`))
+	}))
+	defer ollama.Close()
+
+	tempDir := t.TempDir()
+	chromaService := services.NewChromaService(filepath.Join(tempDir, "db"))
+	chromaService.Initialize()
+	handler := NewQAHandler(services.NewNovelService(filepath.Join(tempDir, "novels")), chromaService, services.NewOllamaService(ollama.URL))
+	handler.SetModels([]string{"llama3", "gemma"})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/ask", handler.AskQuestion)
+
+	for requested, expected := range map[string]string{"gemma": "gemma", "phi3": "llama3"} {
+		body, _ := json.Marshal(map[string]string{"question": "Who?", "model": requested})
+		req := httptest.NewRequest("POST", "/ask", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if model != expected {
+			t.Errorf("Expected %s to be asked with %s, got %s", requested, expected, model)
+		}
+	}
+}
+
 func TestGetModels_Success(t *testing.T) {
 	handler := setupMockHandler()
 
@@ -301,10 +342,9 @@ func TestGetModels_CustomEndpoint(t *testing.T) {
 
 	r.ServeHTTP(w, req)
 
-	// Should fail with 500 since custom endpoint doesn't exist
-	// This tests the error handling for custom endpoints
-	if w.Code != http.StatusInternalServerError {
-		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, w.Code)
+	// Should be refused since custom endpoints must be allowed first
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, w.Code)
 	}
 
 	// Check that response contains error message
@@ -317,3 +357,329 @@ func TestGetModels_CustomEndpoint(t *testing.T) {
 		t.Error("Expected error message in response")
 	}
 }
+
+func TestCustomEndpoints(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/tags" {
+			w.Write([]byte(`{"models":[{"name":"custom-model"}]}`))
+			return
+		}
+		w.Write([]byte(`{"message":{"role":"assistant","content":"From the custom server."},"done":true}`))
+	}))
+	defer ollama.Close()
+
+	tempDir := t.TempDir()
+	chromaService := services.NewChromaService(filepath.Join(tempDir, "db"))
+	chromaService.Initialize()
+	handler := NewQAHandler(services.NewNovelService(filepath.Join(tempDir, "novels")), chromaService, services.NewOllamaService("http://localhost:1"))
+	registry := prometheus.NewRegistry()
+	handler.SetMetrics(services.NewMetrics(registry))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/models", handler.GetModels)
+	r.POST("/ask", handler.AskQuestion)
+	ask := func(endpoint string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"question": "Who?", "model": "phi3", "ollamaEndpoint": endpoint})
+		req := httptest.NewRequest("POST", "/ask", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	models := func(endpoint string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/models?endpoint="+url.QueryEscape(endpoint), nil))
+		return w
+	}
+
+	// Nothing is allowed until configured, including the cloud metadata
+	// service
+	for _, endpoint := range []string{ollama.URL, "http://169.254.169.254"} {
+		if w := ask(endpoint); w.Code != http.StatusForbidden {
+			t.Errorf("Expected %s to be refused, got %d", endpoint, w.Code)
+		}
+		if w := models(endpoint); w.Code != http.StatusForbidden {
+			t.Errorf("Expected %s to be refused, got %d", endpoint, w.Code)
+		}
+	}
+	if w := ask("http://gpu:11434/api/tags"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid endpoint to be rejected, got %d", w.Code)
+	}
+
+	// The test server is on loopback, so is blocked as it is connected to
+	// unless private addresses are allowed
+	handler.SetEndpointGuard(services.NewEndpointGuard([]string{ollama.URL}, false))
+	if w := ask(ollama.URL); w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "127.0.0.1") {
+		t.Errorf("Expected a blocked address without saying which, got %d: %s", w.Code, w.Body.String())
+	}
+
+	handler.SetEndpointGuard(services.NewEndpointGuard([]string{ollama.URL}, true))
+	if w := ask(ollama.URL); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "From the custom server.") {
+		t.Errorf("Expected an answer from the allowed endpoint, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := models(ollama.URL); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "custom-model") {
+		t.Errorf("Expected models from the allowed endpoint, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The configured endpoint can always be named
+	if w := models("http://localhost:1/"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the configured endpoint to be used, got %d", w.Code)
+	}
+
+	if got := errorCount(t, registry, services.CauseEndpointBlocked); got != 6 {
+		t.Errorf("Expected 6 blocked endpoints counted, got %v", got)
+	}
+}
+
+// errorCount reads the errors metric for a cause from registry
+func errorCount(t *testing.T, registry *prometheus.Registry, cause string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "novelqa_errors_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "cause" && label.GetValue() == cause {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestUploadNovel_ReportsDetectedEncoding(t *testing.T) {
+	handler := setupMockHandler()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("files", "latin.txt")
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write([]byte("\x93Call me Ishmael.\x94"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", handler.UploadNovel)
+
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	if !bytes.Contains(w.Body.Bytes(), []byte("encoding: windows-1252")) {
+		t.Errorf("Expected detected encoding in summary, got %s", w.Body.String())
+	}
+}
+
+func TestUploadNovel_CharsetOverride(t *testing.T) {
+	handler := setupMockHandler()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	writer.WriteField("charset", "bogus-charset")
+	part, err := writer.CreateFormFile("files", "override.txt")
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write([]byte("Plain text"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", handler.UploadNovel)
+
+	r.ServeHTTP(w, req)
+
+	// An unknown override is reported rather than silently ignored
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	if !bytes.Contains(w.Body.Bytes(), []byte("unsupported charset")) {
+		t.Errorf("Expected charset error in summary, got %s", w.Body.String())
+	}
+}
+
+func TestUploadNovel_ReportsStrippedBoilerplate(t *testing.T) {
+	handler := setupMockHandler()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("files", "gutenberg.txt")
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write([]byte("Licence\n*** START OF THE PROJECT GUTENBERG EBOOK EMMA ***\nEmma Woodhouse, handsome, clever, and rich.\n*** END OF THE PROJECT GUTENBERG EBOOK EMMA ***\nLicence"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", handler.UploadNovel)
+
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	for _, section := range []string{"Project Gutenberg header", "Project Gutenberg licence footer"} {
+		if !bytes.Contains(w.Body.Bytes(), []byte(section)) {
+			t.Errorf("Expected %q in summary, got %s", section, w.Body.String())
+		}
+	}
+}
+
+func TestUploadNovel_SniffsFormatWithoutExtension(t *testing.T) {
+	handler := setupMockHandler()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("files", "chapter-one")
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write([]byte("<!DOCTYPE html><html><head><title>Emma</title></head><body><p>Emma Woodhouse, handsome, clever, and rich.</p></body></html>"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", handler.UploadNovel)
+
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestUploadNovel_ReportsDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	handler := NewQAHandler(services.NewNovelService(filepath.Join(dir, "novels")), services.NewChromaService(filepath.Join(dir, "db")), services.NewOllamaService("http://localhost:11434"))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", handler.UploadNovel)
+
+	upload := func(filename, duplicate string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("files", filename)
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		part.Write([]byte("Emma Woodhouse, handsome, clever, and rich, with a comfortable home."))
+		if duplicate != "" {
+			writer.WriteField("duplicate", duplicate)
+		}
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	upload("emma.txt", "")
+
+	w := upload("emma-copy.txt", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "already in library as 'emma.txt'") {
+		t.Errorf("Expected duplicate to be reported, got %s", w.Body.String())
+	}
+
+	w = upload("emma-copy.txt", "link")
+	if !strings.Contains(w.Body.String(), "Linked 'emma-copy.txt' to 'emma.txt'") {
+		t.Errorf("Expected duplicate to be linked, got %s", w.Body.String())
+	}
+
+	w = upload("emma-copy.txt", "merge")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid option, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAskQuestion_LogsSummary(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"role":"assistant","content":"Emma."},"done":true}`))
+	}))
+	defer ollama.Close()
+
+	tempDir := t.TempDir()
+	chromaService := services.NewChromaService(filepath.Join(tempDir, "db"))
+	chromaService.AddDocuments([]services.NovelChunk{{ID: "emma.txt-0", Text: "Emma Woodhouse was clever", Novel: "emma.txt"}})
+	handler := NewQAHandler(services.NewNovelService(filepath.Join(tempDir, "novels")), chromaService, services.NewOllamaService(ollama.URL))
+
+	var buf bytes.Buffer
+	logger, _ := logging.New(&buf, "info", "json")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestLogger(logger))
+	r.POST("/ask", handler.AskQuestion)
+
+	for _, body := range []string{`{"question":"clever","model":"phi3"}`, `not json`} {
+		req := httptest.NewRequest("POST", "/ask", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var summaries []map[string]interface{}
+	for _, record := range logRecords(t, &buf) {
+		if record["msg"] == "Handled question" {
+			summaries = append(summaries, record)
+		}
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("Expected one summary per question, got %s", buf.String())
+	}
+
+	answered := summaries[0]
+	if answered["outcome"] != "answered" || answered["model"] != "phi3" || answered["endpoint"] != ollama.URL || answered["node"] != strings.TrimPrefix(ollama.URL, "http://") || answered["answer_model"] != "phi3" {
+		t.Errorf("Unexpected summary %v", answered)
+	}
+	if answered["hits"] != float64(1) || answered["top_score"] != float64(1) || answered["request_id"] == nil {
+		t.Errorf("Expected one matching hit and the request ID, got %v", answered)
+	}
+	if ids, _ := answered["chunk_ids"].([]interface{}); len(ids) != 1 || ids[0] != "emma.txt-0" {
+		t.Errorf("Expected chunk_ids [emma.txt-0], got %v", answered["chunk_ids"])
+	}
+	if chars, _ := answered["prompt_chars"].(float64); chars == 0 {
+		t.Errorf("Expected the prompt size, got %v", answered["prompt_chars"])
+	}
+
+	if failed := summaries[1]; failed["outcome"] != "invalid_request" || failed["error"] == nil {
+		t.Errorf("Expected the invalid request to be logged, got %v", failed)
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit is middleware limiting each client's requests to a route with
+// the limiter for its path in routes, or fallback for other paths. Nil
+// limiters allow everything.
+func RateLimit(routes map[string]*services.RateLimiter, fallback *services.RateLimiter, metrics *services.Metrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiter, ok := routes[c.FullPath()]
+		if !ok {
+			limiter = fallback
+		}
+		client := ClientKey(c)
+		allowed, wait := limiter.Allow(client)
+		if allowed {
+			c.Next()
+			return
+		}
+		metrics.Error(services.CauseRateLimited)
+		logging.FromContext(c.Request.Context()).Warn("Rate limited", "client", client, "route", c.FullPath(), "retry_after_ms", wait.Milliseconds())
+		tooManyRequests(c, wait, "Too many requests")
+	}
+}
+
+// ClientKey identifies who a request is from for rate limits and the
+// generation queue: the API key it used, the logged-in user or its IP
+func ClientKey(c *gin.Context) string {
+	if key := CurrentAPIKey(c); key != nil {
+		return "key:" + strconv.FormatInt(key.ID, 10)
+	}
+	if user := CurrentUser(c); user != nil {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// tooManyRequests responds with 429, saying in Retry-After how many whole
+// seconds to wait
+func tooManyRequests(c *gin.Context, wait time.Duration, message string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":      message + ", try again in " + strconv.Itoa(seconds) + "s",
+		"retryAfter": seconds,
+	})
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		// Stand in for Session, logging in the user named by a header
+		if c.GetHeader("X-User") != "" {
+			c.Set(userKey, &services.User{ID: 1, Username: c.GetHeader("X-User")})
+		}
+	})
+	routes := map[string]*services.RateLimiter{
+		"/ask":    services.NewRateLimiter(2, time.Minute),
+		"/models": nil,
+	}
+	r.Use(RateLimit(routes, services.NewRateLimiter(1, time.Hour), nil))
+	for _, path := range []string{"/ask", "/models", "/other"} {
+		r.GET(path, func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	}
+
+	request := func(path, user, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("/ask", "emma", "10.0.0.1"); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be allowed, got %d", i+1, w.Code)
+		}
+	}
+	// The user is limited wherever they ask from
+	w := request("/ask", "emma", "10.0.0.2")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected 429 with Retry-After 30, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	var body map[string]any
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["retryAfter"] != float64(30) {
+		t.Errorf("Expected retryAfter in the body, got %v", body)
+	}
+
+	// Anonymous clients are limited by IP, and routes separately
+	if w := request("/ask", "", "10.0.0.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected an anonymous client to have its own limit, got %d", w.Code)
+	}
+	if w := request("/other", "emma", "10.0.0.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected other routes to have their own limit, got %d", w.Code)
+	}
+	if w := request("/other", "emma", "10.0.0.1"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Expected the default limit, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// A route can be left unlimited
+	for i := 0; i < 5; i++ {
+		if w := request("/models", "emma", "10.0.0.1"); w.Code != http.StatusOK {
+			t.Fatalf("Expected an unlimited route, got %d", w.Code)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	c.Request.RemoteAddr = "192.0.2.1:1234"
+
+	if key := ClientKey(c); key != "ip:192.0.2.1" {
+		t.Errorf("Expected the IP, got %s", key)
+	}
+	c.Set(userKey, &services.User{ID: 3})
+	if key := ClientKey(c); key != "user:3" {
+		t.Errorf("Expected the user, got %s", key)
+	}
+	c.Set(apiKeyKey, &services.APIKey{ID: 8})
+	if key := ClientKey(c); key != "key:8" {
+		t.Errorf("Expected the API key, got %s", key)
+	}
+}
+
+func TestAskQuestion_GenerationQueue(t *testing.T) {
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"role":"assistant","content":"An answer."},"done":true}`))
+	}))
+	defer ollama.Close()
+
+	tempDir := t.TempDir()
+	chromaService := services.NewChromaService(filepath.Join(tempDir, "db"))
+	chromaService.Initialize()
+	handler := NewQAHandler(services.NewNovelService(filepath.Join(tempDir, "novels")), chromaService, services.NewOllamaService(ollama.URL))
+	queue := services.NewGenerationQueue(1, 0, time.Minute)
+	handler.SetGenerationQueue(queue)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/ask", handler.AskQuestion)
+	r.GET("/ask/queue", handler.QueueStatus)
+	ask := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"question": "Who?", "model": "phi3"})
+		req := httptest.NewRequest("POST", "/ask", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := ask(); w.Code != http.StatusOK {
+		t.Fatalf("Expected an answer with a free slot, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// With the only slot taken and no room to wait, questions are turned
+	// away until it frees up
+	release, _ := queue.Acquire(context.Background(), "someone else")
+	w := ask()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	req := httptest.NewRequest("GET", "/ask/queue", nil)
+	status := httptest.NewRecorder()
+	r.ServeHTTP(status, req)
+	var queued services.QueueStatus
+	json.Unmarshal(status.Body.Bytes(), &queued)
+	if queued.Running != 1 || queued.Slots != 1 || queued.Positions == nil {
+		t.Errorf("Unexpected queue status %s", status.Body.String())
+	}
+
+	release()
+	if w := ask(); w.Code != http.StatusOK {
+		t.Errorf("Expected an answer once the slot is free, got %d", w.Code)
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kweusuf/novel-qa-go/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var buf bytes.Buffer
+	logger, _ := logging.New(&buf, "info", "json")
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Tracing(), RequestLogger(logger))
+	r.GET("/jobs/:id", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/jobs/7", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	ended := spans.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("Expected one span, got %d", len(ended))
+	}
+	span := ended[0]
+	if span.Name() != "GET /jobs/:id" || span.SpanContext().TraceID().String() != traceID {
+		t.Errorf("Expected the caller's trace to continue, got %s in %s", span.Name(), span.SpanContext().TraceID())
+	}
+	if span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected the caller's span as parent, got %s", span.Parent().SpanID())
+	}
+	if span.Status().Code.String() != "Error" {
+		t.Errorf("Expected a 500 to mark the span failed, got %v", span.Status())
+	}
+
+	// Logs carry the trace ID
+	if records := logRecords(t, &buf); len(records) != 1 || records[0]["trace_id"] != traceID {
+		t.Errorf("Expected trace_id %s in the logs, got %s", traceID, buf.String())
+	}
+}
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 
 	"github.com/kweusuf/novel-qa-go/services"
@@ -9,58 +11,155 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// UploadLimits caps the size of uploads. Zero means no limit.
+type UploadLimits struct {
+	// MaxFileBytes limits each uploaded file
+	MaxFileBytes int64
+	// MaxRequestBytes limits the whole upload request, across all files
+	MaxRequestBytes int64
+}
+
+// DefaultUploadLimits allow novels of up to 50 MB, 200 MB per request
+var DefaultUploadLimits = UploadLimits{MaxFileBytes: 50 << 20, MaxRequestBytes: 200 << 20}
+
+// uploadError describes why an uploaded file was rejected
+type uploadError struct {
+	Filename string `json:"filename"`
+	Code     string `json:"code"`
+	Message  string `json:"error"`
+	// Entry is the offending archive entry, for archive errors
+	Entry  string `json:"entry,omitempty"`
+	status int
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
 type UploadHandler struct {
 	novelService  *services.NovelService
 	chromaService *services.ChromaService
+	limits        UploadLimits
 }
 
 func NewUploadHandler(ns *services.NovelService, cs *services.ChromaService) *UploadHandler {
 	return &UploadHandler{
 		novelService:  ns,
 		chromaService: cs,
+		limits:        DefaultUploadLimits,
 	}
 }
 
+// SetUploadLimits changes the file and request size limits
+func (uh *UploadHandler) SetUploadLimits(limits UploadLimits) {
+	uh.limits = limits
+}
+
 func (uh *UploadHandler) UploadNovel(c *gin.Context) {
+	limitRequest(c, uh.limits)
 	file, err := c.FormFile("file")
 	if err != nil {
+		if tooLarge(err) {
+			c.String(http.StatusRequestEntityTooLarge, "Upload exceeds the %d byte request limit", uh.limits.MaxRequestBytes)
+			return
+		}
 		c.String(http.StatusBadRequest, "Failed to get file: %v", err)
 		return
 	}
 
-	// Check if file is .txt or .epub
-	if len(file.Filename) < 4 {
-		c.String(http.StatusBadRequest, "Invalid filename")
+	// How to handle a novel already in the library
+	onDuplicate, err := duplicateOption(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "%v", err)
 		return
 	}
 
-	extension := file.Filename[len(file.Filename)-4:]
-	if extension != ".txt" && extension != ".epub" {
-		c.String(http.StatusBadRequest, "Only .txt and .epub files are supported. Please upload files with .txt or .epub extensions.")
+	// Check the format by sniffing the contents, then store the file
+	stored, format, rejected := saveUpload(uh.novelService, file, uh.limits, 0)
+	if rejected != nil {
+		c.String(rejected.status, "Invalid file: %v", rejected)
 		return
 	}
 
-	// Save file temporarily
-	dst := "novels/" + file.Filename
-	if err := c.SaveUploadedFile(file, dst); err != nil {
-		c.String(http.StatusInternalServerError, "Failed to save file: %v", err)
+	// Read, chunk and index the novel
+	opts := services.IngestOptions{
+		ReadOptions: services.ReadOptions{Charset: c.PostForm("charset"), Format: format.Name},
+		OnDuplicate: onDuplicate,
+	}
+	result, err := services.NewIngestService(uh.novelService, uh.chromaService).Ingest(stored, opts, nil)
+	if err != nil {
+		var archiveErr *services.ArchiveError
+		if errors.As(err, &archiveErr) {
+			c.String(http.StatusUnprocessableEntity, "Failed to process file: %v", err)
+			return
+		}
+		c.String(http.StatusInternalServerError, "Failed to process file: %v", err)
 		return
 	}
 
-	// Read content
-	content, err := uh.novelService.ReadNovel(dst)
+	c.String(http.StatusOK, uploadSummary(file.Filename, result))
+}
+
+// limitRequest caps the request body before the multipart form is parsed
+func limitRequest(c *gin.Context, limits UploadLimits) {
+	if limits.MaxRequestBytes > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limits.MaxRequestBytes)
+	}
+}
+
+// tooLarge reports whether parsing a request failed on the request limit
+func tooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// saveUpload checks an uploaded file's size and format and stores it in the
+// novels directory under a sanitised, collision-free name, returning the
+// stored path. Files with an owner are private to that user; rejected files
+// are described by an uploadError.
+func saveUpload(ns *services.NovelService, fileHeader *multipart.FileHeader, limits UploadLimits, owner int64) (string, *services.Format, *uploadError) {
+	reject := func(status int, code string, err error) (string, *services.Format, *uploadError) {
+		rejected := &uploadError{Filename: fileHeader.Filename, Code: code, Message: err.Error(), status: status}
+		var archiveErr *services.ArchiveError
+		if errors.As(err, &archiveErr) {
+			rejected.Code, rejected.Entry, rejected.status = archiveErr.Kind, archiveErr.Entry, http.StatusUnprocessableEntity
+		}
+		return "", nil, rejected
+	}
+
+	if limits.MaxFileBytes > 0 && fileHeader.Size > limits.MaxFileBytes {
+		return reject(http.StatusRequestEntityTooLarge, "file_too_large", fmt.Errorf("%w: more than %d bytes", services.ErrFileTooLarge, limits.MaxFileBytes))
+	}
+
+	format, err := detectUploadFormat(fileHeader)
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Failed to read file: %v", err)
-		return
+		return reject(http.StatusBadRequest, "unsupported_format", err)
 	}
 
-	// Process and add to ChromaDB
-	chunks := uh.novelService.ProcessNovel(file.Filename, content)
-	err = uh.chromaService.AddDocuments(chunks)
+	file, err := fileHeader.Open()
 	if err != nil {
-		c.String(http.StatusInternalServerError, "Failed to add to database: %v", err)
-		return
+		return reject(http.StatusInternalServerError, "save_failed", err)
+	}
+	defer file.Close()
+
+	stored, err := ns.SaveOwnedUpload(file, fileHeader.Filename, format, limits.MaxFileBytes, owner)
+	if errors.Is(err, services.ErrFileTooLarge) {
+		return reject(http.StatusRequestEntityTooLarge, "file_too_large", err)
+	}
+	if err != nil {
+		return reject(http.StatusInternalServerError, "save_failed", err)
+	}
+	return ns.StoredPath(stored.Name), format, nil
+}
+
+// detectUploadFormat sniffs an uploaded file to check it is in a supported
+// novel format, using its name and declared type as hints
+func detectUploadFormat(fileHeader *multipart.FileHeader) (*services.Format, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	c.String(http.StatusOK, fmt.Sprintf("Successfully uploaded '%s' (%d chunks added)", file.Filename, len(chunks)))
+	return services.DetectFormat(fileHeader.Filename, fileHeader.Header.Get("Content-Type"), file, fileHeader.Size)
 }
@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"archive/zip"
 	"bytes"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/kweusuf/novel-qa-go/services"
@@ -83,7 +85,7 @@ func TestUploadHandler_UploadNovel_InvalidFileType(t *testing.T) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
-	part, err := writer.CreateFormFile("file", "test.pdf")
+	part, err := writer.CreateFormFile("file", "test.mobi")
 	if err != nil {
 		t.Fatalf("Failed to create form file: %v", err)
 	}
@@ -105,7 +107,7 @@ func TestUploadHandler_UploadNovel_InvalidFileType(t *testing.T) {
 	}
 
 	response := w.Body.String()
-	if !bytes.Contains([]byte(response), []byte("Only .txt and .epub files are supported")) {
+	if !bytes.Contains([]byte(response), []byte("unsupported file format")) {
 		t.Error("Expected response to contain file type error message")
 	}
 }
@@ -250,3 +252,179 @@ func TestUploadHandler_UploadNovel_SpecialCharactersInFilename(t *testing.T) {
 		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
 	}
 }
+
+func TestUploadHandler_UploadNovel_InvalidPDF(t *testing.T) {
+	novelService := services.NewNovelService("test_novels")
+	chromaService := services.NewChromaService("test_chroma_db")
+	handler := NewUploadHandler(novelService, chromaService)
+
+	defer func() {
+		os.RemoveAll("test_novels")
+		os.RemoveAll("test_chroma_db")
+	}()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", "broken.pdf")
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write([]byte("%PDF-1.4\nThis is not really a PDF."))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", handler.UploadNovel)
+
+	r.ServeHTTP(w, req)
+
+	// The PDF header passes sniffing, so a broken one fails while reading
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+
+	if !bytes.Contains(w.Body.Bytes(), []byte("failed to read file")) {
+		t.Errorf("Expected read error, got %s", w.Body.String())
+	}
+}
+
+func TestUploadHandler_UploadNovel_MislabelledFile(t *testing.T) {
+	novelService := services.NewNovelService("test_novels")
+	chromaService := services.NewChromaService("test_chroma_db")
+	handler := NewUploadHandler(novelService, chromaService)
+
+	defer func() {
+		os.RemoveAll("test_novels")
+		os.RemoveAll("test_chroma_db")
+	}()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", "renamed.epub")
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write([]byte("Plain text saved with the wrong extension."))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", handler.UploadNovel)
+
+	r.ServeHTTP(w, req)
+
+	// The contents don't match the extension, so the upload is rejected
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	if !bytes.Contains(w.Body.Bytes(), []byte("does not contain epub data")) {
+		t.Errorf("Expected sniffing error, got %s", w.Body.String())
+	}
+}
+
+// postUpload sends a single file to an UploadHandler
+func postUpload(t *testing.T, handler *UploadHandler, filename string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	part.Write(content)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.Default()
+	r.POST("/upload", handler.UploadNovel)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadHandler_UploadNovel_PathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	novelsDir := filepath.Join(dir, "novels")
+	handler := NewUploadHandler(services.NewNovelService(novelsDir), services.NewChromaService(filepath.Join(dir, "db")))
+
+	w := postUpload(t, handler, "../../escaped.txt", []byte("Emma Woodhouse, handsome, clever, and rich."))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Error("Expected upload not to escape the novels directory")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(novelsDir, "*-escaped.txt"))
+	if len(matches) != 1 {
+		t.Errorf("Expected the upload to be stored in the novels directory, found %v", matches)
+	}
+}
+
+func TestUploadHandler_UploadNovel_SizeLimits(t *testing.T) {
+	dir := t.TempDir()
+	handler := NewUploadHandler(services.NewNovelService(filepath.Join(dir, "novels")), services.NewChromaService(filepath.Join(dir, "db")))
+	content := bytes.Repeat([]byte("word "), 100)
+
+	tests := []struct {
+		name     string
+		limits   UploadLimits
+		expected string
+	}{
+		{"file limit", UploadLimits{MaxFileBytes: 100}, "file too large"},
+		{"request limit", UploadLimits{MaxRequestBytes: 100}, "request limit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.SetUploadLimits(tt.limits)
+			w := postUpload(t, handler, "big.txt", content)
+
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("Expected status code %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+			}
+			if !bytes.Contains(w.Body.Bytes(), []byte(tt.expected)) {
+				t.Errorf("Expected %q in response, got %s", tt.expected, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestUploadHandler_UploadNovel_ZipBomb(t *testing.T) {
+	dir := t.TempDir()
+	handler := NewUploadHandler(services.NewNovelService(filepath.Join(dir, "novels")), services.NewChromaService(filepath.Join(dir, "db")))
+
+	// Megabytes of zeros deflate to a few kilobytes
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	mimetype, _ := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	mimetype.Write([]byte("application/epub+zip"))
+	bomb, _ := zw.Create("OEBPS/chapter1.xhtml")
+	bomb.Write(make([]byte, 4<<20))
+	zw.Close()
+
+	w := postUpload(t, handler, "bomb.epub", buf.Bytes())
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("compression ratio")) {
+		t.Errorf("Expected archive error, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,89 @@
+// Package logging sets up structured logging and carries a request's logger
+// and ID through contexts, so everything logged while handling a request or
+// running the job it queued can be tied back to it
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Levels and Formats are the accepted names for the log level and format
+var (
+	Levels  = []string{"debug", "info", "warn", "error"}
+	Formats = []string{"json", "text"}
+)
+
+// New returns a logger writing to w at the named level in the named format
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+type loggerKey struct{}
+type requestIDKey struct{}
+
+// NewContext returns a copy of ctx carrying logger
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID, with a logger
+// that adds it to every record
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return NewContext(ctx, FromContext(ctx).With("request_id", id))
+}
+
+// RequestID returns the request ID carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether an ID supplied by a client is safe to log
+// and return: up to 64 letters, digits, dots, dashes and underscores
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
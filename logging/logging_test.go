@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", "json")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "novel", "emma.txt")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Expected one JSON record, got %q", buf.String())
+	}
+	if record["msg"] != "shown" || record["novel"] != "emma.txt" {
+		t.Errorf("Unexpected record %v", record)
+	}
+
+	buf.Reset()
+	logger, _ = New(&buf, "DEBUG", "text")
+	logger.Debug("shown")
+	if !strings.Contains(buf.String(), "msg=shown") {
+		t.Errorf("Expected a text record, got %q", buf.String())
+	}
+
+	for _, tt := range []struct{ level, format string }{{"loud", "json"}, {"info", "xml"}} {
+		if _, err := New(&buf, tt.level, tt.format); err == nil {
+			t.Errorf("Expected an error for level %q and format %q", tt.level, tt.format)
+		}
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Error("Expected the default logger without one in the context")
+	}
+
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "info", "json")
+	ctx := WithRequestID(NewContext(context.Background(), logger), "abc123")
+
+	if RequestID(ctx) != "abc123" {
+		t.Errorf("Expected request ID abc123, got %q", RequestID(ctx))
+	}
+	FromContext(ctx).Info("asked")
+	if !strings.Contains(buf.String(), `"request_id":"abc123"`) {
+		t.Errorf("Expected the request ID on every record, got %q", buf.String())
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, expected := range map[string]bool{
+		NewRequestID():          true,
+		"trace-01.a_b":          true,
+		"":                      false,
+		"has space":             false,
+		"line\nbreak":           false,
+		strings.Repeat("a", 65): false,
+	} {
+		if ValidRequestID(id) != expected {
+			t.Errorf("Expected ValidRequestID(%q) to be %t", id, expected)
+		}
+	}
+}
@@ -2,34 +2,156 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/kweusuf/novel-qa-go/config"
 	"github.com/kweusuf/novel-qa-go/handlers"
 	"github.com/kweusuf/novel-qa-go/services"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// version is reported by /status, set at build time with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// server is the web application along with the background work that must
+// be stopped with it
+type server struct {
+	router  *gin.Engine
+	jobs    *services.JobManager
+	watcher *services.Watcher
+	health  *handlers.HealthHandler
+	// endpoints are the Ollama servers admins register, checked in the
+	// background
+	endpoints *services.EndpointRegistry
+	// users is nil when accounts are disabled
+	users *services.UserStore
+	// draining is set once shutdown starts, after which uploads are refused
+	draining atomic.Bool
+}
+
 // runServer contains all the main application logic that can be tested
-func runServer() (*gin.Engine, error) {
-	// Get Ollama host from environment variable, fallback to localhost
-	ollamaHost := os.Getenv("OLLAMA_HOST")
-	if ollamaHost == "" {
-		ollamaHost = "http://localhost:11434"
-	}
+func runServer(cfg *config.Config) (*server, error) {
+	s := &server{}
+
+	// Metrics for /metrics, including the Go runtime and process
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metrics := services.NewMetrics(registry)
 
 	// Initialize services
-	novelService := services.NewNovelService("novels")
-	chromaService := services.NewChromaService("chroma_db")
+	novelService := services.NewNovelService(cfg.Storage.NovelsDir)
+	novelService.SetChunkWords(cfg.Retrieval.ChunkWords)
+	chromaService := services.NewChromaService(cfg.Storage.DBDir)
 	chromaService.Initialize() // Initialize the ChromaDB
-	ollamaService := services.NewOllamaService(ollamaHost)
+	chromaService.SetContextWindow(cfg.Retrieval.ContextWindow)
+	chromaService.SetMetrics(metrics)
+	ollamaService := services.NewOllamaPool(cfg.OllamaNodes())
+	ollamaService.SetTimeout(time.Duration(cfg.Ollama.Timeout))
+	ollamaService.SetRetries(cfg.Ollama.Retries, time.Duration(cfg.Ollama.RetryBackoff))
+	ollamaService.SetFallbacks(cfg.Ollama.FallbackModels)
+	ollamaService.SetMetrics(metrics)
+
+	// Run uploads as background ingestion jobs, resuming any left unfinished
+	ingestService := services.NewIngestService(novelService, chromaService)
+	ingestService.SetMetrics(metrics)
+	jobManager, err := services.NewJobManager(filepath.Join(cfg.Storage.DBDir, "jobs.json"), ingestService, cfg.Ingest.Workers)
+	if err != nil {
+		return nil, err
+	}
+	jobManager.SetRetention(time.Duration(cfg.Ingest.JobRetention), cfg.Ingest.MaxFinishedJobs)
 
-	// Initialize handler
+	// Accounts for logging in, when enabled
+	if cfg.Auth.Enabled {
+		s.users, err = services.OpenUserStore(cfg.Auth.UsersDB)
+		if err != nil {
+			return nil, err
+		}
+		s.users.SetSessionTTL(time.Duration(cfg.Auth.SessionTTL))
+	}
+
+	// Bring the index in line with the novels directory before taking new
+	// work, leaving resumed uploads to their jobs
+	report, err := ingestService.Reconcile(jobManager.PendingFiles())
+	if err != nil {
+		return nil, err
+	}
+	if report.Changed() || len(report.Failed) > 0 {
+		slog.Info("Reconciled novels with the index", "added", report.Added, "updated", report.Updated,
+			"removed", report.Removed, "skipped", report.Skipped, "unchanged", report.Unchanged)
+		for _, failure := range report.Failed {
+			slog.Error("Could not ingest novel", "novel", failure.Name, "error", failure.Error)
+		}
+	}
+	jobManager.Start()
+	s.jobs = jobManager
+
+	// Optionally pick up novels copied into the novels directory
+	if cfg.Ingest.Watch {
+		s.watcher = services.NewWatcher(jobManager, time.Duration(cfg.Ingest.WatchInterval), time.Duration(cfg.Ingest.WatchSettle))
+		s.watcher.Start()
+		slog.Info("Watching novels directory for changes", "dir", cfg.Storage.NovelsDir)
+	}
+
+	// Other Ollama servers clients may choose: those admins register, and
+	// any allowed by URL
+	guard := services.NewEndpointGuard(cfg.Ollama.AllowedEndpoints, cfg.Ollama.AllowPrivateEndpoints)
+	s.endpoints, err = services.NewEndpointRegistry(filepath.Join(cfg.Storage.DBDir, "endpoints.json"), guard)
+	if err != nil {
+		return nil, err
+	}
+	s.endpoints.SetTimeout(time.Duration(cfg.Ollama.Timeout))
+	s.endpoints.SetMetrics(metrics)
+
+	// Upload size limits, in megabytes
+	limits := handlers.UploadLimits{
+		MaxFileBytes:    cfg.Uploads.MaxFileMB << 20,
+		MaxRequestBytes: cfg.Uploads.MaxRequestMB << 20,
+	}
+
+	// Initialize handlers
 	qaHandler := handlers.NewQAHandler(novelService, chromaService, ollamaService)
+	qaHandler.SetJobManager(jobManager)
+	qaHandler.SetUploadLimits(limits)
+	qaHandler.SetModels(cfg.Ollama.Models)
+	qaHandler.SetResults(cfg.Retrieval.Results)
+	qaHandler.SetMetrics(metrics)
+	qaHandler.SetGenerationQueue(services.NewGenerationQueue(cfg.Limits.MaxGenerations, cfg.Limits.MaxQueue, time.Duration(cfg.Limits.QueueTimeout)))
+	qaHandler.SetEndpointGuard(guard)
+	qaHandler.SetEndpointRegistry(s.endpoints)
+	jobsHandler := handlers.NewJobsHandler(jobManager)
+	adminHandler := handlers.NewAdminHandler(ingestService, jobManager)
+	endpointsHandler := handlers.NewEndpointsHandler(s.endpoints)
+	s.health = handlers.NewHealthHandler(chromaService, ollamaService, version)
+	s.health.SetEndpointRegistry(s.endpoints)
 
 	// Set up Gin
-	r := gin.Default()
+	// Gin's own request logging is replaced by structured request logs
+	if os.Getenv(gin.EnvGinMode) == "" && !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	r := gin.New()
+	// Client IPs, used in logs and rate limits, come from X-Forwarded-For
+	// only when the request came through a trusted proxy
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+	r.Use(handlers.Tracing(), handlers.RequestLogger(slog.Default()), handlers.Recovery(), handlers.RequestMetrics(metrics))
 
 	// Register static files handler
 	r.Static("/static", "./static")
@@ -37,22 +159,172 @@ func runServer() (*gin.Engine, error) {
 	// Load HTML templates
 	r.LoadHTMLGlob("templates/*")
 
+	// With accounts enabled, uploads, questions, jobs and admin routes need
+	// a login or an API key with the right scope, and every post from a
+	// browser a CSRF token
+	requireAsk, requireUpload, requireAdmin := allowAll, allowAll, allowAll
+	var authHandler *handlers.AuthHandler
+	if s.users != nil {
+		authHandler = handlers.NewAuthHandler(s.users)
+		authHandler.SetRegistration(cfg.Auth.Registration)
+		authHandler.SetSecureCookies(cfg.Auth.SecureCookies)
+		r.Use(authHandler.Session(), authHandler.CSRF())
+		requireAsk = handlers.RequireScope(services.ScopeAsk)
+		requireUpload = handlers.RequireScope(services.ScopeUpload)
+		requireAdmin = handlers.RequireAdmin
+	}
+
+	// Each client's requests to the app's routes are rate limited, while
+	// probes and metrics scrapes are not
+	routeLimits := make(map[string]*services.RateLimiter)
+	for route, rate := range cfg.Limits.Routes {
+		routeLimits[route] = services.NewRateLimiter(rate.Requests, rate.Per)
+	}
+	defaultLimit := services.NewRateLimiter(cfg.Limits.Default.Requests, cfg.Limits.Default.Per)
+	app := r.Group("/", handlers.RateLimit(routeLimits, defaultLimit, metrics))
+
+	if s.users != nil {
+		app.GET("/login", authHandler.ShowLogin)
+		app.POST("/login", authHandler.Login)
+		app.GET("/register", authHandler.ShowRegister)
+		app.POST("/register", authHandler.Register)
+		app.POST("/logout", authHandler.Logout)
+		app.POST("/admin/invites", requireAdmin, authHandler.CreateInvite)
+
+		// Keys can only be managed from the browser or with an admin key
+		manageKeys := handlers.RequireScope(services.ScopeAdmin)
+		apiKeysHandler := handlers.NewAPIKeysHandler(s.users)
+		app.GET("/api-keys", manageKeys, apiKeysHandler.List)
+		app.POST("/api-keys", manageKeys, apiKeysHandler.Create)
+		app.DELETE("/api-keys/:id", manageKeys, apiKeysHandler.Revoke)
+
+		// Each user's uploads are private; collections share them
+		qaHandler.SetUserStore(s.users)
+		collectionsHandler := handlers.NewCollectionsHandler(s.users, novelService)
+		app.GET("/novels", requireAsk, collectionsHandler.ListNovels)
+		app.GET("/collections", requireAsk, collectionsHandler.List)
+		app.POST("/collections", requireUpload, collectionsHandler.Create)
+		app.GET("/collections/:id", requireAsk, collectionsHandler.Get)
+		app.DELETE("/collections/:id", requireUpload, collectionsHandler.Delete)
+		app.POST("/collections/:id/members", requireUpload, collectionsHandler.AddMember)
+		app.DELETE("/collections/:id/members/:username", requireUpload, collectionsHandler.RemoveMember)
+		app.POST("/collections/:id/novels", requireUpload, collectionsHandler.AddNovel)
+		app.DELETE("/collections/:id/novels/:novel", requireUpload, collectionsHandler.RemoveNovel)
+	}
+
+	app.GET("/", requireAsk, qaHandler.ShowIndex)
+	app.POST("/upload", requireUpload, s.refuseWhileDraining, qaHandler.UploadNovel)
+	app.POST("/ask", requireAsk, qaHandler.AskQuestion)
+	app.GET("/ask/queue", requireAsk, qaHandler.QueueStatus)
+	app.GET("/jobs/:id", requireAsk, jobsHandler.GetJob)
+	app.GET("/jobs/:id/events", requireAsk, jobsHandler.StreamJob)
+	app.POST("/admin/reindex", requireAdmin, s.refuseWhileDraining, adminHandler.Reindex)
+	app.GET("/endpoints", requireAsk, endpointsHandler.List)
+	app.GET("/admin/endpoints", requireAdmin, endpointsHandler.AdminList)
+	app.POST("/admin/endpoints", requireAdmin, endpointsHandler.Add)
+	app.DELETE("/admin/endpoints/:id", requireAdmin, endpointsHandler.Remove)
+	app.GET("/admin/nodes", requireAdmin, s.health.Nodes)
+
 	// Public routes (no authentication)
-	r.GET("/", qaHandler.ShowIndex)
-	r.POST("/upload", qaHandler.UploadNovel)
-	r.POST("/ask", qaHandler.AskQuestion)
-	r.GET("/models", qaHandler.GetModels)
+	app.GET("/models", qaHandler.GetModels)
+	r.GET("/healthz", s.health.Healthz)
+	r.GET("/readyz", s.health.Readyz)
+	r.GET("/status", s.health.Status)
+	r.GET("/metrics", gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
 
-	log.Printf("🚀 Starting server at http://localhost:8080")
-	log.Printf("🔗 Using Ollama at: %s", ollamaHost)
+	slog.Info("Using Ollama", "host", cfg.Redacted().Ollama.Host)
+	s.endpoints.Start(time.Duration(cfg.Ollama.HealthInterval))
 
-	return r, nil
+	s.router = r
+	return s, nil
 }
 
-func main() {
-	r, err := runServer()
+// allowAll stands in for the login checks when accounts are disabled
+func allowAll(c *gin.Context) {
+	c.Next()
+}
+
+// refuseWhileDraining rejects requests that would start new work once the
+// server is shutting down
+func (s *server) refuseWhileDraining(c *gin.Context) {
+	if s.draining.Load() {
+		c.Header("Retry-After", "30")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	c.Next()
+}
+
+// serve listens on addr until SIGINT or SIGTERM, then shuts down
+// gracefully: uploads are refused, in-flight requests and event streams are
+// given until timeout to finish, and ingestion workers are drained. Jobs
+// that don't finish in time are saved and resume on the next start. A second
+// signal exits immediately.
+func (s *server) serve(addr string, timeout time.Duration) error {
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatal("Failed to initialize server:", err)
+		return err
+	}
+	slog.Info("Starting server", "addr", ln.Addr().String(), "version", version)
+
+	// Event streams would otherwise hold shutdown open until the timeout
+	streams, cancelStreams := context.WithCancel(context.Background())
+	defer cancelStreams()
+	srv := &http.Server{
+		Handler:     s.router,
+		BaseContext: func(net.Listener) context.Context { return streams },
+	}
+	srv.RegisterOnShutdown(cancelStreams)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("Shutting down, waiting for requests and ingestion jobs", "timeout", timeout.String())
+
+	return s.shutdown(srv, timeout)
+}
+
+// shutdown stops the server within timeout, reporting anything left
+// unfinished
+func (s *server) shutdown(srv *http.Server, timeout time.Duration) error {
+	s.draining.Store(true)
+	s.health.Drain()
+	if s.watcher != nil {
+		s.watcher.Stop()
+	}
+	s.endpoints.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("requests still running: %v", err))
+	}
+	if err := s.jobs.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("ingestion jobs still running will resume on restart: %v", err))
+	}
+	if s.users != nil {
+		if err := s.users.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close users database: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
 	}
-	r.Run(":8080")
+	slog.Info("Shut down cleanly")
+	return nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
 }
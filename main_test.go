@@ -5,10 +5,21 @@ import (
 	"encoding/json"
 	"mime/multipart"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/kweusuf/novel-qa-go/config"
 	"github.com/kweusuf/novel-qa-go/handlers"
 	"github.com/kweusuf/novel-qa-go/services"
 
@@ -18,6 +29,11 @@ import (
 func TestMain(m *testing.M) {
 	// Setup test environment
 	gin.SetMode(gin.TestMode)
+
+	// Run as the application when started as a subprocess by a test
+	if os.Getenv("NOVEL_QA_TEST_SERVE") == "1" {
+		os.Exit(run(strings.Split(os.Getenv("NOVEL_QA_TEST_ARGS"), "\n"), os.Stdout, os.Stderr))
+	}
 	os.Exit(m.Run())
 }
 
@@ -287,21 +303,52 @@ func TestRunServer(t *testing.T) {
 
 	// Test with default host
 	os.Unsetenv("OLLAMA_HOST")
-	r, err := runServer()
+	cfg, err := config.Load("", os.Getenv)
 	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
+		t.Fatalf("Expected no error loading config, got %v", err)
 	}
-	if r == nil {
-		t.Error("Expected Gin router to be returned")
+	cfg.Auth.Enabled = true
+	cfg.Auth.UsersDB = filepath.Join(t.TempDir(), "users.db")
+	r, err := runServer(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	r.jobs.Stop()
+	if r.router == nil {
+		t.Fatal("Expected Gin router to be returned")
 	}
 
+	// Requests are counted by route on /metrics
+	r.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+	w := httptest.NewRecorder()
+	r.router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `novelqa_http_requests_total{method="GET",route="/healthz",status="200"} 1`) {
+		t.Errorf("Expected the request to be counted, got:\n%s", w.Body.String())
+	}
+
+	// Uploads and questions need a login
+	for _, path := range []string{"/upload", "/ask"} {
+		w = httptest.NewRecorder()
+		r.router.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+		if w.Code != http.StatusForbidden && w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %s to be refused without a login, got %d", path, w.Code)
+		}
+	}
+	r.users.Close()
+
 	// Test with custom host
 	os.Setenv("OLLAMA_HOST", "http://test:9999")
-	r2, err2 := runServer()
+	cfg, err = config.Load("", os.Getenv)
+	if err != nil || cfg.Ollama.Host != "http://test:9999" {
+		t.Fatalf("Expected the custom host to be loaded, got %v (%v)", cfg, err)
+	}
+	cfg.Auth.Enabled = false
+	r2, err2 := runServer(cfg)
 	if err2 != nil {
-		t.Errorf("Expected no error with custom host, got %v", err2)
+		t.Fatalf("Expected no error with custom host, got %v", err2)
 	}
-	if r2 == nil {
+	r2.jobs.Stop()
+	if r2.router == nil {
 		t.Error("Expected Gin router to be returned with custom host")
 	}
 
@@ -386,3 +433,187 @@ func TestMainFunction_InitializationLogic(t *testing.T) {
 		t.Error("Gin router should not be nil")
 	}
 }
+
+// startServer runs the application's serve command in a subprocess with its
+// data in dir, returning the process, the address it listens on and its
+// log so far
+func startServer(t *testing.T, dir string) (*exec.Cmd, string, *syncBuffer) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("Signals can't be sent to subprocesses on Windows")
+	}
+
+	args := []string{"serve", "--addr", "127.0.0.1:0", "--novels", filepath.Join(dir, "novels"), "--db", filepath.Join(dir, "db"), "--users-db", filepath.Join(dir, "users.db"), "--auth=true", "--shutdown-timeout", "10s"}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "NOVEL_QA_TEST_SERVE=1", "NOVEL_QA_TEST_ARGS="+strings.Join(args, "\n"))
+	logs := &syncBuffer{}
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	listening := regexp.MustCompile(`"msg":"Starting server","addr":"([^"]+)"`)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if m := listening.FindStringSubmatch(logs.String()); m != nil {
+			return cmd, m[1], logs
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Server did not start:\n%s", logs.String())
+	return nil, "", nil
+}
+
+// registerUser registers the admin on a running server with its data in
+// dir, using an invite from the invite command, and returns a client logged
+// in as it and the CSRF token to send with posts
+func registerUser(t *testing.T, addr, dir string) (*http.Client, string) {
+	t.Helper()
+	code, stdout, stderr := runCLI(t, dir, "invite", "--json")
+	var invite map[string]string
+	if err := json.Unmarshal([]byte(stdout), &invite); code != 0 || err != nil {
+		t.Fatalf("Failed to create an invite: %s%s", stdout, stderr)
+	}
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	resp, err := client.Get("http://" + addr + "/register")
+	if err != nil {
+		t.Fatalf("Failed to load the registration form: %v", err)
+	}
+	resp.Body.Close()
+	var token string
+	for _, cookie := range jar.Cookies(resp.Request.URL) {
+		if cookie.Name == handlers.CSRFCookie {
+			token = cookie.Value
+		}
+	}
+
+	form := url.Values{"username": {"emma"}, "password": {"knightley1"}, "confirm": {"knightley1"}, "invite": {invite["code"]}, "csrf_token": {token}}
+	resp, err = client.PostForm("http://"+addr+"/register", form)
+	if err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/" {
+		t.Fatalf("Expected to register and reach the index page, got %d at %s", resp.StatusCode, resp.Request.URL)
+	}
+	return client, token
+}
+
+// syncBuffer collects a subprocess's output for reading while it runs
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitForExit waits for a subprocess to exit, failing the test if it takes
+// too long
+func waitForExit(t *testing.T, cmd *exec.Cmd, logs *syncBuffer) int {
+	t.Helper()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case <-exited:
+		return cmd.ProcessState.ExitCode()
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Server did not exit:\n%s", logs.String())
+		return -1
+	}
+}
+
+func TestServe_GracefulShutdown(t *testing.T) {
+	dir := t.TempDir()
+	cmd, addr, logs := startServer(t, dir)
+	client, csrfToken := registerUser(t, addr, dir)
+
+	// Queue an upload just before stopping
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("files", "emma.txt")
+	part.Write([]byte(strings.Repeat("Emma Woodhouse, handsome, clever, and rich. ", 2000)))
+	writer.Close()
+	req, _ := http.NewRequest("POST", "http://"+addr+"/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(handlers.CSRFHeader, csrfToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status code %d, got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to signal server: %v", err)
+	}
+	if code := waitForExit(t, cmd, logs); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d:\n%s", code, logs.String())
+	}
+	if !strings.Contains(logs.String(), "Shut down cleanly") {
+		t.Errorf("Expected a clean shutdown, got:\n%s", logs.String())
+	}
+
+	// The job was drained and the stores left readable
+	var jobs []services.Job
+	data, _ := os.ReadFile(filepath.Join(dir, "db", "jobs.json"))
+	if err := json.Unmarshal(data, &jobs); err != nil || len(jobs) != 1 {
+		t.Fatalf("Expected one saved job, got %s (%v)", data, err)
+	}
+	if jobs[0].Stage != services.StageDone {
+		t.Errorf("Expected the job to finish before exit, got %s (%s)", jobs[0].Stage, jobs[0].Error)
+	}
+	var docs []services.ChromaDocument
+	data, _ = os.ReadFile(filepath.Join(dir, "db", "documents.json"))
+	if err := json.Unmarshal(data, &docs); err != nil || len(docs) == 0 {
+		t.Errorf("Expected indexed documents, got %d (%v)", len(docs), err)
+	}
+}
+
+func TestServe_StopsOnInterrupt(t *testing.T) {
+	cmd, addr, logs := startServer(t, t.TempDir())
+
+	resp, err := http.Get("http://" + addr + "/jobs/unknown")
+	if err != nil {
+		t.Fatalf("Failed to reach server: %v", err)
+	}
+	resp.Body.Close()
+
+	cmd.Process.Signal(os.Interrupt)
+	if code := waitForExit(t, cmd, logs); code != 0 {
+		t.Errorf("Expected exit code 0, got %d:\n%s", code, logs.String())
+	}
+}
+
+func TestRefuseWhileDraining(t *testing.T) {
+	s := &server{}
+	r := gin.New()
+	r.POST("/upload", s.refuseWhileDraining, func(c *gin.Context) { c.String(http.StatusOK, "uploaded") })
+
+	for _, tt := range []struct {
+		draining bool
+		expected int
+	}{{false, http.StatusOK}, {true, http.StatusServiceUnavailable}} {
+		s.draining.Store(tt.draining)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/upload", nil))
+		if w.Code != tt.expected {
+			t.Errorf("Expected status code %d while draining=%t, got %d", tt.expected, tt.draining, w.Code)
+		}
+	}
+}
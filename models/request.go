@@ -4,6 +4,9 @@ type QuestionRequest struct {
 	Question       string `json:"question" binding:"required"`
 	Model          string `json:"model" binding:"required"`
 	OllamaEndpoint string `json:"ollamaEndpoint,omitempty"`
+	// Collection, when set, limits the question to the novels in that
+	// collection
+	Collection int64 `json:"collection,omitempty"`
 }
 
 type UploadRequest struct {
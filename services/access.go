@@ -0,0 +1,58 @@
+package services
+
+// Access limits which indexed documents a query can read. The zero value
+// reads nothing, so a query that forgets to say whose it is finds no
+// context rather than someone else's.
+type Access struct {
+	// All reads every document, for the command line and servers without
+	// accounts
+	All bool
+	// User reads the novels that user uploaded, and Library the shared
+	// library of novels nobody owns
+	User    int64
+	Library bool
+	// Novels are further novels readable by name, such as those shared
+	// through collections
+	Novels map[string]bool
+}
+
+// FullAccess reads every document
+var FullAccess = Access{All: true}
+
+// UserAccess reads a user's own novels, the shared library and the novels
+// shared with them
+func UserAccess(user int64, shared map[string]bool) Access {
+	return Access{User: user, Library: true, Novels: shared}
+}
+
+// NovelsAccess reads only the named novels, as when querying a collection
+func NovelsAccess(novels map[string]bool) Access {
+	return Access{Novels: novels}
+}
+
+// Allows reports whether a document can be read
+func (a Access) Allows(doc ChromaDocument) bool {
+	switch {
+	case a.All:
+		return true
+	case doc.Owner == 0 && a.Library:
+		return true
+	case doc.Owner != 0 && doc.Owner == a.User:
+		return true
+	}
+	return a.Novels[doc.Novel]
+}
+
+// filter returns the documents that can be read
+func (a Access) filter(docs []ChromaDocument) []ChromaDocument {
+	if a.All {
+		return docs
+	}
+	var allowed []ChromaDocument
+	for _, doc := range docs {
+		if a.Allows(doc) {
+			allowed = append(allowed, doc)
+		}
+	}
+	return allowed
+}
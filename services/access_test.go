@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccess_Allows(t *testing.T) {
+	library := ChromaDocument{Novel: "emma.txt"}
+	emmas := ChromaDocument{Novel: "u1-persuasion.txt", Owner: 1}
+	harriets := ChromaDocument{Novel: "u2-mansfield.txt", Owner: 2}
+
+	tests := []struct {
+		name     string
+		access   Access
+		expected []bool
+	}{
+		{"zero value", Access{}, []bool{false, false, false}},
+		{"full", FullAccess, []bool{true, true, true}},
+		{"user", UserAccess(1, nil), []bool{true, true, false}},
+		{"user with shared novel", UserAccess(1, map[string]bool{"u2-mansfield.txt": true}), []bool{true, true, true}},
+		{"collection", NovelsAccess(map[string]bool{"u2-mansfield.txt": true}), []bool{false, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, doc := range []ChromaDocument{library, emmas, harriets} {
+				if got := tt.access.Allows(doc); got != tt.expected[i] {
+					t.Errorf("Expected %t for %s, got %t", tt.expected[i], doc.Novel, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSearch_Isolation(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	cs := NewChromaService(filepath.Join(tempDir, "db"))
+	is := NewIngestService(ns, cs)
+
+	ingest := func(name, text string, owner int64) string {
+		t.Helper()
+		stored, err := ns.SaveOwnedUpload(strings.NewReader(text), name, FormatByName("txt"), 0, owner)
+		if err != nil {
+			t.Fatalf("Failed to save upload: %v", err)
+		}
+		if _, err := is.Ingest(ns.StoredPath(stored.Name), IngestOptions{Owner: owner}, nil); err != nil {
+			t.Fatalf("Failed to ingest: %v", err)
+		}
+		return stored.Name
+	}
+	ingest("library.txt", "The vicarage stood beside the church.", 0)
+	secret := ingest("diary.txt", "Emma kept a secret diary about Mr Knightley.", 1)
+	ingest("letters.txt", "Harriet wrote letters to Robert Martin.", 2)
+
+	search := func(question string, access Access) string {
+		t.Helper()
+		result, err := cs.Search(context.Background(), question, 5, "", access)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return result.Context
+	}
+
+	// The owner finds their own passage; nobody else does, not even through
+	// the fallback used when nothing matches
+	if context := search("secret diary", UserAccess(1, nil)); !strings.Contains(context, "secret diary") {
+		t.Errorf("Expected the owner to find their novel, got %q", context)
+	}
+	for _, question := range []string{"secret diary", "Knightley", "unmatched words"} {
+		if context := search(question, UserAccess(2, nil)); strings.Contains(context, "secret") {
+			t.Errorf("Expected %q not to reveal another user's novel, got %q", question, context)
+		}
+	}
+	if context := search("secret diary", Access{}); context != "" {
+		t.Errorf("Expected no context without access, got %q", context)
+	}
+
+	// Everyone reads the shared library
+	if context := search("vicarage", UserAccess(2, nil)); !strings.Contains(context, "vicarage") {
+		t.Errorf("Expected the shared library to be readable, got %q", context)
+	}
+
+	// Sharing a novel makes it readable, and a collection reads nothing else
+	if context := search("secret diary", UserAccess(2, map[string]bool{secret: true})); !strings.Contains(context, "secret diary") {
+		t.Errorf("Expected a shared novel to be readable, got %q", context)
+	}
+	context := search("vicarage letters diary", NovelsAccess(map[string]bool{secret: true}))
+	if !strings.Contains(context, "secret diary") || strings.Contains(context, "vicarage") || strings.Contains(context, "Harriet") {
+		t.Errorf("Expected a collection to read only its novels, got %q", context)
+	}
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// API key scopes. ScopeAsk is read-only: asking questions and listing
+// novels, collections and jobs. ScopeUpload adds uploading novels and
+// changing collections, and ScopeAdmin the admin routes and managing keys.
+const (
+	ScopeAsk    = "ask"
+	ScopeUpload = "upload"
+	ScopeAdmin  = "admin"
+)
+
+// Scopes are the scopes a key can be given
+var Scopes = []string{ScopeAsk, ScopeUpload, ScopeAdmin}
+
+// APIKeyPrefix starts every API key so leaked keys are easy to recognise
+const APIKeyPrefix = "nqa_"
+
+// MaxAPIKeyNameLength caps key names in characters
+const MaxAPIKeyNameLength = 64
+
+var (
+	ErrInvalidAPIKeyName = fmt.Errorf("key names are 1 to %d characters", MaxAPIKeyNameLength)
+	ErrInvalidScope      = fmt.Errorf("scopes are %s", strings.Join(Scopes, ", "))
+	ErrAdminScope        = errors.New("only admins can create keys with the admin scope")
+	ErrAPIKeyNotFound    = errors.New("API key not found or revoked")
+)
+
+// APIKey describes a key without the key itself, which is only shown once
+// when it is created
+type APIKey struct {
+	ID     int64    `json:"id"`
+	Name   string   `json:"name"`
+	Prefix string   `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	// LastUsedAt is nil for keys that have never been used
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// HasScope reports whether the key grants scope. Admin keys can do
+// anything, and upload keys can also ask.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		switch {
+		case granted == scope, granted == ScopeAdmin:
+			return true
+		case granted == ScopeUpload && scope == ScopeAsk:
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKey creates a key for user, returning the key to hand to the
+// client once along with its description
+func (us *UserStore) CreateAPIKey(user *User, name string, scopes []string) (string, *APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > MaxAPIKeyNameLength {
+		return "", nil, ErrInvalidAPIKeyName
+	}
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, scope := range scopes {
+		if scope == ScopeAdmin && !user.Admin {
+			return "", nil, ErrAdminScope
+		}
+	}
+
+	key := APIKeyPrefix + newSecret()
+	created := us.now()
+	prefix := key[:len(APIKeyPrefix)+6]
+	result, err := us.db.Exec(`INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		user.ID, name, prefix, hashSecret(key), strings.Join(scopes, ","), created.Unix())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create API key: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create API key: %v", err)
+	}
+	return key, &APIKey{ID: id, Name: name, Prefix: prefix, Scopes: scopes, CreatedAt: time.Unix(created.Unix(), 0)}, nil
+}
+
+// APIKeys returns user's keys, newest first
+func (us *UserStore) APIKeys(user int64) ([]APIKey, error) {
+	rows, err := us.db.Query(`SELECT id, name, prefix, scopes, created_at, last_used_at FROM api_keys
+		WHERE user_id = ? ORDER BY created_at DESC, id DESC`, user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list API keys: %v", err)
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list API keys: %v", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey deletes one of user's keys
+func (us *UserStore) RevokeAPIKey(user, id int64) error {
+	result, err := us.db.Exec(`DELETE FROM api_keys WHERE id = ? AND user_id = ?`, id, user)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// APIKeyUser returns the user a key belongs to and the key's description,
+// recording that it was used
+func (us *UserStore) APIKeyUser(key string) (*User, *APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, nil, ErrAPIKeyNotFound
+	}
+	row := us.db.QueryRow(`SELECT k.id, k.name, k.prefix, k.scopes, k.created_at, k.last_used_at,
+		u.id, u.username, u.is_admin, u.created_at FROM api_keys k
+		JOIN users u ON u.id = k.user_id WHERE k.key_hash = ?`, hashSecret(key))
+
+	var user User
+	var userCreated int64
+	apiKey, err := scanAPIKey(row, &user.ID, &user.Username, &user.Admin, &userCreated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up API key: %v", err)
+	}
+	user.CreatedAt = time.Unix(userCreated, 0)
+
+	now := us.now()
+	if _, err := us.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now.Unix(), apiKey.ID); err != nil {
+		return nil, nil, fmt.Errorf("failed to record API key use: %v", err)
+	}
+	used := time.Unix(now.Unix(), 0)
+	apiKey.LastUsedAt = &used
+	return &user, apiKey, nil
+}
+
+// normalizeScopes checks and de-duplicates scopes, in the order of Scopes
+func normalizeScopes(scopes []string) ([]string, error) {
+	requested := make(map[string]bool)
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		valid := false
+		for _, known := range Scopes {
+			valid = valid || scope == known
+		}
+		if !valid {
+			return nil, ErrInvalidScope
+		}
+		requested[scope] = true
+	}
+	if len(requested) == 0 {
+		return nil, ErrInvalidScope
+	}
+	var normalized []string
+	for _, scope := range Scopes {
+		if requested[scope] {
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized, nil
+}
+
+// scanAPIKey reads the key columns of a row, followed by any extra columns
+// into dest
+func scanAPIKey(row interface{ Scan(...any) error }, dest ...any) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var created int64
+	var lastUsed sql.NullInt64
+	if err := row.Scan(append([]any{&key.ID, &key.Name, &key.Prefix, &scopes, &created, &lastUsed}, dest...)...); err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	key.CreatedAt = time.Unix(created, 0)
+	if lastUsed.Valid {
+		used := time.Unix(lastUsed.Int64, 0)
+		key.LastUsedAt = &used
+	}
+	return &key, nil
+}
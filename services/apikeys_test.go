@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserStore_APIKeys(t *testing.T) {
+	us := newTestUserStore(t)
+	admin, _ := us.Register("emma", "knightley1", adminInvite(t, us), false)
+	reader, _ := us.Register("harriet", "martin123", "", false)
+
+	tests := []struct {
+		name     string
+		user     *User
+		keyName  string
+		scopes   []string
+		expected error
+	}{
+		{"no scopes", reader, "script", nil, ErrInvalidScope},
+		{"unknown scope", reader, "script", []string{"write"}, ErrInvalidScope},
+		{"empty name", reader, " ", []string{ScopeAsk}, ErrInvalidAPIKeyName},
+		{"admin scope for a reader", reader, "script", []string{ScopeAdmin}, ErrAdminScope},
+		{"admin scope for an admin", admin, "script", []string{ScopeAdmin}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := us.CreateAPIKey(tt.user, tt.keyName, tt.scopes); !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+
+	secret, key, err := us.CreateAPIKey(reader, "nightly", []string{"Upload", "ask", "ask"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.HasPrefix(secret, APIKeyPrefix) || !strings.HasPrefix(secret, key.Prefix) || key.LastUsedAt != nil {
+		t.Errorf("Unexpected key %s %+v", secret, key)
+	}
+	if strings.Join(key.Scopes, ",") != "ask,upload" {
+		t.Errorf("Expected scopes ask,upload, got %v", key.Scopes)
+	}
+
+	// The key is stored hashed, never as given
+	var stored int
+	us.db.QueryRow(`SELECT COUNT(*) FROM api_keys WHERE key_hash = ? OR prefix = ?`, secret, secret).Scan(&stored)
+	if stored != 0 {
+		t.Errorf("Expected the key not to be stored in the clear")
+	}
+
+	// Using the key finds its user and records when
+	us.now = func() time.Time { return time.Unix(1700000000, 0) }
+	user, used, err := us.APIKeyUser(secret)
+	if err != nil || user.Username != "harriet" || used.ID != key.ID {
+		t.Fatalf("Expected harriet's key, got %+v %+v %v", user, used, err)
+	}
+	keys, _ := us.APIKeys(reader.ID)
+	if len(keys) != 1 || keys[0].LastUsedAt == nil || keys[0].LastUsedAt.Unix() != 1700000000 {
+		t.Errorf("Expected the last use to be recorded, got %+v", keys)
+	}
+
+	for _, bad := range []string{"", "nqa_wrong", strings.TrimPrefix(secret, APIKeyPrefix)} {
+		if _, _, err := us.APIKeyUser(bad); !errors.Is(err, ErrAPIKeyNotFound) {
+			t.Errorf("Expected ErrAPIKeyNotFound for %q, got %v", bad, err)
+		}
+	}
+
+	// Only the owner can revoke it, after which it no longer works
+	if err := us.RevokeAPIKey(admin.ID, key.ID); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound revoking another user's key, got %v", err)
+	}
+	if err := us.RevokeAPIKey(reader.ID, key.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, _, err := us.APIKeyUser(secret); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Expected a revoked key to be refused, got %v", err)
+	}
+}
+
+func TestAPIKey_HasScope(t *testing.T) {
+	tests := []struct {
+		scopes   []string
+		expected map[string]bool
+	}{
+		{[]string{ScopeAsk}, map[string]bool{ScopeAsk: true, ScopeUpload: false, ScopeAdmin: false}},
+		{[]string{ScopeUpload}, map[string]bool{ScopeAsk: true, ScopeUpload: true, ScopeAdmin: false}},
+		{[]string{ScopeAdmin}, map[string]bool{ScopeAsk: true, ScopeUpload: true, ScopeAdmin: true}},
+	}
+	for _, tt := range tests {
+		key := APIKey{Scopes: tt.scopes}
+		for scope, expected := range tt.expected {
+			if got := key.HasScope(scope); got != expected {
+				t.Errorf("Expected %v to grant %s: %t, got %t", tt.scopes, scope, expected, got)
+			}
+		}
+	}
+}
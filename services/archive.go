@@ -0,0 +1,132 @@
+package services
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Limits on ZIP-based formats (EPUB, DOCX, ODT) that stop a small upload
+// from expanding into gigabytes when read
+const (
+	maxZipEntries    = 10000
+	maxZipEntryBytes = 64 << 20
+	maxZipTotalBytes = 512 << 20
+	// maxZipRatio caps how far an entry may expand relative to its
+	// compressed size; text rarely compresses beyond 20:1
+	maxZipRatio = 200
+	// zipRatioMinBytes exempts small entries, which can legitimately have
+	// extreme ratios, from the ratio check
+	zipRatioMinBytes = 1 << 20
+)
+
+// Kinds of ArchiveError
+const (
+	ArchiveMalformed     = "malformed_archive"
+	ArchiveTooManyFiles  = "too_many_entries"
+	ArchiveEntryTooLarge = "entry_too_large"
+	ArchiveTooLarge      = "archive_too_large"
+	ArchiveCompression   = "suspicious_compression"
+	ArchiveMissingEntry  = "missing_entry"
+)
+
+// ErrInvalidArchive is matched by every ArchiveError
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// ArchiveError reports a ZIP-based upload that is corrupt or would expand
+// beyond the archive limits
+type ArchiveError struct {
+	Kind  string `json:"code"`
+	Entry string `json:"entry,omitempty"`
+	// Detail is a human-readable description of the problem
+	Detail string `json:"error"`
+	Err    error  `json:"-"`
+}
+
+func (e *ArchiveError) Error() string {
+	msg := "invalid archive"
+	if e.Entry != "" {
+		msg += fmt.Sprintf(" (entry %s)", e.Entry)
+	}
+	msg += ": " + e.Detail
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ArchiveError) Is(target error) bool {
+	return target == ErrInvalidArchive
+}
+
+// openZip opens a ZIP archive and checks it against the archive limits
+func openZip(path string) (*zip.ReadCloser, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, &ArchiveError{Kind: ArchiveMalformed, Detail: "not a readable ZIP file", Err: err}
+	}
+	if err := checkZipArchive(&archive.Reader); err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return archive, nil
+}
+
+// checkZipArchive rejects archives whose declared sizes exceed the limits.
+// Declared sizes can lie, so readZipFile enforces the limits again while
+// decompressing.
+func checkZipArchive(archive *zip.Reader) error {
+	if len(archive.File) > maxZipEntries {
+		return &ArchiveError{Kind: ArchiveTooManyFiles, Detail: fmt.Sprintf("more than %d entries", maxZipEntries)}
+	}
+
+	var total uint64
+	for _, file := range archive.File {
+		size := file.UncompressedSize64
+		if size > maxZipEntryBytes {
+			return &ArchiveError{Kind: ArchiveEntryTooLarge, Entry: file.Name, Detail: fmt.Sprintf("expands to more than %d bytes", maxZipEntryBytes)}
+		}
+		if size >= zipRatioMinBytes && size > file.CompressedSize64*maxZipRatio {
+			return &ArchiveError{Kind: ArchiveCompression, Entry: file.Name, Detail: fmt.Sprintf("compression ratio exceeds %d:1", maxZipRatio)}
+		}
+		total += size
+		if total > maxZipTotalBytes {
+			return &ArchiveError{Kind: ArchiveTooLarge, Detail: fmt.Sprintf("expands to more than %d bytes", maxZipTotalBytes)}
+		}
+	}
+	return nil
+}
+
+// readZipFile decompresses an archive entry, failing once it passes the
+// entry size limit whatever size its header declares
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, &ArchiveError{Kind: ArchiveMalformed, Entry: file.Name, Detail: "cannot open entry", Err: err}
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxZipEntryBytes+1))
+	if err != nil {
+		return nil, &ArchiveError{Kind: ArchiveMalformed, Entry: file.Name, Detail: "cannot decompress entry", Err: err}
+	}
+	if len(data) > maxZipEntryBytes {
+		return nil, &ArchiveError{Kind: ArchiveEntryTooLarge, Entry: file.Name, Detail: fmt.Sprintf("expands to more than %d bytes", maxZipEntryBytes)}
+	}
+	return data, nil
+}
+
+// readZipEntry returns the contents of a named entry in a ZIP archive
+func readZipEntry(archive *zip.Reader, name string) ([]byte, error) {
+	for _, file := range archive.File {
+		if file.Name == name {
+			return readZipFile(file)
+		}
+	}
+	return nil, &ArchiveError{Kind: ArchiveMissingEntry, Entry: name, Detail: "required entry not found"}
+}
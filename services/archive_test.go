@@ -0,0 +1,83 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeZipBomb writes an EPUB whose content entry is megabytes of zeros,
+// which deflate shrinks by a factor of about a thousand
+func writeZipBomb(t *testing.T, path string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	mimetype, _ := w.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	mimetype.Write([]byte("application/epub+zip"))
+	bomb, _ := w.CreateHeader(&zip.FileHeader{Name: "OEBPS/chapter1.xhtml", Method: zip.Deflate})
+	bomb.Write(make([]byte, 4<<20))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to write zip: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+}
+
+func TestDetectFormat_RejectsZipBomb(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bomb.epub")
+	writeZipBomb(t, path)
+
+	_, err := DetectFileFormat(path)
+
+	var archiveErr *ArchiveError
+	if !errors.As(err, &archiveErr) {
+		t.Fatalf("Expected ArchiveError, got %v", err)
+	}
+	if archiveErr.Kind != ArchiveCompression || archiveErr.Entry != "OEBPS/chapter1.xhtml" {
+		t.Errorf("Unexpected archive error %+v", archiveErr)
+	}
+	if !errors.Is(err, ErrInvalidArchive) {
+		t.Error("Expected error to match ErrInvalidArchive")
+	}
+}
+
+func TestReadNovel_RejectsZipBomb(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "bomb.epub")
+	writeZipBomb(t, path)
+
+	ns := NewNovelService(tempDir)
+	_, err := ns.ReadNovel(path)
+	if !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("Expected ErrInvalidArchive, got %v", err)
+	}
+}
+
+func TestDetectFormat_MalformedArchive(t *testing.T) {
+	data := []byte("PK\x03\x04 this is not really a zip file")
+	_, err := DetectFormat("broken.epub", "", bytes.NewReader(data), int64(len(data)))
+
+	var archiveErr *ArchiveError
+	if !errors.As(err, &archiveErr) || archiveErr.Kind != ArchiveMalformed {
+		t.Errorf("Expected malformed archive error, got %v", err)
+	}
+}
+
+func TestReadNovel_MissingArchiveEntry(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "empty.docx")
+	writeTestZip(t, path, [][2]string{{"[Content_Types].xml", "<Types/>"}})
+
+	ns := NewNovelService(tempDir)
+	_, err := ns.ReadNovel(path)
+
+	var archiveErr *ArchiveError
+	if !errors.As(err, &archiveErr) || archiveErr.Kind != ArchiveMissingEntry || archiveErr.Entry != "word/document.xml" {
+		t.Errorf("Expected missing entry error, got %v", err)
+	}
+}
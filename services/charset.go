@@ -0,0 +1,125 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Canonical names reported for detected encodings
+const (
+	CharsetUTF8        = "utf-8"
+	CharsetUTF16LE     = "utf-16le"
+	CharsetUTF16BE     = "utf-16be"
+	CharsetWindows1252 = "windows-1252"
+	CharsetISO88591    = "iso-8859-1"
+)
+
+// DetectCharset guesses the character encoding of raw text. A byte order mark
+// wins outright; otherwise UTF-16 is recognised by its zero bytes, valid UTF-8
+// is taken as UTF-8, and anything else is treated as a single-byte Western
+// encoding (Windows-1252 when it uses the 0x80-0x9F range, Latin-1 otherwise).
+func DetectCharset(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return CharsetUTF8
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return CharsetUTF16LE
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return CharsetUTF16BE
+	}
+
+	if charset := detectUTF16(data); charset != "" {
+		return charset
+	}
+
+	if utf8.Valid(data) {
+		return CharsetUTF8
+	}
+
+	for _, b := range data {
+		if b >= 0x80 && b <= 0x9F {
+			return CharsetWindows1252
+		}
+	}
+	return CharsetISO88591
+}
+
+// detectUTF16 spots BOM-less UTF-16 text, which for Western languages has a
+// zero in almost every other byte
+func detectUTF16(data []byte) string {
+	// Only look at the start of large files
+	if len(data) > 4096 {
+		data = data[:4096]
+	}
+	pairs := len(data) / 2
+	if pairs < 2 {
+		return ""
+	}
+
+	var evenZeros, oddZeros int
+	for i := 0; i+1 < len(data); i += 2 {
+		if data[i] == 0 {
+			evenZeros++
+		}
+		if data[i+1] == 0 {
+			oddZeros++
+		}
+	}
+
+	switch {
+	case oddZeros*10 >= pairs*7 && evenZeros*10 <= pairs:
+		return CharsetUTF16LE
+	case evenZeros*10 >= pairs*7 && oddZeros*10 <= pairs:
+		return CharsetUTF16BE
+	}
+	return ""
+}
+
+// lookupCharset resolves a charset label to an encoding and its canonical name
+func lookupCharset(label string) (encoding.Encoding, string, error) {
+	switch strings.ToLower(strings.TrimSpace(label)) {
+	case "utf-8", "utf8":
+		return unicode.UTF8, CharsetUTF8, nil
+	case "utf-16le", "utf-16":
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), CharsetUTF16LE, nil
+	case "utf-16be":
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), CharsetUTF16BE, nil
+	case "windows-1252", "cp1252":
+		return charmap.Windows1252, CharsetWindows1252, nil
+	case "iso-8859-1", "latin1", "latin-1":
+		return charmap.ISO8859_1, CharsetISO88591, nil
+	}
+
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported charset %q", label)
+	}
+	name, err := htmlindex.Name(enc)
+	if err != nil {
+		name = strings.ToLower(label)
+	}
+	return enc, name, nil
+}
+
+// DecodeText converts raw text in the named charset to UTF-8, dropping any
+// byte order mark. It returns the canonical name of the charset used.
+func DecodeText(data []byte, charset string) (string, string, error) {
+	enc, name, err := lookupCharset(charset)
+	if err != nil {
+		return "", "", err
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode %s text: %v", name, err)
+	}
+
+	return strings.TrimPrefix(string(decoded), "\uFEFF"), name, nil
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectCharset(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{
+			name:     "Plain ASCII",
+			data:     []byte("It was a dark and stormy night."),
+			expected: CharsetUTF8,
+		},
+		{
+			name:     "UTF-8 with BOM",
+			data:     []byte("\xEF\xBB\xBFCaf\xC3\xA9"),
+			expected: CharsetUTF8,
+		},
+		{
+			name:     "UTF-16LE with BOM",
+			data:     []byte{0xFF, 0xFE, 'H', 0, 'i', 0},
+			expected: CharsetUTF16LE,
+		},
+		{
+			name:     "UTF-16BE with BOM",
+			data:     []byte{0xFE, 0xFF, 0, 'H', 0, 'i'},
+			expected: CharsetUTF16BE,
+		},
+		{
+			name:     "UTF-16LE without BOM",
+			data:     []byte{'C', 0, 'h', 0, 'a', 0, 'p', 0, 't', 0, 'e', 0, 'r', 0},
+			expected: CharsetUTF16LE,
+		},
+		{
+			name:     "Windows-1252 smart quotes",
+			data:     []byte("\x93Hello,\x94 she said."),
+			expected: CharsetWindows1252,
+		},
+		{
+			name:     "Latin-1 accents",
+			data:     []byte("Caf\xE9 au lait"),
+			expected: CharsetISO88591,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := DetectCharset(tt.data); result != tt.expected {
+				t.Errorf("DetectCharset() = %s, want %s", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		charset      string
+		expected     string
+		expectedName string
+	}{
+		{
+			name:         "Windows-1252 smart quotes",
+			data:         []byte("\x93Hello,\x94 she said."),
+			charset:      "windows-1252",
+			expected:     "“Hello,” she said.",
+			expectedName: CharsetWindows1252,
+		},
+		{
+			name:         "Latin-1 alias",
+			data:         []byte("Caf\xE9"),
+			charset:      "latin1",
+			expected:     "Café",
+			expectedName: CharsetISO88591,
+		},
+		{
+			name:         "UTF-16LE strips BOM",
+			data:         []byte{0xFF, 0xFE, 'H', 0, 'i', 0},
+			charset:      "utf-16le",
+			expected:     "Hi",
+			expectedName: CharsetUTF16LE,
+		},
+		{
+			name:         "UTF-8 strips BOM",
+			data:         []byte("\xEF\xBB\xBFCaf\xC3\xA9"),
+			charset:      "UTF-8",
+			expected:     "Café",
+			expectedName: CharsetUTF8,
+		},
+		{
+			name:         "Other WHATWG label",
+			data:         []byte{0xC1, 0xE1},
+			charset:      "koi8-r",
+			expected:     "аА",
+			expectedName: "koi8-r",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, name, err := DecodeText(tt.data, tt.charset)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("DecodeText() = %q, want %q", result, tt.expected)
+			}
+			if name != tt.expectedName {
+				t.Errorf("Expected charset name %s, got %s", tt.expectedName, name)
+			}
+		})
+	}
+}
+
+func TestDecodeText_UnsupportedCharset(t *testing.T) {
+	_, _, err := DecodeText([]byte("text"), "not-a-charset")
+	if err == nil {
+		t.Error("Expected an error for an unknown charset, got nil")
+	}
+}
+
+func TestNovelService_ReadNovelWithOptions_DetectsEncoding(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "gutenberg.txt")
+	if err := os.WriteFile(filePath, []byte("\x93Call me Ishmael.\x94"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	content, err := service.ReadNovelWithOptions(filePath, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if content.Encoding != CharsetWindows1252 {
+		t.Errorf("Expected encoding %s, got %s", CharsetWindows1252, content.Encoding)
+	}
+	if content.Text != "“Call me Ishmael.”" {
+		t.Errorf("Expected decoded text, got %q", content.Text)
+	}
+}
+
+func TestNovelService_ReadNovelWithOptions_CharsetOverride(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	// Valid UTF-8 bytes that the user knows are really Latin-1
+	filePath := filepath.Join(dir, "override.txt")
+	if err := os.WriteFile(filePath, []byte("\xC3\xA9"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	content, err := service.ReadNovelWithOptions(filePath, ReadOptions{Charset: "iso-8859-1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if content.Encoding != CharsetISO88591 {
+		t.Errorf("Expected encoding %s, got %s", CharsetISO88591, content.Encoding)
+	}
+	if content.Text != "Ã©" {
+		t.Errorf("Expected override to be honoured, got %q", content.Text)
+	}
+}
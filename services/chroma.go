@@ -1,23 +1,43 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ChromaService struct {
 	dbPath string
+	// mu serialises read-modify-write updates of the collection file
+	mu sync.Mutex
+	// contextWindow is how many neighbouring child chunks on each side of a
+	// match are returned. Zero returns the enclosing passage instead.
+	contextWindow int
+	metrics       *Metrics
 }
 
 type ChromaDocument struct {
-	ID    string    `json:"id"`
-	Text  string    `json:"text"`
-	Embed []float64 `json:"embed"`
+	ID       string    `json:"id"`
+	Text     string    `json:"text"`
+	Novel    string    `json:"novel,omitempty"`
+	Seq      int       `json:"seq"`
+	ParentID string    `json:"parentId,omitempty"`
+	Page     int       `json:"page,omitempty"`
+	EndPage  int       `json:"endPage,omitempty"`
+	Embed    []float64 `json:"embed"`
+	// Owner is the user who uploaded the novel, or zero for the shared
+	// library
+	Owner int64 `json:"owner,omitempty"`
 }
 
 func NewChromaService(dbPath string) *ChromaService {
@@ -25,11 +45,29 @@ func NewChromaService(dbPath string) *ChromaService {
 	return &ChromaService{dbPath: dbPath}
 }
 
+// SetContextWindow sets how many neighbouring child chunks on each side of a
+// matching child are returned by Query. Zero (the default) returns the whole
+// enclosing passage.
+func (cs *ChromaService) SetContextWindow(n int) {
+	if n < 0 {
+		n = 0
+	}
+	cs.contextWindow = n
+}
+
+// SetMetrics records query latency and scores to m
+func (cs *ChromaService) SetMetrics(m *Metrics) {
+	cs.metrics = m
+}
+
 func (cs *ChromaService) getCollectionPath() string {
 	return filepath.Join(cs.dbPath, "documents.json")
 }
 
 func (cs *ChromaService) AddDocuments(chunks []NovelChunk) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
 	docs := []ChromaDocument{}
 
 	// Load existing documents
@@ -38,54 +76,383 @@ func (cs *ChromaService) AddDocuments(chunks []NovelChunk) error {
 	}
 
 	// Add new chunks
-	for _, chunk := range chunks {
+	docs = append(docs, cs.EmbedChunks(chunks, nil)...)
+
+	return cs.saveDocuments(docs)
+}
+
+// EmbedChunks turns chunks into documents ready for indexing, calling
+// progress, when set, after each one is embedded
+func (cs *ChromaService) EmbedChunks(chunks []NovelChunk, progress func(done, total int)) []ChromaDocument {
+	docs := make([]ChromaDocument, 0, len(chunks))
+	for i, chunk := range chunks {
 		docs = append(docs, ChromaDocument{
-			ID:    chunk.ID,
-			Text:  chunk.Text,
-			Embed: cs.generateDummyEmbedding(), // In real app, use actual embedding
+			ID:       chunk.ID,
+			Text:     chunk.Text,
+			Novel:    chunk.Novel,
+			Seq:      chunk.Seq,
+			ParentID: chunk.ParentID,
+			Page:     chunk.Page,
+			EndPage:  chunk.EndPage,
+			Embed:    cs.generateDummyEmbedding(), // In real app, use actual embedding
 		})
+		if progress != nil {
+			progress(i+1, len(chunks))
+		}
 	}
+	return docs
+}
 
-	data, err := json.Marshal(docs)
-	if err != nil {
-		return err
+// ReplaceNovel indexes the documents for a novel, dropping any already
+// stored for it so re-ingesting a file doesn't duplicate its chunks
+func (cs *ChromaService) ReplaceNovel(novel string, newDocs []ChromaDocument) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	docs := []ChromaDocument{}
+	if data, err := os.ReadFile(cs.getCollectionPath()); err == nil {
+		json.Unmarshal(data, &docs)
+	}
+
+	kept := docs[:0]
+	for _, doc := range docs {
+		if doc.Novel != novel {
+			kept = append(kept, doc)
+		}
 	}
 
-	return os.WriteFile(cs.getCollectionPath(), data, 0644)
+	return cs.saveDocuments(append(kept, newDocs...))
+}
+
+// DeleteNovel removes every document indexed for a novel
+func (cs *ChromaService) DeleteNovel(novel string) error {
+	return cs.ReplaceNovel(novel, nil)
 }
 
-func (cs *ChromaService) Query(question string, nResults int) (string, error) {
+// Documents returns the indexed documents of a novel, or of every novel when
+// novel is empty
+func (cs *ChromaService) Documents(novel string) ([]ChromaDocument, error) {
 	data, err := os.ReadFile(cs.getCollectionPath())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var docs []ChromaDocument
 	if err := json.Unmarshal(data, &docs); err != nil {
+		return nil, err
+	}
+	if novel == "" {
+		return docs, nil
+	}
+
+	kept := docs[:0]
+	for _, doc := range docs {
+		if doc.Novel == novel {
+			kept = append(kept, doc)
+		}
+	}
+	return kept, nil
+}
+
+// IndexStats summarises the index
+type IndexStats struct {
+	Novels int `json:"novels"`
+	// Chunks counts passages and Documents every indexed document,
+	// including child chunks
+	Chunks    int   `json:"chunks"`
+	Documents int   `json:"documents"`
+	SizeBytes int64 `json:"sizeBytes"`
+}
+
+// Stats loads the index and summarises it, failing if it can't be read
+func (cs *ChromaService) Stats() (IndexStats, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var stats IndexStats
+	info, err := os.Stat(cs.getCollectionPath())
+	if err != nil {
+		return stats, err
+	}
+	stats.SizeBytes = info.Size()
+
+	docs, err := cs.Documents("")
+	if err != nil {
+		return stats, err
+	}
+	novels := make(map[string]bool)
+	for _, doc := range docs {
+		if doc.ParentID == "" {
+			stats.Chunks++
+		}
+		if doc.Novel != "" {
+			novels[doc.Novel] = true
+		}
+	}
+	stats.Novels = len(novels)
+	stats.Documents = len(docs)
+	return stats, nil
+}
+
+// IndexedNovels returns the number of passages indexed for each novel, not
+// counting child chunks
+func (cs *ChromaService) IndexedNovels() (map[string]int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	docs := []ChromaDocument{}
+	data, err := os.ReadFile(cs.getCollectionPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &docs); err != nil {
+			return nil, err
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, doc := range docs {
+		if doc.Novel != "" && doc.ParentID == "" {
+			counts[doc.Novel]++
+		}
+	}
+	return counts, nil
+}
+
+// saveDocuments writes the collection atomically so readers never see a
+// partly written collection
+func (cs *ChromaService) saveDocuments(docs []ChromaDocument) error {
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(cs.getCollectionPath(), data, 0644)
+}
+
+// Query returns context for a question from the documents access allows
+func (cs *ChromaService) Query(question string, nResults int, access Access) (string, error) {
+	return cs.QueryNovel(question, nResults, "", access)
+}
+
+// QueryNovel is Query restricted to the documents of one novel, or across
+// all novels when novel is empty
+func (cs *ChromaService) QueryNovel(question string, nResults int, novel string, access Access) (string, error) {
+	result, err := cs.Search(context.Background(), question, nResults, novel, access)
+	if err != nil {
 		return "", err
 	}
+	return result.Context, nil
+}
+
+// SearchResult is the context retrieved for a question along with where it
+// came from
+type SearchResult struct {
+	Context string
+	// IDs are the documents the context was taken from, in order
+	IDs []string
+	// Passages are where each passage of the context came from, in order
+	Passages []Passage
+	// TopScore scores the best passage from 0 to 1, and Matched says
+	// whether any passage matched the question rather than being a fallback
+	TopScore float64
+	Matched  bool
+}
+
+// Passage is the source of one passage of context. Page and EndPage are
+// the pages it spans, and are zero for novels without pages.
+type Passage struct {
+	Novel   string `json:"novel"`
+	Page    int    `json:"page,omitempty"`
+	EndPage int    `json:"endPage,omitempty"`
+}
+
+// passageOf describes the passage made from docs, which all come from one
+// novel
+func passageOf(docs []ChromaDocument) Passage {
+	passage := Passage{Novel: docs[0].Novel}
+	for _, doc := range docs {
+		if doc.Page == 0 {
+			continue
+		}
+		if passage.Page == 0 || doc.Page < passage.Page {
+			passage.Page = doc.Page
+		}
+		passage.EndPage = max(passage.EndPage, doc.EndPage)
+	}
+	return passage
+}
+
+// Search is QueryNovel reporting which documents the context came from,
+// traced as a child of any span in ctx. Documents access doesn't allow are
+// dropped before matching, so they can't be matched, expanded into or
+// returned as fallback context.
+func (cs *ChromaService) Search(ctx context.Context, question string, nResults int, novel string, access Access) (*SearchResult, error) {
+	_, span := tracer.Start(ctx, "chroma.query", trace.WithAttributes(
+		attribute.String("retrieval.novel", novel),
+		attribute.Int("retrieval.results_requested", nResults),
+	))
+	start := time.Now()
+	docs, err := cs.Documents(novel)
+	if err != nil {
+		endSpan(span, err)
+		cs.metrics.Error(CauseRetrieval)
+		return nil, err
+	}
+	docs = access.filter(docs)
+
+	// Passages that have been split into children are only ever returned as
+	// context for a matching child, never matched directly
+	byID := make(map[string]ChromaDocument, len(docs))
+	hasChildren := make(map[string]bool)
+	siblings := make(map[string]map[int]ChromaDocument)
+	for _, doc := range docs {
+		byID[doc.ID] = doc
+		if doc.ParentID != "" {
+			hasChildren[doc.ParentID] = true
+			if siblings[doc.Novel] == nil {
+				siblings[doc.Novel] = make(map[int]ChromaDocument)
+			}
+			siblings[doc.Novel][doc.Seq] = doc
+		}
+	}
 
 	// Simple keyword matching (in real app, use vector similarity)
-	var results []string
+	var results, ids []string
+	var passages []Passage
+	seen := make(map[string]bool)
 	questionLower := strings.ToLower(question)
 
 	for _, doc := range docs {
 		if len(results) >= nResults {
 			break
 		}
+		if hasChildren[doc.ID] || seen[docKey(doc)] {
+			continue
+		}
 		if strings.Contains(strings.ToLower(doc.Text), questionLower) {
-			results = append(results, doc.Text)
+			if text, from := cs.expandMatch(doc, byID, siblings, seen); text != "" {
+				results = append(results, text)
+				for _, source := range from {
+					ids = append(ids, source.ID)
+				}
+				passages = append(passages, passageOf(from))
+			}
 		}
 	}
 
-	// If no matches found, return first few documents
-	if len(results) == 0 && len(docs) > 0 {
-		for i := 0; i < nResults && i < len(docs); i++ {
-			results = append(results, docs[i].Text)
+	// An exact match scores 1; the fallback passages are scored by how many
+	// of the question's words they contain
+	topScore := 1.0
+	matched := len(results) > 0
+
+	// If no matches found, return first few passages
+	if !matched && len(docs) > 0 {
+		topScore = 0
+		for _, doc := range docs {
+			if len(results) >= nResults {
+				break
+			}
+			if doc.ParentID == "" {
+				results = append(results, doc.Text)
+				ids = append(ids, doc.ID)
+				passages = append(passages, passageOf([]ChromaDocument{doc}))
+				topScore = max(topScore, termOverlap(questionLower, doc.Text))
+			}
 		}
 	}
 
-	return strings.Join(results, "\n\n"), nil
+	if len(results) == 0 {
+		topScore = 0
+	}
+	cs.metrics.ObserveRetrieval(time.Since(start), topScore, len(results) > 0)
+	span.SetAttributes(
+		attribute.Int("retrieval.documents", len(docs)),
+		attribute.Int("retrieval.hits", len(ids)),
+		attribute.StringSlice("retrieval.chunk_ids", ids),
+		attribute.Bool("retrieval.matched", matched),
+		attribute.Float64("retrieval.top_score", topScore),
+	)
+	span.End()
+	return &SearchResult{
+		Context:  strings.Join(results, "\n\n"),
+		IDs:      ids,
+		Passages: passages,
+		TopScore: topScore,
+		Matched:  matched,
+	}, nil
+}
+
+// termOverlap is the share of the distinct words in question that appear in
+// text
+func termOverlap(question, text string) float64 {
+	isSeparator := func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }
+	terms := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(question), isSeparator) {
+		terms[word] = true
+	}
+	if len(terms) == 0 {
+		return 0
+	}
+
+	found := 0
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), isSeparator) {
+		if terms[word] {
+			found++
+			delete(terms, word)
+		}
+	}
+	return float64(found) / float64(found+len(terms))
+}
+
+// expandMatch turns a matching document into the context returned for it:
+// the enclosing passage for a child chunk, or a window of neighbouring
+// children when a context window is set, along with the documents it was
+// taken from. Documents already covered by an earlier
+// match are recorded in seen and yield an empty string.
+func (cs *ChromaService) expandMatch(doc ChromaDocument, byID map[string]ChromaDocument, siblings map[string]map[int]ChromaDocument, seen map[string]bool) (string, []ChromaDocument) {
+	if doc.ParentID == "" {
+		seen[docKey(doc)] = true
+		return doc.Text, []ChromaDocument{doc}
+	}
+
+	if cs.contextWindow == 0 {
+		parent, ok := byID[doc.ParentID]
+		if !ok {
+			seen[docKey(doc)] = true
+			return doc.Text, []ChromaDocument{doc}
+		}
+		if seen[docKey(parent)] {
+			return "", nil
+		}
+		seen[docKey(parent)] = true
+		// Mark the passage's children so they don't match again
+		for _, child := range siblings[doc.Novel] {
+			if child.ParentID == parent.ID {
+				seen[docKey(child)] = true
+			}
+		}
+		return parent.Text, []ChromaDocument{parent}
+	}
+
+	var window []string
+	var from []ChromaDocument
+	for seq := doc.Seq - cs.contextWindow; seq <= doc.Seq+cs.contextWindow; seq++ {
+		neighbour, ok := siblings[doc.Novel][seq]
+		if !ok {
+			continue
+		}
+		seen[docKey(neighbour)] = true
+		window = append(window, neighbour.Text)
+		from = append(from, neighbour)
+	}
+	return strings.Join(window, " "), from
+}
+
+// docKey identifies a document across novels whose chunk IDs may collide
+func docKey(doc ChromaDocument) string {
+	return doc.Novel + "#" + doc.ID
 }
 
 // Dummy embedding generation (replace with real sentence transformer)
@@ -104,8 +471,8 @@ func (cs *ChromaService) Initialize() {
 		docs := []ChromaDocument{}
 		data, _ := json.Marshal(docs)
 		os.WriteFile(cs.getCollectionPath(), data, 0644)
-		log.Println("📁 Created new ChromaDB collection")
+		slog.Info("Created new ChromaDB collection", "path", cs.getCollectionPath())
 	} else {
-		log.Println("🔁 Using existing ChromaDB collection")
+		slog.Debug("Using existing ChromaDB collection", "path", cs.getCollectionPath())
 	}
 }
@@ -1,11 +1,15 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewChromaService(t *testing.T) {
@@ -192,7 +196,7 @@ func TestChromaService_Query_WithMatches(t *testing.T) {
 	service.AddDocuments(chunks)
 
 	// Query for "brown"
-	result, err := service.Query("brown", 2)
+	result, err := service.Query("brown", 2, FullAccess)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -227,7 +231,7 @@ func TestChromaService_Query_NoMatches(t *testing.T) {
 	service.AddDocuments(chunks)
 
 	// Query for non-existent term
-	result, err := service.Query("purple", 2)
+	result, err := service.Query("purple", 2, FullAccess)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -251,7 +255,7 @@ func TestChromaService_Query_EmptyCollection(t *testing.T) {
 	// Initialize empty collection
 	service.Initialize()
 
-	result, err := service.Query("test", 2)
+	result, err := service.Query("test", 2, FullAccess)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -268,7 +272,7 @@ func TestChromaService_Query_NonExistentCollection(t *testing.T) {
 
 	// Don't initialize collection
 
-	_, err := service.Query("test", 2)
+	_, err := service.Query("test", 2, FullAccess)
 	if err == nil {
 		t.Error("Expected error for non-existent collection")
 	}
@@ -310,7 +314,7 @@ func TestChromaService_Query_LimitResults(t *testing.T) {
 	service.AddDocuments(chunks)
 
 	// Query with limit of 3
-	result, err := service.Query("test", 3)
+	result, err := service.Query("test", 3, FullAccess)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -320,3 +324,247 @@ func TestChromaService_Query_LimitResults(t *testing.T) {
 		t.Errorf("Expected exactly 3 results, got %d", len(lines))
 	}
 }
+
+func addParentChildFixture(t *testing.T, service *ChromaService) {
+	t.Helper()
+
+	novels := NewNovelService("test_novels")
+	defer os.RemoveAll("test_novels")
+
+	passages := []NovelChunk{
+		{ID: "book.txt-0", Text: "The ship left at dawn. The captain was nervous. Gulls circled the mast.", Novel: "book.txt", Seq: 0},
+		{ID: "book.txt-1", Text: "A storm rose at noon. The sailors hid the lantern. Night fell quickly.", Novel: "book.txt", Seq: 1},
+	}
+	children := novels.SplitChildren(passages)
+
+	if err := service.AddDocuments(append(passages, children...)); err != nil {
+		t.Fatalf("Failed to add documents: %v", err)
+	}
+}
+
+func TestChromaService_Query_ReturnsParentPassage(t *testing.T) {
+	dbPath := "test_chroma_db"
+	service := NewChromaService(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	service.Initialize()
+	addParentChildFixture(t, service)
+
+	result, err := service.Query("lantern", 2, FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := "A storm rose at noon. The sailors hid the lantern. Night fell quickly."
+	if result != expected {
+		t.Errorf("Expected enclosing passage %q, got %q", expected, result)
+	}
+}
+
+func TestChromaService_Query_DeduplicatesParents(t *testing.T) {
+	dbPath := "test_chroma_db"
+	service := NewChromaService(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	service.Initialize()
+	addParentChildFixture(t, service)
+
+	// "the" matches several children of both passages
+	result, err := service.Query("the", 5, FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	parts := strings.Split(result, "\n\n")
+	if len(parts) != 2 {
+		t.Errorf("Expected each passage once, got %d results: %q", len(parts), result)
+	}
+}
+
+func TestChromaService_Query_ContextWindow(t *testing.T) {
+	dbPath := "test_chroma_db"
+	service := NewChromaService(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	service.Initialize()
+	service.SetContextWindow(1)
+	addParentChildFixture(t, service)
+
+	// The window crosses the passage boundary in reading order
+	result, err := service.Query("storm", 2, FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := "Gulls circled the mast. A storm rose at noon. The sailors hid the lantern."
+	if result != expected {
+		t.Errorf("Expected window %q, got %q", expected, result)
+	}
+}
+
+func TestChromaService_Query_FallbackUsesPassages(t *testing.T) {
+	dbPath := "test_chroma_db"
+	service := NewChromaService(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	service.Initialize()
+	addParentChildFixture(t, service)
+
+	result, err := service.Query("purple", 1, FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !strings.HasPrefix(result, "The ship left at dawn.") || strings.Contains(result, "storm") {
+		t.Errorf("Expected first passage as fallback, got %q", result)
+	}
+}
+
+func TestChromaService_ReplaceNovel(t *testing.T) {
+	dbPath := "test_chroma_db"
+	service := NewChromaService(dbPath)
+	defer os.RemoveAll(dbPath)
+
+	service.AddDocuments([]NovelChunk{
+		{ID: "emma.txt-0", Text: "old emma", Novel: "emma.txt"},
+		{ID: "persuasion.txt-0", Text: "persuasion", Novel: "persuasion.txt"},
+	})
+
+	var progress []int
+	docs := service.EmbedChunks([]NovelChunk{{ID: "emma.txt-0", Text: "new emma", Novel: "emma.txt"}}, func(done, total int) {
+		progress = append(progress, done, total)
+	})
+	if len(progress) != 2 || progress[0] != 1 || progress[1] != 1 {
+		t.Errorf("Expected progress 1/1, got %v", progress)
+	}
+
+	if err := service.ReplaceNovel("emma.txt", docs); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	data, _ := os.ReadFile(service.getCollectionPath())
+	var stored []ChromaDocument
+	json.Unmarshal(data, &stored)
+
+	if len(stored) != 2 {
+		t.Fatalf("Expected 2 documents, got %d", len(stored))
+	}
+	for _, doc := range stored {
+		if doc.Text == "old emma" {
+			t.Error("Expected the old version of emma.txt to be replaced")
+		}
+	}
+}
+
+func TestChromaService_QueryNovel(t *testing.T) {
+	service := NewChromaService(t.TempDir())
+	service.AddDocuments([]NovelChunk{
+		{ID: "emma.txt-0", Text: "Emma was clever", Novel: "emma.txt"},
+		{ID: "persuasion.txt-0", Text: "Anne was clever", Novel: "persuasion.txt"},
+	})
+
+	context, err := service.QueryNovel("clever", 5, "persuasion.txt", FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if context != "Anne was clever" {
+		t.Errorf("Expected only persuasion.txt, got %q", context)
+	}
+
+	indexed, err := service.IndexedNovels()
+	if err != nil || len(indexed) != 2 || indexed["emma.txt"] != 1 {
+		t.Errorf("Expected one passage for each novel, got %v (%v)", indexed, err)
+	}
+}
+
+func TestChromaService_Stats(t *testing.T) {
+	service := NewChromaService(t.TempDir())
+	if _, err := service.Stats(); err == nil {
+		t.Error("Expected an error before the collection exists")
+	}
+
+	service.AddDocuments([]NovelChunk{
+		{ID: "emma.txt-0", Text: "Emma was clever", Novel: "emma.txt"},
+		{ID: "emma.txt-0-0", Text: "Emma", Novel: "emma.txt", ParentID: "emma.txt-0"},
+		{ID: "persuasion.txt-0", Text: "Anne was clever", Novel: "persuasion.txt"},
+	})
+
+	stats, err := service.Stats()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if stats.Novels != 2 || stats.Chunks != 2 || stats.Documents != 3 {
+		t.Errorf("Expected 2 novels, 2 chunks and 3 documents, got %+v", stats)
+	}
+	if stats.SizeBytes == 0 {
+		t.Error("Expected the index size to be reported")
+	}
+
+	os.WriteFile(service.getCollectionPath(), []byte("{not json"), 0644)
+	if _, err := service.Stats(); err == nil {
+		t.Error("Expected an error for a corrupt collection")
+	}
+}
+
+func TestChromaService_QueryNovel_RecordsScore(t *testing.T) {
+	service := NewChromaService(t.TempDir())
+	m := NewMetrics(prometheus.NewRegistry())
+	service.SetMetrics(m)
+	service.AddDocuments([]NovelChunk{{ID: "emma.txt-0", Text: "Emma was clever and rich", Novel: "emma.txt"}})
+
+	service.Query("clever", 1, FullAccess)
+	service.Query("was Emma poor?", 1, FullAccess)
+
+	if got := testutil.CollectAndCount(m.retrievalDuration); got != 1 {
+		t.Errorf("Expected retrieval latency to be recorded, got %d series", got)
+	}
+	if score := termOverlap("was emma poor?", "Emma was clever and rich"); score != 2.0/3 {
+		t.Errorf("Expected a score of 2/3, got %v", score)
+	}
+	if score := termOverlap("?", "Emma"); score != 0 {
+		t.Errorf("Expected a score of 0 for a question without words, got %v", score)
+	}
+}
+
+func TestChromaService_Search(t *testing.T) {
+	service := NewChromaService(t.TempDir())
+	service.AddDocuments([]NovelChunk{
+		{ID: "emma.txt-0", Text: "Emma was clever. Emma was rich.", Novel: "emma.txt"},
+		{ID: "emma.txt-0-0", Text: "Emma was clever.", Novel: "emma.txt", ParentID: "emma.txt-0"},
+		{ID: "emma.txt-0-1", Text: "Emma was rich.", Novel: "emma.txt", ParentID: "emma.txt-0", Seq: 1},
+	})
+
+	result, err := service.Search(context.Background(), "rich", 2, "", FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// The matching child is returned as its passage
+	if !result.Matched || len(result.IDs) != 1 || result.IDs[0] != "emma.txt-0" || result.TopScore != 1 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	result, _ = service.Search(context.Background(), "poor", 2, "", FullAccess)
+	if result.Matched || len(result.IDs) != 1 || result.TopScore != 0 {
+		t.Errorf("Expected an unscored fallback passage, got %+v", result)
+	}
+}
+
+func TestChromaService_Search_Traced(t *testing.T) {
+	service := NewChromaService(t.TempDir())
+	service.AddDocuments([]NovelChunk{{ID: "emma.txt-0", Text: "Emma was rich.", Novel: "emma.txt"}})
+
+	ctx, root := traceRoot(t)
+	service.Search(ctx, "rich", 2, "", FullAccess)
+	root.End()
+
+	span, ok := tracedSpans(root)["chroma.query"]
+	if !ok {
+		t.Fatal("Expected a chroma.query span")
+	}
+	if hits := spanAttr(span, "retrieval.hits").AsInt64(); hits != 1 {
+		t.Errorf("Expected 1 hit, got %d", hits)
+	}
+	if ids := spanAttr(span, "retrieval.chunk_ids").AsStringSlice(); len(ids) != 1 || ids[0] != "emma.txt-0" {
+		t.Errorf("Expected chunk IDs [emma.txt-0], got %v", ids)
+	}
+}
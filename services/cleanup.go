@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	gutenbergStart = regexp.MustCompile(`(?i)\*{3}\s*START OF (THE|THIS) PROJECT GUTENBERG E-?BOOK[^*]*\*{3}`)
+	gutenbergEnd   = regexp.MustCompile(`(?i)\*{3}\s*END OF (THE|THIS) PROJECT GUTENBERG E-?BOOK[^*]*\*{3}`)
+	// The "End of the Project Gutenberg EBook of ..." line that precedes the footer marker
+	gutenbergEndLine = regexp.MustCompile(`(?im)^[ \t]*End of (the )?Project Gutenberg('s)?\b[^\n]*$`)
+	producerCredits  = regexp.MustCompile(`(?is)^\s*((produced|prepared|transcribed) by|e-?text prepared by)\b.*?(\n[ \t]*\n|\z)`)
+	transcriberBlock = regexp.MustCompile(`(?is)\[\s*transcriber['’]?s?\s+notes?\b.*?\]`)
+	transcriberPara  = regexp.MustCompile(`(?ims)^[ \t]*transcriber['’]?s?\s+notes?\b.*?(\n[ \t]*\n|\z)`)
+	contentsHeading  = regexp.MustCompile(`(?i)^\s*(table of )?contents\.?\s*$`)
+)
+
+// tocScanLimit bounds how far into a book a table of contents is looked for
+const tocScanLimit = 1000
+
+// StripBoilerplate removes Project Gutenberg licence headers and footers,
+// producer credits, tables of contents and transcriber notes from a novel's
+// text. It returns the cleaned text and a description of each section removed.
+func StripBoilerplate(text string) (string, []string) {
+	var stripped []string
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	if loc := gutenbergStart.FindStringIndex(text); loc != nil {
+		stripped = append(stripped, describeStripped("Project Gutenberg header", text[:loc[1]]))
+		text = text[loc[1]:]
+
+		if loc := producerCredits.FindStringIndex(text); loc != nil {
+			stripped = append(stripped, describeStripped("producer credits", text[:loc[1]]))
+			text = text[loc[1]:]
+		}
+	}
+
+	if loc := gutenbergEnd.FindStringIndex(text); loc != nil {
+		cut := loc[0]
+		if lines := gutenbergEndLine.FindAllStringIndex(text[:cut], -1); len(lines) > 0 {
+			cut = lines[len(lines)-1][0]
+		}
+		stripped = append(stripped, describeStripped("Project Gutenberg licence footer", text[cut:]))
+		text = text[:cut]
+	}
+
+	for _, re := range []*regexp.Regexp{transcriberBlock, transcriberPara} {
+		text = re.ReplaceAllStringFunc(text, func(note string) string {
+			stripped = append(stripped, describeStripped("transcriber's note", note))
+			return "\n"
+		})
+	}
+
+	if cleaned, toc := stripTableOfContents(text); toc != "" {
+		stripped = append(stripped, describeStripped("table of contents", toc))
+		text = cleaned
+	}
+
+	return strings.TrimSpace(text), stripped
+}
+
+// stripTableOfContents removes a "Contents" heading and the entries under it.
+// The list ends at a gap of two or more blank lines, at a line repeating the
+// first entry (the chapter heading itself), or at a line of prose.
+func stripTableOfContents(text string) (string, string) {
+	lines := strings.Split(text, "\n")
+
+	heading := -1
+	for i := 0; i < len(lines) && i < tocScanLimit; i++ {
+		if contentsHeading.MatchString(lines[i]) {
+			heading = i
+			break
+		}
+	}
+	if heading < 0 {
+		return text, ""
+	}
+
+	end := len(lines)
+	firstEntry := ""
+	entries := 0
+	blanks := 0
+	for i := heading + 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			blanks++
+			if entries > 0 && blanks >= 2 {
+				end = i
+				break
+			}
+			continue
+		}
+		blanks = 0
+
+		key := tocEntryKey(line)
+		if len(line) > 100 || (entries > 0 && key == firstEntry) {
+			end = i
+			break
+		}
+		if entries == 0 {
+			firstEntry = key
+		}
+		entries++
+	}
+	if entries == 0 {
+		return text, ""
+	}
+
+	toc := strings.Join(lines[heading:end], "\n")
+	rest := append(lines[:heading:heading], lines[end:]...)
+	return strings.Join(rest, "\n"), toc
+}
+
+// tocEntryKey reduces a table of contents line to its leading words, so
+// "CHAPTER I.   Down the Rabbit-Hole" and the later "CHAPTER I." heading match
+func tocEntryKey(line string) string {
+	words := strings.Fields(strings.ToUpper(line))
+	if len(words) > 2 {
+		words = words[:2]
+	}
+	return strings.Join(words, " ")
+}
+
+// describeStripped summarises a removed section for upload reports
+func describeStripped(what, section string) string {
+	lines := strings.Count(strings.TrimSpace(section), "\n") + 1
+	if lines == 1 {
+		return fmt.Sprintf("%s (1 line)", what)
+	}
+	return fmt.Sprintf("%s (%d lines)", what, lines)
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const gutenbergFixture = `The Project Gutenberg eBook of Alice's Adventures in Wonderland
+
+This eBook is for the use of anyone anywhere in the United States and
+most other parts of the world at no cost and with almost no restrictions
+whatsoever.
+
+*** START OF THE PROJECT GUTENBERG EBOOK ALICE'S ADVENTURES IN WONDERLAND ***
+
+Produced by Arthur DiBianca and David Widger
+
+[Transcriber's Note: Obvious printing errors have been corrected.]
+
+Contents
+
+ CHAPTER I.     Down the Rabbit-Hole
+ CHAPTER II.    The Pool of Tears
+
+
+CHAPTER I.
+Down the Rabbit-Hole
+
+Alice was beginning to get very tired of sitting by her sister on the bank.
+
+CHAPTER II.
+The Pool of Tears
+
+"Curiouser and curiouser!" cried Alice.
+
+End of the Project Gutenberg EBook of Alice's Adventures in Wonderland
+
+*** END OF THE PROJECT GUTENBERG EBOOK ALICE'S ADVENTURES IN WONDERLAND ***
+
+Section 1. General Terms of Use and Redistributing Project Gutenberg-tm
+electronic works
+`
+
+func TestStripBoilerplate_Gutenberg(t *testing.T) {
+	text, stripped := StripBoilerplate(gutenbergFixture)
+
+	for _, unwanted := range []string{"Project Gutenberg", "Produced by", "Transcriber", "Contents", "Section 1."} {
+		if strings.Contains(text, unwanted) {
+			t.Errorf("Expected %q to be stripped, got:\n%s", unwanted, text)
+		}
+	}
+
+	if !strings.HasPrefix(text, "CHAPTER I.\nDown the Rabbit-Hole") {
+		t.Errorf("Expected text to start at the first chapter, got:\n%s", text)
+	}
+	if !strings.HasSuffix(text, `"Curiouser and curiouser!" cried Alice.`) {
+		t.Errorf("Expected text to end with the last paragraph, got:\n%s", text)
+	}
+
+	expected := []string{
+		"Project Gutenberg header",
+		"producer credits",
+		"Project Gutenberg licence footer",
+		"transcriber's note",
+		"table of contents (4 lines)",
+	}
+	if len(stripped) != len(expected) {
+		t.Fatalf("Expected %d stripped sections, got %d: %v", len(expected), len(stripped), stripped)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(stripped[i], prefix) {
+			t.Errorf("Stripped section %d: expected %q, got %q", i, prefix, stripped[i])
+		}
+	}
+}
+
+func TestStripBoilerplate_PlainText(t *testing.T) {
+	input := "It was the best of times, it was the worst of times."
+
+	text, stripped := StripBoilerplate(input)
+
+	if text != input {
+		t.Errorf("Expected text to be unchanged, got %q", text)
+	}
+	if len(stripped) != 0 {
+		t.Errorf("Expected nothing stripped, got %v", stripped)
+	}
+}
+
+func TestStripBoilerplate_FlattenedMarkers(t *testing.T) {
+	// EPUB text arrives without line breaks
+	input := "Licence blurb *** START OF THIS PROJECT GUTENBERG EBOOK EMMA *** Emma Woodhouse, handsome, clever, and rich. *** END OF THIS PROJECT GUTENBERG EBOOK EMMA *** Licence terms"
+
+	text, stripped := StripBoilerplate(input)
+
+	if text != "Emma Woodhouse, handsome, clever, and rich." {
+		t.Errorf("Expected only the novel text, got %q", text)
+	}
+	if len(stripped) != 2 {
+		t.Errorf("Expected header and footer to be stripped, got %v", stripped)
+	}
+}
+
+func TestStripBoilerplate_ContentsEndsAtProse(t *testing.T) {
+	input := "TABLE OF CONTENTS\nOne\nTwo\n" + strings.Repeat("Prose ", 30) + "\nMore prose."
+
+	text, stripped := StripBoilerplate(input)
+
+	if !strings.HasPrefix(text, "Prose Prose") {
+		t.Errorf("Expected text to start with prose, got %q", text)
+	}
+	if len(stripped) != 1 || !strings.HasPrefix(stripped[0], "table of contents (3 lines)") {
+		t.Errorf("Expected a three line table of contents, got %v", stripped)
+	}
+}
+
+func TestNovelService_ReadNovelWithOptions_StripsBoilerplate(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "alice.txt")
+	if err := os.WriteFile(filePath, []byte(strings.ReplaceAll(gutenbergFixture, "\n", "\r\n")), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	content, err := service.ReadNovelWithOptions(filePath, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if strings.Contains(content.Text, "Gutenberg") {
+		t.Errorf("Expected licence text to be stripped, got:\n%s", content.Text)
+	}
+	if len(content.Stripped) == 0 {
+		t.Error("Expected stripped sections to be reported")
+	}
+}
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxCollectionNameLength caps collection names in characters
+const MaxCollectionNameLength = 64
+
+var (
+	// ErrCollectionNotFound is also returned for collections the user isn't
+	// a member of, so their existence isn't revealed
+	ErrCollectionNotFound    = errors.New("collection not found")
+	ErrCollectionExists      = errors.New("you already have a collection with that name")
+	ErrInvalidCollectionName = fmt.Errorf("collection names are 1 to %d characters", MaxCollectionNameLength)
+	ErrNotCollectionOwner    = errors.New("only the collection's owner can do that")
+	ErrOwnerCannotLeave      = errors.New("the owner can't leave a collection; delete it instead")
+	ErrUserNotFound          = errors.New("user not found")
+)
+
+// Collection is a named set of novels shared with its members. Its owner
+// manages the members; any member can add novels they own, and a novel can
+// be taken out by whoever added it or by the owner.
+type Collection struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	OwnerID   int64     `json:"-"`
+	Members   []string  `json:"members"`
+	Novels    []string  `json:"novels"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CreateCollection creates an empty collection with owner as its only
+// member
+func (us *UserStore) CreateCollection(owner int64, name string) (*Collection, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > MaxCollectionNameLength {
+		return nil, ErrInvalidCollectionName
+	}
+
+	tx, err := us.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create collection: %v", err)
+	}
+	defer tx.Rollback()
+
+	var taken int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM collections WHERE owner_id = ? AND name = ? COLLATE NOCASE`, owner, name).Scan(&taken); err != nil {
+		return nil, fmt.Errorf("failed to create collection: %v", err)
+	}
+	if taken > 0 {
+		return nil, ErrCollectionExists
+	}
+	result, err := tx.Exec(`INSERT INTO collections (name, owner_id, created_at) VALUES (?, ?, ?)`, name, owner, us.now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create collection: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create collection: %v", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO collection_members (collection_id, user_id) VALUES (?, ?)`, id, owner); err != nil {
+		return nil, fmt.Errorf("failed to create collection: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create collection: %v", err)
+	}
+	return us.Collection(id, owner)
+}
+
+// Collections returns the collections user is a member of, by name
+func (us *UserStore) Collections(user int64) ([]Collection, error) {
+	rows, err := us.db.Query(`SELECT c.id FROM collections c
+		JOIN collection_members m ON m.collection_id = c.id
+		WHERE m.user_id = ? ORDER BY c.name COLLATE NOCASE, c.id`, user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %v", err)
+	}
+	ids, err := scanInt64s(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %v", err)
+	}
+
+	collections := []Collection{}
+	for _, id := range ids {
+		collection, err := us.Collection(id, user)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, *collection)
+	}
+	return collections, nil
+}
+
+// Collection returns a collection user is a member of
+func (us *UserStore) Collection(id, user int64) (*Collection, error) {
+	if err := us.checkMember(id, user); err != nil {
+		return nil, err
+	}
+
+	var c Collection
+	var created int64
+	err := us.db.QueryRow(`SELECT c.id, c.name, c.owner_id, u.username, c.created_at FROM collections c
+		JOIN users u ON u.id = c.owner_id WHERE c.id = ?`, id).
+		Scan(&c.ID, &c.Name, &c.OwnerID, &c.Owner, &created)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load collection: %v", err)
+	}
+	c.CreatedAt = time.Unix(created, 0)
+
+	rows, err := us.db.Query(`SELECT u.username FROM collection_members m
+		JOIN users u ON u.id = m.user_id WHERE m.collection_id = ? ORDER BY u.username COLLATE NOCASE`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load collection: %v", err)
+	}
+	if c.Members, err = scanStrings(rows); err != nil {
+		return nil, fmt.Errorf("failed to load collection: %v", err)
+	}
+
+	rows, err = us.db.Query(`SELECT novel FROM collection_novels WHERE collection_id = ? ORDER BY novel`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load collection: %v", err)
+	}
+	if c.Novels, err = scanStrings(rows); err != nil {
+		return nil, fmt.Errorf("failed to load collection: %v", err)
+	}
+	return &c, nil
+}
+
+// DeleteCollection deletes a collection owned by user. The novels in it
+// are left alone.
+func (us *UserStore) DeleteCollection(id, user int64) error {
+	if err := us.checkOwner(id, user); err != nil {
+		return err
+	}
+	if _, err := us.db.Exec(`DELETE FROM collections WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete collection: %v", err)
+	}
+	return nil
+}
+
+// AddMember lets username into a collection owned by user
+func (us *UserStore) AddMember(id, user int64, username string) error {
+	if err := us.checkOwner(id, user); err != nil {
+		return err
+	}
+	var member int64
+	err := us.db.QueryRow(`SELECT id FROM users WHERE username = ? COLLATE NOCASE`, username).Scan(&member)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add member: %v", err)
+	}
+	if _, err := us.db.Exec(`INSERT OR IGNORE INTO collection_members (collection_id, user_id) VALUES (?, ?)`, id, member); err != nil {
+		return fmt.Errorf("failed to add member: %v", err)
+	}
+	return nil
+}
+
+// RemoveMember takes username out of a collection, along with the novels
+// they added. The owner can remove anyone but themselves; other members can
+// only leave.
+func (us *UserStore) RemoveMember(id, user int64, username string) error {
+	if err := us.checkMember(id, user); err != nil {
+		return err
+	}
+	var member, owner int64
+	err := us.db.QueryRow(`SELECT u.id, c.owner_id FROM users u, collections c
+		WHERE u.username = ? COLLATE NOCASE AND c.id = ?`, username, id).Scan(&member, &owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove member: %v", err)
+	}
+	switch {
+	case member == owner:
+		return ErrOwnerCannotLeave
+	case user != owner && user != member:
+		return ErrNotCollectionOwner
+	}
+	// Novels they shared stop being shared when they leave
+	if _, err := us.db.Exec(`DELETE FROM collection_novels WHERE collection_id = ? AND added_by = ?`, id, member); err != nil {
+		return fmt.Errorf("failed to remove member: %v", err)
+	}
+	if _, err := us.db.Exec(`DELETE FROM collection_members WHERE collection_id = ? AND user_id = ?`, id, member); err != nil {
+		return fmt.Errorf("failed to remove member: %v", err)
+	}
+	return nil
+}
+
+// AddNovel shares a novel with a collection's members. The caller checks
+// that user may share it.
+func (us *UserStore) AddNovel(id, user int64, novel string) error {
+	if err := us.checkMember(id, user); err != nil {
+		return err
+	}
+	if _, err := us.db.Exec(`INSERT OR IGNORE INTO collection_novels (collection_id, novel, added_by) VALUES (?, ?, ?)`, id, novel, user); err != nil {
+		return fmt.Errorf("failed to add novel: %v", err)
+	}
+	return nil
+}
+
+// RemoveNovel takes a novel out of a collection, if user added it or owns
+// the collection
+func (us *UserStore) RemoveNovel(id, user int64, novel string) error {
+	if err := us.checkMember(id, user); err != nil {
+		return err
+	}
+	result, err := us.db.Exec(`DELETE FROM collection_novels WHERE collection_id = ? AND novel = ?
+		AND (added_by = ? OR ? = (SELECT owner_id FROM collections WHERE id = ?))`, id, novel, user, user, id)
+	if err != nil {
+		return fmt.Errorf("failed to remove novel: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var present int
+		us.db.QueryRow(`SELECT COUNT(*) FROM collection_novels WHERE collection_id = ? AND novel = ?`, id, novel).Scan(&present)
+		if present > 0 {
+			return ErrNotCollectionOwner
+		}
+	}
+	return nil
+}
+
+// SharedNovels returns the novels in every collection user is a member of
+func (us *UserStore) SharedNovels(user int64) (map[string]bool, error) {
+	rows, err := us.db.Query(`SELECT DISTINCT n.novel FROM collection_novels n
+		JOIN collection_members m ON m.collection_id = n.collection_id WHERE m.user_id = ?`, user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shared novels: %v", err)
+	}
+	novels, err := scanStrings(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shared novels: %v", err)
+	}
+	shared := make(map[string]bool, len(novels))
+	for _, novel := range novels {
+		shared[novel] = true
+	}
+	return shared, nil
+}
+
+// checkMember returns ErrCollectionNotFound unless user is a member of the
+// collection
+func (us *UserStore) checkMember(id, user int64) error {
+	var n int
+	if err := us.db.QueryRow(`SELECT COUNT(*) FROM collection_members WHERE collection_id = ? AND user_id = ?`, id, user).Scan(&n); err != nil {
+		return fmt.Errorf("failed to check membership: %v", err)
+	}
+	if n == 0 {
+		return ErrCollectionNotFound
+	}
+	return nil
+}
+
+// checkOwner is checkMember also requiring user to own the collection
+func (us *UserStore) checkOwner(id, user int64) error {
+	if err := us.checkMember(id, user); err != nil {
+		return err
+	}
+	var owner int64
+	if err := us.db.QueryRow(`SELECT owner_id FROM collections WHERE id = ?`, id).Scan(&owner); err != nil {
+		return fmt.Errorf("failed to check ownership: %v", err)
+	}
+	if owner != user {
+		return ErrNotCollectionOwner
+	}
+	return nil
+}
+
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func scanInt64s(rows *sql.Rows) ([]int64, error) {
+	defer rows.Close()
+	var values []int64
+	for rows.Next() {
+		var value int64
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+// newTestCollectionUsers registers emma, who owns a collection, and
+// harriet and jane, who don't
+func newTestCollectionUsers(t *testing.T) (*UserStore, *User, *User, *User) {
+	t.Helper()
+	us := newTestUserStore(t)
+	var users []*User
+	invite := adminInvite(t, us)
+	for _, name := range []string{"emma", "harriet", "jane"} {
+		user, err := us.Register(name, "knightley1", invite, false)
+		invite = ""
+		if err != nil {
+			t.Fatalf("Failed to register %s: %v", name, err)
+		}
+		users = append(users, user)
+	}
+	return us, users[0], users[1], users[2]
+}
+
+func TestUserStore_CreateCollection(t *testing.T) {
+	us, emma, harriet, _ := newTestCollectionUsers(t)
+
+	collection, err := us.CreateCollection(emma.ID, " Highbury ")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if collection.Name != "Highbury" || collection.Owner != "emma" || len(collection.Members) != 1 || len(collection.Novels) != 0 {
+		t.Errorf("Unexpected collection %+v", collection)
+	}
+
+	tests := []struct {
+		name     string
+		owner    int64
+		title    string
+		expected error
+	}{
+		{"taken ignoring case", emma.ID, "HIGHBURY", ErrCollectionExists},
+		{"empty", emma.ID, "  ", ErrInvalidCollectionName},
+		{"too long", emma.ID, string(make([]rune, MaxCollectionNameLength+1)), ErrInvalidCollectionName},
+		{"same name, other owner", harriet.ID, "Highbury", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := us.CreateCollection(tt.owner, tt.title); !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+
+	// Each user sees only their own collections
+	collections, _ := us.Collections(emma.ID)
+	if len(collections) != 1 || collections[0].ID != collection.ID {
+		t.Errorf("Expected emma to see one collection, got %+v", collections)
+	}
+	if _, err := us.Collection(collection.ID, harriet.ID); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Expected ErrCollectionNotFound for a non-member, got %v", err)
+	}
+}
+
+func TestUserStore_CollectionMembers(t *testing.T) {
+	us, emma, harriet, jane := newTestCollectionUsers(t)
+	collection, _ := us.CreateCollection(emma.ID, "Highbury")
+
+	// Only the owner adds members, and only existing users
+	if err := us.AddMember(collection.ID, harriet.ID, "jane"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Expected ErrCollectionNotFound for a non-member, got %v", err)
+	}
+	if err := us.AddMember(collection.ID, emma.ID, "frank"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+	if err := us.AddMember(collection.ID, emma.ID, "Harriet"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := us.AddMember(collection.ID, harriet.ID, "jane"); !errors.Is(err, ErrNotCollectionOwner) {
+		t.Errorf("Expected ErrNotCollectionOwner, got %v", err)
+	}
+	us.AddMember(collection.ID, emma.ID, "jane")
+
+	// Members share novels; leaving takes a member's novels with them
+	us.AddNovel(collection.ID, emma.ID, "u1-emma.txt")
+	us.AddNovel(collection.ID, harriet.ID, "u2-letters.txt")
+	if shared, _ := us.SharedNovels(jane.ID); !shared["u1-emma.txt"] || !shared["u2-letters.txt"] {
+		t.Errorf("Expected jane to read both novels, got %v", shared)
+	}
+	if err := us.RemoveMember(collection.ID, jane.ID, "harriet"); !errors.Is(err, ErrNotCollectionOwner) {
+		t.Errorf("Expected ErrNotCollectionOwner, got %v", err)
+	}
+	if err := us.RemoveMember(collection.ID, emma.ID, "emma"); !errors.Is(err, ErrOwnerCannotLeave) {
+		t.Errorf("Expected ErrOwnerCannotLeave, got %v", err)
+	}
+	if err := us.RemoveMember(collection.ID, harriet.ID, "harriet"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if shared, _ := us.SharedNovels(jane.ID); !shared["u1-emma.txt"] || shared["u2-letters.txt"] {
+		t.Errorf("Expected harriet's novel to leave with her, got %v", shared)
+	}
+	if shared, _ := us.SharedNovels(harriet.ID); len(shared) != 0 {
+		t.Errorf("Expected harriet to read nothing once she left, got %v", shared)
+	}
+
+	// Deleting the collection stops sharing everything in it
+	if err := us.DeleteCollection(collection.ID, jane.ID); !errors.Is(err, ErrNotCollectionOwner) {
+		t.Errorf("Expected ErrNotCollectionOwner, got %v", err)
+	}
+	if err := us.DeleteCollection(collection.ID, emma.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if shared, _ := us.SharedNovels(jane.ID); len(shared) != 0 {
+		t.Errorf("Expected nothing shared after deletion, got %v", shared)
+	}
+}
+
+func TestUserStore_RemoveNovel(t *testing.T) {
+	us, emma, harriet, jane := newTestCollectionUsers(t)
+	collection, _ := us.CreateCollection(emma.ID, "Highbury")
+	us.AddMember(collection.ID, emma.ID, "harriet")
+	us.AddMember(collection.ID, emma.ID, "jane")
+	us.AddNovel(collection.ID, harriet.ID, "u2-letters.txt")
+	us.AddNovel(collection.ID, jane.ID, "u3-diary.txt")
+
+	// Jane can't take out harriet's novel, but harriet and the owner can
+	// take out novels
+	if err := us.RemoveNovel(collection.ID, jane.ID, "u2-letters.txt"); !errors.Is(err, ErrNotCollectionOwner) {
+		t.Errorf("Expected ErrNotCollectionOwner, got %v", err)
+	}
+	if err := us.RemoveNovel(collection.ID, harriet.ID, "u2-letters.txt"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if err := us.RemoveNovel(collection.ID, emma.ID, "u3-diary.txt"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if found, _ := us.Collection(collection.ID, emma.ID); len(found.Novels) != 0 {
+		t.Errorf("Expected no novels left, got %v", found.Novels)
+	}
+}
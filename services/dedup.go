@@ -0,0 +1,252 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Ways of handling an upload that duplicates a novel already in the library
+const (
+	// DuplicateSkip leaves an exact duplicate out of the library and indexes
+	// a near-duplicate alongside the original. It is the default.
+	DuplicateSkip = "skip"
+	// DuplicateLink records the upload's name as another name for the
+	// existing novel without indexing it again
+	DuplicateLink = "link"
+	// DuplicateReplace removes the existing novel and indexes the upload in
+	// its place
+	DuplicateReplace = "replace"
+)
+
+const (
+	// shingleWords is the number of words in each shingle compared by MinHash
+	shingleWords = 5
+	// minHashSize is the number of hash functions in a MinHash signature
+	minHashSize = 128
+	// NearDuplicateThreshold is the estimated Jaccard similarity above which
+	// two novels are flagged as editions of the same book
+	NearDuplicateThreshold = 0.7
+)
+
+// DuplicateMatch describes a novel in the library that an upload duplicates
+type DuplicateMatch struct {
+	// Name is the storage name of the existing novel
+	Name         string `json:"name"`
+	OriginalName string `json:"originalName"`
+	// Exact is set when the normalised texts are identical; otherwise the
+	// upload is a near-duplicate such as a different edition
+	Exact      bool    `json:"exact"`
+	Similarity float64 `json:"similarity"`
+}
+
+// Fingerprint identifies a novel's text for duplicate detection
+type Fingerprint struct {
+	// TextHash is the SHA-256 of the normalised text
+	TextHash string
+	// MinHash is the MinHash signature of the text's word shingles
+	MinHash []uint64
+}
+
+// FingerprintText computes the fingerprint of a novel's text
+func FingerprintText(text string) Fingerprint {
+	normalised := NormalizeText(text)
+	sum := sha256.Sum256([]byte(normalised))
+	return Fingerprint{
+		TextHash: hex.EncodeToString(sum[:]),
+		MinHash:  minHashSignature(strings.Fields(normalised)),
+	}
+}
+
+// NormalizeText reduces text to lower-case words separated by single spaces,
+// so copies differing only in formatting, punctuation or Unicode composition
+// compare equal
+func NormalizeText(text string) string {
+	text = norm.NFKC.String(text)
+	var b strings.Builder
+	space := true
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+			space = false
+		} else if !space {
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// minHashSignature returns the minimum of each of minHashSize hash functions
+// over the word shingles of a text
+func minHashSignature(words []string) []uint64 {
+	if len(words) == 0 {
+		return nil
+	}
+
+	sig := make([]uint64, minHashSize)
+	for i := range sig {
+		sig[i] = ^uint64(0)
+	}
+
+	n := shingleWords
+	if len(words) < n {
+		n = len(words)
+	}
+	for i := 0; i+n <= len(words); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+n], " ")))
+		shingle := h.Sum64()
+		for j := range sig {
+			if v := mix64(shingle ^ minHashSeeds[j]); v < sig[j] {
+				sig[j] = v
+			}
+		}
+	}
+	return sig
+}
+
+// minHashSeeds derive the hash functions of a MinHash signature
+var minHashSeeds = func() []uint64 {
+	seeds := make([]uint64, minHashSize)
+	state := uint64(0x9E3779B97F4A7C15)
+	for i := range seeds {
+		state += 0x9E3779B97F4A7C15
+		seeds[i] = mix64(state)
+	}
+	return seeds
+}()
+
+// mix64 is the SplitMix64 finaliser, spreading the bits of x
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xBF58476D1CE4E5B9
+	x ^= x >> 27
+	x *= 0x94D049BB133111EB
+	return x ^ (x >> 31)
+}
+
+// EstimateSimilarity estimates the Jaccard similarity of two texts' shingle
+// sets from their MinHash signatures
+func EstimateSimilarity(a, b []uint64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a))
+}
+
+// FindDuplicate looks through the library, other than the novel stored as
+// name, for one with the same normalised text or, failing that, the most
+// similar near-duplicate. Only novels with the same owner are compared, so
+// an upload never reveals, links to or replaces another user's novel.
+func (ns *NovelService) FindDuplicate(name string, fp Fingerprint) *DuplicateMatch {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	catalog := ns.loadCatalog()
+	owner := catalog[name].Owner
+	var best *DuplicateMatch
+	for _, novel := range catalog {
+		if novel.Name == name || novel.TextHash == "" || novel.Owner != owner {
+			continue
+		}
+		if novel.TextHash == fp.TextHash {
+			return &DuplicateMatch{Name: novel.Name, OriginalName: novel.OriginalName, Exact: true, Similarity: 1}
+		}
+		similarity := EstimateSimilarity(novel.MinHash, fp.MinHash)
+		if similarity >= NearDuplicateThreshold && (best == nil || similarity > best.Similarity) {
+			best = &DuplicateMatch{Name: novel.Name, OriginalName: novel.OriginalName, Similarity: similarity}
+		}
+	}
+	return best
+}
+
+// SetFingerprint records the fingerprint of a stored novel in the catalog,
+// adding an entry for files that were placed in the novels directory
+// directly
+func (ns *NovelService) SetFingerprint(name string, fp Fingerprint) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	catalog := ns.loadCatalog()
+	novel, ok := catalog[name]
+	if !ok {
+		novel = StoredNovel{Name: name, OriginalName: name}
+	}
+	novel.TextHash = fp.TextHash
+	novel.MinHash = fp.MinHash
+	catalog[name] = novel
+	return ns.saveCatalog(catalog)
+}
+
+// LinkDuplicate records the stored novel name as another copy of existing,
+// keeping its original name as an alias and removing its file
+func (ns *NovelService) LinkDuplicate(name, existing string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	catalog := ns.loadCatalog()
+	target, ok := catalog[existing]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if duplicate, ok := catalog[name]; ok && duplicate.OriginalName != target.OriginalName {
+		target.Aliases = appendUnique(target.Aliases, duplicate.OriginalName)
+	}
+	catalog[existing] = target
+	delete(catalog, name)
+
+	if err := os.Remove(ns.StoredPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ns.saveCatalog(catalog)
+}
+
+// RemoveStored deletes a stored novel's file and catalog entry
+func (ns *NovelService) RemoveStored(name string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if err := os.Remove(ns.StoredPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ns.uncatalog(name)
+}
+
+// ForgetStored deletes a stored novel's catalog entry, leaving its file
+func (ns *NovelService) ForgetStored(name string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.uncatalog(name)
+}
+
+// uncatalog deletes a catalog entry. The caller holds mu.
+func (ns *NovelService) uncatalog(name string) error {
+	catalog := ns.loadCatalog()
+	if _, ok := catalog[name]; !ok {
+		return nil
+	}
+	delete(catalog, name)
+	return ns.saveCatalog(catalog)
+}
+
+// appendUnique appends value to values unless it is already present
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
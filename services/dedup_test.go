@@ -0,0 +1,203 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testNovelText builds a text of n distinct words, replacing the words at
+// the given positions to make a different edition
+func testNovelText(n int, changed ...int) string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = fmt.Sprintf("word%d", i)
+	}
+	for _, i := range changed {
+		words[i] = "revised"
+	}
+	return strings.Join(words, " ")
+}
+
+func TestNormalizeText(t *testing.T) {
+	a := NormalizeText("Emma Woodhouse,\n\thandsome — clever, and RICH.")
+	b := NormalizeText("emma woodhouse handsome clever and rich")
+	if a != b {
+		t.Errorf("Expected %q and %q to normalise equally", a, b)
+	}
+
+	// Compatibility forms such as ligatures are folded
+	if got := NormalizeText("ﬁne"); got != "fine" {
+		t.Errorf("Expected %q, got %q", "fine", got)
+	}
+}
+
+func TestEstimateSimilarity(t *testing.T) {
+	original := FingerprintText(testNovelText(400))
+	edition := FingerprintText(testNovelText(400, 50, 150, 250))
+	unrelated := FingerprintText(strings.ReplaceAll(testNovelText(400), "word", "other"))
+
+	if original.TextHash == edition.TextHash {
+		t.Error("Expected different editions to have different text hashes")
+	}
+	if s := EstimateSimilarity(original.MinHash, edition.MinHash); s < NearDuplicateThreshold {
+		t.Errorf("Expected edition to be a near-duplicate, similarity %.2f", s)
+	}
+	if s := EstimateSimilarity(original.MinHash, unrelated.MinHash); s > 0.2 {
+		t.Errorf("Expected unrelated texts to differ, similarity %.2f", s)
+	}
+}
+
+// ingestUpload stores text as an upload and ingests it
+func ingestUpload(t *testing.T, ns *NovelService, is *IngestService, name, text, onDuplicate string) (*StoredNovel, *IngestResult) {
+	t.Helper()
+	stored, err := ns.SaveUpload(strings.NewReader(text), name, FormatByName("txt"), 0)
+	if err != nil {
+		t.Fatalf("Failed to save upload: %v", err)
+	}
+	result, err := is.Ingest(ns.StoredPath(stored.Name), IngestOptions{OnDuplicate: onDuplicate}, nil)
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	return stored, result
+}
+
+func TestIngest_Duplicates(t *testing.T) {
+	tests := []struct {
+		name           string
+		text           string
+		onDuplicate    string
+		expectedAction string
+		expectExact    bool
+		expectStored   int
+	}{
+		{"exact copy is skipped", strings.ToUpper(testNovelText(400)), "", DuplicateSkip, true, 1},
+		{"exact copy is linked", testNovelText(400), DuplicateLink, DuplicateLink, true, 1},
+		{"exact copy replaces", testNovelText(400), DuplicateReplace, DuplicateReplace, true, 1},
+		{"edition is flagged and kept", testNovelText(400, 50, 150, 250), "", "", false, 2},
+		{"edition replaces", testNovelText(400, 50, 150, 250), DuplicateReplace, DuplicateReplace, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			ns := NewNovelService(filepath.Join(tempDir, "novels"))
+			cs := NewChromaService(filepath.Join(tempDir, "db"))
+			is := NewIngestService(ns, cs)
+
+			first, _ := ingestUpload(t, ns, is, "first.txt", testNovelText(400), "")
+			second, result := ingestUpload(t, ns, is, "second.txt", tt.text, tt.onDuplicate)
+
+			if result.Duplicate == nil {
+				t.Fatal("Expected a duplicate to be found")
+			}
+			if result.Duplicate.Name != first.Name || result.Duplicate.OriginalName != "first.txt" || result.Duplicate.Exact != tt.expectExact {
+				t.Errorf("Unexpected duplicate %+v", result.Duplicate)
+			}
+			if result.Action != tt.expectedAction {
+				t.Errorf("Expected action %q, got %q", tt.expectedAction, result.Action)
+			}
+
+			stored := ns.StoredNovels()
+			if len(stored) != tt.expectStored {
+				t.Errorf("Expected %d stored novels, got %d", tt.expectStored, len(stored))
+			}
+
+			_, secondErr := os.Stat(ns.StoredPath(second.Name))
+			switch tt.expectedAction {
+			case DuplicateSkip:
+				if !os.IsNotExist(secondErr) {
+					t.Error("Expected the skipped copy to be removed")
+				}
+			case DuplicateLink:
+				if len(stored) != 1 || len(stored[0].Aliases) != 1 || stored[0].Aliases[0] != "second.txt" {
+					t.Errorf("Expected second.txt to be linked as an alias, got %+v", stored)
+				}
+			case DuplicateReplace:
+				if _, err := os.Stat(ns.StoredPath(first.Name)); !os.IsNotExist(err) {
+					t.Error("Expected the replaced novel to be removed")
+				}
+				if result.Chunks == 0 {
+					t.Error("Expected the replacement to be indexed")
+				}
+			}
+		})
+	}
+}
+
+func TestSaveUpload_ReuploadKeepsLinks(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	is := NewIngestService(ns, NewChromaService(filepath.Join(tempDir, "db")))
+
+	first, _ := ingestUpload(t, ns, is, "first.txt", testNovelText(400), "")
+	ingestUpload(t, ns, is, "second.txt", testNovelText(400), DuplicateLink)
+	linked := ns.StoredNovels()[0]
+
+	// Uploading the same file again only refreshes when it was uploaded
+	again, err := ns.SaveUpload(strings.NewReader(testNovelText(400)), "first.txt", FormatByName("txt"), 0)
+	if err != nil {
+		t.Fatalf("Failed to save upload: %v", err)
+	}
+	if again.Name != first.Name {
+		t.Fatalf("Expected the same storage name, got %s and %s", first.Name, again.Name)
+	}
+
+	stored := ns.StoredNovels()
+	if len(stored) != 1 {
+		t.Fatalf("Expected 1 stored novel, got %+v", stored)
+	}
+	novel := stored[0]
+	if len(novel.Aliases) != 1 || novel.Aliases[0] != "second.txt" {
+		t.Errorf("Expected second.txt to stay linked, got %v", novel.Aliases)
+	}
+	if novel.TextHash != linked.TextHash || len(novel.MinHash) != len(linked.MinHash) || novel.IndexedSHA256 != linked.IndexedSHA256 {
+		t.Errorf("Expected the fingerprint and index state to be kept, got %+v", novel)
+	}
+	if !novel.UploadedAt.Equal(again.UploadedAt) {
+		t.Errorf("Expected the upload time to be refreshed, got %v", novel.UploadedAt)
+	}
+	if name, ok := ns.ResolveNovel("second.txt"); !ok || name != first.Name {
+		t.Errorf("Expected second.txt to resolve to %s, got %q", first.Name, name)
+	}
+}
+
+func TestIngest_NoDuplicate(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	is := NewIngestService(ns, NewChromaService(filepath.Join(tempDir, "db")))
+
+	ingestUpload(t, ns, is, "first.txt", testNovelText(400), "")
+	_, result := ingestUpload(t, ns, is, "other.txt", strings.ReplaceAll(testNovelText(400), "word", "other"), "")
+
+	if result.Duplicate != nil {
+		t.Errorf("Expected no duplicate, got %+v", result.Duplicate)
+	}
+}
+
+func TestIngest_DuplicatesPerOwner(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	is := NewIngestService(ns, NewChromaService(filepath.Join(tempDir, "db")))
+
+	ingestUpload(t, ns, is, "first.txt", testNovelText(400), "")
+
+	// Another user's copy isn't a duplicate of the library's, so it is kept
+	// rather than skipped or linked to a novel they can't read
+	stored, err := ns.SaveOwnedUpload(strings.NewReader(testNovelText(400)), "mine.txt", FormatByName("txt"), 0, 3)
+	if err != nil {
+		t.Fatalf("Failed to save upload: %v", err)
+	}
+	result, err := is.Ingest(ns.StoredPath(stored.Name), IngestOptions{Owner: 3}, nil)
+	if err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if result.Duplicate != nil {
+		t.Errorf("Expected no duplicate across owners, got %+v", result.Duplicate)
+	}
+	if got := len(ns.StoredNovels()); got != 2 {
+		t.Errorf("Expected 2 stored novels, got %d", got)
+	}
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrInvalidEndpoint is returned for endpoints that aren't the base URL
+	// of an http or https server
+	ErrInvalidEndpoint = errors.New("invalid Ollama endpoint")
+	// ErrEndpointNotAllowed is returned for endpoints missing from the
+	// allowlist
+	ErrEndpointNotAllowed = errors.New("Ollama endpoint is not allowed")
+	// ErrEndpointBlocked is returned when an endpoint resolves to an address
+	// the server mustn't contact, or redirects elsewhere
+	ErrEndpointBlocked = errors.New("Ollama endpoint is blocked")
+)
+
+// EndpointGuard decides which Ollama endpoints clients may have the server
+// send requests to. An endpoint must be on the allowlist, and is then only
+// contacted at a public address unless private ones are allowed; link-local
+// addresses, where cloud metadata services live, are never contacted.
+// Redirects aren't followed, so an allowed server can't send requests on
+// elsewhere.
+type EndpointGuard struct {
+	allowed      map[string]bool
+	allowPrivate bool
+	transport    *http.Transport
+}
+
+// NewEndpointGuard allows clients the endpoints listed, skipping any that
+// aren't valid. allowPrivate lets them resolve to loopback and private
+// network addresses, as Ollama servers on the local network do.
+func NewEndpointGuard(allowed []string, allowPrivate bool) *EndpointGuard {
+	g := &EndpointGuard{allowed: make(map[string]bool), allowPrivate: allowPrivate}
+	for _, endpoint := range allowed {
+		if u, err := parseEndpoint(endpoint); err == nil {
+			g.allowed[endpointKey(u)] = true
+		}
+	}
+
+	// The address is checked after it is resolved, as the connection is
+	// made, so a name can't be pointed somewhere else once allowed. Proxies
+	// are never used as they would make the connection instead.
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: g.control}
+	g.transport = &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return g
+}
+
+// NormalizeEndpoint checks that endpoint is an http or https base URL and
+// returns it with its port spelled out, so equal endpoints compare equal
+func NormalizeEndpoint(endpoint string) (string, error) {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Check returns endpoint normalised if clients may use it, or an error
+// saying why not
+func (g *EndpointGuard) Check(endpoint string) (string, error) {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if !g.allowed[endpointKey(u)] {
+		return "", fmt.Errorf("%w: %s is not on the allowlist", ErrEndpointNotAllowed, u.Redacted())
+	}
+	if err := g.checkAddress(u); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Service returns an Ollama service for an endpoint clients may use,
+// connecting only to allowed addresses and refusing redirects
+func (g *EndpointGuard) Service(endpoint string) (*OllamaService, error) {
+	checked, err := g.Check(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return g.service(checked), nil
+}
+
+// checkAddress refuses an endpoint given as an address that is blocked,
+// before connecting
+func (g *EndpointGuard) checkAddress(u *url.URL) error {
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && g.blocked(ip) {
+		return fmt.Errorf("%w: %s is not a public address", ErrEndpointBlocked, ip)
+	}
+	return nil
+}
+
+// service creates an Ollama service for endpoint whose connections are
+// checked by the guard and shared with its other services
+func (g *EndpointGuard) service(endpoint string) *OllamaService {
+	service := NewOllamaService(endpoint)
+	service.client = &http.Client{
+		Transport: g.transport,
+		Timeout:   service.client.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return fmt.Errorf("%w: redirected to %s", ErrEndpointBlocked, req.URL.Redacted())
+		},
+	}
+	return service
+}
+
+// control refuses connections to blocked addresses
+func (g *EndpointGuard) control(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: unexpected address %s", ErrEndpointBlocked, address)
+	}
+	if ip := addr.Addr().Unmap(); g.blocked(ip) {
+		return fmt.Errorf("%w: %s is not a public address", ErrEndpointBlocked, ip)
+	}
+	return nil
+}
+
+// nonPublicPrefixes are ranges that aren't public but that IsPrivate leaves
+// out: shared carrier-grade NAT space (where some clouds put their metadata
+// service, at 100.100.100.200), "this network", benchmarking and NAT64
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+func (g *EndpointGuard) blocked(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	switch {
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast(), ip.IsInterfaceLocalMulticast(),
+		ip.IsMulticast(), ip.IsUnspecified():
+		return true
+	case ip.IsLoopback(), ip.IsPrivate(), nonPublic(ip):
+		return !g.allowPrivate
+	}
+	return false
+}
+
+// nonPublic reports whether ip is in one of nonPublicPrefixes
+func nonPublic(ip netip.Addr) bool {
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEndpoint parses an endpoint, filling in the scheme's default port
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(endpoint))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.Opaque != "" {
+		return nil, fmt.Errorf("%w: %q is not an http or https URL", ErrInvalidEndpoint, endpoint)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("%w: %s must not have a path or query", ErrInvalidEndpoint, u.Redacted())
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("%w: %s has an invalid port", ErrInvalidEndpoint, u.Redacted())
+	}
+	u.Host = net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+	u.Path, u.RawPath = "", ""
+	return u, nil
+}
+
+// endpointKey identifies an endpoint's server, leaving out any credentials
+func endpointKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,512 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultHealthInterval is how often registered endpoints are checked
+const DefaultHealthInterval = 30 * time.Second
+
+// healthCheckTimeout bounds each endpoint's health check
+const healthCheckTimeout = 5 * time.Second
+
+// Capabilities an endpoint can be registered with. Questions are only sent
+// to endpoints that can chat.
+const (
+	CapabilityChat  = "chat"
+	CapabilityEmbed = "embed"
+)
+
+// Capabilities lists the valid capabilities
+var Capabilities = []string{CapabilityChat, CapabilityEmbed}
+
+// Health states of a registered endpoint
+const (
+	HealthUnknown = "unknown"
+	HealthOK      = "ok"
+	HealthError   = "error"
+)
+
+var (
+	ErrEndpointNotFound    = errors.New("endpoint not found")
+	ErrEndpointExists      = errors.New("an endpoint with that name already exists")
+	ErrInvalidEndpointName = errors.New("endpoint names are 1 to 64 characters with at least one letter or digit")
+	ErrInvalidCapability   = errors.New("capabilities are " + strings.Join(Capabilities, " and "))
+	ErrEndpointNotCapable  = errors.New("the endpoint can't do that")
+)
+
+// Endpoint is a registered Ollama server as shown to clients. Its URL has
+// any credentials hidden, and its credentials are never shown.
+type Endpoint struct {
+	ID           string         `json:"id"`
+	Name         string         `json:"name"`
+	URL          string         `json:"url,omitempty"`
+	Capabilities []string       `json:"capabilities"`
+	AddedAt      time.Time      `json:"addedAt"`
+	Health       EndpointHealth `json:"health"`
+}
+
+// Can reports whether the endpoint has a capability
+func (e Endpoint) Can(capability string) bool {
+	for _, c := range e.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// EndpointHealth is the result of an endpoint's last health check, with
+// the models it listed
+type EndpointHealth struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	// Error says briefly why the check failed, such as "unreachable" or
+	// "status 503", never giving the endpoint's address
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Models    []string  `json:"models"`
+}
+
+// EndpointSpec describes an endpoint to register. The URL may carry basic
+// auth credentials, and Token is sent as a bearer token, for servers behind
+// an authenticating proxy. Capabilities default to chat.
+type EndpointSpec struct {
+	Name         string   `json:"name"`
+	URL          string   `json:"url"`
+	Token        string   `json:"token,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// savedEndpoint is an endpoint as stored, credentials included
+type savedEndpoint struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	Token        string    `json:"token,omitempty"`
+	Capabilities []string  `json:"capabilities"`
+	AddedAt      time.Time `json:"addedAt"`
+}
+
+// registeredEndpoint is an endpoint with the service shared by every
+// request sent to it
+type registeredEndpoint struct {
+	saved   savedEndpoint
+	service *OllamaService
+	health  EndpointHealth
+	// err is the last health check's error, which health describes without
+	// the endpoint's address
+	err error
+}
+
+// EndpointRegistry holds the Ollama servers an admin has registered by
+// name, so clients can choose one by ID without naming its URL. Each
+// endpoint has one service whose connections are reused across requests,
+// and is checked periodically, which also keeps its model list. Endpoints
+// are saved to a JSON file and contacted through the endpoint guard, so
+// only at the addresses it allows.
+type EndpointRegistry struct {
+	path    string
+	guard   *EndpointGuard
+	timeout time.Duration
+	metrics *Metrics
+
+	mu        sync.RWMutex
+	endpoints map[string]*registeredEndpoint
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewEndpointRegistry creates a registry saved to path, loading the
+// endpoints saved there
+func NewEndpointRegistry(path string, guard *EndpointGuard) (*EndpointRegistry, error) {
+	r := &EndpointRegistry{
+		path:      path,
+		guard:     guard,
+		endpoints: make(map[string]*registeredEndpoint),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read endpoints: %v", err)
+	}
+	if err == nil {
+		var saved []savedEndpoint
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, fmt.Errorf("failed to parse endpoints: %v", err)
+		}
+		for _, endpoint := range saved {
+			u, err := parseEndpoint(endpoint.URL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load endpoint %s: %v", endpoint.ID, err)
+			}
+			r.endpoints[endpoint.ID] = r.register(endpoint, u)
+		}
+	}
+	return r, nil
+}
+
+// SetTimeout sets how long a request to a registered endpoint may take
+func (r *EndpointRegistry) SetTimeout(timeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timeout = timeout
+	for _, endpoint := range r.endpoints {
+		endpoint.service.SetTimeout(timeout)
+	}
+}
+
+// SetMetrics records the Ollama metrics of requests to registered endpoints
+// to m
+func (r *EndpointRegistry) SetMetrics(m *Metrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = m
+	for _, endpoint := range r.endpoints {
+		endpoint.service.SetMetrics(m)
+	}
+}
+
+// Add registers an endpoint, giving it an ID made from its name
+func (r *EndpointRegistry) Add(spec EndpointSpec) (Endpoint, error) {
+	name := strings.TrimSpace(spec.Name)
+	id := endpointID(name)
+	if id == "" || utf8.RuneCountInString(name) > 64 {
+		return Endpoint{}, ErrInvalidEndpointName
+	}
+	u, err := parseEndpoint(spec.URL)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if err := r.guard.checkAddress(u); err != nil {
+		return Endpoint{}, err
+	}
+	capabilities, err := normalizeCapabilities(spec.Capabilities)
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.endpoints[id]; exists {
+		return Endpoint{}, ErrEndpointExists
+	}
+	endpoint := r.register(savedEndpoint{
+		ID:           id,
+		Name:         name,
+		URL:          u.String(),
+		Token:        spec.Token,
+		Capabilities: capabilities,
+		AddedAt:      time.Now().UTC(),
+	}, u)
+	r.endpoints[id] = endpoint
+	if err := r.save(); err != nil {
+		delete(r.endpoints, id)
+		return Endpoint{}, err
+	}
+	return endpoint.view(), nil
+}
+
+// Remove unregisters an endpoint
+func (r *EndpointRegistry) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoint, ok := r.endpoints[id]
+	if !ok {
+		return ErrEndpointNotFound
+	}
+	delete(r.endpoints, id)
+	if err := r.save(); err != nil {
+		r.endpoints[id] = endpoint
+		return err
+	}
+	return nil
+}
+
+// List returns the registered endpoints ordered by name
+func (r *EndpointRegistry) List() []Endpoint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	endpoints := make([]Endpoint, 0, len(r.endpoints))
+	for _, endpoint := range r.endpoints {
+		endpoints = append(endpoints, endpoint.view())
+	}
+	sort.Slice(endpoints, func(a, b int) bool {
+		return strings.ToLower(endpoints[a].Name) < strings.ToLower(endpoints[b].Name)
+	})
+	return endpoints
+}
+
+// Get returns a registered endpoint
+func (r *EndpointRegistry) Get(id string) (Endpoint, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	endpoint, ok := r.endpoints[id]
+	if !ok {
+		return Endpoint{}, false
+	}
+	return endpoint.view(), true
+}
+
+// Service returns the shared service for an endpoint, which must have the
+// capability unless it is empty
+func (r *EndpointRegistry) Service(id, capability string) (*OllamaService, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	endpoint, ok := r.endpoints[id]
+	if !ok {
+		return nil, ErrEndpointNotFound
+	}
+	if capability != "" && !endpoint.view().Can(capability) {
+		return nil, fmt.Errorf("%w: %s has no %s capability", ErrEndpointNotCapable, endpoint.saved.Name, capability)
+	}
+	return endpoint.service, nil
+}
+
+// Models returns the models an endpoint listed at its last health check,
+// checking it again first if that check failed or none has run
+func (r *EndpointRegistry) Models(ctx context.Context, id string) ([]string, error) {
+	endpoint, ok := r.Get(id)
+	if !ok {
+		return nil, ErrEndpointNotFound
+	}
+	if endpoint.Health.Status != HealthOK {
+		endpoint = r.Check(ctx, id)
+	}
+	if endpoint.Health.Status != HealthOK {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		if registered, ok := r.endpoints[id]; ok && registered.err != nil {
+			return nil, registered.err
+		}
+		return nil, errors.New(endpoint.Health.Error)
+	}
+	return endpoint.Health.Models, nil
+}
+
+// Check checks an endpoint's health now, returning it as updated
+func (r *EndpointRegistry) Check(ctx context.Context, id string) Endpoint {
+	r.mu.RLock()
+	endpoint, ok := r.endpoints[id]
+	r.mu.RUnlock()
+	if !ok {
+		return Endpoint{}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	models, err := endpoint.service.GetModelsContext(ctx)
+	health := EndpointHealth{
+		Status:    HealthOK,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		CheckedAt: time.Now().UTC(),
+		Models:    models,
+	}
+	if health.Models == nil {
+		health.Models = []string{}
+	}
+	if err != nil {
+		health.Status, health.Error = HealthError, DescribeError(err)
+	}
+
+	r.mu.Lock()
+	previous := endpoint.health.Status
+	endpoint.health, endpoint.err = health, err
+	view := endpoint.view()
+	r.mu.Unlock()
+
+	switch {
+	case health.Status == HealthError && previous != HealthError:
+		slog.Warn("Ollama endpoint is unhealthy", "endpoint", view.ID, "url", view.URL, "error", err)
+	case health.Status == HealthOK && previous == HealthError:
+		slog.Info("Ollama endpoint is healthy again", "endpoint", view.ID, "url", view.URL)
+	}
+	return view
+}
+
+// DescribeError describes a failed call to Ollama for clients, such as
+// "unreachable" or "status 503". The error itself names the server's URL,
+// so it is only logged.
+func DescribeError(err error) string {
+	var status *statusError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &status):
+		return fmt.Sprintf("status %d", status.code)
+	case errors.Is(err, ErrEndpointBlocked):
+		return "blocked"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &urlErr) && urlErr.Timeout():
+		return "timed out"
+	case errors.As(err, &urlErr):
+		return "unreachable"
+	}
+	return "invalid response"
+}
+
+// CheckAll checks every endpoint's health at once
+func (r *EndpointRegistry) CheckAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, endpoint := range r.List() {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			r.Check(ctx, id)
+		}(endpoint.ID)
+	}
+	wg.Wait()
+}
+
+// Start checks every endpoint now and then every interval until Stop
+func (r *EndpointRegistry) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	r.stop, r.done = stop, done
+
+	go func() {
+		defer close(done)
+		// Stopping gives up on checks still running
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			r.CheckAll(ctx)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the health checks, waiting for any running to give up
+func (r *EndpointRegistry) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+// register creates the service for an endpoint. The caller must hold r.mu
+// or be the constructor.
+func (r *EndpointRegistry) register(saved savedEndpoint, u *url.URL) *registeredEndpoint {
+	service := r.guard.service(u.String())
+	service.SetToken(saved.Token)
+	service.SetMetrics(r.metrics)
+	if r.timeout > 0 {
+		service.SetTimeout(r.timeout)
+	}
+	return &registeredEndpoint{
+		saved:   saved,
+		service: service,
+		health:  EndpointHealth{Status: HealthUnknown, Models: []string{}},
+	}
+}
+
+// save writes all endpoints to disk, readable only by the server as they
+// hold credentials. The caller must hold r.mu.
+func (r *EndpointRegistry) save() error {
+	saved := make([]savedEndpoint, 0, len(r.endpoints))
+	for _, endpoint := range r.endpoints {
+		saved = append(saved, endpoint.saved)
+	}
+	sort.Slice(saved, func(a, b int) bool { return saved[a].AddedAt.Before(saved[b].AddedAt) })
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save endpoints: %v", err)
+	}
+	return nil
+}
+
+func (e *registeredEndpoint) view() Endpoint {
+	endpoint := Endpoint{
+		ID:           e.saved.ID,
+		Name:         e.saved.Name,
+		URL:          e.saved.URL,
+		Capabilities: append([]string(nil), e.saved.Capabilities...),
+		AddedAt:      e.saved.AddedAt,
+		Health:       e.health,
+	}
+	if u, err := url.Parse(e.saved.URL); err == nil {
+		endpoint.URL = u.Redacted()
+	}
+	endpoint.Health.Models = append([]string{}, e.health.Models...)
+	return endpoint
+}
+
+// endpointID makes an ID from an endpoint's name: its letters and digits in
+// lower case, with runs of anything else replaced by a dash
+func endpointID(name string) string {
+	var id strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && id.Len() > 0 {
+				id.WriteByte('-')
+			}
+			id.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	return id.String()
+}
+
+// normalizeCapabilities checks capabilities, defaulting to chat and
+// dropping repeats
+func normalizeCapabilities(capabilities []string) ([]string, error) {
+	if len(capabilities) == 0 {
+		return []string{CapabilityChat}, nil
+	}
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, capability := range capabilities {
+		capability = strings.ToLower(strings.TrimSpace(capability))
+		valid := false
+		for _, known := range Capabilities {
+			valid = valid || capability == known
+		}
+		if !valid {
+			return nil, fmt.Errorf("%w, not %q", ErrInvalidCapability, capability)
+		}
+		if !seen[capability] {
+			seen[capability] = true
+			normalized = append(normalized, capability)
+		}
+	}
+	return normalized, nil
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testOllama is an Ollama server listing one model and answering every
+// question, which records the Authorization header it was sent
+func testOllama(t *testing.T, authorization *atomic.Value) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorization != nil {
+			authorization.Store(r.Header.Get("Authorization"))
+		}
+		if r.URL.Path == "/api/tags" {
+			w.Write([]byte(`{"models":[{"name":"llama3"}]}`))
+			return
+		}
+		w.Write([]byte(`{"message":{"role":"assistant","content":"Registered."},"done":true}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEndpointID(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"GPU box", "gpu-box"},
+		{"  Workstation #2 (upstairs) ", "workstation-2-upstairs"},
+		{"ollama", "ollama"},
+		{"Ünïcode", "n-code"},
+		{"---", ""},
+	}
+	for _, tt := range tests {
+		if got := endpointID(tt.name); got != tt.expected {
+			t.Errorf("Expected %q for %q, got %q", tt.expected, tt.name, got)
+		}
+	}
+}
+
+func TestEndpointRegistry(t *testing.T) {
+	var authorization atomic.Value
+	ollama := testOllama(t, &authorization)
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	guard := NewEndpointGuard(nil, true)
+
+	registry, err := NewEndpointRegistry(path, guard)
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	endpoint, err := registry.Add(EndpointSpec{
+		Name:  "GPU box",
+		URL:   strings.Replace(ollama.URL, "http://", "http://user:secret@", 1),
+		Token: "s3cret-token",
+	})
+	if err != nil {
+		t.Fatalf("Failed to add endpoint: %v", err)
+	}
+	if endpoint.ID != "gpu-box" || !endpoint.Can(CapabilityChat) || endpoint.Health.Status != HealthUnknown {
+		t.Errorf("Unexpected endpoint %+v", endpoint)
+	}
+	if strings.Contains(endpoint.URL, "secret") {
+		t.Errorf("Expected the password to be hidden, got %s", endpoint.URL)
+	}
+
+	tests := []struct {
+		name string
+		spec EndpointSpec
+		err  error
+	}{
+		{"same name", EndpointSpec{Name: "gpu BOX", URL: ollama.URL}, ErrEndpointExists},
+		{"no name", EndpointSpec{Name: " ", URL: ollama.URL}, ErrInvalidEndpointName},
+		{"bad url", EndpointSpec{Name: "other", URL: "gpu:11434"}, ErrInvalidEndpoint},
+		{"bad capability", EndpointSpec{Name: "other", URL: ollama.URL, Capabilities: []string{"chat", "dance"}}, ErrInvalidCapability},
+		{"metadata service", EndpointSpec{Name: "other", URL: "http://169.254.169.254"}, ErrEndpointBlocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := registry.Add(tt.spec); !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// Health checks keep the model list
+	checked := registry.Check(context.Background(), "gpu-box")
+	if checked.Health.Status != HealthOK || len(checked.Health.Models) != 1 || checked.Health.Models[0] != "llama3" {
+		t.Errorf("Unexpected health %+v", checked.Health)
+	}
+	if got := authorization.Load(); got != "Bearer s3cret-token" {
+		t.Errorf("Expected the token to be sent, got %v", got)
+	}
+	models, err := registry.Models(context.Background(), "gpu-box")
+	if err != nil || len(models) != 1 {
+		t.Errorf("Expected the cached models, got %v (%v)", models, err)
+	}
+
+	// Every request to an endpoint shares its service
+	first, err := registry.Service("gpu-box", CapabilityChat)
+	if err != nil {
+		t.Fatalf("Expected the service, got %v", err)
+	}
+	if second, _ := registry.Service("gpu-box", ""); second != first {
+		t.Error("Expected the same service for each request")
+	}
+	if answer, err := first.Ask("Who?", "llama3", ""); err != nil || answer != "Registered." {
+		t.Errorf("Expected an answer, got %q (%v)", answer, err)
+	}
+	if _, err := registry.Service("gpu-box", CapabilityEmbed); !errors.Is(err, ErrEndpointNotCapable) {
+		t.Errorf("Expected ErrEndpointNotCapable, got %v", err)
+	}
+
+	// Endpoints are saved with their credentials, readable only by the
+	// server
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected endpoints saved privately, got %v (%v)", info, err)
+	}
+	reloaded, err := NewEndpointRegistry(path, guard)
+	if err != nil {
+		t.Fatalf("Failed to reload registry: %v", err)
+	}
+	if list := reloaded.List(); len(list) != 1 || list[0].Name != "GPU box" {
+		t.Errorf("Expected the endpoint to be reloaded, got %+v", list)
+	}
+	reloaded.Check(context.Background(), "gpu-box")
+	if got := authorization.Load(); got != "Bearer s3cret-token" {
+		t.Errorf("Expected the reloaded token to be sent, got %v", got)
+	}
+
+	if err := registry.Remove("gpu-box"); err != nil {
+		t.Fatalf("Failed to remove endpoint: %v", err)
+	}
+	if err := registry.Remove("gpu-box"); !errors.Is(err, ErrEndpointNotFound) {
+		t.Errorf("Expected ErrEndpointNotFound, got %v", err)
+	}
+	if _, err := registry.Service("gpu-box", ""); !errors.Is(err, ErrEndpointNotFound) {
+		t.Errorf("Expected ErrEndpointNotFound, got %v", err)
+	}
+}
+
+func TestDescribeError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{&statusError{code: 503, body: "loading"}, "status 503"},
+		{&url.Error{Op: "Get", URL: "http://gpu-box:11434/api/tags", Err: ErrEndpointBlocked}, "blocked"},
+		{&url.Error{Op: "Get", URL: "http://gpu-box:11434/api/tags", Err: context.DeadlineExceeded}, "timed out"},
+		{&url.Error{Op: "Get", URL: "http://gpu-box:11434/api/tags", Err: errors.New("connection refused")}, "unreachable"},
+		{errors.New("failed to decode response"), "invalid response"},
+	}
+	for _, tt := range tests {
+		if got := DescribeError(tt.err); got != tt.expected {
+			t.Errorf("Expected %q for %v, got %q", tt.expected, tt.err, got)
+		}
+	}
+}
+
+func TestEndpointRegistry_HealthChecks(t *testing.T) {
+	ollama := testOllama(t, nil)
+	registry, err := NewEndpointRegistry(filepath.Join(t.TempDir(), "endpoints.json"), NewEndpointGuard(nil, true))
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	registry.Add(EndpointSpec{Name: "up", URL: ollama.URL})
+	// Nothing listens on port 1
+	registry.Add(EndpointSpec{Name: "down", URL: "http://127.0.0.1:1"})
+
+	registry.Start(time.Hour)
+	defer registry.Stop()
+
+	// The first checks run straight away
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		up, _ := registry.Get("up")
+		down, _ := registry.Get("down")
+		if up.Health.Status == HealthOK && down.Health.Status == HealthError {
+			// The error doesn't give the endpoint's address away
+			if down.Health.Error != "unreachable" || down.Health.CheckedAt.IsZero() {
+				t.Errorf("Expected the failure to be recorded, got %+v", down.Health)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected health checks, got %+v and %+v", up.Health, down.Health)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := registry.Models(context.Background(), "down"); err == nil || DescribeError(err) != "unreachable" {
+		t.Errorf("Expected an unhealthy endpoint's models to fail, got %v", err)
+	}
+}
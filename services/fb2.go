@@ -0,0 +1,139 @@
+package services
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// fb2Paragraphs are the FictionBook elements holding a line or paragraph of text
+var fb2Paragraphs = map[string]bool{
+	"p": true, "v": true, "subtitle": true, "text-author": true, "td": true,
+}
+
+// readFB2 extracts the text and title-info metadata of a FictionBook2 file.
+// FB2 files declare their own encoding, often windows-1251.
+func readFB2(path string) (*NovelContent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	encoding := CharsetUTF8
+	decoder := xml.NewDecoder(f)
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		encoding = strings.ToLower(label)
+		return charset.NewReaderLabel(label, input)
+	}
+
+	metadata := make(map[string]string)
+	var authors, genres []string
+	var author []string
+	var paragraphs []string
+	var text strings.Builder
+	var stack []string
+	inParagraph := 0
+
+	within := func(names ...string) bool {
+		i := 0
+		for _, name := range stack {
+			if i < len(names) && name == names[i] {
+				i++
+			}
+		}
+		return i == len(names)
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse FB2 file: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if within("body") && fb2Paragraphs[t.Name.Local] {
+				inParagraph++
+			}
+			if t.Name.Local == "author" && within("title-info") {
+				author = nil
+			}
+		case xml.EndElement:
+			name := t.Name.Local
+			switch {
+			case within("body") && fb2Paragraphs[name]:
+				inParagraph--
+				if inParagraph == 0 {
+					if p := strings.Join(strings.Fields(text.String()), " "); p != "" {
+						paragraphs = append(paragraphs, p)
+					}
+					text.Reset()
+				}
+			case within("title-info", "author") && name == "author":
+				if a := strings.Join(author, " "); a != "" {
+					authors = append(authors, a)
+				}
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			value := string(t)
+			switch {
+			case inParagraph > 0:
+				text.WriteString(value)
+			case within("title-info", "author"):
+				if name := stack[len(stack)-1]; name == "first-name" || name == "middle-name" || name == "last-name" {
+					if v := strings.TrimSpace(value); v != "" {
+						author = append(author, v)
+					}
+				}
+			case within("title-info", "annotation"):
+				metadata["description"] = strings.TrimSpace(metadata["description"] + " " + strings.Join(strings.Fields(value), " "))
+			case within("title-info"):
+				v := strings.TrimSpace(value)
+				switch stack[len(stack)-1] {
+				case "book-title":
+					metadata["title"] = v
+				case "lang":
+					metadata["language"] = v
+				case "date":
+					metadata["date"] = v
+				case "genre":
+					if v != "" {
+						genres = append(genres, v)
+					}
+				}
+			case within("publish-info"):
+				if stack[len(stack)-1] == "publisher" {
+					metadata["publisher"] = strings.TrimSpace(value)
+				}
+			}
+		}
+	}
+
+	if len(authors) > 0 {
+		metadata["author"] = strings.Join(authors, ", ")
+	}
+	if len(genres) > 0 {
+		metadata["genre"] = strings.Join(genres, ", ")
+	}
+	for key, value := range metadata {
+		if value == "" {
+			delete(metadata, key)
+		}
+	}
+
+	return &NovelContent{
+		Text:     strings.Join(paragraphs, "\n\n"),
+		Encoding: encoding,
+		Metadata: metadata,
+	}, nil
+}
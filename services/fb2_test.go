@@ -0,0 +1,78 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadNovel_FB2(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "emma.fb2")
+	doc := `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description>
+<title-info>
+<genre>prose_classic</genre>
+<author><first-name>Jane</first-name><last-name>Austen</last-name></author>
+<book-title>Emma</book-title>
+<annotation><p>A comedy of manners.</p></annotation>
+<lang>en</lang>
+</title-info>
+</description>
+<body>
+<title><p>Chapter I</p></title>
+<section>
+<p>Emma Woodhouse, <emphasis>handsome</emphasis>, clever, and rich.</p>
+<poem><stanza><v>A line of verse</v></stanza></poem>
+</section>
+</body>
+<binary id="cover.jpg" content-type="image/jpeg">AAAA</binary>
+</FictionBook>`
+	if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	ns := NewNovelService(tempDir)
+	content, err := ns.ReadNovelWithOptions(path, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := "Chapter I\n\nEmma Woodhouse, handsome, clever, and rich.\n\nA line of verse"
+	if content.Text != expected {
+		t.Errorf("Expected text %q, got %q", expected, content.Text)
+	}
+
+	metadata := map[string]string{
+		"title": "Emma", "author": "Jane Austen", "language": "en",
+		"genre": "prose_classic", "description": "A comedy of manners.",
+	}
+	for key, value := range metadata {
+		if content.Metadata[key] != value {
+			t.Errorf("Expected metadata %s=%q, got %q", key, value, content.Metadata[key])
+		}
+	}
+}
+
+func TestReadNovel_FB2DeclaredEncoding(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "cyrillic.fb2")
+	// "Привет" in windows-1251
+	doc := "<?xml version=\"1.0\" encoding=\"windows-1251\"?><FictionBook><body><p>\xcf\xf0\xe8\xe2\xe5\xf2</p></body></FictionBook>"
+	if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	ns := NewNovelService(tempDir)
+	content, err := ns.ReadNovelWithOptions(path, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if content.Text != "Привет" {
+		t.Errorf("Expected text %q, got %q", "Привет", content.Text)
+	}
+	if content.Encoding != "windows-1251" {
+		t.Errorf("Expected encoding windows-1251, got %s", content.Encoding)
+	}
+}
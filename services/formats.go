@@ -0,0 +1,325 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsupportedFormat is returned when a file isn't in any registered format
+var ErrUnsupportedFormat = errors.New("unsupported file format")
+
+// sniffLen is how much of a file is read to recognise its format
+const sniffLen = 4096
+
+// Format describes a novel file format and how to read it
+type Format struct {
+	Name       string
+	Extensions []string
+	MIMETypes  []string
+	// SelfDescribing formats have contents that identify them regardless
+	// of the filename; others are only recognised by name or MIME type
+	SelfDescribing bool
+	sniff          func(sig *fileSignature) bool
+	read           func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error)
+}
+
+// fileSignature is what format detection knows about a file's contents
+type fileSignature struct {
+	head []byte
+	// zipNames lists the entries when the file is a ZIP archive, and
+	// zipMimetype holds its "mimetype" entry as used by EPUB and ODF
+	zipNames    []string
+	zipMimetype string
+}
+
+func (sig *fileSignature) hasZipEntry(name string) bool {
+	for _, n := range sig.zipNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// formats is the registry of supported formats, in detection order
+var formats = []*Format{
+	{
+		Name:           "pdf",
+		Extensions:     []string{".pdf"},
+		MIMETypes:      []string{"application/pdf"},
+		SelfDescribing: true,
+		sniff: func(sig *fileSignature) bool {
+			return bytes.Contains(sig.head[:min(len(sig.head), 1024)], []byte("%PDF-"))
+		},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			return ns.readPDF(path)
+		},
+	},
+	{
+		Name:           "epub",
+		Extensions:     []string{".epub"},
+		MIMETypes:      []string{"application/epub+zip"},
+		SelfDescribing: true,
+		sniff: func(sig *fileSignature) bool {
+			return sig.zipMimetype == "application/epub+zip" || sig.hasZipEntry("META-INF/container.xml")
+		},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			text, err := ns.readEPUB(path)
+			if err != nil {
+				return nil, err
+			}
+			return &NovelContent{Text: text, Metadata: readEPUBMetadata(path)}, nil
+		},
+	},
+	{
+		Name:           "docx",
+		Extensions:     []string{".docx"},
+		MIMETypes:      []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		SelfDescribing: true,
+		sniff: func(sig *fileSignature) bool {
+			return sig.hasZipEntry("word/document.xml")
+		},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			return readDOCX(path)
+		},
+	},
+	{
+		Name:           "odt",
+		Extensions:     []string{".odt"},
+		MIMETypes:      []string{"application/vnd.oasis.opendocument.text"},
+		SelfDescribing: true,
+		sniff: func(sig *fileSignature) bool {
+			return sig.zipMimetype == "application/vnd.oasis.opendocument.text"
+		},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			return readODT(path)
+		},
+	},
+	{
+		Name:           "fb2",
+		Extensions:     []string{".fb2"},
+		MIMETypes:      []string{"application/x-fictionbook+xml", "text/fb2+xml"},
+		SelfDescribing: true,
+		sniff: func(sig *fileSignature) bool {
+			return looksLikeText(sig.head) && bytes.Contains(sig.head, []byte("<FictionBook"))
+		},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			return readFB2(path)
+		},
+	},
+	{
+		Name:           "html",
+		Extensions:     []string{".html", ".htm", ".xhtml"},
+		MIMETypes:      []string{"text/html", "application/xhtml+xml"},
+		SelfDescribing: true,
+		sniff: func(sig *fileSignature) bool {
+			head := bytes.ToLower(sig.head)
+			return looksLikeText(sig.head) && (bytes.Contains(head, []byte("<!doctype html")) || bytes.Contains(head, []byte("<html")))
+		},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			return readHTML(path, opts)
+		},
+	},
+	{
+		Name:       "markdown",
+		Extensions: []string{".md", ".markdown"},
+		MIMETypes:  []string{"text/markdown", "text/x-markdown"},
+		sniff: func(sig *fileSignature) bool {
+			return looksLikeText(sig.head)
+		},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			return readMarkdown(path, opts)
+		},
+	},
+	{
+		Name:       "txt",
+		Extensions: []string{".txt"},
+		MIMETypes:  []string{"text/plain"},
+		sniff: func(sig *fileSignature) bool {
+			return looksLikeText(sig.head)
+		},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			return readPlainText(path, opts)
+		},
+	},
+}
+
+// Formats returns the registered novel formats
+func Formats() []*Format {
+	return formats
+}
+
+// SupportedExtensions lists the filename extensions of all registered formats
+func SupportedExtensions() []string {
+	var exts []string
+	for _, f := range formats {
+		exts = append(exts, f.Extensions...)
+	}
+	return exts
+}
+
+// FormatByName returns the registered format with the given name, or nil
+func FormatByName(name string) *Format {
+	for _, f := range formats {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// FormatByExtension returns the format registered for a filename's
+// extension, or nil
+func FormatByExtension(filename string) *Format {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, f := range formats {
+		for _, e := range f.Extensions {
+			if e == ext {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// FormatByMIME returns the format registered for a MIME type, or nil.
+// Parameters such as charset are ignored.
+func FormatByMIME(contentType string) *Format {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	for _, f := range formats {
+		for _, m := range f.MIMETypes {
+			if m == mediaType {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// DetectFormat works out the format of a novel from its contents. The
+// filename and declared MIME type decide between formats the contents alone
+// can't tell apart, such as plain text and Markdown, but a file whose
+// contents don't match its name is only accepted when the contents carry an
+// unambiguous signature of another format.
+func DetectFormat(filename, contentType string, r io.ReaderAt, size int64) (*Format, error) {
+	sig, err := readSignature(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := FormatByExtension(filename)
+	if claimed == nil {
+		claimed = FormatByMIME(contentType)
+	}
+	if claimed != nil && claimed.sniff(sig) {
+		return claimed, nil
+	}
+
+	for _, f := range formats {
+		if f.SelfDescribing && f.sniff(sig) {
+			return f, nil
+		}
+	}
+
+	if claimed != nil {
+		return nil, fmt.Errorf("%w: '%s' does not contain %s data", ErrUnsupportedFormat, filename, claimed.Name)
+	}
+	return nil, fmt.Errorf("%w: '%s' (supported: %s)", ErrUnsupportedFormat, filename, strings.Join(SupportedExtensions(), ", "))
+}
+
+// DetectFileFormat runs DetectFormat on a file on disk
+func DetectFileFormat(path string) (*Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return DetectFormat(path, "", f, info.Size())
+}
+
+// readSignature reads the start of a file and, for ZIP archives, the names
+// of its entries
+func readSignature(r io.ReaderAt, size int64) (*fileSignature, error) {
+	head := make([]byte, min(size, sniffLen))
+	if _, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	sig := &fileSignature{head: head}
+
+	if !bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		return sig, nil
+	}
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, &ArchiveError{Kind: ArchiveMalformed, Detail: "not a readable ZIP file", Err: err}
+	}
+	if err := checkZipArchive(archive); err != nil {
+		return nil, err
+	}
+	for _, file := range archive.File {
+		sig.zipNames = append(sig.zipNames, file.Name)
+		if file.Name == "mimetype" && file.UncompressedSize64 < 256 {
+			if rc, err := file.Open(); err == nil {
+				data, _ := io.ReadAll(rc)
+				rc.Close()
+				sig.zipMimetype = strings.TrimSpace(string(data))
+			}
+		}
+	}
+	return sig, nil
+}
+
+// looksLikeText reports whether data is plausibly text in one of the
+// encodings DetectCharset recognises
+func looksLikeText(data []byte) bool {
+	switch DetectCharset(data) {
+	case CharsetUTF16LE, CharsetUTF16BE:
+		return true
+	}
+
+	for _, b := range data {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' {
+			return false
+		}
+	}
+	return true
+}
+
+// readPlainText reads a text file, converting it to UTF-8 from either the
+// requested charset or the one detected in the file
+func readPlainText(path string, opts ReadOptions) (*NovelContent, error) {
+	text, encoding, err := readTextFile(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &NovelContent{Text: text, Encoding: encoding}, nil
+}
+
+// readTextFile reads a file as text in the requested or detected charset
+func readTextFile(path string, opts ReadOptions) (string, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	charset := opts.Charset
+	if charset == "" {
+		charset = DetectCharset(data)
+	}
+	return DecodeText(data, charset)
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestZip builds a ZIP archive from name/content pairs, storing each
+// entry uncompressed in the order given
+func writeTestZip(t *testing.T, path string, entries [][2]string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: entry[0], Method: zip.Store})
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		f.Write([]byte(entry[1]))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to write zip: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+}
+
+func TestFormatByExtension(t *testing.T) {
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{"novel.txt", "txt"},
+		{"NOVEL.EPUB", "epub"},
+		{"novel.htm", "html"},
+		{"novel.markdown", "markdown"},
+		{"novel.fb2", "fb2"},
+		{"novel.docx", "docx"},
+		{"novel.odt", "odt"},
+		{"novel.mobi", ""},
+		{"novel", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			format := FormatByExtension(tt.filename)
+			name := ""
+			if format != nil {
+				name = format.Name
+			}
+			if name != tt.expected {
+				t.Errorf("Expected format %q, got %q", tt.expected, name)
+			}
+		})
+	}
+}
+
+func TestFormatByMIME(t *testing.T) {
+	format := FormatByMIME("text/html; charset=utf-8")
+	if format == nil || format.Name != "html" {
+		t.Errorf("Expected html format, got %v", format)
+	}
+
+	if format := FormatByMIME("application/octet-stream"); format != nil {
+		t.Errorf("Expected no format, got %s", format.Name)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		filename    string
+		contentType string
+		data        string
+		expected    string
+		expectError bool
+	}{
+		{"plain text", "novel.txt", "", "It was a dark and stormy night.", "txt", false},
+		{"markdown by extension", "novel.md", "", "# Chapter One\n\nIt was a dark night.", "markdown", false},
+		{"html without extension", "novel", "", "<!DOCTYPE html><html><body>Hi</body></html>", "html", false},
+		{"html labelled as text", "novel.txt", "", "<html><body>Hi</body></html>", "txt", false},
+		{"pdf labelled as text", "novel.txt", "", "%PDF-1.4\n\x00\x01binary", "pdf", false},
+		{"fb2", "novel.xml", "", `<?xml version="1.0"?><FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">`, "fb2", false},
+		{"text by mime type", "upload", "text/plain", "Just some words.", "txt", false},
+		{"binary", "novel.txt", "", "\x00\x01\x02\x03", "", true},
+		{"unknown extension", "novel.mobi", "", "BOOKMOBI\x00\x00", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := DetectFormat(tt.filename, tt.contentType, bytes.NewReader([]byte(tt.data)), int64(len(tt.data)))
+			if tt.expectError {
+				if !errors.Is(err, ErrUnsupportedFormat) {
+					t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if format.Name != tt.expected {
+				t.Errorf("Expected format %q, got %q", tt.expected, format.Name)
+			}
+		})
+	}
+}
+
+func TestDetectFileFormat_ZipContainers(t *testing.T) {
+	tempDir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		entries  [][2]string
+		expected string
+	}{
+		{"epub", [][2]string{{"mimetype", "application/epub+zip"}, {"META-INF/container.xml", "<container/>"}}, "epub"},
+		{"docx", [][2]string{{"[Content_Types].xml", "<Types/>"}, {"word/document.xml", "<document/>"}}, "docx"},
+		{"odt", [][2]string{{"mimetype", "application/vnd.oasis.opendocument.text"}, {"content.xml", "<content/>"}}, "odt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No extension, so only the archive contents identify the format
+			path := filepath.Join(tempDir, tt.name)
+			writeTestZip(t, path, tt.entries)
+
+			format, err := DetectFileFormat(path)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if format.Name != tt.expected {
+				t.Errorf("Expected format %q, got %q", tt.expected, format.Name)
+			}
+		})
+	}
+}
+
+func TestDetectFormat_MismatchedExtension(t *testing.T) {
+	data := "Plain text saved with the wrong extension."
+	_, err := DetectFormat("novel.epub", "", bytes.NewReader([]byte(data)), int64(len(data)))
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
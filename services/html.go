@@ -0,0 +1,152 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// htmlBlockElements start a new paragraph in extracted HTML text
+var htmlBlockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"br": true, "dd": true, "div": true, "dl": true, "dt": true,
+	"figcaption": true, "footer": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "header": true, "hr": true,
+	"li": true, "main": true, "nav": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "tr": true, "ul": true,
+}
+
+// htmlSkippedElements hold no readable text
+var htmlSkippedElements = map[string]bool{
+	"head": true, "noscript": true, "script": true, "style": true, "template": true,
+}
+
+// htmlMetaNames maps <meta name="..."> values to metadata keys
+var htmlMetaNames = map[string]string{
+	"author":         "author",
+	"dc.creator":     "author",
+	"dc.title":       "title",
+	"description":    "description",
+	"dc.description": "description",
+	"keywords":       "keywords",
+	"dc.language":    "language",
+	"dc.publisher":   "publisher",
+	"dc.date":        "date",
+}
+
+// readHTML extracts the text and metadata of a standalone HTML document. The
+// charset comes from the override, a BOM or <meta> declaration, or detection.
+func readHTML(path string, opts ReadOptions) (*NovelContent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	label := opts.Charset
+	if label == "" {
+		_, name, certain := charset.DetermineEncoding(data, "")
+		if certain {
+			label = name
+		} else {
+			label = DetectCharset(data)
+		}
+	}
+	text, encoding, err := DecodeText(data, label)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := html.Parse(strings.NewReader(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %v", err)
+	}
+
+	return &NovelContent{
+		Text:     htmlToText(doc),
+		Encoding: encoding,
+		Metadata: htmlMetadata(doc),
+	}, nil
+}
+
+// htmlToText returns the readable text of an HTML tree, with block elements
+// separated into paragraphs
+func htmlToText(doc *html.Node) string {
+	var paragraphs []string
+	var current bytes.Buffer
+
+	flush := func() {
+		if p := strings.Join(strings.Fields(current.String()), " "); p != "" {
+			paragraphs = append(paragraphs, p)
+		}
+		current.Reset()
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			current.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			if htmlSkippedElements[n.Data] {
+				return
+			}
+			if htmlBlockElements[n.Data] {
+				flush()
+				defer flush()
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+	flush()
+
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// htmlMetadata collects the title, language and <meta> details of a document
+func htmlMetadata(doc *html.Node) map[string]string {
+	metadata := make(map[string]string)
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "html":
+				if lang := htmlAttr(n, "lang"); lang != "" {
+					metadata["language"] = lang
+				}
+			case "title":
+				if n.FirstChild != nil && metadata["title"] == "" {
+					metadata["title"] = strings.TrimSpace(n.FirstChild.Data)
+				}
+			case "meta":
+				key := htmlMetaNames[strings.ToLower(htmlAttr(n, "name"))]
+				if content := strings.TrimSpace(htmlAttr(n, "content")); key != "" && content != "" {
+					metadata[key] = content
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+
+	return metadata
+}
+
+func htmlAttr(n *html.Node, name string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
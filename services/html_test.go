@@ -0,0 +1,65 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadNovel_HTML(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "emma.html")
+	doc := `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Emma</title>
+<meta name="author" content="Jane Austen">
+<style>p { margin: 0 }</style>
+<script>alert("hi")</script>
+</head>
+<body>
+<h1>Chapter I</h1>
+<p>Emma Woodhouse, <em>handsome</em>, clever, and rich.</p>
+<p>She was the youngest&nbsp;of the two daughters.</p>
+</body>
+</html>`
+	if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	ns := NewNovelService(tempDir)
+	content, err := ns.ReadNovelWithOptions(path, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := "Chapter I\n\nEmma Woodhouse, handsome, clever, and rich.\n\nShe was the youngest of the two daughters."
+	if content.Text != expected {
+		t.Errorf("Expected text %q, got %q", expected, content.Text)
+	}
+	if content.Format != "html" {
+		t.Errorf("Expected format html, got %s", content.Format)
+	}
+	if content.Metadata["title"] != "Emma" || content.Metadata["author"] != "Jane Austen" || content.Metadata["language"] != "en" {
+		t.Errorf("Unexpected metadata %v", content.Metadata)
+	}
+}
+
+func TestReadNovel_HTMLDeclaredCharset(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "latin.htm")
+	doc := "<html><head><meta charset=\"iso-8859-1\"></head><body><p>Caf\xe9</p></body></html>"
+	if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	ns := NewNovelService(tempDir)
+	content, err := ns.ReadNovelWithOptions(path, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if content.Text != "Café" {
+		t.Errorf("Expected text %q, got %q", "Café", content.Text)
+	}
+}
@@ -0,0 +1,283 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Ingestion stages reported while a novel is processed
+const (
+	StageQueued    = "queued"
+	StageParsing   = "parsing"
+	StageChunking  = "chunking"
+	StageEmbedding = "embedding"
+	StageIndexing  = "indexing"
+	StageDone      = "done"
+	StageFailed    = "failed"
+)
+
+// IngestProgress reports how far ingestion has got. Done and Total count
+// embedded chunks during the embedding stage and are zero otherwise.
+type IngestProgress func(stage string, done, total int)
+
+// IngestOptions control how a novel is ingested
+type IngestOptions struct {
+	ReadOptions
+	// OnDuplicate says what to do when the novel duplicates one already in
+	// the library: DuplicateSkip (the default), DuplicateLink or
+	// DuplicateReplace
+	OnDuplicate string
+	// KeepFiles leaves a skipped duplicate's file where it is, unindexed,
+	// for files the user put in the novels directory rather than uploaded
+	KeepFiles bool
+	// Owner is the user who uploaded the novel, recorded on its ingestion
+	// job so only they can follow it
+	Owner int64
+}
+
+// IngestResult describes a novel once it has been indexed
+type IngestResult struct {
+	// Chunks is the number of passages added, not counting child chunks
+	Chunks  int
+	Content *NovelContent
+	// Duplicate is the novel already in the library that this one
+	// duplicates, if any, and Action how the duplicate was handled. Action
+	// is empty for a near-duplicate indexed alongside the original.
+	Duplicate *DuplicateMatch
+	Action    string
+}
+
+// IngestService runs the pipeline that turns a saved novel file into
+// indexed chunks
+type IngestService struct {
+	novelService  *NovelService
+	chromaService *ChromaService
+	// mu lets a reconciliation pass run while no novel is being ingested
+	mu      sync.RWMutex
+	metrics *Metrics
+}
+
+func NewIngestService(ns *NovelService, cs *ChromaService) *IngestService {
+	return &IngestService{novelService: ns, chromaService: cs}
+}
+
+// SetMetrics records ingestion time, chunk counts and failures to m
+func (is *IngestService) SetMetrics(m *Metrics) {
+	is.metrics = m
+}
+
+// Ingest reads, chunks, embeds and indexes the novel saved at path, keyed
+// by its file name, replacing anything already indexed for it. A novel
+// duplicating one already in the library is handled as opts.OnDuplicate
+// says.
+func (is *IngestService) Ingest(path string, opts IngestOptions, progress IngestProgress) (*IngestResult, error) {
+	return is.IngestContext(context.Background(), path, opts, progress)
+}
+
+// IngestContext is Ingest logging each stage, and the outcome, to the
+// logger ctx carries
+func (is *IngestService) IngestContext(ctx context.Context, path string, opts IngestOptions, progress IngestProgress) (*IngestResult, error) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	return is.ingest(ctx, path, opts, progress)
+}
+
+// ingest implements IngestContext for callers that already hold is.mu,
+// recording metrics and logs for novels that are indexed
+func (is *IngestService) ingest(ctx context.Context, path string, opts IngestOptions, progress IngestProgress) (*IngestResult, error) {
+	logger := logging.FromContext(ctx).With("novel", filepath.Base(path))
+	if progress == nil {
+		progress = func(string, int, int) {}
+	}
+	stages := &stageTrace{logger: logger}
+
+	ctx, span := tracer.Start(ctx, "ingest", trace.WithAttributes(attribute.String("novel.name", filepath.Base(path))))
+	start := time.Now()
+	result, err := is.index(ctx, path, opts, func(stage string, done, total int) {
+		stages.enter(stage)
+		progress(stage, done, total)
+	})
+	stages.enter("")
+	if err != nil {
+		endSpan(span, err)
+		is.metrics.Error(CauseIngest)
+		logger.Error("Ingestion failed", "stage", stages.last, "duration_ms", time.Since(start).Milliseconds(), "error", err)
+		return nil, err
+	}
+	span.SetAttributes(
+		attribute.String("novel.format", result.Content.Format),
+		attribute.Int("ingest.chunks", result.Chunks),
+		attribute.String("ingest.duplicate_action", result.Action),
+	)
+	span.End()
+
+	attrs := []any{"format", result.Content.Format, "chunks", result.Chunks, "duration_ms", time.Since(start).Milliseconds(), stages.timings()}
+	if result.Duplicate != nil {
+		attrs = append(attrs, "duplicate_of", result.Duplicate.Name, "duplicate_action", result.Action)
+	}
+	logger.Info("Ingested novel", attrs...)
+	if result.Action == "" || result.Action == DuplicateReplace {
+		is.metrics.ObserveIngest(result.Content.Format, result.Chunks, time.Since(start))
+	}
+	return result, nil
+}
+
+// stageTrace times the stages of an ingestion as progress reports them
+type stageTrace struct {
+	logger  *slog.Logger
+	current string
+	started time.Time
+	// durations holds how long each finished stage took, in order
+	durations []slog.Attr
+	// last is the stage that finished most recently: on error, the one that
+	// failed
+	last string
+}
+
+// enter starts stage, finishing the one before it; an empty stage just
+// finishes the current one
+func (st *stageTrace) enter(stage string) {
+	if stage == st.current {
+		return
+	}
+	now := time.Now()
+	if st.current != "" {
+		took := now.Sub(st.started)
+		st.durations = append(st.durations, slog.Int64(st.current+"_ms", took.Milliseconds()))
+		st.logger.Debug("Ingestion stage finished", "stage", st.current, "duration_ms", took.Milliseconds())
+		st.last = st.current
+	}
+	if stage != "" {
+		st.logger.Debug("Ingestion stage started", "stage", stage)
+	}
+	st.current, st.started = stage, now
+}
+
+// timings groups the stage durations for the summary line
+func (st *stageTrace) timings() slog.Attr {
+	return slog.Attr{Key: "stages", Value: slog.GroupValue(st.durations...)}
+}
+
+// index runs the pipeline for ingest, with a span for each stage
+func (is *IngestService) index(ctx context.Context, path string, opts IngestOptions, progress IngestProgress) (*IngestResult, error) {
+	name := filepath.Base(path)
+
+	progress(StageParsing, 0, 0)
+	_, span := tracer.Start(ctx, "read_novel")
+	sum, err := hashFile(path)
+	if err != nil {
+		endSpan(span, err)
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	content, err := is.novelService.ReadNovelWithOptions(path, opts.ReadOptions)
+	if err != nil {
+		endSpan(span, err)
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	span.SetAttributes(
+		attribute.String("novel.format", content.Format),
+		attribute.String("novel.encoding", content.Encoding),
+		attribute.Int("novel.characters", len(content.Text)),
+		attribute.Int("novel.pages", len(content.Pages)),
+	)
+	span.End()
+	result := &IngestResult{Content: content}
+
+	fp := FingerprintText(content.Text)
+	if match := is.novelService.FindDuplicate(name, fp); match != nil {
+		result.Duplicate = match
+		switch {
+		case opts.OnDuplicate == DuplicateLink:
+			result.Action = DuplicateLink
+			if err := is.chromaService.DeleteNovel(name); err != nil {
+				return nil, fmt.Errorf("failed to link duplicate: %v", err)
+			}
+			if err := is.novelService.LinkDuplicate(name, match.Name); err != nil {
+				return nil, fmt.Errorf("failed to link duplicate: %v", err)
+			}
+			return result, nil
+		case opts.OnDuplicate == DuplicateReplace:
+			result.Action = DuplicateReplace
+			if err := is.chromaService.DeleteNovel(match.Name); err != nil {
+				return nil, fmt.Errorf("failed to remove replaced novel: %v", err)
+			}
+			if err := is.novelService.RemoveStored(match.Name); err != nil {
+				return nil, fmt.Errorf("failed to remove replaced novel: %v", err)
+			}
+		case match.Exact:
+			// Leave an exact copy out of the library
+			result.Action = DuplicateSkip
+			if err := is.chromaService.DeleteNovel(name); err != nil {
+				return nil, fmt.Errorf("failed to remove duplicate: %v", err)
+			}
+			remove := is.novelService.RemoveStored
+			if opts.KeepFiles {
+				remove = is.novelService.ForgetStored
+			}
+			if err := remove(name); err != nil {
+				return nil, fmt.Errorf("failed to remove duplicate: %v", err)
+			}
+			return result, nil
+		}
+	}
+	if err := is.novelService.SetFingerprint(name, fp); err != nil {
+		return nil, err
+	}
+
+	progress(StageChunking, 0, 0)
+	_, span = tracer.Start(ctx, "chunk")
+	// Index small child chunks for matching alongside the passages they expand to
+	chunks := is.novelService.ChunkNovel(name, content)
+	children := is.novelService.SplitChildren(chunks)
+	all := append(chunks, children...)
+	span.SetAttributes(attribute.Int("ingest.chunks", len(chunks)), attribute.Int("ingest.child_chunks", len(children)))
+	span.End()
+
+	progress(StageEmbedding, 0, len(all))
+	_, span = tracer.Start(ctx, "embed", trace.WithAttributes(attribute.Int("ingest.documents", len(all))))
+	docs := is.chromaService.EmbedChunks(all, func(done, total int) {
+		progress(StageEmbedding, done, total)
+	})
+	// The catalog says whose the file is, so owners survive re-ingestion
+	if owner := is.novelService.Owner(name); owner != 0 {
+		for i := range docs {
+			docs[i].Owner = owner
+		}
+	}
+	span.End()
+
+	progress(StageIndexing, 0, 0)
+	_, span = tracer.Start(ctx, "index", trace.WithAttributes(attribute.Int("ingest.documents", len(docs))))
+	err = is.chromaService.ReplaceNovel(name, docs)
+	endSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add to database: %v", err)
+	}
+	if err := is.novelService.SetIndexed(name, sum); err != nil {
+		return nil, err
+	}
+
+	result.Chunks = len(chunks)
+	return result, nil
+}
+
+// Remove purges a novel from the index and the catalog, deleting its file
+// if it is still there
+func (is *IngestService) Remove(name string) error {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	if err := is.chromaService.DeleteNovel(name); err != nil {
+		return fmt.Errorf("failed to remove from database: %v", err)
+	}
+	return is.novelService.RemoveStored(name)
+}
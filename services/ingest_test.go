@@ -0,0 +1,147 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIngest_ReportsStagesAndIndexes(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	cs := NewChromaService(filepath.Join(tempDir, "db"))
+
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	if err := os.WriteFile(path, []byte("Emma Woodhouse was rich. She lived with her father."), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	var stages []string
+	var lastDone, lastTotal int
+	result, err := NewIngestService(ns, cs).Ingest(path, IngestOptions{}, func(stage string, done, total int) {
+		if len(stages) == 0 || stages[len(stages)-1] != stage {
+			stages = append(stages, stage)
+		}
+		if stage == StageEmbedding {
+			lastDone, lastTotal = done, total
+		}
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []string{StageParsing, StageChunking, StageEmbedding, StageIndexing}
+	if !reflect.DeepEqual(stages, expected) {
+		t.Errorf("Expected stages %v, got %v", expected, stages)
+	}
+	// One passage plus two sentence children
+	if lastDone != 3 || lastTotal != 3 {
+		t.Errorf("Expected embedding progress 3/3, got %d/%d", lastDone, lastTotal)
+	}
+	if result.Chunks != 1 {
+		t.Errorf("Expected 1 chunk, got %d", result.Chunks)
+	}
+
+	context, err := cs.Query("father", 1, FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error querying, got %v", err)
+	}
+	if context != "Emma Woodhouse was rich. She lived with her father." {
+		t.Errorf("Unexpected context %q", context)
+	}
+}
+
+func TestIngest_ReplacesPreviousVersion(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	cs := NewChromaService(filepath.Join(tempDir, "db"))
+	ingest := NewIngestService(ns, cs)
+
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	for _, text := range []string{"First draft.", "Second draft."} {
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		if _, err := ingest.Ingest(path, IngestOptions{}, nil); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	context, err := cs.Query("draft", 5, FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error querying, got %v", err)
+	}
+	if context != "Second draft." {
+		t.Errorf("Expected only the second draft, got %q", context)
+	}
+}
+
+func TestIngest_ReadError(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	cs := NewChromaService(filepath.Join(tempDir, "db"))
+
+	_, err := NewIngestService(ns, cs).Ingest(filepath.Join(tempDir, "missing.txt"), IngestOptions{}, nil)
+	if err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestIngest_RecordsMetrics(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	is := NewIngestService(ns, NewChromaService(filepath.Join(tempDir, "db")))
+	m := NewMetrics(prometheus.NewRegistry())
+	is.SetMetrics(m)
+
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	os.WriteFile(path, []byte("Emma Woodhouse was rich. She lived with her father."), 0644)
+	if _, err := is.Ingest(path, IngestOptions{}, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := testutil.ToFloat64(m.ingestChunks.WithLabelValues("txt")); got != 1 {
+		t.Errorf("Expected 1 chunk for txt, got %v", got)
+	}
+
+	if _, err := is.Ingest(filepath.Join(tempDir, "novels", "missing.txt"), IngestOptions{}, nil); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if got := testutil.ToFloat64(m.errors.WithLabelValues(CauseIngest)); got != 1 {
+		t.Errorf("Expected 1 ingest error, got %v", got)
+	}
+}
+
+func TestIngest_TracesStages(t *testing.T) {
+	tempDir := t.TempDir()
+	is := NewIngestService(NewNovelService(filepath.Join(tempDir, "novels")), NewChromaService(filepath.Join(tempDir, "db")))
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	os.WriteFile(path, []byte("Emma Woodhouse was rich. She lived with her father."), 0644)
+
+	ctx, root := traceRoot(t)
+	if _, err := is.IngestContext(ctx, path, IngestOptions{}, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	root.End()
+
+	recorded := tracedSpans(root)
+	ingest, ok := recorded["ingest"]
+	if !ok || ingest.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Fatalf("Expected an ingest span under the caller's, got %v", recorded)
+	}
+	for _, name := range []string{"read_novel", "chunk", "embed", "index"} {
+		span, ok := recorded[name]
+		if !ok || span.Parent().SpanID() != ingest.SpanContext().SpanID() {
+			t.Errorf("Expected a %s span under ingest", name)
+		}
+	}
+	if got := spanAttr(recorded["chunk"], "ingest.child_chunks").AsInt64(); got != 2 {
+		t.Errorf("Expected 2 child chunks, got %d", got)
+	}
+	if got := spanAttr(recorded["read_novel"], "novel.format").AsString(); got != "txt" {
+		t.Errorf("Expected format txt, got %q", got)
+	}
+}
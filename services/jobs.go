@@ -0,0 +1,470 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Job is an ingestion job for one uploaded novel
+type Job struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	// Path is where the upload was saved, so the job can be rerun after a
+	// restart
+	Path        string `json:"path"`
+	Format      string `json:"format,omitempty"`
+	Charset     string `json:"charset,omitempty"`
+	OnDuplicate string `json:"onDuplicate,omitempty"`
+	// KeepFiles is set for files the watcher found, which are never deleted
+	// as duplicates
+	KeepFiles bool `json:"keepFiles,omitempty"`
+	// RequestID is the ID of the upload request that queued the job, so its
+	// logs can be tied back to it
+	RequestID string `json:"requestId,omitempty"`
+	// Owner is the user who uploaded the novel, or zero for jobs anyone can
+	// follow
+	Owner int64 `json:"owner,omitempty"`
+	// Trace holds the trace context of that request, so the job's spans
+	// join its trace
+	Trace map[string]string `json:"trace,omitempty"`
+
+	Stage string `json:"stage"`
+	// Done and Total count embedded chunks during the embedding stage
+	Done  int `json:"done,omitempty"`
+	Total int `json:"total,omitempty"`
+
+	// Chunks, Encoding and Stripped describe the indexed novel as for a
+	// synchronous upload
+	Chunks   int      `json:"chunks,omitempty"`
+	Encoding string   `json:"encoding,omitempty"`
+	Stripped []string `json:"stripped,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	// ErrorCode classifies failures such as malformed archives
+	ErrorCode string `json:"errorCode,omitempty"`
+	// Duplicate is a novel already in the library that this one duplicates,
+	// and DuplicateAction how it was handled
+	Duplicate       *DuplicateMatch `json:"duplicate,omitempty"`
+	DuplicateAction string          `json:"duplicateAction,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Finished reports whether the job has completed or failed
+func (j Job) Finished() bool {
+	return j.Stage == StageDone || j.Stage == StageFailed
+}
+
+const (
+	// DefaultJobRetention is how long finished jobs are kept
+	DefaultJobRetention = 7 * 24 * time.Hour
+	// DefaultMaxFinishedJobs is how many finished jobs are kept at most
+	DefaultMaxFinishedJobs = 500
+)
+
+// JobManager queues ingestion jobs for a bounded pool of workers. Jobs are
+// persisted so any that were queued or running when the server stopped are
+// run again when it next starts.
+type JobManager struct {
+	path    string
+	ingest  *IngestService
+	workers int
+	// Finished jobs are forgotten once older than retention, and the oldest
+	// once there are more than maxFinished
+	retention   time.Duration
+	maxFinished int
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	jobs        map[string]*Job
+	pending     []string
+	subscribers map[string][]chan Job
+	stopped     bool
+	wg          sync.WaitGroup
+}
+
+// NewJobManager creates a job manager that persists jobs to path and runs
+// them on the given number of workers. Jobs saved by a previous run are
+// loaded, and unfinished ones queued again.
+func NewJobManager(path string, ingest *IngestService, workers int) (*JobManager, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	jm := &JobManager{
+		path:        path,
+		ingest:      ingest,
+		workers:     workers,
+		retention:   DefaultJobRetention,
+		maxFinished: DefaultMaxFinishedJobs,
+		jobs:        make(map[string]*Job),
+		subscribers: make(map[string][]chan Job),
+	}
+	jm.cond = sync.NewCond(&jm.mu)
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read jobs: %v", err)
+	}
+	if err == nil {
+		var jobs []*Job
+		if err := json.Unmarshal(data, &jobs); err != nil {
+			return nil, fmt.Errorf("failed to parse jobs: %v", err)
+		}
+		for _, job := range jobs {
+			jm.jobs[job.ID] = job
+			if !job.Finished() {
+				job.Stage = StageQueued
+				job.Done, job.Total = 0, 0
+				jm.pending = append(jm.pending, job.ID)
+			}
+		}
+		sortJobIDs(jm.pending, jm.jobs)
+	}
+
+	return jm, nil
+}
+
+// SetRetention keeps finished jobs for maxAge, and at most maxFinished of
+// them
+func (jm *JobManager) SetRetention(maxAge time.Duration, maxFinished int) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jm.retention, jm.maxFinished = maxAge, maxFinished
+}
+
+// Start launches the workers. Jobs resumed from a previous run are picked
+// up first.
+func (jm *JobManager) Start() {
+	if n := len(jm.pending); n > 0 {
+		slog.Info("Resuming ingestion jobs", "count", n)
+	}
+	for i := 0; i < jm.workers; i++ {
+		jm.wg.Add(1)
+		go jm.work()
+	}
+}
+
+// Stop stops taking new work and waits for running jobs to finish. Queued
+// jobs stay saved and run when the manager next starts.
+func (jm *JobManager) Stop() {
+	jm.Shutdown(context.Background())
+}
+
+// Shutdown is Stop with a deadline. Jobs still running when ctx is done are
+// left saved at their last stage, so they run again from the start when the
+// manager next starts, and ctx's error is returned.
+func (jm *JobManager) Shutdown(ctx context.Context) error {
+	jm.mu.Lock()
+	jm.stopped = true
+	jm.cond.Broadcast()
+	jm.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jm.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	if saveErr := jm.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// Submit queues a job to ingest a saved upload
+func (jm *JobManager) Submit(filename, path string, opts IngestOptions) (Job, error) {
+	return jm.SubmitContext(context.Background(), filename, path, opts)
+}
+
+// SubmitContext is Submit recording the request ID ctx carries on the job,
+// so the job's logs carry it too
+func (jm *JobManager) SubmitContext(ctx context.Context, filename, path string, opts IngestOptions) (Job, error) {
+	now := time.Now()
+	job := &Job{
+		ID:          newJobID(),
+		Filename:    filename,
+		Path:        path,
+		Format:      opts.Format,
+		Charset:     opts.Charset,
+		OnDuplicate: opts.OnDuplicate,
+		KeepFiles:   opts.KeepFiles,
+		Owner:       opts.Owner,
+		RequestID:   logging.RequestID(ctx),
+		Trace:       propagation.MapCarrier{},
+		Stage:       StageQueued,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(job.Trace))
+	if len(job.Trace) == 0 {
+		job.Trace = nil
+	}
+
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jm.jobs[job.ID] = job
+	if err := jm.save(); err != nil {
+		delete(jm.jobs, job.ID)
+		return Job{}, err
+	}
+	jm.pending = append(jm.pending, job.ID)
+	jm.cond.Signal()
+	logging.FromContext(ctx).Info("Queued ingestion job", "job_id", job.ID, "filename", filename)
+	return *job, nil
+}
+
+// Get returns a snapshot of a job
+func (jm *JobManager) Get(id string) (Job, bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	job, ok := jm.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// PendingFiles returns the file names of the uploads that queued or running
+// jobs have yet to ingest
+func (jm *JobManager) PendingFiles() []string {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	var names []string
+	for _, job := range jm.jobs {
+		if !job.Finished() {
+			names = append(names, filepath.Base(job.Path))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Subscribe returns a channel receiving a snapshot of the job now and after
+// every change until it finishes, when the channel is closed. The returned
+// function unsubscribes early.
+func (jm *JobManager) Subscribe(id string) (<-chan Job, func(), bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	job, ok := jm.jobs[id]
+	if !ok {
+		return nil, nil, false
+	}
+
+	// Buffered so a slow reader only misses intermediate progress
+	ch := make(chan Job, 16)
+	ch <- *job
+	if job.Finished() {
+		close(ch)
+		return ch, func() {}, true
+	}
+	jm.subscribers[id] = append(jm.subscribers[id], ch)
+
+	cancel := func() {
+		jm.mu.Lock()
+		defer jm.mu.Unlock()
+		subs := jm.subscribers[id]
+		for i, sub := range subs {
+			if sub == ch {
+				jm.subscribers[id] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cancel, true
+}
+
+// work runs queued jobs until the manager is stopped
+func (jm *JobManager) work() {
+	defer jm.wg.Done()
+	for {
+		jm.mu.Lock()
+		for len(jm.pending) == 0 && !jm.stopped {
+			jm.cond.Wait()
+		}
+		if jm.stopped {
+			jm.mu.Unlock()
+			return
+		}
+		id := jm.pending[0]
+		jm.pending = jm.pending[1:]
+		job := *jm.jobs[id]
+		jm.mu.Unlock()
+
+		jm.run(job)
+	}
+}
+
+// run ingests a job's file, publishing each stage as it starts
+func (jm *JobManager) run(job Job) {
+	opts := IngestOptions{
+		ReadOptions: ReadOptions{Charset: job.Charset, Format: job.Format},
+		OnDuplicate: job.OnDuplicate,
+		KeepFiles:   job.KeepFiles,
+		Owner:       job.Owner,
+	}
+	logger := slog.Default().With("job_id", job.ID)
+	ctx := logging.NewContext(context.Background(), logger)
+	if job.RequestID != "" {
+		ctx = logging.WithRequestID(ctx, job.RequestID)
+	}
+	// Continue the upload's trace
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(job.Trace))
+
+	// A reader that panics fails its job rather than the server, and the
+	// failure is saved so the job isn't run again on every restart
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Ingestion job panicked", "panic", r, "stack", string(debug.Stack()))
+			jm.update(job.ID, func(j *Job) {
+				j.Done, j.Total = 0, 0
+				j.Stage = StageFailed
+				j.Error = fmt.Sprintf("ingestion failed: %v", r)
+			})
+		}
+	}()
+	result, err := jm.ingest.IngestContext(ctx, job.Path, opts, func(stage string, done, total int) {
+		jm.update(job.ID, func(j *Job) {
+			j.Stage, j.Done, j.Total = stage, done, total
+		})
+	})
+
+	jm.update(job.ID, func(j *Job) {
+		j.Done, j.Total = 0, 0
+		if err != nil {
+			j.Stage = StageFailed
+			j.Error = err.Error()
+			var archiveErr *ArchiveError
+			if errors.As(err, &archiveErr) {
+				j.ErrorCode = archiveErr.Kind
+			}
+			return
+		}
+		j.Stage = StageDone
+		j.Chunks = result.Chunks
+		j.Encoding = result.Content.Encoding
+		j.Stripped = result.Content.Stripped
+		j.Duplicate = result.Duplicate
+		j.DuplicateAction = result.Action
+	})
+}
+
+// update changes a job and notifies its subscribers. The job file is only
+// rewritten when the stage changes, not for every embedding step.
+func (jm *JobManager) update(id string, change func(*Job)) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	job := jm.jobs[id]
+	stage := job.Stage
+	change(job)
+	job.UpdatedAt = time.Now()
+
+	if job.Stage != stage {
+		if err := jm.save(); err != nil {
+			slog.Error("Failed to save ingestion jobs", "error", err)
+		}
+	}
+
+	for _, ch := range jm.subscribers[id] {
+		select {
+		case ch <- *job:
+		default:
+		}
+		if job.Finished() {
+			close(ch)
+		}
+	}
+	if job.Finished() {
+		delete(jm.subscribers, id)
+	}
+}
+
+// save prunes finished jobs and writes the rest to disk. The caller must
+// hold jm.mu.
+func (jm *JobManager) save() error {
+	jm.prune()
+	jobs := make([]*Job, 0, len(jm.jobs))
+	ids := make([]string, 0, len(jm.jobs))
+	for id := range jm.jobs {
+		ids = append(ids, id)
+	}
+	sortJobIDs(ids, jm.jobs)
+	for _, id := range ids {
+		jobs = append(jobs, jm.jobs[id])
+	}
+
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(jm.path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(jm.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save jobs: %v", err)
+	}
+	return nil
+}
+
+// prune forgets finished jobs past their retention, newest kept first. The
+// caller must hold jm.mu.
+func (jm *JobManager) prune() {
+	var finished []*Job
+	for _, job := range jm.jobs {
+		if job.Finished() {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(a, b int) bool {
+		return finished[a].UpdatedAt.After(finished[b].UpdatedAt)
+	})
+	cutoff := time.Now().Add(-jm.retention)
+	for i, job := range finished {
+		if i >= jm.maxFinished || job.UpdatedAt.Before(cutoff) {
+			delete(jm.jobs, job.ID)
+		}
+	}
+}
+
+// sortJobIDs orders job IDs by when the jobs were created
+func sortJobIDs(ids []string, jobs map[string]*Job) {
+	sort.SliceStable(ids, func(a, b int) bool {
+		return jobs[ids[a]].CreatedAt.Before(jobs[ids[b]].CreatedAt)
+	})
+}
+
+// newJobID returns a random job identifier
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
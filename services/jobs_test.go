@@ -0,0 +1,343 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+)
+
+// waitForJob polls a job until it finishes or the test times out
+func waitForJob(t *testing.T, jm *JobManager, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := jm.Get(id); ok && job.Finished() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return Job{}
+}
+
+func newTestJobManager(t *testing.T, dir string) *JobManager {
+	t.Helper()
+	ns := NewNovelService(filepath.Join(dir, "novels"))
+	cs := NewChromaService(filepath.Join(dir, "db"))
+	jm, err := NewJobManager(filepath.Join(dir, "db", "jobs.json"), NewIngestService(ns, cs), 2)
+	if err != nil {
+		t.Fatalf("Failed to create job manager: %v", err)
+	}
+	return jm
+}
+
+func TestJobManager_RunsSubmittedJobs(t *testing.T) {
+	tempDir := t.TempDir()
+	jm := newTestJobManager(t, tempDir)
+	jm.Start()
+	defer jm.Stop()
+
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	if err := os.WriteFile(path, []byte("Emma Woodhouse, handsome, clever, and rich."), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	job, err := jm.Submit("emma.txt", path, IngestOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if job.Stage != StageQueued {
+		t.Errorf("Expected queued job, got %s", job.Stage)
+	}
+
+	job = waitForJob(t, jm, job.ID)
+	if job.Stage != StageDone {
+		t.Errorf("Expected job to be done, got %s (%s)", job.Stage, job.Error)
+	}
+	if job.Chunks != 1 || job.Encoding != CharsetUTF8 {
+		t.Errorf("Unexpected job result %+v", job)
+	}
+}
+
+func TestJobManager_ReportsFailure(t *testing.T) {
+	tempDir := t.TempDir()
+	jm := newTestJobManager(t, tempDir)
+	jm.Start()
+	defer jm.Stop()
+
+	job, err := jm.Submit("missing.txt", filepath.Join(tempDir, "missing.txt"), IngestOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	job = waitForJob(t, jm, job.ID)
+	if job.Stage != StageFailed || job.Error == "" {
+		t.Errorf("Expected failed job with an error, got %+v", job)
+	}
+}
+
+func TestJobManager_RecoversFromPanics(t *testing.T) {
+	// A reader with a bug that panics
+	formats = append(formats, &Format{
+		Name:       "panicky",
+		Extensions: []string{".panicky"},
+		read: func(ns *NovelService, path string, opts ReadOptions) (*NovelContent, error) {
+			panic("negative Repeat count")
+		},
+	})
+	defer func() { formats = formats[:len(formats)-1] }()
+
+	tempDir := t.TempDir()
+	jm := newTestJobManager(t, tempDir)
+	jm.Start()
+	path := filepath.Join(tempDir, "novels", "emma.panicky")
+	if err := os.WriteFile(path, []byte("Emma"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	job, err := jm.Submit("emma.panicky", path, IngestOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	job = waitForJob(t, jm, job.ID)
+	if job.Stage != StageFailed || !strings.Contains(job.Error, "negative Repeat count") {
+		t.Errorf("Expected the panic to fail the job, got %+v", job)
+	}
+	jm.Stop()
+
+	// The failure is saved, so the job isn't run again
+	jm2 := newTestJobManager(t, tempDir)
+	if job, _ := jm2.Get(job.ID); job.Stage != StageFailed {
+		t.Errorf("Expected the failed job to be saved, got %s", job.Stage)
+	}
+	if pending := jm2.PendingFiles(); len(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %v", pending)
+	}
+}
+
+func TestJobManager_Subscribe(t *testing.T) {
+	tempDir := t.TempDir()
+	jm := newTestJobManager(t, tempDir)
+
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	if err := os.WriteFile(path, []byte("Emma Woodhouse. Handsome, clever, and rich."), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	job, err := jm.Submit("emma.txt", path, IngestOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Subscribe before the workers start so no progress is missed
+	updates, cancel, ok := jm.Subscribe(job.ID)
+	if !ok {
+		t.Fatal("Expected to subscribe to job")
+	}
+	defer cancel()
+	jm.Start()
+	defer jm.Stop()
+
+	stages := make(map[string]bool)
+	for update := range updates {
+		stages[update.Stage] = true
+	}
+	for _, stage := range []string{StageQueued, StageParsing, StageChunking, StageEmbedding, StageIndexing} {
+		if !stages[stage] {
+			t.Errorf("Expected an update for stage %s, got %v", stage, stages)
+		}
+	}
+
+	if _, _, ok := jm.Subscribe("unknown"); ok {
+		t.Error("Expected subscribing to an unknown job to fail")
+	}
+}
+
+func TestJobManager_ResumesUnfinishedJobs(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, []byte("Emma Woodhouse, handsome, clever, and rich."), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	// A job left mid-way through by a previous run
+	interrupted := []Job{{ID: "abc123", Filename: "emma.txt", Path: path, Stage: StageEmbedding, Done: 1, Total: 2, CreatedAt: time.Now()}}
+	data, _ := json.Marshal(interrupted)
+	os.MkdirAll(filepath.Join(tempDir, "db"), 0755)
+	if err := os.WriteFile(filepath.Join(tempDir, "db", "jobs.json"), data, 0644); err != nil {
+		t.Fatalf("Failed to write jobs: %v", err)
+	}
+
+	jm := newTestJobManager(t, tempDir)
+	job, ok := jm.Get("abc123")
+	if !ok || job.Stage != StageQueued {
+		t.Fatalf("Expected interrupted job to be queued again, got %+v", job)
+	}
+	if pending := jm.PendingFiles(); len(pending) != 1 || pending[0] != "emma.txt" {
+		t.Errorf("Expected emma.txt to be pending, got %v", pending)
+	}
+
+	jm.Start()
+	defer jm.Stop()
+	job = waitForJob(t, jm, "abc123")
+	if job.Stage != StageDone {
+		t.Errorf("Expected resumed job to be done, got %s (%s)", job.Stage, job.Error)
+	}
+	if pending := jm.PendingFiles(); len(pending) != 0 {
+		t.Errorf("Expected no pending files, got %v", pending)
+	}
+
+	// The finished state is persisted for the next restart
+	jm2 := newTestJobManager(t, tempDir)
+	if job, _ := jm2.Get("abc123"); job.Stage != StageDone {
+		t.Errorf("Expected persisted job to be done, got %s", job.Stage)
+	}
+}
+
+func TestJobManager_PrunesFinishedJobs(t *testing.T) {
+	tempDir := t.TempDir()
+	now := time.Now()
+	saved := []Job{
+		{ID: "old", Stage: StageDone, CreatedAt: now.Add(-10 * 24 * time.Hour), UpdatedAt: now.Add(-10 * 24 * time.Hour)},
+		{ID: "older-failure", Stage: StageFailed, CreatedAt: now.Add(-3 * time.Hour), UpdatedAt: now.Add(-3 * time.Hour)},
+		{ID: "recent", Stage: StageDone, CreatedAt: now.Add(-2 * time.Hour), UpdatedAt: now.Add(-2 * time.Hour)},
+		{ID: "newest", Stage: StageFailed, CreatedAt: now.Add(-time.Hour), UpdatedAt: now.Add(-time.Hour)},
+		{ID: "unfinished", Filename: "missing.txt", Path: filepath.Join(tempDir, "missing.txt"), Stage: StageQueued, CreatedAt: now.Add(-30 * 24 * time.Hour)},
+	}
+	data, _ := json.Marshal(saved)
+	os.MkdirAll(filepath.Join(tempDir, "db"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "db", "jobs.json"), data, 0644)
+
+	jm := newTestJobManager(t, tempDir)
+	jm.SetRetention(7*24*time.Hour, 3)
+	// Jobs are pruned whenever they are saved
+	jm.Start()
+	waitForJob(t, jm, "unfinished")
+	jm.Stop()
+
+	jm2 := newTestJobManager(t, tempDir)
+	for id, kept := range map[string]bool{"old": false, "older-failure": false, "recent": true, "newest": true, "unfinished": true} {
+		if _, ok := jm2.Get(id); ok != kept {
+			t.Errorf("Expected job %s kept %t, got %t", id, kept, ok)
+		}
+	}
+}
+
+func TestJobManager_ShutdownLeavesQueuedJobs(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte("Emma Woodhouse, handsome, clever, and rich."), 0644)
+
+	jm := newTestJobManager(t, tempDir)
+	jm.Start()
+	if err := jm.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Work submitted while stopping is saved for the next start
+	job, err := jm.Submit("emma.txt", path, IngestOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if current, _ := jm.Get(job.ID); current.Stage != StageQueued {
+		t.Errorf("Expected the job to stay queued, got %s", current.Stage)
+	}
+
+	jm2 := newTestJobManager(t, tempDir)
+	jm2.Start()
+	defer jm2.Stop()
+	if job := waitForJob(t, jm2, job.ID); job.Stage != StageDone {
+		t.Errorf("Expected the job to run after restart, got %s", job.Stage)
+	}
+}
+
+func TestJobManager_LogsWithRequestID(t *testing.T) {
+	var buf syncBuffer
+	logger, _ := logging.New(&buf, "debug", "json")
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	tempDir := t.TempDir()
+	jm := newTestJobManager(t, tempDir)
+	jm.Start()
+	defer jm.Stop()
+
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	os.WriteFile(path, []byte("Emma Woodhouse, handsome, clever, and rich."), 0644)
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	job, err := jm.SubmitContext(ctx, "emma.txt", path, IngestOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if job.RequestID != "req-1" {
+		t.Errorf("Expected the request ID on the job, got %q", job.RequestID)
+	}
+	waitForJob(t, jm, job.ID)
+
+	// Every stage is traced under the job and the request that queued it
+	logs := buf.String()
+	for _, expected := range []string{`"msg":"Ingestion stage finished"`, `"stage":"embedding"`, `"msg":"Ingested novel"`, `"stages":{"parsing_ms"`} {
+		if !strings.Contains(logs, expected) {
+			t.Errorf("Expected logs to contain %s, got:\n%s", expected, logs)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+		if strings.Contains(line, "Ingest") && (!strings.Contains(line, `"request_id":"req-1"`) || !strings.Contains(line, `"job_id":"`+job.ID+`"`)) {
+			t.Errorf("Expected the job and request IDs on %s", line)
+		}
+	}
+}
+
+// syncBuffer collects logs written from worker goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestJobManager_ContinuesTrace(t *testing.T) {
+	tempDir := t.TempDir()
+	jm := newTestJobManager(t, tempDir)
+	jm.Start()
+	defer jm.Stop()
+
+	path := filepath.Join(tempDir, "novels", "emma.txt")
+	os.WriteFile(path, []byte("Emma Woodhouse, handsome, clever, and rich."), 0644)
+
+	ctx, root := traceRoot(t)
+	job, err := jm.SubmitContext(ctx, "emma.txt", path, IngestOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	root.End()
+	if job.Trace["traceparent"] == "" {
+		t.Fatalf("Expected the trace context to be saved with the job, got %v", job.Trace)
+	}
+	waitForJob(t, jm, job.ID)
+
+	if span, ok := tracedSpans(root)["ingest"]; !ok || span.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Errorf("Expected the job's ingest span to continue the submitting trace")
+	}
+}
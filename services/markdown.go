@@ -0,0 +1,132 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	mdHeading   = regexp.MustCompile(`^\s{0,3}(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRule      = regexp.MustCompile(`^\s{0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdListItem  = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+	mdQuote     = regexp.MustCompile(`^\s{0,3}>\s?`)
+	mdRefDef    = regexp.MustCompile(`^\s{0,3}\[[^\]]+\]:\s*\S+`)
+	mdImage     = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink      = regexp.MustCompile(`\[([^\]]+)\](\([^)]*\)|\[[^\]]*\])`)
+	mdCode      = regexp.MustCompile("`+([^`]+)`+")
+	mdStrong    = regexp.MustCompile(`(\*\*|__|~~)(\S(?:.*?\S)?)(\*\*|__|~~)`)
+	mdEmphasis  = regexp.MustCompile(`(^|[^\w*])[*_](\S(?:[^*_]*?\S)?)[*_]([^\w*]|$)`)
+	mdHTMLTag   = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	mdEscape    = regexp.MustCompile(`\\([\\` + "`" + `*_{}\[\]()#+\-.!>])`)
+	frontMatter = regexp.MustCompile(`(?s)^---[ \t]*\n(.*?)\n---[ \t]*(\n|$)`)
+)
+
+// readMarkdown extracts the text of a Markdown file, taking metadata from
+// YAML front matter or the first top-level heading
+func readMarkdown(path string, opts ReadOptions) (*NovelContent, error) {
+	text, encoding, err := readTextFile(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if m := frontMatter.FindStringSubmatch(text); m != nil {
+		var fields map[string]interface{}
+		if err := yaml.Unmarshal([]byte(m[1]), &fields); err != nil {
+			return nil, fmt.Errorf("failed to parse Markdown front matter: %v", err)
+		}
+		for key, value := range fields {
+			switch v := value.(type) {
+			case string, int, float64, bool:
+				metadata[strings.ToLower(key)] = fmt.Sprint(v)
+			case []interface{}:
+				var items []string
+				for _, item := range v {
+					items = append(items, fmt.Sprint(item))
+				}
+				metadata[strings.ToLower(key)] = strings.Join(items, ", ")
+			}
+		}
+		text = text[len(m[0]):]
+	}
+
+	plain, title := markdownToText(text)
+	if metadata["title"] == "" && title != "" {
+		metadata["title"] = title
+	}
+
+	return &NovelContent{Text: plain, Encoding: encoding, Metadata: metadata}, nil
+}
+
+// markdownToText strips Markdown syntax, keeping paragraphs separated by
+// blank lines. It also returns the first top-level heading.
+func markdownToText(text string) (string, string) {
+	var lines []string
+	var title string
+	inFence := false
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			lines = append(lines, "")
+			continue
+		}
+		if inFence {
+			lines = append(lines, line)
+			continue
+		}
+
+		switch {
+		case mdRule.MatchString(line), mdRefDef.MatchString(line):
+			lines = append(lines, "")
+			continue
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			heading := markdownInline(m[2])
+			if m[1] == "#" && title == "" {
+				title = heading
+			}
+			// Headings stand alone as paragraphs
+			lines = append(lines, "", heading, "")
+			continue
+		}
+
+		for mdQuote.MatchString(line) {
+			line = mdQuote.ReplaceAllString(line, "")
+		}
+		line = mdListItem.ReplaceAllString(line, "")
+		lines = append(lines, markdownInline(line))
+	}
+
+	// Collapse runs of blank lines into single paragraph breaks
+	var paragraphs []string
+	var current []string
+	for _, line := range append(lines, "") {
+		if strings.TrimSpace(line) == "" {
+			if len(current) > 0 {
+				paragraphs = append(paragraphs, strings.Join(current, "\n"))
+				current = nil
+			}
+			continue
+		}
+		current = append(current, strings.TrimRight(line, " "))
+	}
+
+	return strings.Join(paragraphs, "\n\n"), title
+}
+
+// markdownInline removes inline Markdown markup from a line
+func markdownInline(line string) string {
+	line = mdImage.ReplaceAllString(line, "$1")
+	line = mdLink.ReplaceAllString(line, "$1")
+	line = mdCode.ReplaceAllString(line, "$1")
+	line = mdStrong.ReplaceAllString(line, "$2")
+	line = mdEmphasis.ReplaceAllString(line, "$1$2$3")
+	line = mdHTMLTag.ReplaceAllString(line, "")
+	return mdEscape.ReplaceAllString(line, "$1")
+}
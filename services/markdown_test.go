@@ -0,0 +1,67 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMarkdownToText(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expected      string
+		expectedTitle string
+	}{
+		{
+			name:          "headings and emphasis",
+			input:         "# Emma\n\n## Chapter I\n\nEmma was *handsome*, **clever**, and `rich`.",
+			expected:      "Emma\n\nChapter I\n\nEmma was handsome, clever, and rich.",
+			expectedTitle: "Emma",
+		},
+		{
+			name:     "links, lists and quotes",
+			input:    "See [the book](http://example.com).\n\n- one\n- two\n\n> quoted\n\n---\n\nEnd",
+			expected: "See the book.\n\none\ntwo\n\nquoted\n\nEnd",
+		},
+		{
+			name:     "fenced code",
+			input:    "Before\n\n```\n*kept as is*\n```\n\nAfter",
+			expected: "Before\n\n*kept as is*\n\nAfter",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, title := markdownToText(tt.input)
+			if text != tt.expected {
+				t.Errorf("Expected text %q, got %q", tt.expected, text)
+			}
+			if title != tt.expectedTitle {
+				t.Errorf("Expected title %q, got %q", tt.expectedTitle, title)
+			}
+		})
+	}
+}
+
+func TestReadNovel_MarkdownFrontMatter(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "emma.md")
+	doc := "---\ntitle: Emma\nauthor: Jane Austen\ntags: [novel, romance]\n---\n# Volume I\n\nEmma Woodhouse, handsome, clever, and rich.\n"
+	if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	ns := NewNovelService(tempDir)
+	content, err := ns.ReadNovelWithOptions(path, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if content.Text != "Volume I\n\nEmma Woodhouse, handsome, clever, and rich." {
+		t.Errorf("Unexpected text %q", content.Text)
+	}
+	if content.Metadata["title"] != "Emma" || content.Metadata["author"] != "Jane Austen" || content.Metadata["tags"] != "novel, romance" {
+		t.Errorf("Unexpected metadata %v", content.Metadata)
+	}
+}
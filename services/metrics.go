@@ -0,0 +1,196 @@
+package services
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Causes counted by the errors metric
+const (
+	CauseInvalidRequest    = "invalid_request"
+	CauseUploadRejected    = "upload_rejected"
+	CauseIngest            = "ingest"
+	CauseRetrieval         = "retrieval"
+	CauseOllamaUnavailable = "ollama_unavailable"
+	CauseOllamaStatus      = "ollama_status"
+	CauseOllamaResponse    = "ollama_response"
+	CauseRateLimited       = "rate_limited"
+	CauseQueueFull         = "queue_full"
+	CauseEndpointBlocked   = "endpoint_blocked"
+)
+
+// Metrics records Prometheus metrics for requests, ingestion, retrieval and
+// generation. Every method does nothing on a nil *Metrics, so services
+// record unconditionally whether or not metrics were set.
+type Metrics struct {
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	ingestDuration    *prometheus.HistogramVec
+	ingestChunks      *prometheus.CounterVec
+	retrievalDuration prometheus.Histogram
+	retrievalScore    prometheus.Histogram
+	ollamaDuration    *prometheus.HistogramVec
+	firstToken        *prometheus.HistogramVec
+	tokensPerSecond   *prometheus.HistogramVec
+	answers           *prometheus.CounterVec
+	retries           *prometheus.CounterVec
+	errors            *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics and registers them with reg
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	// Generation takes from a fraction of a second to minutes
+	ollamaBuckets := prometheus.ExponentialBuckets(0.1, 2, 12)
+
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "novelqa_http_requests_total",
+			Help: "HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "novelqa_http_request_duration_seconds",
+			Help:    "HTTP request latency by method and route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		ingestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "novelqa_ingest_duration_seconds",
+			Help:    "Time to read, chunk, embed and index a novel, by format.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 9),
+		}, []string{"format"}),
+		ingestChunks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "novelqa_ingest_chunks_total",
+			Help: "Passages indexed, not counting child chunks, by format.",
+		}, []string{"format"}),
+		retrievalDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "novelqa_retrieval_duration_seconds",
+			Help:    "Time to retrieve context for a question.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 4, 9),
+		}),
+		retrievalScore: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "novelqa_retrieval_top_score",
+			Help:    "Score of the best passage retrieved for a question, from 0 to 1.",
+			Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+		}),
+		ollamaDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "novelqa_ollama_request_duration_seconds",
+			Help:    "Ollama API call latency by call and model.",
+			Buckets: ollamaBuckets,
+		}, []string{"call", "model"}),
+		firstToken: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "novelqa_ollama_time_to_first_token_seconds",
+			Help:    "Time from sending a question to Ollama until the first answer text arrives, by model.",
+			Buckets: ollamaBuckets,
+		}, []string{"model"}),
+		tokensPerSecond: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "novelqa_ollama_tokens_per_second",
+			Help:    "Generation speed reported by Ollama's eval_count and eval_duration, by model.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"model"}),
+		answers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "novelqa_ollama_answers_total",
+			Help: "Questions answered, by the model asked for and the model that answered.",
+		}, []string{"requested", "model"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "novelqa_ollama_retries_total",
+			Help: "Ollama calls retried after a failure that may pass, by model.",
+		}, []string{"model"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "novelqa_errors_total",
+			Help: "Errors by cause.",
+		}, []string{"cause"}),
+	}
+
+	reg.MustRegister(m.requests, m.requestDuration, m.ingestDuration, m.ingestChunks,
+		m.retrievalDuration, m.retrievalScore, m.ollamaDuration, m.firstToken,
+		m.tokensPerSecond, m.answers, m.retries, m.errors)
+
+	// Start causes at zero so rates can be taken before the first error
+	for _, cause := range []string{CauseInvalidRequest, CauseUploadRejected, CauseIngest, CauseRetrieval,
+		CauseOllamaUnavailable, CauseOllamaStatus, CauseOllamaResponse, CauseRateLimited, CauseQueueFull, CauseEndpointBlocked} {
+		m.errors.WithLabelValues(cause)
+	}
+	return m
+}
+
+// ObserveRequest records an HTTP request to route, the route pattern rather
+// than the path so IDs don't each get their own series
+func (m *Metrics) ObserveRequest(method, route string, status int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	m.requestDuration.WithLabelValues(method, route).Observe(d.Seconds())
+}
+
+// ObserveIngest records a novel indexed as chunks passages
+func (m *Metrics) ObserveIngest(format string, chunks int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.ingestDuration.WithLabelValues(format).Observe(d.Seconds())
+	m.ingestChunks.WithLabelValues(format).Add(float64(chunks))
+}
+
+// ObserveRetrieval records a query, along with the score of its best
+// passage when it returned any
+func (m *Metrics) ObserveRetrieval(d time.Duration, topScore float64, found bool) {
+	if m == nil {
+		return
+	}
+	m.retrievalDuration.Observe(d.Seconds())
+	if found {
+		m.retrievalScore.Observe(topScore)
+	}
+}
+
+// ObserveOllama records the latency of an Ollama API call
+func (m *Metrics) ObserveOllama(call, model string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.ollamaDuration.WithLabelValues(call, model).Observe(d.Seconds())
+}
+
+// ObserveFirstToken records how long a model took to start answering
+func (m *Metrics) ObserveFirstToken(model string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.firstToken.WithLabelValues(model).Observe(d.Seconds())
+}
+
+// ObserveGeneration records generation speed from Ollama's eval_count and
+// eval_duration, ignoring responses that don't report them
+func (m *Metrics) ObserveGeneration(model string, evalCount int, evalDuration time.Duration) {
+	if m == nil || evalCount <= 0 || evalDuration <= 0 {
+		return
+	}
+	m.tokensPerSecond.WithLabelValues(model).Observe(float64(evalCount) / evalDuration.Seconds())
+}
+
+// ObserveAnswer counts a question asking for requested that model answered,
+// which differs when a fallback model answered
+func (m *Metrics) ObserveAnswer(requested, model string) {
+	if m == nil {
+		return
+	}
+	m.answers.WithLabelValues(requested, model).Inc()
+}
+
+// Retry counts an Ollama call for model made again after a failure
+func (m *Metrics) Retry(model string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(model).Inc()
+}
+
+// Error counts an error with one of the Cause constants
+func (m *Metrics) Error(cause string) {
+	if m == nil {
+		return
+	}
+	m.errors.WithLabelValues(cause).Inc()
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics_Nil(t *testing.T) {
+	// Services without metrics record nothing and don't panic
+	var m *Metrics
+	m.ObserveRequest("GET", "/", 200, time.Second)
+	m.ObserveIngest("txt", 3, time.Second)
+	m.ObserveRetrieval(time.Second, 1, true)
+	m.ObserveOllama("chat", "phi3", time.Second)
+	m.ObserveFirstToken("phi3", time.Second)
+	m.ObserveGeneration("phi3", 10, time.Second)
+	m.ObserveAnswer("llama3", "phi3")
+	m.Retry("phi3")
+	m.Error(CauseIngest)
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry())
+
+	m.ObserveRequest("GET", "/jobs/:id", 404, time.Millisecond)
+	m.ObserveIngest("txt", 3, time.Second)
+	m.ObserveIngest("txt", 2, time.Second)
+	m.ObserveRetrieval(time.Millisecond, 0.5, true)
+	m.ObserveRetrieval(time.Millisecond, 0, false)
+	m.ObserveGeneration("phi3", 0, time.Second)
+	m.ObserveGeneration("phi3", 50, 2*time.Second)
+	m.Error(CauseRetrieval)
+
+	if got := testutil.ToFloat64(m.requests.WithLabelValues("GET", "/jobs/:id", "404")); got != 1 {
+		t.Errorf("Expected 1 request, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.ingestChunks.WithLabelValues("txt")); got != 5 {
+		t.Errorf("Expected 5 chunks, got %v", got)
+	}
+	if got := testutil.CollectAndCount(m.retrievalScore); got != 1 {
+		t.Errorf("Expected one score series, got %d", got)
+	}
+	if got := testutil.ToFloat64(m.errors.WithLabelValues(CauseRetrieval)); got != 1 {
+		t.Errorf("Expected 1 retrieval error, got %v", got)
+	}
+	// Every cause is exported from the start
+	if got := testutil.CollectAndCount(m.errors); got != 10 {
+		t.Errorf("Expected 10 error causes, got %d", got)
+	}
+	// Responses without eval counts aren't observed
+	if got := testutil.CollectAndCount(m.tokensPerSecond); got != 1 {
+		t.Errorf("Expected one tokens per second series, got %d", got)
+	}
+}
@@ -2,27 +2,56 @@
 package services
 
 import (
-	"archive/zip"
-	"bufio"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"unicode"
 )
 
 type NovelChunk struct {
 	ID   string `json:"id"`
 	Text string `json:"text"`
+	// Novel is the file the chunk was cut from and Seq its position within
+	// that novel, counted separately for passages and for child chunks.
+	Novel string `json:"novel,omitempty"`
+	Seq   int    `json:"seq"`
+	// ParentID links a small child chunk back to the passage containing it.
+	ParentID string `json:"parentId,omitempty"`
+	// Page and EndPage are the source pages a chunk spans, for formats
+	// with pages such as PDF
+	Page    int `json:"page,omitempty"`
+	EndPage int `json:"endPage,omitempty"`
 }
 
+// defaultChunkWords is the number of words in each passage unless changed
+// with SetChunkWords
+const defaultChunkWords = 400
+
+// childChunkMaxWords caps the length of a child chunk when a sentence runs on
+const childChunkMaxWords = 60
+
 type NovelService struct {
-	novelsDir string
+	novelsDir  string
+	chunkWords int
+	// mu guards the catalog of stored uploads
+	mu sync.Mutex
 }
 
 func NewNovelService(dir string) *NovelService {
 	os.MkdirAll(dir, 0755)
-	return &NovelService{novelsDir: dir}
+	return &NovelService{novelsDir: dir, chunkWords: defaultChunkWords}
+}
+
+// SetChunkWords sets the number of words in each passage. Novels already
+// indexed keep their passages until they are ingested again.
+func (ns *NovelService) SetChunkWords(n int) {
+	if n < 1 {
+		n = defaultChunkWords
+	}
+	ns.chunkWords = n
 }
 
 func (ns *NovelService) LoadNovels() ([]NovelChunk, error) {
@@ -36,112 +65,247 @@ func (ns *NovelService) LoadNovels() ([]NovelChunk, error) {
 	for _, file := range files {
 		filePath := filepath.Join(ns.novelsDir, file.Name())
 
-		var content string
-		var err error
-
-		if filepath.Ext(file.Name()) == ".txt" {
-			contentBytes, err := os.ReadFile(filePath)
-			if err != nil {
-				continue
-			}
-			content = string(contentBytes)
-		} else if filepath.Ext(file.Name()) == ".epub" {
-			content, err = ns.readEPUB(filePath)
-			if err != nil {
-				continue
-			}
-		} else {
+		if FormatByExtension(file.Name()) == nil {
 			continue
 		}
 
-		words := strings.Fields(content)
-		for i := 0; i < len(words); i += 400 {
-			end := i + 400
-			if end > len(words) {
-				end = len(words)
-			}
-			chunk := strings.Join(words[i:end], " ")
-			chunks = append(chunks, NovelChunk{
-				ID:   file.Name() + "-" + fmt.Sprintf("%d", i/400),
-				Text: chunk,
-			})
+		content, err := ns.ReadNovelWithOptions(filePath, ReadOptions{})
+		if err != nil {
+			continue
 		}
+
+		chunks = append(chunks, ns.ChunkNovel(file.Name(), content)...)
 	}
 
 	return chunks, nil
 }
 
 func (ns *NovelService) SaveNovel(filename string, content []byte) error {
-	filePath := filepath.Join(ns.novelsDir, filename)
-	return os.WriteFile(filePath, content, 0644)
+	filePath := filepath.Join(ns.novelsDir, SanitizeFilename(filename))
+	return writeFileAtomic(filePath, content, 0644)
 }
 
 func (ns *NovelService) ProcessNovel(filename string, content string) []NovelChunk {
 	var chunks []NovelChunk
-	scanner := bufio.NewScanner(strings.NewReader(content))
-	var text strings.Builder
-
-	for scanner.Scan() {
-		text.WriteString(scanner.Text() + " ")
-	}
 
-	words := strings.Fields(text.String())
-	for i := 0; i < len(words); i += 400 {
-		end := i + 400
+	size := ns.chunkWords
+	words := strings.Fields(content)
+	for i := 0; i < len(words); i += size {
+		end := i + size
 		if end > len(words) {
 			end = len(words)
 		}
 		chunk := strings.Join(words[i:end], " ")
 		chunks = append(chunks, NovelChunk{
-			ID:   filename + "-" + fmt.Sprintf("%d", i/400),
-			Text: chunk,
+			ID:    filename + "-" + fmt.Sprintf("%d", i/size),
+			Text:  chunk,
+			Novel: filename,
+			Seq:   i / size,
 		})
 	}
 
 	return chunks
 }
 
+// ChunkNovel splits read novel content into passages like ProcessNovel,
+// tagging each passage with the source pages it spans when known
+func (ns *NovelService) ChunkNovel(filename string, content *NovelContent) []NovelChunk {
+	chunks := ns.ProcessNovel(filename, content.Text)
+	if len(content.Pages) == 0 {
+		return chunks
+	}
+
+	offsets := wordOffsets(content.Text)
+	pageAt := func(word int) int {
+		offset := offsets[word]
+		page := content.Pages[0].Number
+		for _, span := range content.Pages {
+			if span.Offset > offset {
+				break
+			}
+			page = span.Number
+		}
+		return page
+	}
+
+	for i := range chunks {
+		first := chunks[i].Seq * ns.chunkWords
+		last := first + len(strings.Fields(chunks[i].Text)) - 1
+		chunks[i].Page = pageAt(first)
+		chunks[i].EndPage = pageAt(last)
+	}
+	return chunks
+}
+
+// wordOffsets returns the byte offset of each word strings.Fields would
+// return for text
+func wordOffsets(text string) []int {
+	var offsets []int
+	inWord := false
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			inWord = false
+		} else if !inWord {
+			inWord = true
+			offsets = append(offsets, i)
+		}
+	}
+	return offsets
+}
+
+// SplitChildren breaks passages into sentence-sized child chunks for precise
+// matching. Children are numbered in reading order across each novel and keep
+// a ParentID pointing at the passage they came from.
+func (ns *NovelService) SplitChildren(passages []NovelChunk) []NovelChunk {
+	var children []NovelChunk
+	nextSeq := make(map[string]int)
+
+	for _, passage := range passages {
+		var sentence []string
+		n := 0
+
+		flush := func() {
+			if len(sentence) == 0 {
+				return
+			}
+			children = append(children, NovelChunk{
+				ID:       passage.ID + "-s" + fmt.Sprintf("%d", n),
+				Text:     strings.Join(sentence, " "),
+				Novel:    passage.Novel,
+				Seq:      nextSeq[passage.Novel],
+				ParentID: passage.ID,
+				Page:     passage.Page,
+				EndPage:  passage.EndPage,
+			})
+			nextSeq[passage.Novel]++
+			sentence = nil
+			n++
+		}
+
+		for _, word := range strings.Fields(passage.Text) {
+			sentence = append(sentence, word)
+			if endsSentence(word) || len(sentence) >= childChunkMaxWords {
+				flush()
+			}
+		}
+		flush()
+	}
+
+	return children
+}
+
+// endsSentence reports whether a word closes a sentence, ignoring any
+// trailing quotes or brackets
+func endsSentence(word string) bool {
+	word = strings.TrimRight(word, "\"')]”’»")
+	return strings.HasSuffix(word, ".") || strings.HasSuffix(word, "!") || strings.HasSuffix(word, "?")
+}
+
+// ReadOptions control how a novel file is read
+type ReadOptions struct {
+	// Charset overrides encoding detection for plain-text files
+	Charset string
+	// Format names the registered format to read the file as, for files
+	// whose format was detected from their contents rather than their name
+	Format string
+}
+
+// NovelContent is the text extracted from a novel file along with details
+// of how it was read
+type NovelContent struct {
+	Text string
+	// Format is the name of the registered format the file was read as
+	Format string
+	// Metadata holds details such as title and author for formats that
+	// record them
+	Metadata map[string]string
+	// Encoding is the charset plain text was decoded from
+	Encoding string
+	// Stripped describes boilerplate removed from the text, such as
+	// Project Gutenberg licence sections
+	Stripped []string
+	// Pages records where each source page starts in Text, for paged
+	// formats such as PDF
+	Pages []PageSpan
+}
+
 // Add the missing ReadNovel method
 func (ns *NovelService) ReadNovel(filepath string) (string, error) {
-	if strings.HasSuffix(filepath, ".epub") {
-		return ns.readEPUB(filepath)
+	content, err := ns.ReadNovelWithOptions(filepath, ReadOptions{})
+	if err != nil {
+		return "", err
 	}
+	return content.Text, nil
+}
 
-	content, err := os.ReadFile(filepath)
+// ReadNovelWithOptions reads a novel file, converting plain text to UTF-8
+// from either the requested charset or the one detected in the file, and
+// strips licence boilerplate and front matter from the result
+func (ns *NovelService) ReadNovelWithOptions(filepath string, opts ReadOptions) (*NovelContent, error) {
+	content, err := ns.readContent(filepath, opts)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	content.Text, content.Stripped = StripBoilerplate(content.Text)
+	content.Text, content.Pages = extractPageMarkers(content.Text)
+	return content, nil
+}
+
+// readContent extracts the raw text of a novel file using the reader for
+// its format. Files with an unknown extension are sniffed, falling back to
+// plain text.
+func (ns *NovelService) readContent(filepath string, opts ReadOptions) (*NovelContent, error) {
+	format := FormatByName(opts.Format)
+	if format == nil {
+		format = FormatByExtension(filepath)
+	}
+	if format == nil {
+		if detected, err := DetectFileFormat(filepath); err == nil {
+			format = detected
+		} else {
+			format = FormatByName("txt")
+		}
 	}
-	return string(content), nil
+
+	content, err := format.read(ns, filepath, opts)
+	if err != nil {
+		return nil, err
+	}
+	content.Format = format.Name
+	return content, nil
 }
 
 // readEPUB reads and extracts text content from an EPUB file
 func (ns *NovelService) readEPUB(filepath string) (string, error) {
 	// Open the EPUB file as a ZIP archive
-	reader, err := zip.OpenReader(filepath)
+	reader, err := openZip(filepath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open EPUB file: %v", err)
+		return "", fmt.Errorf("failed to open EPUB file: %w", err)
 	}
 	defer reader.Close()
 
 	var content strings.Builder
+	var total int
 
 	// Iterate through all files in the EPUB
 	for _, file := range reader.File {
 		// Look for HTML/XHTML content files
 		if strings.HasSuffix(file.Name, ".html") || strings.HasSuffix(file.Name, ".xhtml") {
-			// Open the file from the ZIP archive
-			rc, err := file.Open()
-			if err != nil {
-				continue
+			// Read the content, skipping unreadable files but stopping at
+			// entries that expand past the archive limits
+			data, err := readZipFile(file)
+			var archiveErr *ArchiveError
+			if errors.As(err, &archiveErr) && archiveErr.Kind == ArchiveEntryTooLarge {
+				return "", fmt.Errorf("failed to read EPUB file: %w", err)
 			}
-
-			// Read the content
-			data, err := io.ReadAll(rc)
 			if err != nil {
-				rc.Close()
 				continue
 			}
-			rc.Close()
+			total += len(data)
+			if total > maxZipTotalBytes {
+				return "", fmt.Errorf("failed to read EPUB file: %w", &ArchiveError{Kind: ArchiveTooLarge, Detail: fmt.Sprintf("expands to more than %d bytes", maxZipTotalBytes)})
+			}
 
 			// Simple text extraction (remove HTML tags)
 			text := ns.extractTextFromHTML(string(data))
@@ -185,3 +349,31 @@ func (ns *NovelService) extractTextFromHTML(html string) string {
 
 	return text
 }
+
+// epubMetadata maps OPF Dublin Core elements to metadata keys
+var epubMetadata = map[string]string{
+	"title": "title", "creator": "author", "language": "language",
+	"publisher": "publisher", "date": "date", "description": "description",
+	"subject": "subject",
+}
+
+// readEPUBMetadata returns the Dublin Core metadata from an EPUB's package
+// document, or nil when it can't be read
+func readEPUBMetadata(filepath string) map[string]string {
+	reader, err := openZip(filepath)
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		if strings.HasSuffix(file.Name, ".opf") {
+			data, err := readZipEntry(&reader.Reader, file.Name)
+			if err != nil {
+				return nil
+			}
+			return xmlMetadata(data, epubMetadata)
+		}
+	}
+	return nil
+}
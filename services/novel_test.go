@@ -3,6 +3,7 @@ package services
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -85,6 +86,19 @@ func TestNovelService_ProcessNovel(t *testing.T) {
 	}
 }
 
+func TestNovelService_SetChunkWords(t *testing.T) {
+	service := NewNovelService(t.TempDir())
+	service.SetChunkWords(3)
+
+	chunks := service.ProcessNovel("test.txt", "one two three four five six seven")
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+	if chunks[1].Text != "four five six" || chunks[1].Seq != 1 {
+		t.Errorf("Unexpected second chunk %+v", chunks[1])
+	}
+}
+
 func TestNovelService_ProcessNovel_EmptyContent(t *testing.T) {
 	dir := "test_novels"
 	service := NewNovelService(dir)
@@ -318,3 +332,95 @@ func TestNovelService_ProcessNovel_WithHTMLTags(t *testing.T) {
 		t.Errorf("Expected chunk text %q, got %q", cleanContent, chunks[0].Text)
 	}
 }
+
+func TestNovelService_ProcessNovel_SequencePositions(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	words := make([]string, 900)
+	for i := range words {
+		words[i] = "word"
+	}
+	chunks := service.ProcessNovel("long.txt", strings.Join(words, " "))
+
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+
+	for i, chunk := range chunks {
+		if chunk.Novel != "long.txt" {
+			t.Errorf("Chunk %d: expected novel long.txt, got %s", i, chunk.Novel)
+		}
+		if chunk.Seq != i {
+			t.Errorf("Chunk %d: expected seq %d, got %d", i, i, chunk.Seq)
+		}
+		if chunk.ParentID != "" {
+			t.Errorf("Chunk %d: expected no parent, got %s", i, chunk.ParentID)
+		}
+	}
+}
+
+func TestNovelService_SplitChildren(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	passages := []NovelChunk{
+		{ID: "book.txt-0", Text: "Hari woke early. \"Where is the map?\" he asked.", Novel: "book.txt", Seq: 0},
+		{ID: "book.txt-1", Text: "Nobody answered! The house was silent", Novel: "book.txt", Seq: 1},
+	}
+
+	children := service.SplitChildren(passages)
+
+	expected := []struct {
+		text   string
+		parent string
+	}{
+		{"Hari woke early.", "book.txt-0"},
+		{"\"Where is the map?\"", "book.txt-0"},
+		{"he asked.", "book.txt-0"},
+		{"Nobody answered!", "book.txt-1"},
+		{"The house was silent", "book.txt-1"},
+	}
+
+	if len(children) != len(expected) {
+		t.Fatalf("Expected %d children, got %d: %+v", len(expected), len(children), children)
+	}
+
+	for i, child := range children {
+		if child.Text != expected[i].text {
+			t.Errorf("Child %d: expected text %q, got %q", i, expected[i].text, child.Text)
+		}
+		if child.ParentID != expected[i].parent {
+			t.Errorf("Child %d: expected parent %s, got %s", i, expected[i].parent, child.ParentID)
+		}
+		if child.Seq != i {
+			t.Errorf("Child %d: expected seq %d, got %d", i, i, child.Seq)
+		}
+		if child.Novel != "book.txt" {
+			t.Errorf("Child %d: expected novel book.txt, got %s", i, child.Novel)
+		}
+	}
+}
+
+func TestNovelService_SplitChildren_LongSentence(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	words := make([]string, childChunkMaxWords*2+5)
+	for i := range words {
+		words[i] = "and"
+	}
+	passages := []NovelChunk{{ID: "run.txt-0", Text: strings.Join(words, " "), Novel: "run.txt"}}
+
+	children := service.SplitChildren(passages)
+
+	if len(children) != 3 {
+		t.Fatalf("Expected 3 children for a run-on sentence, got %d", len(children))
+	}
+	if n := len(strings.Fields(children[0].Text)); n != childChunkMaxWords {
+		t.Errorf("Expected first child to hold %d words, got %d", childChunkMaxWords, n)
+	}
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxODTSpaces is the most spaces one ODT text:s element stands for, so a
+// document can't ask for an enormous run of them
+const maxODTSpaces = 1000
+
+// docxMetadata and odtMetadata map document property elements to metadata keys
+var (
+	docxMetadata = map[string]string{
+		"title": "title", "creator": "author", "subject": "subject",
+		"description": "description", "language": "language",
+		"keywords": "keywords", "created": "date",
+	}
+	odtMetadata = map[string]string{
+		"title": "title", "initial-creator": "author", "subject": "subject",
+		"description": "description", "language": "language",
+		"keyword": "keywords", "creation-date": "date",
+	}
+)
+
+// readDOCX extracts the paragraphs and core properties of a Word document
+func readDOCX(path string) (*NovelContent, error) {
+	archive, err := openZip(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DOCX file: %w", err)
+	}
+	defer archive.Close()
+
+	document, err := readZipEntry(&archive.Reader, "word/document.xml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DOCX document: %w", err)
+	}
+
+	text, err := xmlParagraphs(document, xmlTextRules{
+		paragraphs: map[string]bool{"p": true},
+		text:       map[string]bool{"t": true},
+		skip:       map[string]bool{"delText": true, "instrText": true},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DOCX document: %v", err)
+	}
+
+	content := &NovelContent{Text: text}
+	if core, err := readZipEntry(&archive.Reader, "docProps/core.xml"); err == nil {
+		content.Metadata = xmlMetadata(core, docxMetadata)
+	}
+	return content, nil
+}
+
+// readODT extracts the paragraphs and metadata of an OpenDocument text file
+func readODT(path string) (*NovelContent, error) {
+	archive, err := openZip(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ODT file: %w", err)
+	}
+	defer archive.Close()
+
+	document, err := readZipEntry(&archive.Reader, "content.xml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ODT content: %w", err)
+	}
+
+	text, err := xmlParagraphs(document, xmlTextRules{
+		paragraphs: map[string]bool{"p": true, "h": true},
+		skip:       map[string]bool{"note": true, "annotation": true, "tracked-changes": true},
+		allText:    true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ODT content: %v", err)
+	}
+
+	content := &NovelContent{Text: text}
+	if meta, err := readZipEntry(&archive.Reader, "meta.xml"); err == nil {
+		content.Metadata = xmlMetadata(meta, odtMetadata)
+		if content.Metadata["author"] == "" {
+			// Fall back to the last editor when the original author is unset
+			if creator := xmlMetadata(meta, map[string]string{"creator": "author"}); creator["author"] != "" {
+				content.Metadata["author"] = creator["author"]
+			}
+		}
+	}
+	return content, nil
+}
+
+// xmlTextRules describe how a word-processing XML format lays out text.
+// Element names are matched without their namespace prefix.
+type xmlTextRules struct {
+	paragraphs map[string]bool
+	// text elements hold character data; with allText set, character data
+	// anywhere inside a paragraph counts
+	text    map[string]bool
+	allText bool
+	// skip elements are ignored along with everything inside them
+	skip map[string]bool
+}
+
+// xmlParagraphs extracts paragraph text from a word-processing XML document,
+// turning tabs, line breaks and ODF space runs into whitespace
+func xmlParagraphs(data []byte, rules xmlTextRules) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	var paragraphs []string
+	var current strings.Builder
+	depth, skipDepth, textDepth := 0, 0, 0
+
+	flush := func() {
+		if p := strings.TrimSpace(current.String()); p != "" {
+			paragraphs = append(paragraphs, p)
+		}
+		current.Reset()
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if skipDepth > 0 || rules.skip[name] {
+				skipDepth++
+				continue
+			}
+			switch {
+			case rules.paragraphs[name]:
+				// Paragraphs nested in frames or text boxes break the outer one
+				flush()
+				depth++
+			case rules.text[name]:
+				textDepth++
+			case name == "tab":
+				current.WriteByte(' ')
+			case name == "br" || name == "cr" || name == "line-break":
+				current.WriteByte('\n')
+			case name == "s":
+				n := 1
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "c" {
+						if c, err := strconv.Atoi(attr.Value); err == nil && c > 1 {
+							n = min(c, maxODTSpaces)
+						}
+					}
+				}
+				current.WriteString(strings.Repeat(" ", n))
+			}
+		case xml.EndElement:
+			name := t.Name.Local
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			switch {
+			case rules.paragraphs[name]:
+				flush()
+				depth--
+			case rules.text[name]:
+				textDepth--
+			}
+		case xml.CharData:
+			if skipDepth == 0 && depth > 0 && (rules.allText || textDepth > 0) {
+				current.Write(t)
+			}
+		}
+	}
+	flush()
+
+	return strings.Join(paragraphs, "\n\n"), nil
+}
+
+// xmlMetadata collects the text of the first occurrence of each named
+// element, keyed by the metadata name it maps to
+func xmlMetadata(data []byte, fields map[string]string) map[string]string {
+	metadata := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	key := ""
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			key = fields[t.Name.Local]
+			if metadata[key] != "" {
+				key = ""
+			}
+		case xml.EndElement:
+			key = ""
+		case xml.CharData:
+			if key != "" {
+				if v := strings.TrimSpace(string(t)); v != "" {
+					metadata[key] = v
+				}
+			}
+		}
+	}
+	return metadata
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReadNovel_DOCX(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "emma.docx")
+	writeTestZip(t, path, [][2]string{
+		{"[Content_Types].xml", "<Types/>"},
+		{"word/document.xml", `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:r><w:t>Chapter I</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Emma Woodhouse, </w:t></w:r><w:r><w:t>handsome.</w:t></w:r><w:del><w:r><w:delText>deleted</w:delText></w:r></w:del></w:p>
+<w:p><w:r><w:t>One</w:t><w:tab/><w:t>Two</w:t></w:r></w:p>
+</w:body></w:document>`},
+		{"docProps/core.xml", `<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Emma</dc:title><dc:creator>Jane Austen</dc:creator></cp:coreProperties>`},
+	})
+
+	ns := NewNovelService(tempDir)
+	content, err := ns.ReadNovelWithOptions(path, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := "Chapter I\n\nEmma Woodhouse, handsome.\n\nOne Two"
+	if content.Text != expected {
+		t.Errorf("Expected text %q, got %q", expected, content.Text)
+	}
+	if content.Metadata["title"] != "Emma" || content.Metadata["author"] != "Jane Austen" {
+		t.Errorf("Unexpected metadata %v", content.Metadata)
+	}
+}
+
+func TestReadNovel_ODT(t *testing.T) {
+	tempDir := t.TempDir()
+	path := filepath.Join(tempDir, "emma.odt")
+	writeTestZip(t, path, [][2]string{
+		{"mimetype", "application/vnd.oasis.opendocument.text"},
+		{"content.xml", `<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"><office:body><office:text>
+<text:h>Chapter I</text:h>
+<text:p>Emma<text:s text:c="2"/>Woodhouse, <text:span>handsome</text:span>.<text:note><text:note-body><text:p>A footnote</text:p></text:note-body></text:note></text:p>
+</office:text></office:body></office:document-content>`},
+		{"meta.xml", `<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/"><office:meta><dc:title>Emma</dc:title><dc:creator>Jane Austen</dc:creator></office:meta></office:document-meta>`},
+	})
+
+	ns := NewNovelService(tempDir)
+	content, err := ns.ReadNovelWithOptions(path, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := "Chapter I\n\nEmma  Woodhouse, handsome."
+	if content.Text != expected {
+		t.Errorf("Expected text %q, got %q", expected, content.Text)
+	}
+	// Without an initial-creator the last editor is reported as the author
+	if content.Metadata["title"] != "Emma" || content.Metadata["author"] != "Jane Austen" {
+		t.Errorf("Unexpected metadata %v", content.Metadata)
+	}
+}
+
+func TestReadNovel_ODTSpaceCounts(t *testing.T) {
+	tests := []struct {
+		count    string
+		expected int
+	}{
+		{"3", 3},
+		{"0", 1},
+		{"-1", 1},
+		{"many", 1},
+		{"2000000000", maxODTSpaces},
+	}
+	for _, tt := range tests {
+		t.Run(tt.count, func(t *testing.T) {
+			tempDir := t.TempDir()
+			path := filepath.Join(tempDir, "spaces.odt")
+			writeTestZip(t, path, [][2]string{
+				{"mimetype", "application/vnd.oasis.opendocument.text"},
+				{"content.xml", `<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"><office:body><office:text>
+<text:p>Emma<text:s text:c="` + tt.count + `"/>Woodhouse</text:p>
+</office:text></office:body></office:document-content>`},
+			})
+
+			content, err := NewNovelService(tempDir).ReadNovelWithOptions(path, ReadOptions{})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got := len(content.Text) - len("EmmaWoodhouse"); got != tt.expected {
+				t.Errorf("Expected %d spaces, got %d", tt.expected, got)
+			}
+		})
+	}
+}
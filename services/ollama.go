@@ -4,17 +4,44 @@ package services
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// OllamaService asks the models on one Ollama server, or shares questions
+// between a pool of them
 type OllamaService struct {
-	baseURL string
+	nodes   []*ollamaNode
 	client  *http.Client
+	metrics *Metrics
+	// mu guards the nodes' state and next, the node to start looking from
+	// so that equally busy nodes take turns
+	mu   sync.Mutex
+	next int
+	// retries is how many more times a question that may succeed later is
+	// asked, the first after backoff and each later one after twice as long
+	retries int
+	backoff time.Duration
+	// fallbacks are the models tried in turn when the one asked for fails
+	fallbacks []string
+	// token, when set, is sent as a bearer token for servers behind an
+	// authenticating proxy
+	token string
 }
 
 type OllamaRequest struct {
@@ -33,19 +60,103 @@ type OllamaStreamResponse struct {
 	CreatedAt string  `json:"created_at"`
 	Message   Message `json:"message"`
 	Done      bool    `json:"done"`
+	// EvalCount and EvalDuration, in nanoseconds, are reported on the final
+	// response and give the generation speed
+	EvalCount    int   `json:"eval_count,omitempty"`
+	EvalDuration int64 `json:"eval_duration,omitempty"`
+	// PromptEvalCount is the number of tokens in the prompt
+	PromptEvalCount int `json:"prompt_eval_count,omitempty"`
+}
+
+// Answer is a model's answer to a question and where it came from
+type Answer struct {
+	Text string
+	// Node is the host and port of the server that answered
+	Node string
+	// Model is the model that answered, which is a fallback when the one
+	// asked for failed
+	Model string
 }
 
 func NewOllamaService(baseURL string) *OllamaService {
-	return &OllamaService{
-		baseURL: baseURL,
+	return NewOllamaPool([]string{baseURL})
+}
+
+// NewOllamaPool returns a service sending each question to the least busy
+// server in baseURLs that is in rotation and has the model, trying another
+// when one fails. A trailing slash on a base URL is dropped, as API paths
+// are added to it.
+func NewOllamaPool(baseURLs []string) *OllamaService {
+	os := &OllamaService{
 		client: &http.Client{
 			Timeout: 300 * time.Second, // 5 minute timeout
 		},
 	}
+	for _, baseURL := range baseURLs {
+		os.nodes = append(os.nodes, &ollamaNode{url: strings.TrimRight(baseURL, "/")})
+	}
+	return os
+}
+
+// SetTimeout sets how long a request to Ollama may take
+func (os *OllamaService) SetTimeout(timeout time.Duration) {
+	os.client.Timeout = timeout
+}
+
+// SetToken sends token as a bearer token with every request
+func (os *OllamaService) SetToken(token string) {
+	os.token = token
+}
+
+// SetRetries asks again up to retries times when Ollama can't be reached or
+// is unavailable, waiting around backoff before the first retry and twice as
+// long before each one after
+func (os *OllamaService) SetRetries(retries int, backoff time.Duration) {
+	os.retries, os.backoff = retries, backoff
+}
+
+// SetFallbacks tries models in order when the model asked for is missing or
+// fails
+func (os *OllamaService) SetFallbacks(models []string) {
+	os.fallbacks = models
 }
 
-func (os *OllamaService) Ask(question, model, context string) (string, error) {
-	prompt := fmt.Sprintf(`
+// SetMetrics records call latency, generation speed and errors to m
+func (os *OllamaService) SetMetrics(m *Metrics) {
+	os.metrics = m
+}
+
+// Endpoint returns the Ollama URLs with any credentials hidden, for logging
+func (os *OllamaService) Endpoint() string {
+	endpoints := make([]string, len(os.nodes))
+	for i, node := range os.nodes {
+		endpoints[i] = node.url
+		if u, err := url.Parse(node.url); err == nil {
+			endpoints[i] = u.Redacted()
+		}
+	}
+	return strings.Join(endpoints, ",")
+}
+
+// Serves reports whether endpoint names an Ollama server this service
+// calls
+func (os *OllamaService) Serves(endpoint string) bool {
+	theirs, err := NormalizeEndpoint(endpoint)
+	if err != nil {
+		return false
+	}
+	for _, node := range os.nodes {
+		if ours, err := NormalizeEndpoint(node.url); err == nil && ours == theirs {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildPrompt is the prompt sent to the model for a question and the
+// passages retrieved for it
+func BuildPrompt(question, passages string) string {
+	return fmt.Sprintf(`
 You are a helpful assistant answering questions based on a novel.
 Use only the following context to answer. If unsure, say 'I don't know'.
 
@@ -54,8 +165,66 @@ Context:
 
 Question: %s
 Answer:
-`, context, question)
+`, passages, question)
+}
+
+func (os *OllamaService) Ask(question, model, passages string) (string, error) {
+	return os.AskContext(context.Background(), question, model, passages)
+}
 
+// AskContext is Ask giving up when ctx is done, logging to the logger ctx
+// carries and tracing the call as a child of any span in ctx
+func (os *OllamaService) AskContext(ctx context.Context, question, model, passages string) (string, error) {
+	answer, err := os.Chat(ctx, question, model, passages)
+	if err != nil {
+		return "", err
+	}
+	return answer.Text, nil
+}
+
+// Chat is AskContext also reporting which node and model answered. A node
+// that can't be reached, fails or doesn't have the model is given up on for
+// the next best one until every node has been tried, and then the question
+// is retried after a while if the failure may pass, before falling back to
+// the next model in the chain.
+func (os *OllamaService) Chat(ctx context.Context, question, model, passages string) (answer *Answer, err error) {
+	prompt := BuildPrompt(question, passages)
+
+	ctx, span := tracer.Start(ctx, "ollama.chat", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("gen_ai.system", "ollama"),
+		attribute.String("gen_ai.request.model", model),
+		attribute.Int("gen_ai.prompt.characters", len(prompt)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	defer func() { os.metrics.ObserveOllama("chat", model, time.Since(start)) }()
+
+	for i, candidate := range os.chain(model) {
+		if i > 0 {
+			logging.FromContext(ctx).Warn("Falling back to another model", "model", candidate, "requested_model", model, "error", err)
+			span.AddEvent("fallback", trace.WithAttributes(attribute.String("gen_ai.request.model", candidate)))
+		}
+		answer, err = os.retry(ctx, candidate, prompt, start, span)
+		if err == nil {
+			answer.Model = candidate
+			os.metrics.ObserveAnswer(model, candidate)
+			span.SetAttributes(attribute.String("gen_ai.response.model", candidate))
+			return answer, nil
+		}
+		// A model that timed out isn't followed by another that may take as
+		// long
+		if ctx.Err() != nil || errors.Is(err, ErrEndpointBlocked) || timedOut(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// ask sends a question for model to the best node, then the next best
+// while they fail in a way another node might not, until every node has
+// been tried
+func (os *OllamaService) ask(ctx context.Context, model, prompt string, start time.Time, span trace.Span) (*Answer, error) {
 	reqBody := OllamaRequest{
 		Model:  model,
 		Stream: false, // Explicitly set to false
@@ -66,18 +235,52 @@ Answer:
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	resp, err := os.client.Post(os.baseURL+"/api/chat", "application/json", bytes.NewBuffer(jsonData))
+	tried := make(map[*ollamaNode]bool)
+	for {
+		node := os.acquire(model, tried)
+		if node == nil {
+			return nil, errors.New("no Ollama server to ask")
+		}
+		tried[node] = true
+		span.SetAttributes(attribute.String("server.address", node.name()))
+
+		text, err := os.chat(ctx, node, model, jsonData, start, span)
+		os.release(ctx, node, model, err)
+		if err == nil {
+			return &Answer{Text: text, Node: node.name()}, nil
+		}
+		if !failover(err) || ctx.Err() != nil || len(tried) == len(os.nodes) {
+			return nil, err
+		}
+		logging.FromContext(ctx).Warn("Asking another Ollama node", "node", node.name(), "model", model, "error", err)
+		span.AddEvent("failover", trace.WithAttributes(attribute.String("server.address", node.name())))
+	}
+}
+
+// chat sends a question to one node
+func (os *OllamaService) chat(ctx context.Context, node *ollamaNode, model string, jsonData []byte, start time.Time, span trace.Span) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, node.url+"/api/chat", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to call Ollama API: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	os.authorize(req)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := os.client.Do(req)
 	if err != nil {
+		os.callFailed(err)
 		return "", fmt.Errorf("failed to call Ollama API: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		os.metrics.Error(CauseOllamaStatus)
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("Ollama API returned status %d: %s", resp.StatusCode, string(body))
+		return "", &statusError{code: resp.StatusCode, body: string(body)}
 	}
 
 	// Handle streaming response by reading all lines and taking the last complete one
@@ -95,12 +298,15 @@ Answer:
 		var streamResp OllamaStreamResponse
 		if err := json.Unmarshal([]byte(line), &streamResp); err != nil {
 			// If we can't parse a line, log it but continue
-			fmt.Printf("Warning: Could not parse line as JSON: %s\n", line)
+			logging.FromContext(ctx).Warn("Could not parse Ollama response line", "model", model, "line", line, "error", err)
 			continue
 		}
 
 		// Accumulate content if message exists
 		if streamResp.Message.Content != "" {
+			if fullContent.Len() == 0 {
+				os.metrics.ObserveFirstToken(model, time.Since(start))
+			}
 			fullContent.WriteString(streamResp.Message.Content)
 		}
 
@@ -109,8 +315,14 @@ Answer:
 	}
 
 	if err := scanner.Err(); err != nil {
+		os.metrics.Error(CauseOllamaResponse)
 		return "", fmt.Errorf("error reading response stream: %w", err)
 	}
+	os.metrics.ObserveGeneration(model, lastValidResponse.EvalCount, time.Duration(lastValidResponse.EvalDuration))
+	span.SetAttributes(
+		attribute.Int("gen_ai.usage.input_tokens", lastValidResponse.PromptEvalCount),
+		attribute.Int("gen_ai.usage.output_tokens", lastValidResponse.EvalCount),
+	)
 
 	// Prefer the content from the last response if it's marked as done
 	// Otherwise, use the accumulated content
@@ -122,20 +334,81 @@ Answer:
 		return lastValidResponse.Message.Content, nil
 	}
 
+	os.metrics.Error(CauseOllamaResponse)
 	return "", fmt.Errorf("no valid response content received")
 }
 
 // GetModels retrieves available models from Ollama
 func (os *OllamaService) GetModels() ([]string, error) {
-	resp, err := os.client.Get(os.baseURL + "/api/tags")
+	return os.GetModelsContext(context.Background())
+}
+
+// GetModelsContext is GetModels giving up when ctx is done, for checks that
+// must answer quickly. A pool lists every model any of its nodes has, and
+// fails only when none of them answer.
+func (os *OllamaService) GetModelsContext(ctx context.Context) (models []string, err error) {
+	ctx, span := tracer.Start(ctx, "ollama.tags", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("server.address", os.Endpoint())))
+	defer func() { endSpan(span, err) }()
+	start := time.Now()
+	defer func() { os.metrics.ObserveOllama("tags", "", time.Since(start)) }()
+
+	// Every node is asked, so those out of rotation come back as soon as
+	// they answer
+	listed := make([][]string, len(os.nodes))
+	errs := make([]error, len(os.nodes))
+	var wg sync.WaitGroup
+	for i, node := range os.nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listed[i], errs[i] = os.tags(ctx, node)
+			os.listed(ctx, node, listed[i], errs[i])
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	answered := false
+	for i := range os.nodes {
+		if errs[i] != nil {
+			err = errs[i]
+			continue
+		}
+		answered = true
+		for _, model := range listed[i] {
+			if !seen[model] {
+				seen[model] = true
+				models = append(models, model)
+			}
+		}
+	}
+	if !answered {
+		return nil, err
+	}
+	return models, nil
+}
+
+// tags lists the models on one node
+func (os *OllamaService) tags(ctx context.Context, node *ollamaNode) (models []string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, node.url+"/api/tags", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to call Ollama API: %w", err)
 	}
+	os.authorize(req)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := os.client.Do(req)
+	if err != nil {
+		os.callFailed(err)
+		return nil, fmt.Errorf("failed to call Ollama API: %w", err)
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		os.metrics.Error(CauseOllamaStatus)
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("Ollama API returned status %d: %s", resp.StatusCode, string(body))
+		return nil, &statusError{code: resp.StatusCode, body: string(body)}
 	}
 
 	var tagsResponse struct {
@@ -145,13 +418,28 @@ func (os *OllamaService) GetModels() ([]string, error) {
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&tagsResponse); err != nil {
+		os.metrics.Error(CauseOllamaResponse)
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	var models []string
 	for _, model := range tagsResponse.Models {
 		models = append(models, model.Name)
 	}
 
 	return models, nil
 }
+
+// authorize adds the bearer token, if any, to req
+func (os *OllamaService) authorize(req *http.Request) {
+	if os.token != "" {
+		req.Header.Set("Authorization", "Bearer "+os.token)
+	}
+}
+
+// callFailed counts a request that got no response, unless the endpoint
+// guard stopped it
+func (os *OllamaService) callFailed(err error) {
+	if !errors.Is(err, ErrEndpointBlocked) {
+		os.metrics.Error(CauseOllamaUnavailable)
+	}
+}
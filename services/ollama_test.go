@@ -6,14 +6,17 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewOllamaService(t *testing.T) {
 	baseURL := "http://localhost:11434"
 	service := NewOllamaService(baseURL)
 
-	if service.baseURL != baseURL {
-		t.Errorf("Expected baseURL %s, got %s", baseURL, service.baseURL)
+	if len(service.nodes) != 1 || service.nodes[0].url != baseURL {
+		t.Errorf("Expected baseURL %s, got %+v", baseURL, service.nodes)
 	}
 
 	if service.client == nil {
@@ -25,6 +28,15 @@ func TestNewOllamaService(t *testing.T) {
 	}
 }
 
+func TestOllamaService_SetTimeout(t *testing.T) {
+	service := NewOllamaService("http://localhost:11434")
+	service.SetTimeout(30 * time.Second)
+
+	if service.client.Timeout != 30*time.Second {
+		t.Errorf("Expected timeout %v, got %v", 30*time.Second, service.client.Timeout)
+	}
+}
+
 func TestOllamaService_Ask_Success(t *testing.T) {
 	// Create a mock server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -165,3 +177,71 @@ func TestOllamaService_GetModels_EmptyResponse(t *testing.T) {
 		t.Errorf("Expected 0 models, got %d", len(models))
 	}
 }
+
+func TestOllamaService_Ask_RecordsMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"role":"assistant","content":"An "},"done":false}` + "\n"))
+		w.Write([]byte(`{"message":{"role":"assistant","content":"answer."},"done":false}` + "\n"))
+		w.Write([]byte(`{"message":{"role":"assistant","content":""},"done":true,"eval_count":40,"eval_duration":2000000000}` + "\n"))
+	}))
+	defer server.Close()
+
+	m := NewMetrics(prometheus.NewRegistry())
+	service := NewOllamaService(server.URL)
+	service.SetMetrics(m)
+	answer, err := service.Ask("test question", "phi3", "test context")
+	if err != nil || answer != "An answer." {
+		t.Fatalf("Expected the streamed answer, got %q (%v)", answer, err)
+	}
+
+	for name, metric := range map[string]prometheus.Collector{
+		"call latency":        m.ollamaDuration,
+		"time to first token": m.firstToken,
+		"tokens per second":   m.tokensPerSecond,
+	} {
+		if got := testutil.CollectAndCount(metric); got != 1 {
+			t.Errorf("Expected %s to be recorded once, got %d", name, got)
+		}
+	}
+
+	// A server that can't be reached is counted by cause
+	service = NewOllamaService("http://127.0.0.1:1")
+	service.SetMetrics(m)
+	if _, err := service.Ask("test question", "phi3", "test context"); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if got := testutil.ToFloat64(m.errors.WithLabelValues(CauseOllamaUnavailable)); got != 1 {
+		t.Errorf("Expected 1 unavailable error, got %v", got)
+	}
+}
+
+func TestOllamaService_AskContext_Traced(t *testing.T) {
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"message":{"role":"assistant","content":"Yes."},"done":true,"prompt_eval_count":120,"eval_count":3}`))
+	}))
+	defer server.Close()
+
+	ctx, root := traceRoot(t)
+	if _, err := NewOllamaService(server.URL).AskContext(ctx, "Rich?", "phi3", "Emma was rich."); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	root.End()
+
+	span, ok := tracedSpans(root)["ollama.chat"]
+	if !ok {
+		t.Fatal("Expected an ollama.chat span")
+	}
+	if !strings.Contains(traceparent, span.SpanContext().SpanID().String()) {
+		t.Errorf("Expected the trace to be propagated to Ollama, got %q", traceparent)
+	}
+	for key, expected := range map[string]int64{"gen_ai.usage.input_tokens": 120, "gen_ai.usage.output_tokens": 3} {
+		if got := spanAttr(span, key).AsInt64(); got != expected {
+			t.Errorf("Expected %s %d, got %d", key, expected, got)
+		}
+	}
+	if model := spanAttr(span, "gen_ai.request.model").AsString(); model != "phi3" {
+		t.Errorf("Expected model phi3, got %q", model)
+	}
+}
@@ -0,0 +1,215 @@
+// services/ollamapool.go
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+)
+
+const (
+	// nodeMaxFailures is how many errors in a row take a node out of
+	// rotation
+	nodeMaxFailures = 3
+	// nodeCooldown is how long a node stays out of rotation before it is
+	// tried again
+	nodeCooldown = 30 * time.Second
+)
+
+// ollamaNode is one Ollama server in a service's pool. Everything but url is
+// guarded by the service's mu.
+type ollamaNode struct {
+	url      string
+	inFlight int
+	failures int
+	// downUntil is when a node taken out of rotation is tried again
+	downUntil time.Time
+	// models are the models the node last listed, nil until it has, and
+	// missing the models it has since said it doesn't have
+	models  map[string]bool
+	missing map[string]bool
+}
+
+// OllamaNode describes a node in the pool, as last seen
+type OllamaNode struct {
+	// Node is the server's host and port
+	Node     string `json:"node"`
+	Healthy  bool   `json:"healthy"`
+	InFlight int    `json:"inFlight"`
+	Failures int    `json:"failures"`
+}
+
+// statusError is a response from Ollama other than 200
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Ollama API returned status %d: %s", e.code, e.body)
+}
+
+// name is the node's host and port, which is how answers report it
+func (n *ollamaNode) name() string {
+	if u, err := url.Parse(n.url); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return n.url
+}
+
+// rank orders nodes for a question: those in rotation that have the model,
+// or may have it, first, then those in rotation without it, then those out
+// of rotation
+func (n *ollamaNode) rank(model string, now time.Time) int {
+	switch {
+	case now.Before(n.downUntil):
+		return 2
+	case n.missing[modelKey(model)] || n.models != nil && !n.models[modelKey(model)]:
+		return 1
+	}
+	return 0
+}
+
+// Nodes describes the servers questions are shared between
+func (os *OllamaService) Nodes() []OllamaNode {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	now := time.Now()
+	nodes := make([]OllamaNode, len(os.nodes))
+	for i, node := range os.nodes {
+		nodes[i] = OllamaNode{
+			Node:     node.name(),
+			Healthy:  !now.Before(node.downUntil),
+			InFlight: node.inFlight,
+			Failures: node.failures,
+		}
+	}
+	return nodes
+}
+
+// acquire picks the node to send a question for model to, skipping those
+// already tried: the least busy of the best ranked, taking turns between
+// equally busy ones. It returns nil once every node has been tried.
+func (os *OllamaService) acquire(model string, tried map[*ollamaNode]bool) *ollamaNode {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	now := time.Now()
+	var best *ollamaNode
+	bestRank := 0
+	for i := range os.nodes {
+		node := os.nodes[(os.next+i)%len(os.nodes)]
+		if tried[node] {
+			continue
+		}
+		rank := node.rank(model, now)
+		if best == nil || rank < bestRank || rank == bestRank && node.inFlight < best.inFlight {
+			best, bestRank = node, rank
+		}
+	}
+	os.next++
+	if best != nil {
+		best.inFlight++
+	}
+	return best
+}
+
+// release records how a question sent to node went
+func (os *OllamaService) release(ctx context.Context, node *ollamaNode, model string, err error) {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	node.inFlight--
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusNotFound {
+		// Ollama answers 404 for a model it hasn't pulled
+		if node.missing == nil {
+			node.missing = make(map[string]bool)
+		}
+		node.missing[modelKey(model)] = true
+		return
+	}
+	os.record(ctx, node, err)
+}
+
+// listed records the models node listed, or its failure to list them
+func (os *OllamaService) listed(ctx context.Context, node *ollamaNode, models []string, err error) {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	if err == nil {
+		node.models = make(map[string]bool, len(models))
+		for _, model := range models {
+			node.models[modelKey(model)] = true
+		}
+		node.missing = nil
+	}
+	os.record(ctx, node, err)
+}
+
+// record counts a node's errors in a row, taking it out of rotation after
+// too many and back in once it answers. The caller holds mu.
+func (os *OllamaService) record(ctx context.Context, node *ollamaNode, err error) {
+	switch {
+	case err == nil:
+		if node.failures >= nodeMaxFailures && len(os.nodes) > 1 {
+			logging.FromContext(ctx).Info("Ollama node back in rotation", "node", node.name())
+		}
+		node.failures, node.downUntil = 0, time.Time{}
+	case nodeFailure(err):
+		node.failures++
+		if node.failures >= nodeMaxFailures {
+			node.downUntil = time.Now().Add(nodeCooldown)
+			if len(os.nodes) > 1 {
+				logging.FromContext(ctx).Warn("Took Ollama node out of rotation", "node", node.name(), "failures", node.failures, "error", err)
+			}
+		}
+	}
+}
+
+// nodeFailure reports whether err says the node itself is in trouble: it
+// couldn't be reached or answered with a server error. Requests the guard
+// stopped and ones given up on are not the node's fault, and neither are
+// ones that timed out, which may just be a long answer; asking again would
+// only wait as long again.
+func nodeFailure(err error) bool {
+	if errors.Is(err, ErrEndpointBlocked) || errors.Is(err, context.Canceled) || timedOut(err) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code >= http.StatusInternalServerError
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// timedOut reports whether a call failed because it ran out of time, the
+// client's timeout or the caller's deadline
+func timedOut(err error) bool {
+	var urlErr *url.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &urlErr) && urlErr.Timeout()
+}
+
+// failover reports whether a question that failed with err may be sent to
+// another node: asking is idempotent, so any node failure can be, as can a
+// model the node doesn't have
+func failover(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusNotFound {
+		return true
+	}
+	return nodeFailure(err)
+}
+
+// modelKey is the name Ollama lists a model under, which gives a model
+// without a tag the latest one
+func modelKey(model string) string {
+	if !strings.Contains(model, ":") {
+		return model + ":latest"
+	}
+	return model
+}
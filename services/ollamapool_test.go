@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// poolNode is an Ollama server listing models and answering with its name,
+// or with status when it is set, counting the questions it is sent
+type poolNode struct {
+	*httptest.Server
+	name   string
+	status atomic.Int32
+	asked  atomic.Int32
+}
+
+func newPoolNode(t *testing.T, name string, models ...string) *poolNode {
+	t.Helper()
+	node := &poolNode{name: name}
+	node.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/tags" {
+			var listed []string
+			for _, model := range models {
+				listed = append(listed, `{"name":"`+model+`"}`)
+			}
+			w.Write([]byte(`{"models":[` + strings.Join(listed, ",") + `]}`))
+			return
+		}
+		node.asked.Add(1)
+		if status := node.status.Load(); status != 0 {
+			http.Error(w, `{"error":"failed"}`, int(status))
+			return
+		}
+		w.Write([]byte(`{"message":{"role":"assistant","content":"From ` + name + `."},"done":true}`))
+	}))
+	t.Cleanup(node.Close)
+	return node
+}
+
+// host is how answers name the node
+func (n *poolNode) host() string {
+	u, _ := url.Parse(n.URL)
+	return u.Host
+}
+
+func TestModelKey(t *testing.T) {
+	tests := map[string]string{
+		"llama3":         "llama3:latest",
+		"llama3:latest":  "llama3:latest",
+		"llama3:8b-q4_0": "llama3:8b-q4_0",
+	}
+	for model, expected := range tests {
+		if got := modelKey(model); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, model, got)
+		}
+	}
+}
+
+func TestOllamaPool_Routing(t *testing.T) {
+	first := newPoolNode(t, "first", "phi3:latest", "llama3:latest")
+	second := newPoolNode(t, "second", "llama3")
+	pool := NewOllamaPool([]string{first.URL, second.URL})
+
+	// Models are listed once across the pool
+	models, err := pool.GetModels()
+	if err != nil || strings.Join(models, ",") != "phi3:latest,llama3:latest,llama3" {
+		t.Errorf("Expected every node's models, got %v (%v)", models, err)
+	}
+
+	// Only the first node has phi3
+	for range 3 {
+		answer, err := pool.Chat(context.Background(), "Who?", "phi3", "")
+		if err != nil || answer.Node != first.host() || answer.Text != "From first." {
+			t.Errorf("Expected the first node to answer, got %+v (%v)", answer, err)
+		}
+	}
+	if second.asked.Load() != 0 {
+		t.Errorf("Expected the second node not to be asked, got %d", second.asked.Load())
+	}
+
+	// The least busy node with the model is chosen, and equally busy ones
+	// take turns
+	pool.nodes[0].inFlight = 1
+	if answer, _ := pool.Chat(context.Background(), "Who?", "llama3", ""); answer == nil || answer.Node != second.host() {
+		t.Errorf("Expected the idle node to answer, got %+v", answer)
+	}
+	pool.nodes[0].inFlight = 0
+	answered := make(map[string]int)
+	for range 4 {
+		if answer, err := pool.Chat(context.Background(), "Who?", "llama3", ""); err == nil {
+			answered[answer.Node]++
+		}
+	}
+	if answered[first.host()] != 2 || answered[second.host()] != 2 {
+		t.Errorf("Expected the nodes to take turns, got %v", answered)
+	}
+	for _, node := range pool.Nodes() {
+		if node.InFlight != 0 || !node.Healthy {
+			t.Errorf("Expected an idle healthy node, got %+v", node)
+		}
+	}
+}
+
+func TestOllamaPool_TrailingSlash(t *testing.T) {
+	// Ollama answers 404 for //api/chat, which would read as a missing model
+	node := newPoolNode(t, "only", "phi3")
+	pool := NewOllamaPool([]string{node.URL + "/"})
+	if answer, err := pool.Chat(context.Background(), "Who?", "phi3", ""); err != nil || answer.Text != "From only." {
+		t.Errorf("Expected an answer, got %+v (%v)", answer, err)
+	}
+	if models, err := pool.GetModels(); err != nil || len(models) != 1 {
+		t.Errorf("Expected the node's models, got %v (%v)", models, err)
+	}
+}
+
+func TestOllamaPool_Failover(t *testing.T) {
+	failing := newPoolNode(t, "failing", "llama3")
+	healthy := newPoolNode(t, "healthy", "llama3")
+	failing.status.Store(http.StatusServiceUnavailable)
+	pool := NewOllamaPool([]string{failing.URL, healthy.URL})
+
+	// Failed questions are asked again on another node, until the failing
+	// one is taken out of rotation
+	for range 6 {
+		answer, err := pool.Chat(context.Background(), "Who?", "llama3", "")
+		if err != nil || answer.Node != healthy.host() {
+			t.Errorf("Expected the healthy node to answer, got %+v (%v)", answer, err)
+		}
+	}
+	if got := failing.asked.Load(); got != nodeMaxFailures {
+		t.Errorf("Expected the failing node to be asked %d times, got %d", nodeMaxFailures, got)
+	}
+	if nodes := pool.Nodes(); nodes[0].Healthy || nodes[0].Failures != nodeMaxFailures || !nodes[1].Healthy {
+		t.Errorf("Expected the failing node out of rotation, got %+v", nodes)
+	}
+
+	// A node out of rotation comes back once it answers
+	failing.status.Store(0)
+	if _, err := pool.GetModels(); err != nil {
+		t.Fatalf("Expected models, got %v", err)
+	}
+	if nodes := pool.Nodes(); !nodes[0].Healthy || nodes[0].Failures != 0 {
+		t.Errorf("Expected the node back in rotation, got %+v", nodes)
+	}
+
+	// An unreachable node is failed over too
+	unreachable := NewOllamaPool([]string{"http://127.0.0.1:1", healthy.URL})
+	if answer, err := unreachable.Chat(context.Background(), "Who?", "llama3", ""); err != nil || answer.Node != healthy.host() {
+		t.Errorf("Expected the healthy node to answer, got %+v (%v)", answer, err)
+	}
+
+	// Bad requests are the same wherever they are sent
+	failing.status.Store(http.StatusBadRequest)
+	healthy.status.Store(http.StatusBadRequest)
+	before := failing.asked.Load() + healthy.asked.Load()
+	if _, err := pool.Chat(context.Background(), "Who?", "llama3", ""); err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Errorf("Expected the bad request to fail, got %v", err)
+	}
+	if asked := failing.asked.Load() + healthy.asked.Load() - before; asked != 1 {
+		t.Errorf("Expected one attempt, got %d", asked)
+	}
+
+	// Once every node has failed, the last error is returned
+	failing.status.Store(http.StatusInternalServerError)
+	healthy.status.Store(http.StatusInternalServerError)
+	if _, err := pool.Chat(context.Background(), "Who?", "llama3", ""); err == nil || !strings.Contains(err.Error(), "status 500") {
+		t.Errorf("Expected the pool to fail, got %v", err)
+	}
+}
+
+func TestOllamaPool_MissingModel(t *testing.T) {
+	// Ollama answers 404 for a model it doesn't have
+	without := newPoolNode(t, "without")
+	without.status.Store(http.StatusNotFound)
+	with := newPoolNode(t, "with", "mistral")
+	pool := NewOllamaPool([]string{without.URL, with.URL})
+
+	for range 3 {
+		if answer, err := pool.Chat(context.Background(), "Who?", "mistral", ""); err != nil || answer.Node != with.host() {
+			t.Errorf("Expected the node with the model to answer, got %+v (%v)", answer, err)
+		}
+	}
+	// The node without it is remembered, and isn't out of rotation for it
+	if got := without.asked.Load(); got != 1 {
+		t.Errorf("Expected the node without the model to be asked once, got %d", got)
+	}
+	if nodes := pool.Nodes(); !nodes[0].Healthy || nodes[0].Failures != 0 {
+		t.Errorf("Expected the node to stay in rotation, got %+v", nodes)
+	}
+}
+
+func TestOllamaService_SingleNode(t *testing.T) {
+	// A lone node out of rotation is still asked, as there is no other
+	node := newPoolNode(t, "only", "phi3")
+	node.status.Store(http.StatusInternalServerError)
+	service := NewOllamaService(node.URL)
+	for range nodeMaxFailures + 1 {
+		service.Ask("Who?", "phi3", "")
+	}
+	if got := node.asked.Load(); got != nodeMaxFailures+1 {
+		t.Errorf("Expected every question to be sent, got %d", got)
+	}
+	node.status.Store(0)
+	if answer, err := service.Ask("Who?", "phi3", ""); err != nil || answer != "From only." {
+		t.Errorf("Expected an answer, got %q (%v)", answer, err)
+	}
+}
@@ -0,0 +1,76 @@
+// services/ollamaretry.go
+package services
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// chain is the models to try for a question asking for model: it, then the
+// fallbacks other than it
+func (os *OllamaService) chain(model string) []string {
+	chain := []string{model}
+	for _, fallback := range os.fallbacks {
+		if modelKey(fallback) != modelKey(model) {
+			chain = append(chain, fallback)
+		}
+	}
+	return chain
+}
+
+// retry asks the pool for model, asking again after a wait while it fails in
+// a way that may pass, such as a node starting up or loading the model
+func (os *OllamaService) retry(ctx context.Context, model, prompt string, start time.Time, span trace.Span) (*Answer, error) {
+	for attempt := 0; ; attempt++ {
+		answer, err := os.ask(ctx, model, prompt, start, span)
+		if err == nil || attempt >= os.retries || !retryable(err) {
+			return answer, err
+		}
+
+		wait := backoff(os.backoff, attempt)
+		logging.FromContext(ctx).Warn("Retrying Ollama call", "model", model, "retry", attempt+1, "wait_ms", wait.Milliseconds(), "error", err)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("retry", attempt+1)))
+		os.metrics.Retry(model)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// retryable reports whether a call that failed with err may succeed if made
+// again: the server couldn't be reached, or it or a proxy in front of it was
+// briefly unavailable, as Ollama is while it loads a model
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		switch status.code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return nodeFailure(err)
+}
+
+// backoff is how long to wait before retry attempt+1: base doubled for each
+// earlier retry, with up to half of it taken off at random so that clients
+// failing together don't retry together
+func backoff(base time.Duration, attempt int) time.Duration {
+	wait := base << attempt
+	if wait <= 0 {
+		return 0
+	}
+	return wait - rand.N(wait/2+1)
+}
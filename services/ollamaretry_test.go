@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt, longest := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		for range 20 {
+			if wait := backoff(base, attempt); wait < longest/2 || wait > longest {
+				t.Errorf("Expected retry %d to wait between %v and %v, got %v", attempt+1, longest/2, longest, wait)
+			}
+		}
+	}
+	if wait := backoff(0, 3); wait != 0 {
+		t.Errorf("Expected no wait, got %v", wait)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	// Nothing listens on port 1
+	_, refused := NewOllamaService("http://127.0.0.1:1").GetModels()
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&statusError{code: http.StatusServiceUnavailable}, true},
+		{&statusError{code: http.StatusBadGateway}, true},
+		{&statusError{code: http.StatusInternalServerError}, false},
+		{&statusError{code: http.StatusNotFound}, false},
+		{refused, true},
+		{ErrEndpointBlocked, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{&url.Error{Op: "Post", URL: "http://ollama:11434/api/chat", Err: context.DeadlineExceeded}, false},
+	}
+	for _, tt := range tests {
+		if got := retryable(tt.err); got != tt.retryable {
+			t.Errorf("Expected %v retryable %t, got %t", tt.err, tt.retryable, got)
+		}
+	}
+}
+
+func TestOllamaService_Retries(t *testing.T) {
+	// Ollama is unavailable while it loads the model
+	var loading, asked atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked.Add(1)
+		if loading.Add(-1) >= 0 {
+			http.Error(w, "loading model", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"message":{"role":"assistant","content":"Loaded."},"done":true}`))
+	}))
+	defer server.Close()
+
+	m := NewMetrics(prometheus.NewRegistry())
+	service := NewOllamaService(server.URL)
+	service.SetMetrics(m)
+	service.SetRetries(2, time.Millisecond)
+
+	loading.Store(2)
+	if answer, err := service.Ask("Who?", "phi3", ""); err != nil || answer != "Loaded." {
+		t.Errorf("Expected an answer once the model loaded, got %q (%v)", answer, err)
+	}
+	if got := testutil.ToFloat64(m.retries.WithLabelValues("phi3")); got != 2 {
+		t.Errorf("Expected 2 retries, got %v", got)
+	}
+
+	// Retries run out
+	loading.Store(3)
+	asked.Store(0)
+	if _, err := service.Ask("Who?", "phi3", ""); err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Errorf("Expected the retries to run out, got %v", err)
+	}
+	if got := asked.Load(); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+
+	// Waiting for a retry stops when the caller gives up
+	service.SetRetries(2, time.Hour)
+	loading.Store(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := service.AskContext(ctx, "Who?", "phi3", ""); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the wait to be cut short, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestOllamaService_Timeouts(t *testing.T) {
+	var asked atomic.Int32
+	answered := make(chan struct{})
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		asked.Add(1)
+		<-answered
+	}
+	first := httptest.NewServer(http.HandlerFunc(slow))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(slow))
+	defer second.Close()
+	defer close(answered)
+
+	service := NewOllamaPool([]string{first.URL, second.URL})
+	service.SetTimeout(50 * time.Millisecond)
+	service.SetRetries(2, time.Millisecond)
+	service.SetFallbacks([]string{"mistral"})
+
+	// A question that timed out is neither retried, sent to another node
+	// nor asked of a fallback model
+	if _, err := service.Chat(context.Background(), "Who?", "phi3", ""); err == nil {
+		t.Fatal("Expected the question to time out")
+	}
+	if got := asked.Load(); got != 1 {
+		t.Errorf("Expected one attempt, got %d", got)
+	}
+	for _, node := range service.Nodes() {
+		if node.Failures != 0 {
+			t.Errorf("Expected a timeout not to count against the node, got %+v", node)
+		}
+	}
+}
+
+func TestOllamaService_Fallbacks(t *testing.T) {
+	var asked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req OllamaRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		asked = append(asked, req.Model)
+		switch req.Model {
+		case "llama3":
+			http.Error(w, `{"error":"model 'llama3' not found"}`, http.StatusNotFound)
+		case "mistral":
+			http.Error(w, `{"error":"out of memory"}`, http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"message":{"role":"assistant","content":"From ` + req.Model + `."},"done":true}`))
+		}
+	}))
+	defer server.Close()
+
+	m := NewMetrics(prometheus.NewRegistry())
+	service := NewOllamaService(server.URL)
+	service.SetMetrics(m)
+	service.SetRetries(2, time.Millisecond)
+
+	// Without fallbacks the model's error is returned
+	if _, err := service.Chat(context.Background(), "Who?", "llama3", ""); err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("Expected the missing model's error, got %v", err)
+	}
+
+	service.SetFallbacks([]string{"llama3:latest", "mistral", "phi3"})
+	asked = nil
+	answer, err := service.Chat(context.Background(), "Who?", "llama3", "")
+	if err != nil || answer.Model != "phi3" || answer.Text != "From phi3." {
+		t.Fatalf("Expected phi3 to answer, got %+v (%v)", answer, err)
+	}
+	// Neither a missing model nor a model's error is retried, and the model
+	// asked for isn't tried twice
+	if strings.Join(asked, ",") != "llama3,mistral,phi3" {
+		t.Errorf("Expected each model to be asked once, got %v", asked)
+	}
+	if got := testutil.ToFloat64(m.answers.WithLabelValues("llama3", "phi3")); got != 1 {
+		t.Errorf("Expected the fallback answer to be counted, got %v", got)
+	}
+
+	if answer, err := service.Chat(context.Background(), "Who?", "gemma", ""); err != nil || answer.Model != "gemma" {
+		t.Errorf("Expected gemma to answer, got %+v (%v)", answer, err)
+	}
+}
@@ -0,0 +1,307 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// Page markers are private-use runes wrapped around a page number. They are
+// written into extracted PDF text so page boundaries survive boilerplate
+// stripping, then removed again once page offsets are recorded.
+const (
+	pageMarkStart = '\uE000'
+	pageMarkEnd   = '\uE001'
+)
+
+var (
+	pageMarker = regexp.MustCompile(`\x{E000}(\d+)\x{E001}`)
+	digitsRe   = regexp.MustCompile(`\d+`)
+	// pageNumberRe matches a page number line. Roman numerals are
+	// lowercase, as front matter uses, and no more than xxxix, so words and
+	// headings like "Mix" or "CIVIL" are kept.
+	pageNumberRe = regexp.MustCompile(`^\s*(?i:page\s+)?(\d+|x{0,3}(?:ix|iv|v?i{0,3}))(?i:\s+of\s+\d+)?\s*$`)
+)
+
+// PageSpan records where a page of the source document starts in the
+// extracted text
+type PageSpan struct {
+	Number int `json:"number"`
+	Offset int `json:"offset"`
+}
+
+// pdfLine is a line of text reassembled from positioned glyphs
+type pdfLine struct {
+	text     string
+	x, y     float64
+	fontSize float64
+}
+
+// readPDF extracts the text of a PDF, rebuilding lines and paragraphs from
+// glyph positions, dropping running headers, footers and page numbers and
+// joining words hyphenated across line breaks. Each page is preceded by a
+// page marker. Title and author come from the document information.
+func (ns *NovelService) readPDF(filepath string) (*NovelContent, error) {
+	f, reader, err := pdf.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PDF file: %v", err)
+	}
+	defer f.Close()
+
+	pages := make([][]pdfLine, reader.NumPage())
+	for i := range pages {
+		page := reader.Page(i + 1)
+		if page.V.IsNull() {
+			continue
+		}
+		lines, err := pdfPageLines(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PDF page %d: %v", i+1, err)
+		}
+		pages[i] = lines
+	}
+
+	pages = dropRunningLines(pages)
+
+	var content strings.Builder
+	for i, lines := range pages {
+		content.WriteString(markPage(i + 1))
+		content.WriteString(assembleParagraphs(lines))
+		content.WriteString("\n\n")
+	}
+
+	return &NovelContent{Text: content.String(), Metadata: pdfMetadata(reader)}, nil
+}
+
+// pdfMetadata reads the document information dictionary of a PDF
+func pdfMetadata(reader *pdf.Reader) (metadata map[string]string) {
+	// Malformed trailers panic inside the PDF library
+	defer func() {
+		if recover() != nil {
+			metadata = nil
+		}
+	}()
+
+	metadata = make(map[string]string)
+	info := reader.Trailer().Key("Info")
+	for key, name := range map[string]string{
+		"Title": "title", "Author": "author", "Subject": "subject", "Keywords": "keywords",
+	} {
+		if v := strings.TrimSpace(info.Key(key).Text()); v != "" {
+			metadata[name] = v
+		}
+	}
+	return metadata
+}
+
+// pdfPageLines groups a page's glyphs into lines in content-stream order,
+// inserting spaces where the gap between glyphs is wide enough
+func pdfPageLines(page pdf.Page) (lines []pdfLine, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed content stream: %v", r)
+		}
+	}()
+
+	var current *pdfLine
+	var lastEnd float64
+	var text strings.Builder
+
+	flush := func() {
+		if current != nil {
+			current.text = strings.TrimSpace(text.String())
+			if current.text != "" {
+				lines = append(lines, *current)
+			}
+		}
+		current = nil
+		text.Reset()
+	}
+
+	for _, glyph := range page.Content().Text {
+		size := math.Max(glyph.FontSize, 1)
+		if current == nil || math.Abs(glyph.Y-current.y) > size/2 {
+			flush()
+			current = &pdfLine{x: glyph.X, y: glyph.Y, fontSize: size}
+		} else if glyph.X-lastEnd > size/4 && !strings.HasSuffix(text.String(), " ") && glyph.S != " " {
+			text.WriteByte(' ')
+		}
+		text.WriteString(glyph.S)
+		lastEnd = glyph.X + glyph.W
+	}
+	flush()
+
+	return lines, nil
+}
+
+// dropRunningLines removes page numbers and lines repeated at the top or
+// bottom of most pages, such as running titles and footers. Page numbers
+// are only removed when most pages have one, so a stray short line isn't
+// taken for one.
+func dropRunningLines(pages [][]pdfLine) [][]pdfLine {
+	const edge = 2 // lines at each end of a page that may be headers or footers
+
+	repeats := make(map[string]int)
+	numbered := 0
+	for _, lines := range pages {
+		seen := make(map[string]bool)
+		hasNumber := false
+		for i, line := range lines {
+			if i >= edge && i < len(lines)-edge {
+				continue
+			}
+			key := runningKey(line.text)
+			if !seen[key] {
+				seen[key] = true
+				repeats[key]++
+			}
+			hasNumber = hasNumber || isPageNumber(line.text)
+		}
+		if hasNumber {
+			numbered++
+		}
+	}
+	dropNumbers := numbered*2 > len(pages)
+
+	result := make([][]pdfLine, len(pages))
+	for p, lines := range pages {
+		for i, line := range lines {
+			atEdge := i < edge || i >= len(lines)-edge
+			if atEdge && (dropNumbers && isPageNumber(line.text) ||
+				(len(pages) >= 3 && repeats[runningKey(line.text)]*2 > len(pages))) {
+				continue
+			}
+			result[p] = append(result[p], line)
+		}
+	}
+	return result
+}
+
+// isPageNumber reports whether a line is a page number, such as "12",
+// "Page 3 of 40" or "xiv"
+func isPageNumber(text string) bool {
+	m := pageNumberRe.FindStringSubmatch(text)
+	return m != nil && m[1] != ""
+}
+
+// runningKey normalises a line so running headers that include the page
+// number still compare equal
+func runningKey(text string) string {
+	return strings.ToLower(digitsRe.ReplaceAllString(strings.TrimSpace(text), "#"))
+}
+
+// assembleParagraphs joins a page's lines into paragraphs. A new paragraph
+// starts after a larger than usual vertical gap or at an indented line.
+func assembleParagraphs(lines []pdfLine) string {
+	if len(lines) == 0 {
+		return ""
+	}
+
+	var gaps []float64
+	left := lines[0].x
+	for i, line := range lines {
+		left = math.Min(left, line.x)
+		if i > 0 {
+			if gap := lines[i-1].y - line.y; gap > 0 {
+				gaps = append(gaps, gap)
+			}
+		}
+	}
+	sort.Float64s(gaps)
+	lineGap := 0.0
+	if len(gaps) > 0 {
+		lineGap = gaps[len(gaps)/2]
+	}
+
+	var content strings.Builder
+	content.WriteString(lines[0].text)
+	for i := 1; i < len(lines); i++ {
+		prev, line := lines[i-1], lines[i]
+		gap := prev.y - line.y
+		newParagraph := (lineGap > 0 && gap > lineGap*1.4) || line.x-left > line.fontSize
+
+		if newParagraph {
+			content.WriteString("\n\n")
+			content.WriteString(line.text)
+			continue
+		}
+		joinLine(&content, line.text)
+	}
+	return content.String()
+}
+
+// joinLine appends the next line of a paragraph, removing a hyphen that
+// splits a word across the line break
+func joinLine(content *strings.Builder, next string) {
+	text := content.String()
+	trimmed := strings.TrimSuffix(text, "\u00AD")
+	if trimmed != text {
+		content.Reset()
+		content.WriteString(trimmed)
+		content.WriteString(next)
+		return
+	}
+
+	first, _ := firstRune(next)
+	if strings.HasSuffix(text, "-") && len(text) > 1 && unicode.IsLetter(lastRune(text[:len(text)-1])) && unicode.IsLower(first) {
+		content.Reset()
+		content.WriteString(text[:len(text)-1])
+		content.WriteString(next)
+		return
+	}
+
+	content.WriteByte(' ')
+	content.WriteString(next)
+}
+
+func firstRune(s string) (rune, bool) {
+	for _, r := range s {
+		return r, true
+	}
+	return 0, false
+}
+
+func lastRune(s string) rune {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return 0
+	}
+	return runes[len(runes)-1]
+}
+
+// markPage returns the marker written at the start of a page
+func markPage(n int) string {
+	return string(pageMarkStart) + strconv.Itoa(n) + string(pageMarkEnd)
+}
+
+// extractPageMarkers removes page markers from text and returns where each
+// page starts. Text before the first remaining marker belongs to the page
+// preceding it, whose own marker was stripped along with boilerplate.
+func extractPageMarkers(text string) (string, []PageSpan) {
+	matches := pageMarker.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, nil
+	}
+
+	var result strings.Builder
+	var pages []PageSpan
+	last := 0
+	for _, m := range matches {
+		number, _ := strconv.Atoi(text[m[2]:m[3]])
+		if len(pages) == 0 && strings.TrimSpace(text[:m[0]]) != "" && number > 1 {
+			pages = append(pages, PageSpan{Number: number - 1, Offset: 0})
+		}
+		result.WriteString(text[last:m[0]])
+		pages = append(pages, PageSpan{Number: number, Offset: result.Len()})
+		last = m[1]
+	}
+	result.WriteString(text[last:])
+
+	return result.String(), pages
+}
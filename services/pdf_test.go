@@ -0,0 +1,292 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pdfTestLine is a line of text drawn at a fixed position on a test page
+type pdfTestLine struct {
+	x, y float64
+	text string
+}
+
+// writeTestPDF builds a minimal uncompressed PDF with one Helvetica text
+// line per entry on each page
+func writeTestPDF(t *testing.T, path string, pages [][]pdfTestLine) {
+	t.Helper()
+
+	var objects []string
+	objects = append(objects, "<< /Type /Catalog /Pages 2 0 R >>")
+	objects = append(objects, "") // page tree, filled in below
+	objects = append(objects, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+
+	var kids []string
+	for _, lines := range pages {
+		var stream strings.Builder
+		for _, line := range lines {
+			text := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(line.text)
+			fmt.Fprintf(&stream, "BT /F1 12 Tf 1 0 0 1 %.0f %.0f Tm (%s) Tj ET\n", line.x, line.y, text)
+		}
+		contentID := len(objects) + 1
+		objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", stream.Len(), stream.String()))
+		pageID := len(objects) + 1
+		objects = append(objects, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", contentID))
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write test PDF: %v", err)
+	}
+}
+
+func novelPDFPages() [][]pdfTestLine {
+	return [][]pdfTestLine{
+		{
+			{72, 760, "THE TEST NOVEL"},
+			{72, 700, "It was a bright cold day in April, and the clocks were strik-"},
+			{72, 686, "ing thirteen. Winston slipped quickly through the glass"},
+			{72, 672, "doors."},
+			{90, 658, "The hallway smelt of boiled cabbage and old rag mats."},
+			{300, 40, "1"},
+		},
+		{
+			{72, 760, "THE TEST NOVEL"},
+			{90, 700, "At one end of it a coloured poster had been tacked to the"},
+			{72, 686, "wall."},
+			{300, 40, "2"},
+		},
+		{
+			{72, 760, "THE TEST NOVEL"},
+			{90, 700, "Outside, even through the shut window-pane, the world"},
+			{72, 686, "looked cold."},
+			{300, 40, "Page 3"},
+		},
+	}
+}
+
+func TestNovelService_ReadNovel_PDF(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "novel.pdf")
+	writeTestPDF(t, filePath, novelPDFPages())
+
+	content, err := service.ReadNovelWithOptions(filePath, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := "It was a bright cold day in April, and the clocks were striking thirteen. Winston slipped quickly through the glass doors.\n\n" +
+		"The hallway smelt of boiled cabbage and old rag mats.\n\n" +
+		"At one end of it a coloured poster had been tacked to the wall.\n\n" +
+		"Outside, even through the shut window-pane, the world looked cold."
+	if content.Text != expected {
+		t.Errorf("Expected text:\n%q\ngot:\n%q", expected, content.Text)
+	}
+
+	if len(content.Pages) != 3 {
+		t.Fatalf("Expected 3 pages, got %d: %+v", len(content.Pages), content.Pages)
+	}
+	for i, page := range content.Pages {
+		if page.Number != i+1 {
+			t.Errorf("Expected page number %d, got %d", i+1, page.Number)
+		}
+	}
+	if !strings.HasPrefix(content.Text[content.Pages[1].Offset:], "At one end") {
+		t.Errorf("Expected page 2 to start at its first line, got %q", content.Text[content.Pages[1].Offset:])
+	}
+	if !strings.HasPrefix(content.Text[content.Pages[2].Offset:], "Outside") {
+		t.Errorf("Expected page 3 to start at its first line, got %q", content.Text[content.Pages[2].Offset:])
+	}
+}
+
+func TestNovelService_ReadNovel_InvalidPDF(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "broken.pdf")
+	if err := os.WriteFile(filePath, []byte("not a pdf"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	if _, err := service.ReadNovel(filePath); err == nil {
+		t.Error("Expected error when reading invalid PDF file, got nil")
+	}
+}
+
+func TestNovelService_ChunkNovel_Pages(t *testing.T) {
+	dir := "test_novels"
+	service := NewNovelService(dir)
+	defer os.RemoveAll(dir)
+
+	// 300 words on page 4, then 300 on page 5
+	page := strings.TrimSpace(strings.Repeat("word ", 300))
+	content := &NovelContent{
+		Text:  page + "\n\n" + page,
+		Pages: []PageSpan{{Number: 4, Offset: 0}, {Number: 5, Offset: len(page) + 2}},
+	}
+
+	chunks := service.ChunkNovel("book.pdf", content)
+	if len(chunks) != 2 {
+		t.Fatalf("Expected 2 chunks, got %d", len(chunks))
+	}
+
+	if chunks[0].Page != 4 || chunks[0].EndPage != 5 {
+		t.Errorf("Expected first chunk to span pages 4-5, got %d-%d", chunks[0].Page, chunks[0].EndPage)
+	}
+	if chunks[1].Page != 5 || chunks[1].EndPage != 5 {
+		t.Errorf("Expected second chunk on page 5, got %d-%d", chunks[1].Page, chunks[1].EndPage)
+	}
+
+	children := service.SplitChildren(chunks)
+	if children[0].Page != 4 {
+		t.Errorf("Expected children to inherit their passage's page, got %d", children[0].Page)
+	}
+}
+
+func TestExtractPageMarkers_StrippedFirstPage(t *testing.T) {
+	text := "end of page one " + markPage(2) + "page two"
+
+	result, pages := extractPageMarkers(text)
+
+	if result != "end of page one page two" {
+		t.Errorf("Expected markers to be removed, got %q", result)
+	}
+	if len(pages) != 2 || pages[0].Number != 1 || pages[1].Number != 2 || pages[1].Offset != 16 {
+		t.Errorf("Expected pages 1 and 2, got %+v", pages)
+	}
+}
+
+func TestJoinLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		next     string
+		expected string
+	}{
+		{"Plain wrap", "the quick", "brown fox", "the quick brown fox"},
+		{"Hyphenated word", "extra-", "ordinary", "extraordinary"},
+		{"Dash before capital", "Smith-", "Jones", "Smith- Jones"},
+		{"Soft hyphen", "extra\u00AD", "ordinary", "extraordinary"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var content strings.Builder
+			content.WriteString(tt.line)
+			joinLine(&content, tt.next)
+			if content.String() != tt.expected {
+				t.Errorf("joinLine() = %q, want %q", content.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestIsPageNumber(t *testing.T) {
+	tests := map[string]bool{
+		"12":           true,
+		" Page 3 ":     true,
+		"page 3 of 40": true,
+		"xiv":          true,
+		"xxxix":        true,
+		"Mix":          false,
+		"CIVIL":        false,
+		"did":          false,
+		"mild":         false,
+		"XIV":          false,
+		"":             false,
+		"Page":         false,
+	}
+	for text, expected := range tests {
+		if got := isPageNumber(text); got != expected {
+			t.Errorf("Expected %t for %q, got %t", expected, text, got)
+		}
+	}
+}
+
+func TestDropRunningLines_PageNumbersOnMostPages(t *testing.T) {
+	page := func(lines ...string) []pdfLine {
+		var result []pdfLine
+		for _, text := range lines {
+			result = append(result, pdfLine{text: text})
+		}
+		return result
+	}
+	texts := func(pages [][]pdfLine) []string {
+		var result []string
+		for _, lines := range pages {
+			for _, line := range lines {
+				result = append(result, line.text)
+			}
+		}
+		return result
+	}
+
+	// One short line that looks like a number isn't enough to remove it
+	pages := [][]pdfLine{
+		page("Chapter One", "It was a dark night.", "The end of it.", "42"),
+		page("Chapter Two", "It was a bright day.", "The end of that."),
+		page("Chapter Three", "It was a grey dawn.", "The end again."),
+	}
+	if got := texts(dropRunningLines(pages)); len(got) != 10 || got[3] != "42" {
+		t.Errorf("Expected every line kept, got %q", got)
+	}
+
+	// Numbers on most pages are removed
+	pages = [][]pdfLine{
+		page("It was a dark night.", "The end of it.", "i"),
+		page("It was a bright day.", "The end of that.", "ii"),
+		page("It was a grey dawn.", "The end again.", "Mix"),
+	}
+	if got := texts(dropRunningLines(pages)); strings.Join(got, "|") != "It was a dark night.|The end of it.|It was a bright day.|The end of that.|It was a grey dawn.|The end again.|Mix" {
+		t.Errorf("Expected the page numbers removed, got %q", got)
+	}
+}
+
+func TestSearch_PDFPages(t *testing.T) {
+	tempDir := t.TempDir()
+	ns := NewNovelService(filepath.Join(tempDir, "novels"))
+	ns.SetChunkWords(12)
+	cs := NewChromaService(filepath.Join(tempDir, "db"))
+
+	path := filepath.Join(tempDir, "novels", "novel.pdf")
+	writeTestPDF(t, path, novelPDFPages())
+	if _, err := NewIngestService(ns, cs).Ingest(path, IngestOptions{}, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The matching passage runs on from page 2 onto page 3
+	result, err := cs.Search(context.Background(), "coloured poster", 1, "", FullAccess)
+	if err != nil {
+		t.Fatalf("Expected no error searching, got %v", err)
+	}
+	if !result.Matched || len(result.Passages) != 1 {
+		t.Fatalf("Expected one matching passage, got %+v", result)
+	}
+	if passage := result.Passages[0]; passage.Novel != "novel.pdf" || passage.Page != 2 || passage.EndPage != 3 {
+		t.Errorf("Expected the passage on pages 2-3 of novel.pdf, got %+v in %q", passage, result.Context)
+	}
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("too many questions are waiting to be answered")
+	ErrQueueTimeout = errors.New("timed out waiting to be answered")
+)
+
+// defaultGenerationTime is assumed for estimates until an answer has been
+// generated
+const defaultGenerationTime = 10 * time.Second
+
+// GenerationQueue caps how many answers are generated at once. Questions
+// beyond the cap wait in a queue that takes turns between clients, so one
+// client sending many questions can't hold up everyone else's. A nil
+// *GenerationQueue lets everything through.
+type GenerationQueue struct {
+	mu         sync.Mutex
+	slots      int
+	maxWaiting int
+	timeout    time.Duration
+	running    int
+	// waiting holds each client's questions in order, and turns the
+	// clients with questions waiting in the order they will be served
+	waiting map[string][]*waiter
+	turns   []string
+	waiters int
+	// average is a moving average of generation times, for estimates
+	average time.Duration
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// QueueStatus describes the queue as seen by one client
+type QueueStatus struct {
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+	Slots   int `json:"slots"`
+	// Positions are where the client's waiting questions are in the queue,
+	// 1 being next
+	Positions []int `json:"positions"`
+}
+
+// NewGenerationQueue allows slots generations at once with up to
+// maxWaiting questions waiting at most timeout. It returns nil, which
+// doesn't queue, when slots is zero.
+func NewGenerationQueue(slots, maxWaiting int, timeout time.Duration) *GenerationQueue {
+	if slots <= 0 {
+		return nil
+	}
+	return &GenerationQueue{
+		slots:      slots,
+		maxWaiting: maxWaiting,
+		timeout:    timeout,
+		waiting:    make(map[string][]*waiter),
+		average:    defaultGenerationTime,
+	}
+}
+
+// Acquire waits for client's turn to generate an answer, returning a
+// function to call once it is done. It fails with ErrQueueFull when too
+// many questions are waiting, ErrQueueTimeout after waiting too long, or
+// ctx's error if it ends first.
+func (q *GenerationQueue) Acquire(ctx context.Context, client string) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.running < q.slots && q.waiters == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.releaser(), nil
+	}
+	if q.waiters >= q.maxWaiting {
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	if len(q.waiting[client]) == 0 {
+		q.turns = append(q.turns, client)
+	}
+	q.waiting[client] = append(q.waiting[client], w)
+	q.waiters++
+	q.mu.Unlock()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return q.releaser(), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrQueueTimeout
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.granted {
+		// The turn came as the wait ended; pass it on
+		q.running--
+		q.dispatch()
+	} else {
+		q.remove(client, w)
+	}
+	return nil, err
+}
+
+// Status returns the queue as seen by client
+func (q *GenerationQueue) Status(client string) QueueStatus {
+	if q == nil {
+		return QueueStatus{Positions: []int{}}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := QueueStatus{Running: q.running, Waiting: q.waiters, Slots: q.slots, Positions: []int{}}
+	// Play the turns out to see where the client's questions come
+	served := make(map[string]int)
+	turns := append([]string(nil), q.turns...)
+	for position := 1; len(turns) > 0; position++ {
+		next := turns[0]
+		turns = turns[1:]
+		if next == client {
+			status.Positions = append(status.Positions, position)
+		}
+		served[next]++
+		if served[next] < len(q.waiting[next]) {
+			turns = append(turns, next)
+		}
+	}
+	return status
+}
+
+// RetryAfter estimates how long until a question sent now would have a
+// place in the queue
+func (q *GenerationQueue) RetryAfter() time.Duration {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	wait := q.average * time.Duration(q.waiters-q.maxWaiting+1) / time.Duration(q.slots)
+	return max(wait, time.Second)
+}
+
+// releaser returns a function ending a generation, once however many times
+// it is called
+func (q *GenerationQueue) releaser() func() {
+	started := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.average = (q.average*4 + time.Since(started)) / 5
+			q.running--
+			q.dispatch()
+		})
+	}
+}
+
+// dispatch hands free slots to waiting questions, one client at a time
+func (q *GenerationQueue) dispatch() {
+	for q.running < q.slots && len(q.turns) > 0 {
+		client := q.turns[0]
+		q.turns = q.turns[1:]
+		w := q.waiting[client][0]
+		if rest := q.waiting[client][1:]; len(rest) > 0 {
+			q.waiting[client] = rest
+			q.turns = append(q.turns, client)
+		} else {
+			delete(q.waiting, client)
+		}
+		q.waiters--
+		q.running++
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// remove takes a question that gave up out of the queue
+func (q *GenerationQueue) remove(client string, w *waiter) {
+	waiting := q.waiting[client]
+	for i, other := range waiting {
+		if other == w {
+			waiting = append(waiting[:i:i], waiting[i+1:]...)
+			q.waiters--
+			break
+		}
+	}
+	if len(waiting) > 0 {
+		q.waiting[client] = waiting
+		return
+	}
+	delete(q.waiting, client)
+	for i, other := range q.turns {
+		if other == client {
+			q.turns = append(q.turns[:i:i], q.turns[i+1:]...)
+			break
+		}
+	}
+}
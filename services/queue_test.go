@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queueUp starts a question for client that waits in q, returning a
+// channel receiving its release function once it has a turn
+func queueUp(t *testing.T, q *GenerationQueue, client string) chan func() {
+	t.Helper()
+	turns := make(chan func(), 1)
+	before := q.Status(client).Waiting
+	go func() {
+		release, err := q.Acquire(context.Background(), client)
+		if err != nil {
+			close(turns)
+			return
+		}
+		turns <- release
+	}()
+	// Wait until it is in the queue, so the order is known
+	deadline := time.Now().Add(time.Second)
+	for q.Status(client).Waiting == before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return turns
+}
+
+func TestGenerationQueue_TakesTurns(t *testing.T) {
+	q := NewGenerationQueue(1, 10, time.Minute)
+	release, err := q.Acquire(context.Background(), "emma")
+	if err != nil {
+		t.Fatalf("Expected a free slot, got %v", err)
+	}
+
+	// Emma queues three questions before harriet asks one
+	emma := []chan func(){queueUp(t, q, "emma"), queueUp(t, q, "emma"), queueUp(t, q, "emma")}
+	harriet := queueUp(t, q, "harriet")
+
+	if positions := q.Status("emma").Positions; !reflect.DeepEqual(positions, []int{1, 3, 4}) {
+		t.Errorf("Expected emma at 1, 3 and 4, got %v", positions)
+	}
+	if status := q.Status("harriet"); !reflect.DeepEqual(status.Positions, []int{2}) || status.Waiting != 4 || status.Running != 1 {
+		t.Errorf("Expected harriet second of 4 waiting, got %+v", status)
+	}
+
+	// Harriet goes after emma's first question rather than her third
+	release()
+	next := <-emma[0]
+	next()
+	release = <-harriet
+	if positions := q.Status("emma").Positions; !reflect.DeepEqual(positions, []int{1, 2}) {
+		t.Errorf("Expected emma's last two questions next, got %v", positions)
+	}
+	release()
+	(<-emma[1])()
+	(<-emma[2])()
+	if status := q.Status("emma"); status.Running != 0 || status.Waiting != 0 {
+		t.Errorf("Expected an empty queue, got %+v", status)
+	}
+}
+
+func TestGenerationQueue_Limits(t *testing.T) {
+	q := NewGenerationQueue(1, 1, 20*time.Millisecond)
+	release, _ := q.Acquire(context.Background(), "emma")
+	defer release()
+
+	// One question can wait, until it times out
+	waited := make(chan error)
+	go func() {
+		_, err := q.Acquire(context.Background(), "harriet")
+		waited <- err
+	}()
+	deadline := time.Now().Add(time.Second)
+	for q.Status("harriet").Waiting == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := q.Acquire(context.Background(), "jane"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if err := <-waited; !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Expected ErrQueueTimeout, got %v", err)
+	}
+	if retry := q.RetryAfter(); retry < time.Second {
+		t.Errorf("Expected a retry of at least a second, got %v", retry)
+	}
+
+	// A cancelled question leaves the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.Acquire(ctx, "jane"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if status := q.Status("jane"); status.Waiting != 0 || len(status.Positions) != 0 {
+		t.Errorf("Expected nobody waiting, got %+v", status)
+	}
+}
+
+func TestGenerationQueue_Unlimited(t *testing.T) {
+	q := NewGenerationQueue(0, 0, time.Minute)
+	if q != nil {
+		t.Fatalf("Expected no queue without a cap")
+	}
+	release, err := q.Acquire(context.Background(), "emma")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	release()
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits each client to a number of requests per period with a
+// token bucket: a client can make that many requests at once, and earns
+// them back evenly over the period
+type RateLimiter struct {
+	mu       sync.Mutex
+	capacity float64
+	// perToken is how long a client waits to earn one request back
+	perToken time.Duration
+	buckets  map[string]*bucket
+	calls    int
+	now      func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter allows each client requests per period. It returns nil,
+// which allows everything, when requests is zero.
+func NewRateLimiter(requests int, per time.Duration) *RateLimiter {
+	if requests <= 0 || per <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		capacity: float64(requests),
+		perToken: per / time.Duration(requests),
+		buckets:  make(map[string]*bucket),
+		now:      time.Now,
+	}
+}
+
+// Allow takes a request from client's bucket, reporting whether there was
+// one and, when there wasn't, how long until there is
+func (rl *RateLimiter) Allow(client string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.calls++
+	if rl.calls%1000 == 0 {
+		rl.prune(now)
+	}
+
+	b, ok := rl.buckets[client]
+	if !ok {
+		b = &bucket{tokens: rl.capacity, updated: now}
+		rl.buckets[client] = b
+	}
+	b.tokens = rl.refill(b, now)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration(math.Ceil((1 - b.tokens) * float64(rl.perToken)))
+	return false, wait
+}
+
+// refill returns the tokens in b once those earned since its last use are
+// added
+func (rl *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	earned := float64(now.Sub(b.updated)) / float64(rl.perToken)
+	return math.Min(rl.capacity, b.tokens+earned)
+}
+
+// prune forgets clients whose buckets have filled up again, as they are
+// no different from new clients
+func (rl *RateLimiter) prune(now time.Time) {
+	for client, b := range rl.buckets {
+		if rl.refill(b, now) >= rl.capacity {
+			delete(rl.buckets, client)
+		}
+	}
+}
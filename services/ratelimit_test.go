@@ -0,0 +1,57 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(3, time.Minute)
+	now := time.Unix(1700000000, 0)
+	rl.now = func() time.Time { return now }
+
+	// A burst of the whole allowance, then a wait for the next request
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("emma"); !ok {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	ok, wait := rl.Allow("emma")
+	if ok || wait != 20*time.Second {
+		t.Errorf("Expected to wait 20s, got %t %v", ok, wait)
+	}
+
+	// Other clients have their own allowance
+	if ok, _ := rl.Allow("harriet"); !ok {
+		t.Errorf("Expected another client to be allowed")
+	}
+
+	// Requests are earned back evenly
+	now = now.Add(15 * time.Second)
+	if ok, wait := rl.Allow("emma"); ok || wait != 5*time.Second {
+		t.Errorf("Expected to wait 5s more, got %t %v", ok, wait)
+	}
+	now = now.Add(5 * time.Second)
+	if ok, _ := rl.Allow("emma"); !ok {
+		t.Errorf("Expected a request to have been earned back")
+	}
+
+	// Idle clients are forgotten once their bucket is full
+	now = now.Add(time.Hour)
+	rl.prune(now)
+	if len(rl.buckets) != 0 {
+		t.Errorf("Expected idle buckets to be pruned, got %d", len(rl.buckets))
+	}
+}
+
+func TestRateLimiter_Unlimited(t *testing.T) {
+	rl := NewRateLimiter(0, time.Minute)
+	if rl != nil {
+		t.Fatalf("Expected no limiter for a zero rate")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := rl.Allow("emma"); !ok {
+			t.Fatalf("Expected a nil limiter to allow everything")
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReconcileReport lists what a reconciliation pass changed, by storage name
+type ReconcileReport struct {
+	// Added are files that weren't indexed, such as ones placed in the
+	// novels directory by hand or all of them after the index was deleted
+	Added []string `json:"added"`
+	// Updated are files that changed since they were indexed
+	Updated []string `json:"updated"`
+	// Removed are novels whose files are gone; their chunks and catalog
+	// entries were purged
+	Removed []string `json:"removed"`
+	// Skipped are files left out of the index as exact copies of a novel in
+	// the library. They stay in the novels directory, and are reported by
+	// every pass until they are removed.
+	Skipped   []string           `json:"skipped"`
+	Unchanged int                `json:"unchanged"`
+	Failed    []ReconcileFailure `json:"failed,omitempty"`
+}
+
+// ReconcileFailure is a file a reconciliation pass couldn't ingest
+type ReconcileFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// Changed reports whether the pass changed the index
+func (r *ReconcileReport) Changed() bool {
+	return len(r.Added)+len(r.Updated)+len(r.Removed)+len(r.Skipped) > 0
+}
+
+func (r *ReconcileReport) String() string {
+	s := fmt.Sprintf("%d added, %d updated, %d removed, %d skipped, %d unchanged",
+		len(r.Added), len(r.Updated), len(r.Removed), len(r.Skipped), r.Unchanged)
+	if len(r.Failed) > 0 {
+		s += fmt.Sprintf(", %d failed", len(r.Failed))
+	}
+	return s
+}
+
+// Reconcile brings the index in line with the novels directory. Files that
+// aren't indexed are ingested, files whose SHA-256 differs from the one they
+// were indexed with are ingested again, and novels whose files have gone are
+// purged from the index and the catalog. Files named in pending, such as
+// uploads waiting for an ingestion job, are left for their jobs. Files are
+// never deleted. Ingestion waits until the pass finishes.
+func (is *IngestService) Reconcile(pending []string) (*ReconcileReport, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	ns := is.novelService
+	entries, err := os.ReadDir(ns.novelsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list novels: %v", err)
+	}
+	indexed, err := is.chromaService.IndexedNovels()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %v", err)
+	}
+	catalog := make(map[string]StoredNovel)
+	for _, novel := range ns.StoredNovels() {
+		catalog[novel.Name] = novel
+	}
+
+	waiting := make(map[string]bool)
+	for _, name := range pending {
+		waiting[name] = true
+	}
+
+	report := &ReconcileReport{Added: []string{}, Updated: []string{}, Removed: []string{}, Skipped: []string{}}
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		// Temporary files from uploads in progress are hidden
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || FormatByExtension(name) == nil {
+			continue
+		}
+		files[name] = true
+		if waiting[name] {
+			continue
+		}
+
+		path := filepath.Join(ns.novelsDir, name)
+		sum, err := hashFile(path)
+		if err != nil {
+			report.Failed = append(report.Failed, ReconcileFailure{Name: name, Error: err.Error()})
+			continue
+		}
+
+		novel := catalog[name]
+		indexedSum := novel.IndexedSHA256
+		if indexedSum == "" {
+			// Indexed before hashes were recorded; the upload hash stands in
+			indexedSum = novel.SHA256
+		}
+		_, isIndexed := indexed[name]
+		if isIndexed && indexedSum == sum {
+			if novel.IndexedSHA256 == "" {
+				if err := ns.SetIndexed(name, sum); err != nil {
+					return nil, err
+				}
+			}
+			report.Unchanged++
+			continue
+		}
+
+		result, err := is.ingest(context.Background(), path, IngestOptions{KeepFiles: true}, nil)
+		switch {
+		case err != nil:
+			report.Failed = append(report.Failed, ReconcileFailure{Name: name, Error: err.Error()})
+		case result.Action == DuplicateSkip:
+			report.Skipped = append(report.Skipped, name)
+		case isIndexed:
+			report.Updated = append(report.Updated, name)
+		default:
+			report.Added = append(report.Added, name)
+		}
+	}
+
+	// Purge novels whose files have gone from the index and the catalog
+	orphans := make(map[string]bool)
+	for name := range indexed {
+		if !files[name] {
+			orphans[name] = true
+		}
+	}
+	for name := range catalog {
+		if !files[name] {
+			orphans[name] = true
+		}
+	}
+	for name := range orphans {
+		if err := is.chromaService.DeleteNovel(name); err != nil {
+			return nil, fmt.Errorf("failed to purge %s: %v", name, err)
+		}
+		if err := ns.RemoveStored(name); err != nil {
+			return nil, fmt.Errorf("failed to purge %s: %v", name, err)
+		}
+		report.Removed = append(report.Removed, name)
+	}
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Updated)
+	sort.Strings(report.Removed)
+	sort.Strings(report.Skipped)
+	return report, nil
+}
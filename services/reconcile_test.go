@@ -0,0 +1,144 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// reconcileFixture sets up an ingest service over a temporary novels
+// directory and index
+func reconcileFixture(t *testing.T) (*IngestService, *ChromaService, string) {
+	t.Helper()
+	tempDir := t.TempDir()
+	novelsDir := filepath.Join(tempDir, "novels")
+	cs := NewChromaService(filepath.Join(tempDir, "db"))
+	return NewIngestService(NewNovelService(novelsDir), cs), cs, novelsDir
+}
+
+func reconcile(t *testing.T, is *IngestService, pending ...string) *ReconcileReport {
+	t.Helper()
+	report, err := is.Reconcile(pending)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return report
+}
+
+func TestReconcile(t *testing.T) {
+	is, cs, novelsDir := reconcileFixture(t)
+	write := func(name, text string) {
+		if err := os.WriteFile(filepath.Join(novelsDir, name), []byte(text), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	// Files dropped in by hand are ingested
+	write("emma.txt", "Emma Woodhouse, handsome, clever, and rich.")
+	write("persuasion.txt", "Sir Walter Elliot, of Kellynch Hall, in Somersetshire.")
+	write("notes.json", "{}")
+	report := reconcile(t, is)
+	if !reflect.DeepEqual(report.Added, []string{"emma.txt", "persuasion.txt"}) {
+		t.Errorf("Expected both novels to be added, got %v", report.Added)
+	}
+	indexed, _ := cs.IndexedNovels()
+	if len(indexed) != 2 {
+		t.Errorf("Expected 2 indexed novels, got %v", indexed)
+	}
+
+	// Nothing changes on a second pass
+	report = reconcile(t, is)
+	if report.Changed() || report.Unchanged != 2 {
+		t.Errorf("Expected 2 unchanged novels, got %s", report)
+	}
+
+	// Edited files are re-ingested and deleted ones purged
+	write("emma.txt", "Emma Woodhouse, handsome, clever, and rich, with a comfortable home.")
+	os.Remove(filepath.Join(novelsDir, "persuasion.txt"))
+	report = reconcile(t, is)
+	if !reflect.DeepEqual(report.Updated, []string{"emma.txt"}) {
+		t.Errorf("Expected emma.txt to be updated, got %v", report.Updated)
+	}
+	if !reflect.DeepEqual(report.Removed, []string{"persuasion.txt"}) {
+		t.Errorf("Expected persuasion.txt to be removed, got %v", report.Removed)
+	}
+	context, _ := cs.Query("comfortable", 1, FullAccess)
+	if context != "Emma Woodhouse, handsome, clever, and rich, with a comfortable home." {
+		t.Errorf("Expected the edited text to be indexed, got %q", context)
+	}
+	indexed, _ = cs.IndexedNovels()
+	if _, ok := indexed["persuasion.txt"]; ok {
+		t.Error("Expected persuasion.txt chunks to be purged")
+	}
+
+	// A deleted index is rebuilt
+	os.Remove(cs.getCollectionPath())
+	report = reconcile(t, is)
+	if !reflect.DeepEqual(report.Added, []string{"emma.txt"}) {
+		t.Errorf("Expected emma.txt to be added again, got %v", report.Added)
+	}
+}
+
+func TestReconcile_LeavesPendingUploads(t *testing.T) {
+	is, cs, novelsDir := reconcileFixture(t)
+	if err := os.WriteFile(filepath.Join(novelsDir, "emma.txt"), []byte("Emma Woodhouse."), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	report := reconcile(t, is, "emma.txt")
+	if report.Changed() || report.Unchanged != 0 {
+		t.Errorf("Expected a pending upload to be left alone, got %s", report)
+	}
+	if indexed, _ := cs.IndexedNovels(); len(indexed) != 0 {
+		t.Errorf("Expected nothing indexed, got %v", indexed)
+	}
+}
+
+func TestReconcile_UploadedNovelsAreUnchanged(t *testing.T) {
+	is, _, _ := reconcileFixture(t)
+	stored, _ := ingestUpload(t, is.novelService, is, "emma.txt", testNovelText(100), "")
+
+	// Catalogs written before indexed hashes were recorded fall back on
+	// the upload hash
+	is.novelService.SetIndexed(stored.Name, "")
+
+	report := reconcile(t, is)
+	if report.Changed() || report.Unchanged != 1 {
+		t.Errorf("Expected the upload to be unchanged, got %s", report)
+	}
+	if novel := is.novelService.StoredNovels()[0]; novel.IndexedSHA256 != stored.SHA256 {
+		t.Errorf("Expected the indexed hash to be recorded, got %q", novel.IndexedSHA256)
+	}
+}
+
+func TestReconcile_KeepsDuplicateFiles(t *testing.T) {
+	is, cs, novelsDir := reconcileFixture(t)
+	text := testNovelText(400)
+	for _, name := range []string{"emma.txt", "emma-copy.txt"} {
+		if err := os.WriteFile(filepath.Join(novelsDir, name), []byte(text), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	// Whichever is found second is reported and left unindexed, but the
+	// user's file is never deleted
+	report := reconcile(t, is)
+	if len(report.Added) != 1 || len(report.Skipped) != 1 {
+		t.Fatalf("Expected one novel added and one skipped, got %s", report)
+	}
+	for _, name := range []string{"emma.txt", "emma-copy.txt"} {
+		if _, err := os.Stat(filepath.Join(novelsDir, name)); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", name, err)
+		}
+	}
+	if indexed, _ := cs.IndexedNovels(); len(indexed) != 1 {
+		t.Errorf("Expected 1 indexed novel, got %v", indexed)
+	}
+
+	// The duplicate is reported again, and not purged as missing
+	report = reconcile(t, is)
+	if len(report.Skipped) != 1 || len(report.Removed) != 0 || report.Unchanged != 1 {
+		t.Errorf("Expected the duplicate to be skipped again, got %s", report)
+	}
+}
@@ -0,0 +1,358 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrFileTooLarge is returned when an upload is bigger than the size limit
+var ErrFileTooLarge = errors.New("file too large")
+
+// catalogFile lists the stored novels in the novels directory. Its
+// extension isn't a novel format, so LoadNovels passes over it.
+const catalogFile = "catalog.json"
+
+// maxStoredNameLen caps the sanitised part of a storage name
+const maxStoredNameLen = 100
+
+// StoredNovel describes an uploaded novel file kept in the novels directory
+type StoredNovel struct {
+	// Name is the file's name on disk: a content hash prefix followed by the
+	// sanitised original name
+	Name string `json:"name"`
+	// OriginalName is the filename the novel was uploaded with
+	OriginalName string    `json:"originalName"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+	// Aliases are the names of duplicate uploads linked to this novel
+	Aliases []string `json:"aliases,omitempty"`
+	// TextHash and MinHash fingerprint the novel's text once it has been
+	// read, for duplicate detection
+	TextHash string   `json:"textHash,omitempty"`
+	MinHash  []uint64 `json:"minHash,omitempty"`
+	// IndexedSHA256 is the SHA-256 of the file as it was when last indexed,
+	// so reconciliation can tell when a file has changed since
+	IndexedSHA256 string `json:"indexedSha256,omitempty"`
+	// Owner is the user who uploaded the novel, or zero for the shared
+	// library that files added by hand or from the command line join
+	Owner int64 `json:"owner,omitempty"`
+}
+
+// SaveUpload stores an uploaded novel under a collision-free name derived
+// from its content and original filename, recording the original name in
+// the catalog. The file is written to a temporary file and renamed into
+// place so a partial upload is never picked up. Uploads larger than limit
+// bytes fail with ErrFileTooLarge; a limit of zero means no limit.
+func (ns *NovelService) SaveUpload(r io.Reader, originalName string, format *Format, limit int64) (*StoredNovel, error) {
+	return ns.SaveOwnedUpload(r, originalName, format, limit, 0)
+}
+
+// SaveOwnedUpload is SaveUpload for a novel private to the user owner. Its
+// storage name is prefixed with the owner so the same file uploaded by two
+// users is stored, and can be shared or deleted, separately.
+func (ns *NovelService) SaveOwnedUpload(r io.Reader, originalName string, format *Format, limit int64, owner int64) (*StoredNovel, error) {
+	tmp, err := os.CreateTemp(ns.novelsDir, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(tmp, io.TeeReader(r, hash))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write file: %v", err)
+	}
+	if limit > 0 && size > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrFileTooLarge, limit)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	stored := &StoredNovel{
+		Name:         StorageName(originalName, sum, format),
+		OriginalName: originalName,
+		Size:         size,
+		SHA256:       sum,
+		UploadedAt:   time.Now().UTC(),
+		Owner:        owner,
+	}
+	if owner != 0 {
+		stored.Name = fmt.Sprintf("u%d-%s", owner, stored.Name)
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), filepath.Join(ns.novelsDir, stored.Name)); err != nil {
+		return nil, fmt.Errorf("failed to save file: %v", err)
+	}
+
+	// The same content uploaded again under the same name keeps what was
+	// learnt about the novel, such as its aliases and fingerprint
+	catalog := ns.loadCatalog()
+	if existing, ok := catalog[stored.Name]; ok {
+		existing.OriginalName = stored.OriginalName
+		existing.UploadedAt = stored.UploadedAt
+		stored = &existing
+	}
+	catalog[stored.Name] = *stored
+	if err := ns.saveCatalog(catalog); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// StoredNovels returns the catalog of uploaded novels, ordered by name
+func (ns *NovelService) StoredNovels() []StoredNovel {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	var novels []StoredNovel
+	for _, novel := range ns.loadCatalog() {
+		novels = append(novels, novel)
+	}
+	sort.Slice(novels, func(i, j int) bool { return novels[i].Name < novels[j].Name })
+	return novels
+}
+
+// OriginalName returns the name a stored novel was uploaded with, or the
+// storage name itself for files that aren't in the catalog
+func (ns *NovelService) OriginalName(name string) string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if novel, ok := ns.loadCatalog()[name]; ok {
+		return novel.OriginalName
+	}
+	return name
+}
+
+// Owner returns the user who uploaded a stored novel, or zero for novels in
+// the shared library
+func (ns *NovelService) Owner(name string) int64 {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.loadCatalog()[name].Owner
+}
+
+// SetIndexed records the SHA-256 of a stored novel's file as last indexed,
+// adding an entry for files that were placed in the novels directory
+// directly
+func (ns *NovelService) SetIndexed(name, sha256Hex string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	catalog := ns.loadCatalog()
+	novel, ok := catalog[name]
+	if !ok {
+		novel = StoredNovel{Name: name, OriginalName: name}
+	}
+	novel.IndexedSHA256 = sha256Hex
+	catalog[name] = novel
+	return ns.saveCatalog(catalog)
+}
+
+// ResolveNovel finds the storage name of a novel given its storage name,
+// the name it was uploaded with or one of its aliases
+func (ns *NovelService) ResolveNovel(name string) (string, bool) {
+	ns.mu.Lock()
+	catalog := ns.loadCatalog()
+	ns.mu.Unlock()
+
+	if _, ok := catalog[name]; ok {
+		return name, true
+	}
+	// Prefer the latest upload when several share a name
+	var found *StoredNovel
+	for _, novel := range catalog {
+		matches := novel.OriginalName == name
+		for _, alias := range novel.Aliases {
+			matches = matches || alias == name
+		}
+		if matches && (found == nil || novel.UploadedAt.After(found.UploadedAt)) {
+			novel := novel
+			found = &novel
+		}
+	}
+	if found != nil {
+		return found.Name, true
+	}
+
+	// Files placed in the novels directory by hand aren't in the catalog
+	if name == SanitizeFilename(name) {
+		if _, err := os.Stat(ns.StoredPath(name)); err == nil {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ResolveOwnedNovel is ResolveNovel among the novels owner uploaded
+func (ns *NovelService) ResolveOwnedNovel(name string, owner int64) (string, bool) {
+	ns.mu.Lock()
+	catalog := ns.loadCatalog()
+	ns.mu.Unlock()
+
+	if novel, ok := catalog[name]; ok && novel.Owner == owner {
+		return name, true
+	}
+	var found *StoredNovel
+	for _, novel := range catalog {
+		if novel.Owner != owner {
+			continue
+		}
+		matches := novel.OriginalName == name
+		for _, alias := range novel.Aliases {
+			matches = matches || alias == name
+		}
+		if matches && (found == nil || novel.UploadedAt.After(found.UploadedAt)) {
+			novel := novel
+			found = &novel
+		}
+	}
+	if found != nil {
+		return found.Name, true
+	}
+	return "", false
+}
+
+// IsIndexed reports whether the stored novel at path was last indexed with
+// its current contents
+func (ns *NovelService) IsIndexed(path string) (bool, error) {
+	sum, err := hashFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	novel, ok := ns.loadCatalog()[filepath.Base(path)]
+	return ok && novel.IndexedSHA256 == sum, nil
+}
+
+// loadCatalog reads the catalog. The caller must hold ns.mu.
+func (ns *NovelService) loadCatalog() map[string]StoredNovel {
+	catalog := make(map[string]StoredNovel)
+	if data, err := os.ReadFile(filepath.Join(ns.novelsDir, catalogFile)); err == nil {
+		json.Unmarshal(data, &catalog)
+	}
+	return catalog
+}
+
+// saveCatalog writes the catalog. The caller must hold ns.mu.
+func (ns *NovelService) saveCatalog(catalog map[string]StoredNovel) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(ns.novelsDir, catalogFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to save catalog: %v", err)
+	}
+	return nil
+}
+
+// StorageName builds the on-disk name for an upload: the first 12 hex digits
+// of its SHA-256 followed by the sanitised original name, with the format's
+// extension added when the name lacks one
+func StorageName(originalName, sha256Hex string, format *Format) string {
+	name := SanitizeFilename(originalName)
+	if format != nil && FormatByExtension(name) != format && len(format.Extensions) > 0 {
+		name += format.Extensions[0]
+	}
+	return sha256Hex[:12] + "-" + name
+}
+
+// SanitizeFilename reduces an uploaded filename to a safe base name: any
+// directory part (with either separator) is dropped, characters outside
+// letters, digits, '.', '-' and '_' become '_', and leading dots are removed
+// so the result can't be hidden or refer to a parent directory
+func SanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '.' || r == '-' || r == '_':
+			b.WriteRune(r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	name = strings.TrimLeft(b.String(), ".")
+
+	if len(name) > maxStoredNameLen {
+		// Keep the extension when trimming a long name
+		ext := filepath.Ext(name)
+		if len(ext) > 10 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxStoredNameLen-len(ext)], "") + ext
+	}
+	if name == "" {
+		name = "novel"
+	}
+	return name
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it
+// into place, so readers never see a partly written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// StoredPath returns the path of a stored novel in the novels directory
+func (ns *NovelService) StoredPath(name string) string {
+	return filepath.Join(ns.novelsDir, name)
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"emma.txt", "emma.txt"},
+		{"../../etc/passwd", "passwd"},
+		{`..\..\windows\win.ini`, "win.ini"},
+		{"my novel (2nd ed).epub", "my_novel__2nd_ed_.epub"},
+		{".hidden.txt", "hidden.txt"},
+		{"..", "novel"},
+		{"", "novel"},
+		{"Анна Каренина.fb2", "Анна_Каренина.fb2"},
+		{strings.Repeat("a", 200) + ".txt", strings.Repeat("a", 96) + ".txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := SanitizeFilename(tt.input); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestStorageName(t *testing.T) {
+	sum := "0123456789abcdef0123456789abcdef"
+
+	if name := StorageName("emma.txt", sum, FormatByName("txt")); name != "0123456789ab-emma.txt" {
+		t.Errorf("Unexpected storage name %s", name)
+	}
+	// A sniffed format's extension is added so the file is recognised later
+	if name := StorageName("chapter-one", sum, FormatByName("html")); name != "0123456789ab-chapter-one.html" {
+		t.Errorf("Unexpected storage name %s", name)
+	}
+}
+
+func TestSaveUpload(t *testing.T) {
+	dir := t.TempDir()
+	ns := NewNovelService(dir)
+
+	first, err := ns.SaveUpload(strings.NewReader("First book"), "../novel.txt", FormatByName("txt"), 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	second, err := ns.SaveUpload(strings.NewReader("Second book"), "novel.txt", FormatByName("txt"), 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Identically named uploads don't overwrite each other
+	if first.Name == second.Name {
+		t.Errorf("Expected distinct storage names, got %s twice", first.Name)
+	}
+	for _, stored := range []*StoredNovel{first, second} {
+		if !strings.HasSuffix(stored.Name, "-novel.txt") {
+			t.Errorf("Unexpected storage name %s", stored.Name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, stored.Name)); err != nil {
+			t.Errorf("Expected %s to be saved in the novels directory: %v", stored.Name, err)
+		}
+	}
+
+	if name := ns.OriginalName(first.Name); name != "../novel.txt" {
+		t.Errorf("Expected original name to be kept, got %s", name)
+	}
+	if got := len(ns.StoredNovels()); got != 2 {
+		t.Errorf("Expected 2 stored novels, got %d", got)
+	}
+
+	// Only the two novels and the catalog remain; no temporary files
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("Expected 3 files, got %d", len(entries))
+	}
+}
+
+func TestSaveUpload_TooLarge(t *testing.T) {
+	dir := t.TempDir()
+	ns := NewNovelService(dir)
+
+	_, err := ns.SaveUpload(strings.NewReader("This is more than ten bytes"), "big.txt", FormatByName("txt"), 10)
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("Expected ErrFileTooLarge, got %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Expected nothing to be saved, got %d files", len(entries))
+	}
+}
+
+func TestResolveNovel(t *testing.T) {
+	ns := NewNovelService(filepath.Join(t.TempDir(), "novels"))
+	stored, err := ns.SaveUpload(strings.NewReader("Emma Woodhouse."), "Emma.txt", FormatByName("txt"), 0)
+	if err != nil {
+		t.Fatalf("Failed to save upload: %v", err)
+	}
+	os.WriteFile(ns.StoredPath("persuasion.txt"), []byte("Anne Elliot."), 0644)
+
+	tests := []struct {
+		name     string
+		expected string
+		found    bool
+	}{
+		{stored.Name, stored.Name, true},
+		{"Emma.txt", stored.Name, true},
+		{"persuasion.txt", "persuasion.txt", true},
+		{"../persuasion.txt", "", false},
+		{"missing.txt", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, found := ns.ResolveNovel(tt.name)
+			if name != tt.expected || found != tt.found {
+				t.Errorf("Expected %q (%t), got %q (%t)", tt.expected, tt.found, name, found)
+			}
+		})
+	}
+}
+
+func TestSaveOwnedUpload(t *testing.T) {
+	ns := NewNovelService(filepath.Join(t.TempDir(), "novels"))
+	library, err := ns.SaveUpload(strings.NewReader("Emma Woodhouse."), "Emma.txt", FormatByName("txt"), 0)
+	if err != nil {
+		t.Fatalf("Failed to save upload: %v", err)
+	}
+	owned, err := ns.SaveOwnedUpload(strings.NewReader("Emma Woodhouse."), "Emma.txt", FormatByName("txt"), 0, 7)
+	if err != nil {
+		t.Fatalf("Failed to save upload: %v", err)
+	}
+
+	// The same file uploaded by a user is stored apart from the library's
+	if !strings.HasPrefix(owned.Name, "u7-") || owned.Name == library.Name {
+		t.Errorf("Unexpected storage name %s", owned.Name)
+	}
+	if owner := ns.Owner(owned.Name); owner != 7 {
+		t.Errorf("Expected owner 7, got %d", owner)
+	}
+	if owner := ns.Owner(library.Name); owner != 0 {
+		t.Errorf("Expected the library's copy to have no owner, got %d", owner)
+	}
+
+	tests := []struct {
+		name     string
+		owner    int64
+		expected string
+		found    bool
+	}{
+		{"Emma.txt", 7, owned.Name, true},
+		{owned.Name, 7, owned.Name, true},
+		{"Emma.txt", 0, library.Name, true},
+		{owned.Name, 8, "", false},
+		{"Emma.txt", 8, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, found := ns.ResolveOwnedNovel(tt.name, tt.owner)
+			if name != tt.expected || found != tt.found {
+				t.Errorf("Expected %q (%t), got %q (%t)", tt.expected, tt.found, name, found)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package services
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the spans of the ingest and ask pipelines. It uses the
+// global provider, so spans go nowhere until tracing is set up.
+var tracer = otel.Tracer("github.com/kweusuf/novel-qa-go/services")
+
+// endSpan ends span, marking it failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
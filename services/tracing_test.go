@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	installSpans sync.Once
+	spans        = tracetest.NewSpanRecorder()
+)
+
+// traceRoot records spans for the test, which can only install the global
+// provider once, and returns a context holding a root span whose trace
+// tracedSpans filters on
+func traceRoot(t *testing.T) (context.Context, trace.Span) {
+	t.Helper()
+	installSpans.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return otel.Tracer("test").Start(context.Background(), t.Name())
+}
+
+// tracedSpans returns the ended spans of root's trace by name
+func tracedSpans(root trace.Span) map[string]sdktrace.ReadOnlySpan {
+	found := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans.Ended() {
+		if span.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			found[span.Name()] = span
+		}
+	}
+	return found
+}
+
+// spanAttr returns a span attribute by key
+func spanAttr(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestEndSpan(t *testing.T) {
+	ctx, root := traceRoot(t)
+	_, ok := tracer.Start(ctx, "ok")
+	endSpan(ok, nil)
+	_, failed := tracer.Start(ctx, "failed")
+	endSpan(failed, errors.New("disk full"))
+	root.End()
+
+	recorded := tracedSpans(root)
+	if recorded["ok"].Status().Code != codes.Unset {
+		t.Errorf("Expected an unset status, got %v", recorded["ok"].Status())
+	}
+	if status := recorded["failed"].Status(); status.Code != codes.Error || status.Description != "disk full" {
+		t.Errorf("Expected an error status, got %v", status)
+	}
+	if events := recorded["failed"].Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Errorf("Expected the error to be recorded, got %v", events)
+	}
+}
@@ -0,0 +1,340 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+)
+
+// DefaultSessionTTL is how long a login lasts
+const DefaultSessionTTL = 7 * 24 * time.Hour
+
+// InviteTTL is how long an invite code can be used to register
+const InviteTTL = 7 * 24 * time.Hour
+
+// MinPasswordLength and MaxPasswordLength bound passwords in bytes; bcrypt
+// ignores anything beyond 72
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+var (
+	ErrInvalidUsername    = errors.New("usernames are 3 to 32 letters, digits, dots, dashes or underscores")
+	ErrInvalidPassword    = fmt.Errorf("passwords are %d to %d bytes long", MinPasswordLength, MaxPasswordLength)
+	ErrUserExists         = errors.New("that username is taken")
+	ErrInvalidInvite      = errors.New("the invite code is invalid, used or expired")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrSessionNotFound    = errors.New("session not found or expired")
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,32}$`)
+
+// User is an account that can log in
+type User struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Admin     bool      `json:"admin"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UserStore keeps accounts, login sessions, invite codes, API keys and
+// collections in a SQLite database. Session tokens, invite codes and API
+// keys are stored as SHA-256 hashes so a copy of the database can't be used
+// to log in.
+type UserStore struct {
+	db  *sql.DB
+	ttl time.Duration
+	now func() time.Time
+	// dummyHash is compared against when a username doesn't exist, so
+	// failed logins take as long whether or not it does
+	dummyHash []byte
+}
+
+// OpenUserStore opens the database at path, creating it or adding the
+// tables and columns it lacks
+func OpenUserStore(path string) (*UserStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open users database: %v", err)
+	}
+	// SQLite allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	us := &UserStore{db: db, ttl: DefaultSessionTTL, now: time.Now}
+	if err := us.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to prepare users database: %v", err)
+	}
+	us.dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return us, nil
+}
+
+// migrate brings the schema up to date. The users table predates the
+// admin flag and creation time, so those are added to older databases.
+func (us *UserStore) migrate() error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT UNIQUE NOT NULL,
+			password TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			expires_at INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS invites (
+			code_hash TEXT PRIMARY KEY,
+			created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			expires_at INTEGER NOT NULL,
+			used_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS collections (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at INTEGER NOT NULL,
+			UNIQUE (owner_id, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS collection_members (
+			collection_id INTEGER NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			PRIMARY KEY (collection_id, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS collection_novels (
+			collection_id INTEGER NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+			novel TEXT NOT NULL,
+			added_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			PRIMARY KEY (collection_id, novel)
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			last_used_at INTEGER
+		)`,
+	}
+	for _, stmt := range statements {
+		if _, err := us.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	columns := make(map[string]bool)
+	rows, err := us.db.Query(`SELECT name FROM pragma_table_info('users')`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range []struct{ name, definition string }{
+		{"is_admin", "INTEGER NOT NULL DEFAULT 0"},
+		{"created_at", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if !columns[column.name] {
+			if _, err := us.db.Exec("ALTER TABLE users ADD COLUMN " + column.name + " " + column.definition); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the database
+func (us *UserStore) Close() error {
+	return us.db.Close()
+}
+
+// SetSessionTTL sets how long new sessions last
+func (us *UserStore) SetSessionTTL(ttl time.Duration) {
+	if ttl > 0 {
+		us.ttl = ttl
+	}
+}
+
+// Register creates an account, consuming an unused invite code when
+// requireInvite is set. The first account becomes the admin, so it always
+// needs an invite, which only the invite command can create before there is
+// an admin.
+func (us *UserStore) Register(username, password, invite string, requireInvite bool) (*User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return nil, ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	tx, err := us.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to register user: %v", err)
+	}
+	defer tx.Rollback()
+
+	var users int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&users); err != nil {
+		return nil, fmt.Errorf("failed to register user: %v", err)
+	}
+	var taken int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ? COLLATE NOCASE`, username).Scan(&taken); err != nil {
+		return nil, fmt.Errorf("failed to register user: %v", err)
+	}
+	if taken > 0 {
+		return nil, ErrUserExists
+	}
+
+	now := us.now()
+	user := &User{Username: username, Admin: users == 0, CreatedAt: now.Truncate(time.Second)}
+	result, err := tx.Exec(`INSERT INTO users (username, password, is_admin, created_at) VALUES (?, ?, ?, ?)`,
+		username, string(hash), user.Admin, now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to register user: %v", err)
+	}
+	if user.ID, err = result.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("failed to register user: %v", err)
+	}
+
+	if requireInvite || user.Admin {
+		used, err := tx.Exec(`UPDATE invites SET used_by = ? WHERE code_hash = ? AND used_by IS NULL AND expires_at > ?`,
+			user.ID, hashSecret(invite), now.Unix())
+		if err != nil {
+			return nil, fmt.Errorf("failed to register user: %v", err)
+		}
+		if n, _ := used.RowsAffected(); n != 1 {
+			return nil, ErrInvalidInvite
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to register user: %v", err)
+	}
+	return user, nil
+}
+
+// Authenticate checks a username and password, returning
+// ErrInvalidCredentials without saying which was wrong
+func (us *UserStore) Authenticate(username, password string) (*User, error) {
+	var user User
+	var hash string
+	var created int64
+	err := us.db.QueryRow(`SELECT id, username, password, is_admin, created_at FROM users WHERE username = ? COLLATE NOCASE`, username).
+		Scan(&user.ID, &user.Username, &hash, &user.Admin, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(us.dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user: %v", err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	user.CreatedAt = time.Unix(created, 0)
+	return &user, nil
+}
+
+// CreateSession logs a user in, returning the token for their cookie and
+// when it expires. Expired sessions are removed at the same time.
+func (us *UserStore) CreateSession(userID int64) (string, time.Time, error) {
+	token := newSecret()
+	now := us.now()
+	expires := now.Add(us.ttl)
+
+	if _, err := us.db.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.Unix()); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create session: %v", err)
+	}
+	if _, err := us.db.Exec(`INSERT INTO sessions (token_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		hashSecret(token), userID, expires.Unix()); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create session: %v", err)
+	}
+	return token, expires, nil
+}
+
+// SessionUser returns the user logged in with a session token
+func (us *UserStore) SessionUser(token string) (*User, error) {
+	var user User
+	var created int64
+	err := us.db.QueryRow(`SELECT u.id, u.username, u.is_admin, u.created_at FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`, hashSecret(token), us.now().Unix()).
+		Scan(&user.ID, &user.Username, &user.Admin, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up session: %v", err)
+	}
+	user.CreatedAt = time.Unix(created, 0)
+	return &user, nil
+}
+
+// DeleteSession logs a session out
+func (us *UserStore) DeleteSession(token string) error {
+	if _, err := us.db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, hashSecret(token)); err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+	return nil
+}
+
+// CreateInvite returns a new invite code valid for InviteTTL. createdBy is
+// the admin creating it, or zero when it comes from the command line.
+func (us *UserStore) CreateInvite(createdBy int64) (string, time.Time, error) {
+	code := newSecret()
+	expires := us.now().Add(InviteTTL)
+	creator := sql.NullInt64{Int64: createdBy, Valid: createdBy != 0}
+	if _, err := us.db.Exec(`INSERT INTO invites (code_hash, created_by, expires_at) VALUES (?, ?, ?)`,
+		hashSecret(code), creator, expires.Unix()); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create invite: %v", err)
+	}
+	return code, expires, nil
+}
+
+// Count returns the number of accounts
+func (us *UserStore) Count() (int, error) {
+	var n int
+	if err := us.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count users: %v", err)
+	}
+	return n, nil
+}
+
+// newSecret returns a random URL-safe token
+func newSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashSecret returns the hex SHA-256 of a token as stored in the database
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestUserStore(t *testing.T) *UserStore {
+	t.Helper()
+	us, err := OpenUserStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Failed to open user store: %v", err)
+	}
+	t.Cleanup(func() { us.Close() })
+	return us
+}
+
+// adminInvite creates an invite for the first account, as the invite command
+// does
+func adminInvite(t *testing.T, us *UserStore) string {
+	t.Helper()
+	code, _, err := us.CreateInvite(0)
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	return code
+}
+
+func TestUserStore_Register(t *testing.T) {
+	us := newTestUserStore(t)
+
+	// The first account becomes the admin, so it needs an invite even when
+	// registration is open
+	if _, err := us.Register("emma", "knightley1", "", false); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("Expected the first account to need an invite, got %v", err)
+	}
+	admin, err := us.Register("emma", "knightley1", adminInvite(t, us), false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !admin.Admin {
+		t.Errorf("Expected the first account to be an admin")
+	}
+	reader, err := us.Register("harriet", "martin123", "", false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reader.Admin {
+		t.Errorf("Expected later accounts not to be admins")
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		expected error
+	}{
+		{"taken ignoring case", "EMMA", "knightley1", ErrUserExists},
+		{"short username", "em", "knightley1", ErrInvalidUsername},
+		{"username with spaces", "miss bates", "knightley1", ErrInvalidUsername},
+		{"short password", "jane", "short", ErrInvalidPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := us.Register(tt.username, tt.password, "", false); !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestUserStore_RegisterWithInvite(t *testing.T) {
+	us := newTestUserStore(t)
+
+	admin, err := us.Register("emma", "knightley1", adminInvite(t, us), true)
+	if err != nil {
+		t.Fatalf("Expected the first account to register, got %v", err)
+	}
+	if _, err := us.Register("harriet", "martin123", "", true); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("Expected an invite to be required, got %v", err)
+	}
+
+	code, expires, err := us.CreateInvite(admin.ID)
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	if time.Until(expires) < InviteTTL-time.Minute {
+		t.Errorf("Expected the invite to last %v, got until %v", InviteTTL, expires)
+	}
+	if _, err := us.Register("harriet", "martin123", code, true); err != nil {
+		t.Fatalf("Expected the invite to be accepted, got %v", err)
+	}
+	if _, err := us.Register("jane", "fairfax12", code, true); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("Expected a used invite to be refused, got %v", err)
+	}
+	// A refused registration creates no account
+	if n, _ := us.Count(); n != 2 {
+		t.Errorf("Expected 2 accounts, got %d", n)
+	}
+
+	// Invites expire
+	expired, _, _ := us.CreateInvite(admin.ID)
+	us.now = func() time.Time { return time.Now().Add(InviteTTL + time.Hour) }
+	if _, err := us.Register("jane", "fairfax12", expired, true); !errors.Is(err, ErrInvalidInvite) {
+		t.Errorf("Expected an expired invite to be refused, got %v", err)
+	}
+}
+
+func TestUserStore_Authenticate(t *testing.T) {
+	us := newTestUserStore(t)
+	us.Register("emma", "knightley1", adminInvite(t, us), false)
+
+	user, err := us.Authenticate("Emma", "knightley1")
+	if err != nil || user.Username != "emma" || !user.Admin {
+		t.Errorf("Expected emma to log in, got %+v (%v)", user, err)
+	}
+	if _, err := us.Authenticate("emma", "wrong-password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected a wrong password to be refused, got %v", err)
+	}
+	if _, err := us.Authenticate("nobody", "knightley1"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected an unknown user to be refused, got %v", err)
+	}
+
+	// Passwords are stored as bcrypt hashes
+	var hash string
+	us.db.QueryRow(`SELECT password FROM users WHERE username = 'emma'`).Scan(&hash)
+	if hash == "knightley1" || len(hash) < 4 || hash[:4] != "$2a$" {
+		t.Errorf("Expected a bcrypt hash, got %q", hash)
+	}
+}
+
+func TestUserStore_Sessions(t *testing.T) {
+	us := newTestUserStore(t)
+	us.SetSessionTTL(time.Hour)
+	emma, _ := us.Register("emma", "knightley1", adminInvite(t, us), false)
+
+	token, expires, err := us.CreateSession(emma.ID)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if d := time.Until(expires); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("Expected the session to last an hour, got %v", d)
+	}
+	user, err := us.SessionUser(token)
+	if err != nil || user.ID != emma.ID {
+		t.Errorf("Expected the session to belong to emma, got %+v (%v)", user, err)
+	}
+	if _, err := us.SessionUser("forged"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected an unknown token to be refused, got %v", err)
+	}
+
+	// Only a hash of the token is stored
+	var stored int
+	us.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE token_hash = ?`, token).Scan(&stored)
+	if stored != 0 {
+		t.Errorf("Expected the raw token not to be stored")
+	}
+
+	// Sessions expire
+	us.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := us.SessionUser(token); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected an expired session to be refused, got %v", err)
+	}
+	us.now = time.Now
+
+	// And end on logout
+	token, _, _ = us.CreateSession(emma.ID)
+	if err := us.DeleteSession(token); err != nil {
+		t.Fatalf("Failed to delete session: %v", err)
+	}
+	if _, err := us.SessionUser(token); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected a deleted session to be refused, got %v", err)
+	}
+}
+
+func TestOpenUserStore_MigratesUsersTable(t *testing.T) {
+	// The users table as first shipped, without the admin flag
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT UNIQUE NOT NULL, password TEXT NOT NULL)`); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	db.Close()
+
+	us, err := OpenUserStore(path)
+	if err != nil {
+		t.Fatalf("Expected the old table to be migrated, got %v", err)
+	}
+	user, err := us.Register("emma", "knightley1", adminInvite(t, us), false)
+	if err != nil || !user.Admin {
+		t.Errorf("Expected to register an admin, got %+v (%v)", user, err)
+	}
+
+	// Opening again leaves the schema alone
+	us.Close()
+	if us, err = OpenUserStore(path); err != nil {
+		t.Fatalf("Expected the store to reopen, got %v", err)
+	}
+	defer us.Close()
+	if n, _ := us.Count(); n != 1 {
+		t.Errorf("Expected 1 account, got %d", n)
+	}
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kweusuf/novel-qa-go/logging"
+)
+
+// Defaults for watching the novels directory
+const (
+	DefaultWatchInterval = 2 * time.Second
+	// DefaultWatchSettle is how long a file must stay unchanged before it is
+	// ingested, so files still being copied in aren't read half-written
+	DefaultWatchSettle = 5 * time.Second
+)
+
+// fileState is what a poll of the novels directory saw of a file
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+// watchedFile tracks a file between polls
+type watchedFile struct {
+	// seen is the state at the last poll and changedAt when it last differed
+	// from the poll before
+	seen      fileState
+	changedAt time.Time
+	// handled is the state the watcher last acted on
+	handled fileState
+}
+
+// Watcher polls the novels directory and feeds created, modified and
+// removed novels through the ingestion jobs, as uploads are. A change is
+// only acted on once the file has stopped changing for the settle time.
+type Watcher struct {
+	jobs     *JobManager
+	interval time.Duration
+	settle   time.Duration
+
+	mu    sync.Mutex
+	files map[string]*watchedFile
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewWatcher creates a watcher that polls every interval and submits files
+// to the job manager once they have been unchanged for settle
+func NewWatcher(jm *JobManager, interval, settle time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	return &Watcher{
+		jobs:     jm,
+		interval: interval,
+		settle:   settle,
+		files:    make(map[string]*watchedFile),
+	}
+}
+
+// Start records the files already in the directory, which reconciliation
+// takes care of, and starts polling for changes
+func (w *Watcher) Start() {
+	w.mu.Lock()
+	now := time.Now()
+	for name, state := range w.scan() {
+		w.files[name] = &watchedFile{seen: state, changedAt: now, handled: state}
+	}
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	w.mu.Unlock()
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				w.poll(now)
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops polling
+func (w *Watcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// scan lists the novels in the directory, skipping hidden files such as
+// uploads being written
+func (w *Watcher) scan() map[string]fileState {
+	dir := w.jobs.ingest.novelService.novelsDir
+	states := make(map[string]fileState)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Warn("Failed to watch novels directory", "dir", dir, "error", err)
+		return states
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || FormatByExtension(name) == nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		states[name] = fileState{exists: true, size: info.Size(), modTime: info.ModTime()}
+	}
+	return states
+}
+
+// poll compares the directory with the last poll and acts on files that
+// have settled since they changed
+func (w *Watcher) poll(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	states := w.scan()
+	for name := range states {
+		if _, ok := w.files[name]; !ok {
+			w.files[name] = &watchedFile{changedAt: now}
+		}
+	}
+
+	for name, file := range w.files {
+		state := states[name]
+		if state != file.seen {
+			file.seen = state
+			file.changedAt = now
+		}
+		if file.seen == file.handled || now.Sub(file.changedAt) < w.settle {
+			continue
+		}
+
+		w.handle(name, state)
+		file.handled = state
+		if !state.exists {
+			delete(w.files, name)
+		}
+	}
+}
+
+// handle ingests a created or modified file, or purges a removed one
+func (w *Watcher) handle(name string, state fileState) {
+	is := w.jobs.ingest
+	if !state.exists {
+		if err := is.Remove(name); err != nil {
+			slog.Error("Failed to remove deleted novel", "novel", name, "error", err)
+			return
+		}
+		slog.Info("Removed deleted novel from the index", "novel", name)
+		return
+	}
+
+	// Uploads are already queued, and may be indexed before the watcher
+	// sees them
+	for _, pending := range w.jobs.PendingFiles() {
+		if pending == name {
+			return
+		}
+	}
+	path := filepath.Join(is.novelService.novelsDir, name)
+	current, err := is.novelService.IsIndexed(path)
+	if err != nil {
+		slog.Warn("Failed to read changed novel", "novel", name, "error", err)
+		return
+	}
+	if current {
+		return
+	}
+
+	ctx := logging.NewContext(context.Background(), slog.Default().With("source", "watcher"))
+	if _, err := w.jobs.SubmitContext(ctx, is.novelService.OriginalName(name), path, IngestOptions{KeepFiles: true}); err != nil {
+		slog.Error("Failed to queue changed novel", "novel", name, "error", err)
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// watcherFixture starts a job manager over a temporary directory with a
+// watcher that is polled by hand
+func watcherFixture(t *testing.T) (*Watcher, *JobManager, string) {
+	t.Helper()
+	tempDir := t.TempDir()
+	jm := newTestJobManager(t, tempDir)
+	jm.Start()
+	t.Cleanup(jm.Stop)
+	return NewWatcher(jm, time.Hour, time.Second), jm, filepath.Join(tempDir, "novels")
+}
+
+// writeAt writes a file with a given modification time
+func writeAt(t *testing.T, path, text string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+}
+
+// jobIDs returns the IDs of every job the manager knows
+func jobIDs(jm *JobManager) []string {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	var ids []string
+	for id := range jm.jobs {
+		ids = append(ids, id)
+	}
+	sortJobIDs(ids, jm.jobs)
+	return ids
+}
+
+func TestWatcher(t *testing.T) {
+	w, jm, novelsDir := watcherFixture(t)
+	cs := jm.ingest.chromaService
+	path := filepath.Join(novelsDir, "emma.txt")
+	start := time.Now()
+
+	// Files already present are left to reconciliation
+	writeAt(t, filepath.Join(novelsDir, "persuasion.txt"), "Sir Walter Elliot.", start)
+	w.Start()
+	w.Stop()
+
+	// A new file is only ingested once it has stopped changing
+	writeAt(t, path, "Emma Woodhouse,", start)
+	w.poll(start)
+	writeAt(t, path, "Emma Woodhouse, handsome, clever, and rich.", start.Add(time.Second))
+	w.poll(start.Add(time.Second))
+	if ids := jobIDs(jm); len(ids) != 0 {
+		t.Fatalf("Expected no jobs while the file is being written, got %v", ids)
+	}
+	w.poll(start.Add(2 * time.Second))
+	ids := jobIDs(jm)
+	if len(ids) != 1 {
+		t.Fatalf("Expected 1 job once the file settled, got %v", ids)
+	}
+	if job := waitForJob(t, jm, ids[0]); job.Stage != StageDone {
+		t.Fatalf("Expected job to be done, got %s (%s)", job.Stage, job.Error)
+	}
+
+	// Touching a file without changing it doesn't re-ingest it
+	later := start.Add(time.Minute)
+	os.Chtimes(path, later, later)
+	w.poll(later)
+	w.poll(later.Add(time.Second))
+	if ids := jobIDs(jm); len(ids) != 1 {
+		t.Errorf("Expected an unchanged file not to be queued, got %v", ids)
+	}
+
+	// A modified file is re-ingested
+	writeAt(t, path, "Emma Woodhouse, handsome, clever, and rich, with a comfortable home.", later.Add(time.Second))
+	w.poll(later.Add(2 * time.Second))
+	w.poll(later.Add(3 * time.Second))
+	ids = jobIDs(jm)
+	if len(ids) != 2 {
+		t.Fatalf("Expected the modified file to be queued, got %v", ids)
+	}
+	waitForJob(t, jm, ids[1])
+	if context, _ := cs.Query("comfortable", 1, FullAccess); context != "Emma Woodhouse, handsome, clever, and rich, with a comfortable home." {
+		t.Errorf("Expected the modified text to be indexed, got %q", context)
+	}
+
+	// A removed file is purged
+	os.Remove(path)
+	w.poll(later.Add(4 * time.Second))
+	w.poll(later.Add(5 * time.Second))
+	if indexed, _ := cs.IndexedNovels(); indexed["emma.txt"] != 0 {
+		t.Errorf("Expected emma.txt to be purged, got %v", indexed)
+	}
+	if _, ok := w.files["emma.txt"]; ok {
+		t.Error("Expected a removed file to be forgotten")
+	}
+}
+
+func TestWatcher_SkipsHiddenAndUnsupportedFiles(t *testing.T) {
+	w, jm, novelsDir := watcherFixture(t)
+	start := time.Now()
+
+	writeAt(t, filepath.Join(novelsDir, ".upload-123"), "partial", start)
+	writeAt(t, filepath.Join(novelsDir, "cover.jpg"), "image", start)
+	w.poll(start)
+	w.poll(start.Add(time.Minute))
+	if ids := jobIDs(jm); len(ids) != 0 {
+		t.Errorf("Expected no jobs, got %v", ids)
+	}
+}
+
+func TestWatcher_KeepsDuplicateFiles(t *testing.T) {
+	w, jm, novelsDir := watcherFixture(t)
+	start := time.Now()
+	text := testNovelText(400)
+	writeAt(t, filepath.Join(novelsDir, "emma.txt"), text, start)
+	w.poll(start)
+	w.poll(start.Add(time.Minute))
+	waitForJob(t, jm, jobIDs(jm)[0])
+
+	// A copy synced in is left unindexed but not deleted
+	copyPath := filepath.Join(novelsDir, "emma-copy.txt")
+	writeAt(t, copyPath, text, start.Add(time.Minute))
+	w.poll(start.Add(2 * time.Minute))
+	w.poll(start.Add(3 * time.Minute))
+	ids := jobIDs(jm)
+	if len(ids) != 2 {
+		t.Fatalf("Expected the copy to be queued, got %v", ids)
+	}
+	if job := waitForJob(t, jm, ids[1]); job.DuplicateAction != DuplicateSkip {
+		t.Errorf("Expected the copy to be skipped, got %+v", job)
+	}
+	if _, err := os.Stat(copyPath); err != nil {
+		t.Errorf("Expected the copy to be kept, got %v", err)
+	}
+	if indexed, _ := jm.ingest.chromaService.IndexedNovels(); len(indexed) != 1 {
+		t.Errorf("Expected 1 indexed novel, got %v", indexed)
+	}
+}
@@ -0,0 +1,123 @@
+// Package tracing sets up OpenTelemetry tracing. Code that records spans
+// uses the global tracer provider, which does nothing until Setup installs
+// an exporter.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kweusuf/novel-qa-go/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// ServiceName identifies this application's spans
+const ServiceName = "novel-qa"
+
+var (
+	mu       sync.Mutex
+	provider *sdktrace.TracerProvider
+	closers  []io.Closer
+)
+
+// Setup installs the exporter cfg names as the global tracer provider,
+// recording spans for the given version of the service, and W3C trace
+// context as the propagator so traces continue from callers' traceparent
+// headers. The stdout exporter writes to stdout.
+func Setup(cfg config.TracingConfig, version string, stdout io.Writer) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, closer, err := newExporter(cfg, stdout)
+	if err != nil || exporter == nil {
+		return err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(ServiceName),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to describe tracing resource: %v", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	mu.Lock()
+	defer mu.Unlock()
+	provider = tp
+	if closer != nil {
+		closers = append(closers, closer)
+	}
+	return nil
+}
+
+func newExporter(cfg config.TracingConfig, stdout io.Writer) (sdktrace.SpanExporter, io.Closer, error) {
+	switch strings.ToLower(cfg.Exporter) {
+	case "", "none":
+		return nil, nil, nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+		}
+		return exporter, nil, nil
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(stdout))
+		return exporter, nil, err
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open trace file: %v", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return exporter, f, nil
+	}
+	return nil, nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+}
+
+// Shutdown exports any spans still buffered and stops the tracer provider
+// installed by Setup, if any
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var errs []error
+	if provider != nil {
+		if err := provider.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush traces: %v", err))
+		}
+		provider = nil
+	}
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	closers = nil
+	return errors.Join(errs...)
+}
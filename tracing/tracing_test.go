@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kweusuf/novel-qa-go/config"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup_File(t *testing.T) {
+	cfg := config.Default().Tracing
+	cfg.Exporter = "file"
+	cfg.File = filepath.Join(t.TempDir(), "traces.json")
+
+	if err := Setup(cfg, "1.2.3", nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "ask")
+	span.End()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected no error shutting down, got %v", err)
+	}
+
+	data, err := os.ReadFile(cfg.File)
+	if err != nil {
+		t.Fatalf("Expected the trace file to be written: %v", err)
+	}
+	var exported struct{ Name string }
+	if err := json.Unmarshal(data, &exported); err != nil || exported.Name != "ask" {
+		t.Fatalf("Expected the span as JSON, got %s (%v)", data, err)
+	}
+	if !strings.Contains(string(data), `"service.version"`) || !strings.Contains(string(data), ServiceName) {
+		t.Errorf("Expected the service to be described, got %s", data)
+	}
+}
+
+func TestSetup_Stdout(t *testing.T) {
+	var out bytes.Buffer
+	cfg := config.Default().Tracing
+	cfg.Exporter = "stdout"
+	if err := Setup(cfg, "dev", &out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "ingest")
+	span.End()
+	Shutdown(context.Background())
+
+	if !strings.Contains(out.String(), `"Name":"ingest"`) {
+		t.Errorf("Expected the span on stdout, got %q", out.String())
+	}
+}
+
+func TestSetup_Errors(t *testing.T) {
+	cfg := config.Default().Tracing
+	if err := Setup(cfg, "dev", nil); err != nil {
+		t.Errorf("Expected no error without an exporter, got %v", err)
+	}
+	if err := Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected shutting down without an exporter to succeed, got %v", err)
+	}
+
+	cfg.Exporter = "file"
+	cfg.File = filepath.Join(t.TempDir(), "missing", "traces.json")
+	if err := Setup(cfg, "dev", nil); err == nil {
+		t.Error("Expected an error for an unwritable trace file")
+	}
+
+	cfg.Exporter = "zipkin"
+	if err := Setup(cfg, "dev", nil); err == nil {
+		t.Error("Expected an error for an unknown exporter")
+	}
+}